@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSessionCookie = "session"
+
+	// introspected sessions are trusted for this long, or until they expire
+	introspectionCacheTTL = 30 * time.Second
+
+	maxIntrospectionBody = 64 << 10
+)
+
+var (
+	// privateRoutes are the routes withheld from anonymous viewers when
+	// their owner's profile is private.
+	privateRoutes = map[string]bool{"banners": true, bannerVideoRoute: true, "songs": true, "attachments": true}
+
+	// sessions is nil unless SESSION_JWT_SECRET, SESSION_JWT_KEYS or
+	// SESSION_INTROSPECTION_URL is set, in which case private profiles are
+	// enforced.
+	sessions      sessionValidator
+	sessionCookie = defaultSessionCookie
+
+	errInvalidSession = errors.New("invalid session")
+)
+
+// sessionValidator checks a session token from the main app and returns the
+// user it belongs to.
+type sessionValidator interface {
+	validate(ctx context.Context, token string) (string, error)
+}
+
+// jwtValidator accepts HS256 tokens signed with the shared secret, or, for
+// tokens with a kid header, with that key from SESSION_JWT_KEYS. Keys are
+// read per token, so a new key can be added, signed with, and the old one
+// dropped once its tokens have expired, all without a restart.
+type jwtValidator struct {
+	secret func() string
+	keys   func() string
+}
+
+func (v *jwtValidator) validate(_ context.Context, token string) (string, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	payload, sig, ok2 := strings.Cut(rest, ".")
+	if !ok || !ok2 {
+		return "", errInvalidSession
+	}
+
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(header, &h); err != nil || h.Alg != "HS256" {
+		return "", errInvalidSession
+	}
+
+	key := v.secret()
+	if h.Kid != "" {
+		keys, _ := parseKeyList("SESSION_JWT_KEYS", v.keys())
+		key = keys[h.Kid]
+	}
+	if key == "" {
+		return "", errInvalidSession
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(header + "." + payload))
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac.Sum(nil), want) {
+		return "", errInvalidSession
+	}
+
+	var claims struct {
+		Sub string      `json:"sub"`
+		Exp json.Number `json:"exp"`
+		Nbf json.Number `json:"nbf"`
+	}
+	if err := decodeJWTPart(payload, &claims); err != nil {
+		return "", errInvalidSession
+	}
+
+	now := time.Now().Unix()
+	if exp, err := claims.Exp.Int64(); err != nil || exp <= now {
+		return "", errInvalidSession
+	}
+	if nbf, err := claims.Nbf.Int64(); err == nil && nbf > now {
+		return "", errInvalidSession
+	}
+
+	return claims.Sub, nil
+}
+
+// parseKeyList reads a rotating key setting such as SESSION_JWT_KEYS:
+// kid:secret pairs separated by commas or newlines. It returns the pairs it
+// could read along with any error.
+func parseKeyList(name, s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	var err error
+	for i, entry := range splitKeyList(s) {
+		// entries are secret, so errors only say which one is wrong
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || secret == "" {
+			err = fmt.Errorf("invalid %s entry %d, want kid:secret", name, i+1)
+			continue
+		}
+		keys[kid] = secret
+	}
+
+	return keys, err
+}
+
+func splitKeyList(s string) []string {
+	entries := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' })
+	for i := range entries {
+		entries[i] = strings.TrimSpace(entries[i])
+	}
+
+	return entries
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// introspectionValidator asks the main app about each token using OAuth 2.0
+// token introspection (RFC 7662), remembering answers briefly.
+type introspectionValidator struct {
+	url    string
+	auth   func() string
+	client *http.Client
+
+	cache sync.Map // sha256 of token -> introspectedSession
+	count atomic.Int64
+}
+
+type introspectedSession struct {
+	subject string
+	active  bool
+	expires time.Time
+}
+
+func (v *introspectionValidator) validate(ctx context.Context, token string) (string, error) {
+	key := sha256.Sum256([]byte(token))
+	if cached, ok := v.cache.Load(key); ok {
+		s := cached.(introspectedSession)
+		if time.Now().Before(s.expires) {
+			if !s.active {
+				return "", errInvalidSession
+			}
+			return s.subject, nil
+		}
+		v.cache.Delete(key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if auth := v.auth(); auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("introspection returned %s", resp.Status)
+	}
+
+	var result struct {
+		Active bool   `json:"active"`
+		Sub    string `json:"sub"`
+		Exp    int64  `json:"exp"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntrospectionBody)).Decode(&result); err != nil {
+		return "", fmt.Errorf("parse introspection response: %w", err)
+	}
+
+	s := introspectedSession{subject: result.Sub, active: result.Active, expires: time.Now().Add(introspectionCacheTTL)}
+	if result.Exp > 0 && time.Unix(result.Exp, 0).Before(s.expires) {
+		s.expires = time.Unix(result.Exp, 0)
+	}
+	v.remember(key, s)
+
+	if !s.active {
+		return "", errInvalidSession
+	}
+
+	return s.subject, nil
+}
+
+func (v *introspectionValidator) remember(key [sha256.Size]byte, s introspectedSession) {
+	v.cache.Store(key, s)
+
+	if v.count.Add(1)%1024 == 0 {
+		now := time.Now()
+		v.cache.Range(func(k, e any) bool {
+			if now.After(e.(introspectedSession).expires) {
+				v.cache.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// sessionToken reads the session from a bearer token or, for media loaded
+// by plain <img> and <audio> tags, the session cookie.
+func sessionToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+
+	return ""
+}
+
+// profilePrivate reports whether userID's profile is private. Cache entries
+// that predate the flag are ignored.
+func profilePrivate(ctx context.Context, userID string) (bool, error) {
+	if profile, ok := cachedProfile(ctx, userID); ok && profile.Private != nil {
+		recordCacheStatus(ctx, profileCacheName, "hit")
+		return *profile.Private, nil
+	}
+
+	recordCacheStatus(ctx, profileCacheName, "fwd=uri-miss")
+
+	profile, err := fetchProfile(ctx, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return *profile.Private, nil
+}
+
+// authorizePrivate requires a valid session for private routes of users
+// whose profile is private. If privacy can't be determined the request is
+// refused rather than risk serving private media.
+func authorizePrivate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt, vars := matchRoute(r.URL.Path)
+		if rt == nil || !privateRoutes[rt.Name] || vars["userID"] == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if authorizeViewer(w, r, vars["userID"], r.URL.Path) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorizeViewer reports whether r may see userID's private media at path,
+// writing the error response if not. A grant covering path is enough;
+// otherwise the viewer needs a session.
+func authorizeViewer(w http.ResponseWriter, r *http.Request, userID, path string) bool {
+	grant := grantFrom(r)
+	if sessions == nil && grantKeys().current == "" {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	defer cancel()
+
+	private, err := profilePrivate(ctx, userID)
+	if err != nil {
+		if err != errCircuitOpen {
+			log.Printf("profile privacy lookup failed for %s: %v", userID, err)
+		}
+		writeError(w, r, proxyError{http.StatusServiceUnavailable, "unavailable"})
+		return false
+	}
+
+	if !private {
+		return true
+	}
+
+	markPrivate(r.Context())
+
+	if grant != "" {
+		if viewer, err := verifyGrant(grant, path); err == nil {
+			traceDecision(r.Context(), "private profile", "grant for "+viewer)
+			return true
+		}
+		traceDecision(r.Context(), "private profile", "grant rejected")
+	}
+
+	token := sessionToken(r)
+	if token == "" || sessions == nil {
+		traceDecision(r.Context(), "private profile", "no session")
+		writeError(w, r, proxyError{http.StatusForbidden, "forbidden"})
+		return false
+	}
+
+	viewer, err := sessions.validate(ctx, token)
+	if err != nil {
+		if err != errInvalidSession {
+			log.Printf("session validation failed: %v", err)
+		}
+		traceDecision(r.Context(), "private profile", "session rejected")
+		writeError(w, r, proxyError{http.StatusForbidden, "forbidden"})
+		return false
+	}
+
+	traceDecision(r.Context(), "private profile", "viewer "+viewer)
+	return true
+}
+
+type privateResponseKey struct{}
+
+// withPrivateFlag lets handlers further down mark the response as private,
+// for instrument to keep it out of shared caches.
+func withPrivateFlag(ctx context.Context) (context.Context, *atomic.Bool) {
+	flag := new(atomic.Bool)
+	return context.WithValue(ctx, privateResponseKey{}, flag), flag
+}
+
+func markPrivate(ctx context.Context) {
+	if flag, ok := ctx.Value(privateResponseKey{}).(*atomic.Bool); ok {
+		flag.Store(true)
+	}
+}
+
+func markedPrivate(ctx context.Context) bool {
+	flag, ok := ctx.Value(privateResponseKey{}).(*atomic.Bool)
+	return ok && flag.Load()
+}
+
+// newSessionValidator picks the validator from the settings read by get.
+func newSessionValidator(get func(string) string) (sessionValidator, error) {
+	jwtSecret, jwtKeys, introspectionURL := get("SESSION_JWT_SECRET"), get("SESSION_JWT_KEYS"), get("SESSION_INTROSPECTION_URL")
+
+	switch {
+	case (jwtSecret != "" || jwtKeys != "") && introspectionURL != "":
+		return nil, errors.New("set only one of SESSION_JWT_SECRET and SESSION_INTROSPECTION_URL")
+	case jwtSecret != "" || jwtKeys != "":
+		if _, err := parseKeyList("SESSION_JWT_KEYS", jwtKeys); err != nil {
+			return nil, err
+		}
+		return &jwtValidator{
+			secret: func() string { return get("SESSION_JWT_SECRET") },
+			keys:   func() string { return get("SESSION_JWT_KEYS") },
+		}, nil
+	case introspectionURL != "":
+		if _, err := url.ParseRequestURI(introspectionURL); err != nil {
+			return nil, fmt.Errorf("invalid SESSION_INTROSPECTION_URL: %w", err)
+		}
+		return &introspectionValidator{url: introspectionURL, auth: func() string { return get("SESSION_INTROSPECTION_TOKEN") }, client: http.DefaultClient}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminToken guards the admin API and ?__debug traces.
+func adminToken() string {
+	return secrets.get("ADMIN_TOKEN")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeAdminRequest reads a JSON request body, answering 400 itself when
+// it can't.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRouteTestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+		return err
+	}
+
+	return nil
+}
+
+// writeAdminError reports a failed admin operation: the caller's mistake,
+// missing configuration, or a store that failed.
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidAdmin):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+	case errors.Is(err, errNoOperation):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found", "detail": err.Error()})
+	case errors.Is(err, errNoBlocklist), errors.Is(err, errNoS3):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "unavailable", "detail": err.Error()})
+	case errors.Is(err, context.Canceled):
+	default:
+		log.Printf("admin operation failed: %v", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "upstream_error", "detail": err.Error()})
+	}
+}
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken())) != 1 {
+			writeJSONError(w, proxyError{http.StatusUnauthorized, "unauthorized"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin runs the admin API on its own listener so it is never exposed
+// alongside public traffic.
+func serveAdmin(addr string) error {
+	return newServer(addr, newAdminHandler()).ListenAndServe()
+}
+
+// newAdminHandler is the admin API, behind the admin token.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/status", handleStatus)
+	mux.HandleFunc("GET /admin/errors", handleErrors)
+	mux.HandleFunc("POST /admin/caches/flush", handleFlushCache)
+	mux.HandleFunc("/admin/features", handleFeatures)
+	mux.HandleFunc("GET /admin/derivatives", handleDerivativeStats)
+	mux.HandleFunc("POST /admin/route-test", handleRouteTest)
+	mux.HandleFunc("GET /admin/config", handleConfig)
+	mux.HandleFunc("POST /admin/config/validate", handleConfigValidate)
+	mux.HandleFunc("POST /admin/grants", handleMintGrant)
+	mux.HandleFunc("POST /admin/operations", handleStartOperation)
+	mux.HandleFunc("GET /admin/operations/{id}", handleOperation)
+	mux.HandleFunc("GET /admin/operations/{id}/events", handleOperationEvents)
+	mux.HandleFunc("POST /admin/prefetch", handlePrefetch)
+	mux.HandleFunc("GET /admin/rules", handleRules)
+	mux.HandleFunc("GET /admin/events", handleServeEvents)
+	mux.HandleFunc("POST /admin/rules/{name}/run", handleRunRule)
+	mux.HandleFunc("/admin/blocklist", handleBlocklist)
+	mux.HandleFunc("GET /admin/bandwidth/{userID}", handleBandwidth)
+	mux.HandleFunc("GET /admin/slos", handleSLOs)
+	mux.HandleFunc("GET /admin/shadow", handleShadowDiffs)
+	mux.HandleFunc("GET /admin/limits", handleLimits)
+	mux.HandleFunc("POST /admin/bucket-events", handleBucketEvents)
+
+	return requireAdmin(mux)
+}
+
+// handleDerivativeStats reports stored derivatives and how much space GC
+// would reclaim at the current idle TTL.
+func handleDerivativeStats(w http.ResponseWriter, r *http.Request) {
+	disk, err := variantCache.stats(derivativeIdleTTL)
+	if err != nil {
+		writeJSONError(w, proxyError{http.StatusInternalServerError, "internal_error"})
+		return
+	}
+
+	resp := map[string]any{
+		"idle_ttl_seconds": int64(derivativeIdleTTL.Seconds()),
+		"disk":             disk,
+	}
+
+	if derivativesBucket != "" {
+		bucket, err := bucketDerivativeStats(r.Context(), derivativeIdleTTL)
+		if err != nil {
+			writeJSONError(w, proxyError{http.StatusServiceUnavailable, "unavailable"})
+			return
+		}
+		resp["bucket"] = bucket
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"io"
+	"net/http"
+
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultMaxAnimationFrames = 500
+	defaultMaxAnimationPixels = 256 << 20
+
+	maxAnimationDimension = 4096
+)
+
+var (
+	maxAnimationFrames = defaultMaxAnimationFrames
+
+	// maxAnimationPixels bounds canvas area times frame count, roughly what
+	// fully decoding the animation would allocate.
+	maxAnimationPixels = defaultMaxAnimationPixels
+
+	errAnimationTooLarge = proxyError{http.StatusUnprocessableEntity, "animation_too_large"}
+	errMalformedImage    = proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+)
+
+// checkAnimation rejects animated GIF and WebP inputs whose frame count or
+// decoded size exceeds the limits. It only walks container structure, so a
+// hostile file costs no more than reading it. Still images and other formats
+// pass.
+func checkAnimation(r io.Reader) error {
+	frames, width, height, err := scanAnimation(r)
+	if err == errAnimationTooLarge {
+		return err
+	} else if err != nil {
+		return errMalformedImage
+	}
+
+	if frames <= 1 {
+		return nil
+	}
+
+	if width > maxAnimationDimension || height > maxAnimationDimension ||
+		int64(frames)*int64(width)*int64(height) > int64(maxAnimationPixels) {
+		return errAnimationTooLarge
+	}
+
+	return nil
+}
+
+// isAnimated reports whether data is a GIF or WebP with more than one frame.
+func isAnimated(data []byte) bool {
+	frames, _, _, err := scanAnimation(bytes.NewReader(data))
+	return err == nil && frames > 1
+}
+
+// scanAnimation counts the frames of a GIF or WebP. Other formats report no
+// frames.
+func scanAnimation(r io.Reader) (frames, width, height int, err error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(12)
+	if err != nil {
+		return 0, 0, 0, nil
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("GIF8")):
+		return scanGIF(br)
+	case bytes.HasPrefix(magic, []byte("RIFF")) && bytes.Equal(magic[8:12], []byte("WEBP")):
+		return scanWebP(br)
+	}
+
+	return 0, 0, 0, nil
+}
+
+func scanGIF(br *bufio.Reader) (frames, width, height int, err error) {
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, 0, 0, err
+	}
+
+	width = int(binary.LittleEndian.Uint16(header[6:8]))
+	height = int(binary.LittleEndian.Uint16(header[8:10]))
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		switch introducer {
+		case 0x21: // extension: label, then data sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, 0, 0, err
+			}
+		case 0x2c: // image descriptor, optional local colour table, LZW data
+			var desc [10]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return 0, 0, 0, err
+			}
+
+			width = max(width, int(binary.LittleEndian.Uint16(desc[4:6])))
+			height = max(height, int(binary.LittleEndian.Uint16(desc[6:8])))
+			if desc[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << (desc[8]&0x07 + 1)); err != nil {
+					return 0, 0, 0, err
+				}
+			}
+
+			if frames++; frames > maxAnimationFrames {
+				return 0, 0, 0, errAnimationTooLarge
+			}
+		case 0x3b: // trailer
+			return frames, width, height, nil
+		default:
+			return 0, 0, 0, io.ErrUnexpectedEOF
+		}
+
+		if err := skipGIFSubBlocks(br); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+}
+
+func skipGIFSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		if _, err := br.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+func scanWebP(br *bufio.Reader) (frames, width, height int, err error) {
+	if _, err := br.Discard(12); err != nil {
+		return 0, 0, 0, err
+	}
+
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err == io.EOF {
+			return frames, width, height, nil
+		} else if err != nil {
+			return 0, 0, 0, err
+		}
+
+		size := int(binary.LittleEndian.Uint32(chunk[4:8]))
+		size += size & 1
+
+		switch string(chunk[:4]) {
+		case "VP8X":
+			var ext [10]byte
+			if size < len(ext) {
+				return 0, 0, 0, io.ErrUnexpectedEOF
+			}
+			if _, err := io.ReadFull(br, ext[:]); err != nil {
+				return 0, 0, 0, err
+			}
+
+			width = (int(ext[4]) | int(ext[5])<<8 | int(ext[6])<<16) + 1
+			height = (int(ext[7]) | int(ext[8])<<8 | int(ext[9])<<16) + 1
+			size -= len(ext)
+		case "ANMF":
+			if frames++; frames > maxAnimationFrames {
+				return 0, 0, 0, errAnimationTooLarge
+			}
+		}
+
+		if _, err := br.Discard(size); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+}
+
+// decodeAnimation decodes every frame of an animated GIF or WebP, each
+// composited onto the full canvas as it would be displayed.
+func decodeAnimation(data []byte) (*webp.WEBP, error) {
+	if !bytes.HasPrefix(data, []byte("GIF8")) {
+		return webp.DecodeAll(bytes.NewReader(data))
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	anim := &webp.WEBP{LoopCount: webpLoopCount(g.LoopCount)}
+
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewNRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		out := image.NewNRGBA(canvas.Bounds())
+		copy(out.Pix, canvas.Pix)
+		anim.Image = append(anim.Image, out)
+		anim.Delay = append(anim.Delay, g.Delay[i]*10)
+
+		switch {
+		case previous != nil:
+			canvas = previous
+		case i < len(g.Disposal) && g.Disposal[i] == gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+
+	return anim, nil
+}
+
+// webpLoopCount converts a GIF loop count, where 0 loops forever, -1 plays
+// once and n repeats n more times, to WebP's, where 0 loops forever and n
+// plays n times.
+func webpLoopCount(n int) int {
+	switch {
+	case n == 0:
+		return 0
+	case n < 0:
+		return 1
+	}
+
+	return n + 1
+}
+
+// encodeAnimation applies fn to every frame and writes the result as
+// animated webp.
+func encodeAnimation(anim *webp.WEBP, fn func(image.Image) image.Image, opts webp.Options) ([]byte, error) {
+	frames := make([]image.Image, len(anim.Image))
+	for i, frame := range anim.Image {
+		frames[i] = fn(frame)
+	}
+
+	var buf bytes.Buffer
+	err := webp.EncodeAll(&buf, &webp.WEBP{Image: frames, Delay: anim.Delay, LoopCount: anim.LoopCount}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultAttachmentMaxBytes = 25 << 20
+
+// attachmentTypes lists the types attachments may be uploaded as, and
+// whether each is safe to show inline. Anything a browser would run, like
+// HTML or SVG, isn't here.
+var attachmentTypes = map[string]bool{
+	"image/png":        true,
+	"image/jpeg":       true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"image/avif":       true,
+	"audio/mpeg":       true,
+	"audio/ogg":        true,
+	"audio/flac":       true,
+	"audio/wav":        true,
+	"video/mp4":        true,
+	"video/webm":       true,
+	"application/pdf":  true,
+	"text/plain":       true,
+	"application/zip":  false,
+	"application/gzip": false,
+	"application/json": false,
+	"text/csv":         false,
+}
+
+// attachment is a row of the attachments table, which the main app shares:
+// user_id, hash, filename, mime_type and size, unique on user_id and hash.
+type attachment struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+}
+
+var attachmentLoads singleflight.Group
+
+func attachmentCacheKey(userID, hash string) string {
+	return "attachment:" + userID + "/" + hash
+}
+
+// lookupAttachment returns an attachment's row, through Valkey. Rows only
+// change when the same file is uploaded again, which drops the entry.
+func lookupAttachment(ctx context.Context, userID, hash string) (*attachment, error) {
+	key := attachmentCacheKey(userID, hash)
+	if data, err := redisClient.Get(ctx, key).Bytes(); err == nil {
+		var a attachment
+		if json.Unmarshal(data, &a) == nil {
+			recordCacheStatus(ctx, profileCacheName, "hit")
+			return &a, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("valkey GET error: %v", err)
+	}
+	recordCacheStatus(ctx, profileCacheName, "fwd=uri-miss")
+
+	if !postgresBreaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	// as with profiles, the shared query outlives the caller that started it
+	v, err, _ := attachmentLoads.Do(key, func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+		defer cancel()
+
+		a, err := loadAttachment(loadCtx, userID, hash)
+		if err == sql.ErrNoRows {
+			postgresBreaker.record(nil)
+		} else {
+			postgresBreaker.record(err)
+		}
+		return a, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a := v.(*attachment)
+	if data, err := json.Marshal(a); err == nil && profileCacheTTL > 0 {
+		if err := redisClient.Set(ctx, key, data, profileCacheTTL).Err(); err != nil {
+			log.Printf("valkey SET error: %v", err)
+		}
+	}
+
+	return a, nil
+}
+
+func loadAttachment(ctx context.Context, userID, hash string) (*attachment, error) {
+	const query = `SELECT filename, mime_type, size FROM attachments WHERE user_id = $1 AND hash = $2`
+	queryCtx, span := startQuerySpan(ctx, "postgres attachments", query)
+
+	var a attachment
+	err := db.QueryRowContext(queryCtx, query, userID, hash).Scan(&a.Filename, &a.MimeType, &a.Size)
+	endQuerySpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// setAttachmentHeaders serves an attachment as the type it was uploaded
+// with, if that's still allowed, and named after its uploaded filename.
+// Types that aren't safe inline are always downloaded.
+func setAttachmentHeaders(resp *http.Response) {
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	resp.Header.Set("Content-Type", "application/octet-stream")
+
+	parts := strings.SplitN(strings.TrimPrefix(resp.Request.URL.Path, "/"+minioBucket+"/attachments/"), "/", 2)
+	if len(parts) != 2 {
+		resp.Header.Set("Content-Disposition", "attachment")
+		return
+	}
+
+	userID := parts[0]
+	ext := filepath.Ext(parts[1])
+	hash := strings.TrimSuffix(parts[1], ext)
+
+	lookupCtx, cancel := context.WithTimeout(resp.Request.Context(), lookupTimeout)
+	a, err := lookupAttachment(lookupCtx, userID, hash)
+	cancel()
+	if err != nil && err != sql.ErrNoRows && err != errCircuitOpen {
+		log.Printf("attachment lookup failed for %s/%s: %v", userID, hash, err)
+	}
+
+	disposition, name := requestedDisposition(resp.Request.URL.Query(), ext)
+	inline := false
+	if a != nil {
+		if safe, ok := attachmentTypes[a.MimeType]; ok {
+			resp.Header.Set("Content-Type", a.MimeType)
+			inline = safe
+		}
+		if name == "" {
+			name = sanitizeFilename(a.Filename)
+		}
+	}
+	if !inline {
+		disposition = "attachment"
+	}
+
+	traceDecision(resp.Request.Context(), "attachment", resp.Header.Get("Content-Type")+" "+disposition)
+	resp.Header.Set("Content-Disposition", contentDisposition(disposition, name))
+}
+
+// attachmentType is the upload's declared type, if attachments may have it.
+func attachmentType(r *http.Request) (string, error) {
+	mimeType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	mimeType = strings.TrimSpace(strings.ToLower(mimeType))
+
+	if _, ok := attachmentTypes[mimeType]; !ok {
+		return "", proxyError{http.StatusUnsupportedMediaType, "unsupported_media_type"}
+	}
+
+	return mimeType, nil
+}
+
+// storeAttachment stores an upload under its hash and the extension of its
+// ?filename=, and records it in the attachments table.
+func storeAttachment(r *http.Request, f *os.File, size int64, userID, hash string) (string, error) {
+	mimeType, err := attachmentType(r)
+	if err != nil {
+		return "", err
+	}
+
+	filename := sanitizeFilename(r.URL.Query().Get("filename"))
+	ext := strings.ToLower(filepath.Ext(filename))
+	if !validExtension.MatchString(strings.TrimPrefix(ext, ".")) {
+		ext = ""
+	}
+	if filename == "" {
+		filename = hash + ext
+	}
+
+	key := "attachments/" + userID + "/" + hash + ext
+	if _, err := s3Client.PutObject(r.Context(), minioBucket, key, f, size, minio.PutObjectOptions{ContentType: mimeType}); err != nil {
+		return "", err
+	}
+
+	const query = `INSERT INTO attachments (user_id, hash, filename, mime_type, size) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, hash) DO UPDATE SET filename = EXCLUDED.filename, mime_type = EXCLUDED.mime_type, size = EXCLUDED.size`
+	ctx, span := startQuerySpan(r.Context(), "postgres insert attachments", query)
+	_, err = db.ExecContext(ctx, query, userID, hash, filename, mimeType, size)
+	endQuerySpan(span, err)
+	if err != nil {
+		return "", err
+	}
+
+	if err := redisClient.Del(r.Context(), attachmentCacheKey(userID, hash)).Err(); err != nil {
+		log.Printf("valkey DEL error: %v", err)
+	}
+
+	return "/attachments/" + userID + "/" + hash + ext, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Replicas count the bytes they serve per media owner and add them to a
+// Valkey hash per month, which one replica at a time copies to Postgres:
+//
+//	CREATE TABLE bandwidth_usage (
+//		owner_id BIGINT NOT NULL,
+//		month    DATE   NOT NULL,
+//		bytes    BIGINT NOT NULL,
+//		PRIMARY KEY (owner_id, month)
+//	);
+//
+// bandwidth_quotas overrides BANDWIDTH_QUOTA for some users, the paid tier
+// among them. Zero is unlimited:
+//
+//	CREATE TABLE bandwidth_quotas (
+//		owner_id      BIGINT PRIMARY KEY,
+//		monthly_bytes BIGINT NOT NULL
+//	);
+const (
+	bandwidthFlushInterval          = 10 * time.Second
+	defaultBandwidthPersistInterval = 5 * time.Minute
+
+	// a month's hash outlives the month long enough for its last copy
+	bandwidthKeyTTL = 62 * 24 * time.Hour
+)
+
+var (
+	bandwidthAccounting bool
+
+	// bandwidthQuota is the default monthly egress per owner; 0 is none
+	bandwidthQuota       int64
+	bandwidthQuotaStatus = http.StatusTooManyRequests
+
+	bandwidthQuotas atomic.Pointer[map[string]int64]
+
+	bandwidth = struct {
+		sync.Mutex
+		month   string
+		pending map[string]int64
+		// used is each owner's total for month as of the last flush
+		used map[string]int64
+		// exceeded is the owners whose quota was reported as exceeded in
+		// month, so the webhook goes out once per month per replica
+		exceeded map[string]bool
+	}{pending: map[string]int64{}, used: map[string]int64{}, exceeded: map[string]bool{}}
+)
+
+func bandwidthMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func bandwidthKey(month string) string {
+	return "bandwidth:" + month
+}
+
+// bandwidthOwner is the user whose media path is, or "" for paths that
+// don't belong to one.
+func bandwidthOwner(path string) string {
+	_, vars := matchRoute(path)
+	owner := vars["userID"]
+	if _, err := strconv.ParseInt(owner, 10, 64); err != nil {
+		return ""
+	}
+
+	return owner
+}
+
+// recordBandwidth counts n bytes served for r against the media's owner.
+// Error responses, quota refusals among them, aren't the owner's media.
+func recordBandwidth(r *http.Request, status int, n int64) {
+	if !bandwidthAccounting || n <= 0 || status >= http.StatusBadRequest || isPrefetch(r.Context()) {
+		return
+	}
+	owner := bandwidthOwner(r.URL.Path)
+	if owner == "" {
+		return
+	}
+
+	bandwidth.Lock()
+	bandwidth.pending[owner] += n
+	bandwidth.Unlock()
+}
+
+// runBandwidthAccounting adds this replica's counts to Valkey every
+// bandwidthFlushInterval and copies the month's totals to Postgres every
+// persist interval.
+func runBandwidthAccounting(ctx context.Context, persistInterval time.Duration) {
+	if err := loadBandwidthQuotas(ctx); err != nil {
+		log.Printf("bandwidth quota load failed: %v", err)
+	}
+
+	ticker := time.NewTicker(bandwidthFlushInterval)
+	defer ticker.Stop()
+
+	lastPersist := time.Now()
+	for range ticker.C {
+		flushBandwidth(ctx)
+
+		if time.Since(lastPersist) < persistInterval {
+			continue
+		}
+		lastPersist = time.Now()
+
+		if err := loadBandwidthQuotas(ctx); err != nil {
+			log.Printf("bandwidth quota load failed: %v", err)
+		}
+
+		release, ok := acquireJobLock(ctx, "bandwidth:persist")
+		if !ok {
+			continue
+		}
+		err := persistBandwidth(ctx)
+		release()
+		if err != nil {
+			log.Printf("bandwidth persist failed: %v", err)
+		}
+	}
+}
+
+func flushBandwidth(ctx context.Context) {
+	month := bandwidthMonth(time.Now())
+
+	bandwidth.Lock()
+	pending := bandwidth.pending
+	bandwidth.pending = map[string]int64{}
+	bandwidth.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	key := bandwidthKey(month)
+	pipe := redisClient.Pipeline()
+	totals := make(map[string]*redis.IntCmd, len(pending))
+	for owner, n := range pending {
+		totals[owner] = pipe.HIncrBy(ctx, key, owner, n)
+	}
+	pipe.Expire(ctx, key, bandwidthKeyTTL)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("bandwidth flush failed: %v", err)
+		// keep the counts for the next flush rather than lose them
+		bandwidth.Lock()
+		for owner, n := range pending {
+			bandwidth.pending[owner] += n
+		}
+		bandwidth.Unlock()
+		return
+	}
+
+	bandwidth.Lock()
+	defer bandwidth.Unlock()
+
+	if bandwidth.month != month {
+		bandwidth.month, bandwidth.used, bandwidth.exceeded = month, map[string]int64{}, map[string]bool{}
+	}
+	for owner, total := range totals {
+		bandwidth.used[owner] = total.Val()
+	}
+}
+
+// persistBandwidth copies this month's and last month's totals to
+// Postgres. Valkey only ever grows a month's counts, so the copy keeps the
+// larger of the two.
+func persistBandwidth(ctx context.Context) error {
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	for _, month := range []time.Time{start.AddDate(0, -1, 0), start} {
+		totals, err := redisClient.HGetAll(ctx, bandwidthKey(bandwidthMonth(month))).Result()
+		if err != nil {
+			return err
+		}
+		if len(totals) == 0 {
+			continue
+		}
+
+		owners := make([]string, 0, len(totals))
+		bytes := make([]string, 0, len(totals))
+		for owner, n := range totals {
+			owners, bytes = append(owners, owner), append(bytes, n)
+		}
+
+		const query = `INSERT INTO bandwidth_usage (owner_id, month, bytes)
+			SELECT owner_id, $2::date, bytes FROM unnest($1::bigint[], $3::bigint[]) AS t(owner_id, bytes)
+			ON CONFLICT (owner_id, month) DO UPDATE SET bytes = GREATEST(bandwidth_usage.bytes, EXCLUDED.bytes)`
+		queryCtx, span := startQuerySpan(ctx, "postgres upsert bandwidth_usage", query)
+		_, err = db.ExecContext(queryCtx, query, pq.Array(owners), month.Format(time.DateOnly), pq.Array(bytes))
+		endQuerySpan(span, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadBandwidthQuotas(ctx context.Context) error {
+	const query = `SELECT owner_id, monthly_bytes FROM bandwidth_quotas`
+	queryCtx, span := startQuerySpan(ctx, "postgres bandwidth_quotas", query)
+	rows, err := db.QueryContext(queryCtx, query)
+	if err != nil {
+		endQuerySpan(span, err)
+		return err
+	}
+	defer rows.Close()
+
+	quotas := map[string]int64{}
+	for rows.Next() {
+		var owner string
+		var n int64
+		if err := rows.Scan(&owner, &n); err != nil {
+			endQuerySpan(span, err)
+			return err
+		}
+		quotas[owner] = n
+	}
+	err = rows.Err()
+	endQuerySpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	bandwidthQuotas.Store(&quotas)
+	return nil
+}
+
+func quotaFor(owner string) int64 {
+	if quotas := bandwidthQuotas.Load(); quotas != nil {
+		if n, ok := (*quotas)[owner]; ok {
+			return n
+		}
+	}
+
+	return bandwidthQuota
+}
+
+// bandwidthUsed is what owner has been served this month: the Valkey total
+// as of the last flush plus what this replica hasn't flushed yet. Owners
+// this replica hasn't served yet are read from Valkey.
+func bandwidthUsed(ctx context.Context, owner string) (int64, error) {
+	month := bandwidthMonth(time.Now())
+
+	bandwidth.Lock()
+	used, ok := bandwidth.used[owner]
+	if bandwidth.month != month {
+		ok = false
+	}
+	pending := bandwidth.pending[owner]
+	bandwidth.Unlock()
+
+	if !ok {
+		n, err := redisClient.HGet(ctx, bandwidthKey(month), owner).Int64()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+
+		bandwidth.Lock()
+		if bandwidth.month != month {
+			bandwidth.month, bandwidth.used, bandwidth.exceeded = month, map[string]int64{}, map[string]bool{}
+		}
+		bandwidth.used[owner] = max(bandwidth.used[owner], n)
+		bandwidth.Unlock()
+		used = n
+	}
+
+	return used + pending, nil
+}
+
+// enforceQuotas refuses media whose owner is over their monthly quota until
+// the month turns over. Quotas aren't enforced while Valkey can't say how
+// much has been used.
+func enforceQuotas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner := ""
+		if bandwidthAccounting {
+			owner = bandwidthOwner(r.URL.Path)
+		}
+		quota := quotaFor(owner)
+		if owner == "" || quota <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+		used, err := bandwidthUsed(ctx, owner)
+		cancel()
+		if err != nil {
+			log.Printf("bandwidth lookup failed for %s: %v", owner, err)
+		} else if used >= quota {
+			now := time.Now().UTC()
+			reset := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			traceDecision(r.Context(), "bandwidth quota", strconv.FormatInt(used, 10)+" of "+strconv.FormatInt(quota, 10)+" bytes used")
+			notifyQuotaExceeded(owner, used, quota)
+			writeError(w, r, proxyError{bandwidthQuotaStatus, "quota_exceeded"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func notifyQuotaExceeded(owner string, used, quota int64) {
+	bandwidth.Lock()
+	first := !bandwidth.exceeded[owner]
+	bandwidth.exceeded[owner] = true
+	month := bandwidth.month
+	bandwidth.Unlock()
+
+	if first {
+		notify("quota_exceeded", owner+" "+month, "user "+owner+" is over their bandwidth quota for "+month, map[string]any{
+			"user_id": owner,
+			"month":   month,
+			"bytes":   used,
+			"quota":   quota,
+		})
+	}
+}
+
+// handleBandwidth serves GET /admin/bandwidth/{userID}, what the user has
+// been served this month against their quota.
+func handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	owner := r.PathValue("userID")
+	if _, err := strconv.ParseInt(owner, 10, 64); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": "userID must be numeric"})
+		return
+	}
+	if !bandwidthAccounting {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "unavailable", "detail": "bandwidth accounting is off"})
+		return
+	}
+
+	used, err := bandwidthUsed(r.Context(), owner)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"user_id": owner,
+		"month":   bandwidthMonth(time.Now()),
+		"bytes":   used,
+		"quota":   quotaFor(owner),
+	})
+}
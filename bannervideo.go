@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const bannerVideoRoute = "banner-videos"
+
+var (
+	// bannerVideoExtensions are the containers video banners are stored in,
+	// in the order a poster looks for them
+	bannerVideoExtensions = []string{".mp4", ".webm"}
+
+	bannerVideoContentTypes = map[string]string{".mp4": "video/mp4", ".webm": "video/webm"}
+
+	posterRenders singleflight.Group
+)
+
+// fixVideoContentType replaces a generic Content-Type on a video banner with
+// the one its extension implies, so browsers play it inline.
+func fixVideoContentType(resp *http.Response) {
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !genericContentTypes[strings.TrimSpace(strings.ToLower(mediaType))] {
+		return
+	}
+
+	if contentType := bannerVideoContentTypes[filepath.Ext(resp.Request.URL.Path)]; contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+}
+
+func posterKey(userID, hash string) string {
+	return "banners/" + userID + "/" + hash + "?poster"
+}
+
+// handleBannerPoster serves GET /banners/{userID}/{hash}/poster, the first
+// frame of a video banner as a JPEG for the video element's poster and
+// for clients that don't autoplay. It's cut once and kept in the variant
+// cache.
+func handleBannerPoster(w http.ResponseWriter, r *http.Request) {
+	userID, hash := r.PathValue("userID"), r.PathValue("hash")
+	if !validID(userID) || !validHash(hash) || ffmpegPath == "" {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	if !authorizeViewer(w, r, userID, r.URL.Path) {
+		return
+	}
+
+	// the video is content-addressed, so its poster never changes
+	etag := generatedETag("poster", userID, hash)
+	if notModified(w, r, etag, variantCacheControl) {
+		return
+	}
+
+	key := posterKey(userID, hash)
+	if f, _, ok := variantCache.get(key); ok {
+		defer f.Close()
+		recordCacheStatus(r.Context(), objectCacheName, "hit")
+		writePoster(w, r, etag, f)
+		return
+	}
+	recordCacheStatus(r.Context(), objectCacheName, "fwd=uri-miss")
+
+	v, err, _ := posterRenders.Do(key, func() (any, error) {
+		return renderPoster(r.Context(), userID, hash)
+	})
+	if err != nil {
+		var perr proxyError
+		if !errors.As(err, &perr) {
+			log.Printf("poster for %s/%s failed: %v", userID, hash, err)
+			perr = proxyError{http.StatusUnprocessableEntity, "unprocessable_video"}
+		}
+		writeError(w, r, perr)
+		return
+	}
+	data := v.([]byte)
+
+	if err := variantCache.put(key, data); errors.Is(err, errCacheDiskLow) {
+		// counted, and served uncached
+	} else if err != nil {
+		log.Printf("variant cache write error: %v", err)
+	} else {
+		recordCacheStatus(r.Context(), objectCacheName, "stored")
+		indexVariant(r.Context(), "banners", userID, hash, key)
+	}
+
+	writePoster(w, r, etag, bytes.NewReader(data))
+}
+
+func writePoster(w http.ResponseWriter, r *http.Request, etag string, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", imageContentTypes["jpeg"])
+	w.Header().Set("Cache-Control", variantCacheControl)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// renderPoster decodes the first frame of the banner video, whichever
+// container it was stored in. ffmpeg reads it from a pipe, so an mp4
+// needs its index up front, as it does to play before it has downloaded.
+func renderPoster(ctx context.Context, userID, hash string) ([]byte, error) {
+	args := []string{"-i", "pipe:0", "-map", "0:v:0", "-frames:v", "1",
+		"-c:v", "mjpeg", "-q:v", "3", "-f", "image2pipe", "pipe:1"}
+
+	for _, ext := range bannerVideoExtensions {
+		data, err := ffmpegObject(ctx, "/"+minioBucket+"/banners/"+userID+"/"+hash+ext, args)
+		var perr proxyError
+		if errors.As(err, &perr) && perr.status == http.StatusNotFound {
+			continue
+		}
+		if err == nil && len(data) == 0 {
+			return nil, errors.New("ffmpeg wrote no frame")
+		}
+
+		return data, err
+	}
+
+	return nil, proxyError{http.StatusNotFound, "not_found"}
+}
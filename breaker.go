@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 10 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var breakerStateNames = [...]string{"closed", "half-open", "open"}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+var (
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_proxy_circuit_breaker_state",
+		Help: "Circuit breaker state: 0 closed, 1 half-open, 2 open.",
+	}, []string{"breaker"})
+
+	breakerRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_circuit_breaker_rejected_total",
+		Help: "Calls skipped because their circuit breaker was open.",
+	}, []string{"breaker"})
+)
+
+// Breakers around the song filename lookup, so an unreachable Valkey or
+// Postgres costs one quick check per request instead of a driver timeout.
+var (
+	redisBreaker    = newCircuitBreaker("valkey", defaultBreakerThreshold, defaultBreakerCooldown)
+	postgresBreaker = newCircuitBreaker("postgres", defaultBreakerThreshold, defaultBreakerCooldown)
+)
+
+// circuitBreaker opens after threshold consecutive failures and rejects
+// calls for cooldown. After that a single probe is let through; its outcome
+// closes the breaker or opens it again.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	breakerStateGauge.WithLabelValues(name).Set(float64(breakerClosed))
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	if b.state != s {
+		log.Printf("%s circuit breaker %s", b.name, breakerStateNames[s])
+		if s == breakerOpen && b.state == breakerClosed {
+			notify("circuit_open", b.name, b.name+" circuit breaker opened after "+strconv.Itoa(b.failures)+" consecutive failures", map[string]any{"breaker": b.name, "failures": b.failures})
+		}
+	}
+
+	b.state = s
+	breakerStateGauge.WithLabelValues(b.name).Set(float64(s))
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be
+// followed by record.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.setState(breakerHalfOpen)
+	}
+
+	switch {
+	case b.state == breakerClosed:
+		return true
+	case b.state == breakerHalfOpen && !b.probing:
+		b.probing = true
+		return true
+	}
+
+	breakerRejectedTotal.WithLabelValues(b.name).Inc()
+	return false
+}
+
+// record reports a call's outcome. err should be nil for results that say
+// nothing about the backend's health, like a missing row or a client that
+// went away.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// breakerStatus is a breaker's state for the admin API.
+type breakerStatus struct {
+	Name     string     `json:"name"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := breakerStatus{Name: b.name, State: breakerStateNames[b.state], Failures: b.failures}
+	if b.state != breakerClosed {
+		opened := b.openedAt
+		st.OpenedAt = &opened
+	}
+
+	return st
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const maxBucketEventBody = 1 << 20
+
+var (
+	// bucketEventsPollTimeout is how long each BLPOP waits, and so how long
+	// the consumer can take to notice it's been stopped
+	bucketEventsPollTimeout = 5 * time.Second
+
+	// bucketEventsKey is the Valkey list MinIO's redis notification target
+	// pushes to, in the access format; empty doesn't consume it
+	bucketEventsKey string
+
+	// warmAvatarQueries are the variants, as query strings, prefetched
+	// when an avatar is written
+	warmAvatarQueries []string
+
+	bucketEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_bucket_events_total",
+		Help: "MinIO bucket notifications handled, by action: created, removed or ignored.",
+	}, []string{"action"})
+)
+
+// bucketEvent is the part of a MinIO notification record the proxy uses.
+// Object keys are URL-encoded.
+type bucketEvent struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// consumeBucketEvents pops notifications MinIO pushed to bucketEventsKey.
+// Each is handled by whichever replica pops it; purges reach the others
+// over cachePurgePrefixChannel.
+func consumeBucketEvents(ctx context.Context) {
+	for ctx.Err() == nil {
+		res, err := redisClient.BLPop(ctx, bucketEventsPollTimeout, bucketEventsKey).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			log.Printf("valkey BLPOP error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var entries []struct {
+			Event []bucketEvent `json:"Event"`
+		}
+		if err := json.Unmarshal([]byte(res[1]), &entries); err != nil {
+			log.Printf("invalid bucket event in %s: %v", bucketEventsKey, err)
+			continue
+		}
+		for _, e := range entries {
+			for _, ev := range e.Event {
+				handleBucketEvent(ctx, ev)
+			}
+		}
+	}
+}
+
+// handleBucketEvents serves POST /admin/bucket-events for MinIO's webhook
+// notification target, whose auth_token is the admin token.
+func handleBucketEvents(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Records []bucketEvent `json:"Records"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBucketEventBody)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+		return
+	}
+
+	for _, ev := range body.Records {
+		handleBucketEvent(r.Context(), ev)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBucketEvent forgets everything cached about an object in the
+// originals bucket that was written or removed: its variants on every
+// replica, derivatives and metadata, where its original is, and a cached
+// 404. A written avatar's variants are then warmed.
+func handleBucketEvent(ctx context.Context, ev bucketEvent) {
+	created := strings.HasPrefix(ev.EventName, "s3:ObjectCreated:")
+	key, err := url.QueryUnescape(ev.S3.Object.Key)
+	if err != nil || ev.S3.Bucket.Name != minioBucket || !hasRoute("/"+key) ||
+		(!created && !strings.HasPrefix(ev.EventName, "s3:ObjectRemoved:")) {
+		bucketEventsTotal.WithLabelValues("ignored").Inc()
+		return
+	}
+
+	kind, owner, hash := splitObjectKey(key)
+	prefix := kind + "/" + owner + "/" + hash
+	if checkPurgePrefix(prefix) != nil {
+		bucketEventsTotal.WithLabelValues("ignored").Inc()
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	if err := purgePrefix(ctx, prefix, func(stageProgress) {}); err != nil {
+		log.Printf("purge of %s after %s failed: %v", prefix, ev.EventName, err)
+	}
+	if err := redisClient.Del(ctx, originalExtKey(kind, owner, hash)).Err(); err != nil {
+		log.Printf("valkey DEL error: %v", err)
+	}
+
+	if !created {
+		bucketEventsTotal.WithLabelValues("removed").Inc()
+		return
+	}
+
+	bucketEventsTotal.WithLabelValues("created").Inc()
+	forgetMissing(ctx, "/"+key)
+
+	// the original uploaded alongside is notified too, but only warmed once
+	if kind == "avatars" && key == prefix+".webp" && len(warmAvatarQueries) > 0 {
+		paths := make([]string, 0, len(warmAvatarQueries))
+		for _, q := range warmAvatarQueries {
+			paths = append(paths, "/"+prefix+"?"+q)
+		}
+		prefetch(ctx, paths, func(res prefetchResult) {
+			if res.Status >= 400 {
+				log.Printf("warming %s answered %d", res.Path, res.Status)
+			}
+		})
+	}
+}
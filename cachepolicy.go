@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const controlArm = "control"
+
+// cachePolicy is the Cache-Control a route hands to browsers and downstream
+// CDNs. Durations are in seconds.
+type cachePolicy struct {
+	MaxAge               int  `json:"max_age"`
+	SMaxAge              int  `json:"s_maxage,omitempty"`
+	StaleWhileRevalidate int  `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         int  `json:"stale_if_error,omitempty"`
+	Immutable            bool `json:"immutable,omitempty"`
+}
+
+func (p *cachePolicy) header() string {
+	directives := []string{"public", "max-age=" + strconv.Itoa(p.MaxAge)}
+	if p.SMaxAge > 0 {
+		directives = append(directives, "s-maxage="+strconv.Itoa(p.SMaxAge))
+	}
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+strconv.Itoa(p.StaleWhileRevalidate))
+	}
+	if p.StaleIfError > 0 {
+		directives = append(directives, "stale-if-error="+strconv.Itoa(p.StaleIfError))
+	}
+	if p.Immutable {
+		directives = append(directives, "immutable")
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// cacheExperiment serves an alternative policy to Percent of a route's
+// objects. Assignment is by object path, so every client sees the same policy
+// for a given object and downstream caches behave consistently.
+type cacheExperiment struct {
+	Name    string      `json:"name"`
+	Percent float64     `json:"percent"`
+	Cache   cachePolicy `json:"cache"`
+}
+
+type routePolicy struct {
+	Cache       *cachePolicy      `json:"cache"`
+	Experiments []cacheExperiment `json:"experiments"`
+}
+
+// cachePolicies is keyed by route name. Routes without an entry keep whatever
+// Cache-Control the origin sent.
+var cachePolicies map[string]routePolicy
+
+// defaultCachePolicies apply unless the policies file configures the route.
+var defaultCachePolicies = map[string]routePolicy{
+	"emojis":         {Cache: &cachePolicy{MaxAge: 31536000, Immutable: true}},
+	bannerVideoRoute: {Cache: &cachePolicy{MaxAge: 31536000, Immutable: true}},
+}
+
+func loadCachePolicies(path string) (map[string]routePolicy, error) {
+	if path == "" {
+		return maps.Clone(defaultCachePolicies), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configured map[string]routePolicy
+	if err := json.Unmarshal(data, &configured); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return mergeCachePolicies(configured)
+}
+
+// mergeCachePolicies applies configured policies over the defaults and
+// validates the result.
+func mergeCachePolicies(configured map[string]routePolicy) (map[string]routePolicy, error) {
+	policies := maps.Clone(defaultCachePolicies)
+	maps.Copy(policies, configured)
+
+	for name, rp := range policies {
+		total := 0.0
+		for _, exp := range rp.Experiments {
+			if exp.Name == "" || exp.Name == controlArm {
+				return nil, fmt.Errorf("route %q: experiment needs a name other than %q", name, controlArm)
+			}
+			if exp.Percent <= 0 {
+				return nil, fmt.Errorf("route %q: experiment %q has no traffic", name, exp.Name)
+			}
+			total += exp.Percent
+		}
+
+		if total > 100 {
+			return nil, fmt.Errorf("route %q: experiments cover %.2f%% of traffic", name, total)
+		}
+	}
+
+	return policies, nil
+}
+
+func selectCachePolicy(route, path string) (string, *cachePolicy) {
+	rp, ok := cachePolicies[route]
+	if !ok {
+		return controlArm, nil
+	}
+
+	if len(rp.Experiments) > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(path))
+		bucket := float64(h.Sum32()%10000) / 100
+
+		for i := range rp.Experiments {
+			exp := &rp.Experiments[i]
+			if bucket < exp.Percent {
+				return exp.Name, &exp.Cache
+			}
+			bucket -= exp.Percent
+		}
+	}
+
+	return controlArm, rp.Cache
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Cache identifiers reported in Cache-Status (RFC 9211). The object tier is
+// the variant cache in front of MinIO; the profile tier is the Redis cache
+// behind per-user metadata like song filenames.
+const (
+	objectCacheName  = "cdn-proxy"
+	profileCacheName = "cdn-proxy-profile"
+)
+
+type cacheStatusKey struct{}
+
+// cacheStatus collects what each cache tier did for one request.
+type cacheStatus struct {
+	mu      sync.Mutex
+	entries []cacheStatusEntry
+}
+
+type cacheStatusEntry struct {
+	cache  string
+	params []string
+}
+
+func withCacheStatus(ctx context.Context) (context.Context, *cacheStatus) {
+	cs := &cacheStatus{}
+	return context.WithValue(ctx, cacheStatusKey{}, cs), cs
+}
+
+// recordCacheStatus adds params such as "hit", "fwd=uri-miss" or "ttl=60" to
+// the entry for cache. Each parameter appears once per cache, the last value
+// recorded winning, except that hit never replaces fwd: when one of several
+// lookups in a tier went to the origin, the tier didn't answer from cache.
+func recordCacheStatus(ctx context.Context, cache string, params ...string) {
+	traceDecision(ctx, "cache "+cache, strings.Join(params, "; "))
+
+	cs, ok := ctx.Value(cacheStatusKey{}).(*cacheStatus)
+	if !ok {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for i := range cs.entries {
+		if cs.entries[i].cache == cache {
+			for _, p := range params {
+				cs.entries[i].params = setCacheStatusParam(cs.entries[i].params, p)
+			}
+			return
+		}
+	}
+
+	var merged []string
+	for _, p := range params {
+		merged = setCacheStatusParam(merged, p)
+	}
+	cs.entries = append(cs.entries, cacheStatusEntry{cache: cache, params: merged})
+}
+
+// setCacheStatusParam replaces the parameter p stands for in params, or
+// appends it.
+func setCacheStatusParam(params []string, p string) []string {
+	slot := cacheStatusSlot(p)
+	for i, q := range params {
+		if cacheStatusSlot(q) == slot {
+			if p != "hit" || !strings.HasPrefix(q, "fwd=") {
+				params[i] = p
+			}
+			return params
+		}
+	}
+
+	return append(params, p)
+}
+
+// cacheStatusSlot is the parameter p sets, hit and fwd being one outcome.
+func cacheStatusSlot(p string) string {
+	name, _, _ := strings.Cut(p, "=")
+	if name == "fwd" {
+		return "hit"
+	}
+
+	return name
+}
+
+// apply appends this proxy's entries after any the origin already sent, since
+// Cache-Status lists caches in order from the origin towards the client.
+func (cs *cacheStatus) apply(h map[string][]string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.entries) == 0 {
+		return
+	}
+
+	members := append([]string(nil), h["Cache-Status"]...)
+	for _, e := range cs.entries {
+		members = append(members, strings.Join(append([]string{e.cache}, e.params...), "; "))
+	}
+
+	h["Cache-Status"] = []string{strings.Join(members, ", ")}
+}
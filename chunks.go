@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultChunkSize = 4 << 20
+	minChunkSize     = 256 << 10
+
+	chunkManifestTTL = 30 * 24 * time.Hour
+)
+
+var (
+	// chunkSize is fixed so every client of a song gets the same ranges,
+	// which the coalescer and downstream caches can then share.
+	chunkSize int64 = defaultChunkSize
+
+	chunkManifests singleflight.Group
+)
+
+// chunkManifest lets a client download a song as parallel ranges of the
+// song's own URL and verify each one. A changed ETag means the manifest is
+// for a different upload.
+type chunkManifest struct {
+	Path      string  `json:"path"`
+	Size      int64   `json:"size"`
+	ETag      string  `json:"etag,omitempty"`
+	ChunkSize int64   `json:"chunk_size"`
+	Chunks    []chunk `json:"chunks"`
+}
+
+type chunk struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+// chunkManifestKey sits under the song's prefix, so purges find it.
+func chunkManifestKey(userID, hash string) string {
+	return "chunks:songs/" + userID + "/" + hash + "?size=" + strconv.FormatInt(chunkSize, 10)
+}
+
+// handleChunkManifest serves GET /songs/{userID}/{hash}/chunks.json.
+func handleChunkManifest(w http.ResponseWriter, r *http.Request) {
+	userID, hash := r.PathValue("userID"), r.PathValue("hash")
+	if !validID(userID) || !validHash(hash) {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	if !authorizeViewer(w, r, userID, r.URL.Path) {
+		return
+	}
+
+	etag := generatedETag("chunks", userID, hash, strconv.FormatInt(chunkSize, 10))
+	if notModified(w, r, etag, variantCacheControl) {
+		return
+	}
+
+	data, err := cachedChunkManifest(r.Context(), userID, hash)
+	if err != nil {
+		var perr proxyError
+		if !errors.As(err, &perr) {
+			log.Printf("chunk manifest for %s/%s failed: %v", userID, hash, err)
+			perr = proxyError{http.StatusBadGateway, "upstream_error"}
+		}
+		writeError(w, r, perr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", variantCacheControl)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func cachedChunkManifest(ctx context.Context, userID, hash string) ([]byte, error) {
+	key := chunkManifestKey(userID, hash)
+	if data, err := redisClient.Get(ctx, key).Bytes(); err == nil {
+		recordCacheStatus(ctx, objectCacheName, "hit")
+		return data, nil
+	} else if err != redis.Nil {
+		log.Printf("valkey GET error: %v", err)
+	}
+	recordCacheStatus(ctx, objectCacheName, "fwd=uri-miss")
+
+	v, err, _ := chunkManifests.Do(key, func() (any, error) {
+		data, err := buildChunkManifest(ctx, userID, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := redisClient.Set(ctx, key, data, chunkManifestTTL).Err(); err != nil {
+			log.Printf("valkey SET error: %v", err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+// buildChunkManifest reads the song once, hashing each chunk as it streams
+// past.
+func buildChunkManifest(ctx context.Context, userID, hash string) ([]byte, error) {
+	path, err := currentSongPath(ctx, userID, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fetchObject(ctx, "/"+minioBucket+path)
+	if err != nil {
+		return nil, proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBody))
+		return nil, parseS3Error(resp.StatusCode, body)
+	}
+
+	m := chunkManifest{Path: path, ETag: resp.Header.Get("ETag"), ChunkSize: chunkSize, Chunks: []chunk{}}
+	for {
+		h := sha256.New()
+		n, err := io.CopyN(h, resp.Body, chunkSize)
+		if n > 0 {
+			m.Chunks = append(m.Chunks, chunk{Offset: m.Size, Length: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+			m.Size += n
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(m)
+}
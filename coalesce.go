@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultCoalesceMaxBytes = 8 << 20
+
+// coalescingTransport collapses concurrent identical GETs into one upstream
+// fetch. Bodies up to maxBytes are buffered and handed to every waiter;
+// larger or unsized ones, such as songs, are spooled to a temp file in the
+// cache dir as they arrive, and every waiter reads that at its own pace.
+type coalescingTransport struct {
+	next     http.RoundTripper
+	maxBytes int64
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a fetch in progress, with the callers waiting on its headers.
+type flight struct {
+	done    chan struct{}
+	waiters int
+
+	resp   *http.Response
+	body   []byte
+	stream *sharedStream
+	err    error
+}
+
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !coalescable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	t.mu.Lock()
+	if f, ok := t.flights[key]; ok {
+		f.waiters++
+		t.mu.Unlock()
+
+		<-f.done
+		if f.err != nil {
+			return nil, f.err
+		}
+		recordCacheStatus(req.Context(), objectCacheName, "collapsed")
+		if f.resp == nil {
+			// the body couldn't be shared
+			return t.next.RoundTrip(req)
+		}
+		return f.response(req), nil
+	}
+	f := &flight{done: make(chan struct{})}
+	if t.flights == nil {
+		t.flights = map[string]*flight{}
+	}
+	t.flights[key] = f
+	t.mu.Unlock()
+
+	// the fetch is shared, so one client going away must not cancel it for
+	// everyone else
+	resp, err := t.next.RoundTrip(req.Clone(context.WithoutCancel(req.Context())))
+
+	var own *http.Response
+	switch {
+	case err != nil:
+		f.err = err
+	case resp.ContentLength >= 0 && resp.ContentLength <= t.maxBytes:
+		f.body, f.err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if f.err == nil {
+			f.resp = resp
+		}
+	default:
+		f.stream, err = newSharedStream(resp.Body)
+		if err != nil {
+			log.Printf("coalesce spool error: %v", err)
+			own = resp
+		} else {
+			f.resp = resp
+		}
+	}
+
+	// no one joins once the headers are in, so the waiters are all the
+	// stream's readers besides this one
+	t.mu.Lock()
+	delete(t.flights, key)
+	if f.stream != nil {
+		f.stream.mu.Lock()
+		f.stream.readers += f.waiters
+		f.stream.mu.Unlock()
+	}
+	t.mu.Unlock()
+	close(f.done)
+
+	switch {
+	case f.err != nil:
+		return nil, f.err
+	case own != nil:
+		own.Request = req
+		return own, nil
+	}
+	return f.response(req), nil
+}
+
+func (f *flight) response(req *http.Request) *http.Response {
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Request = req
+	if f.stream != nil {
+		resp.Body = &sharedStreamReader{s: f.stream}
+	} else {
+		resp.Body = io.NopCloser(bytes.NewReader(f.body))
+		resp.ContentLength = int64(len(f.body))
+	}
+
+	return &resp
+}
+
+// sharedStream is a body being spooled to a temp file for the callers
+// sharing its fetch. It's read from upstream as fast as upstream sends,
+// whoever is reading, until every reader has closed; the file goes once
+// the body is complete or abandoned and they have.
+type sharedStream struct {
+	upstream io.ReadCloser
+	file     *os.File
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int64
+	done    bool
+	err     error
+	readers int
+}
+
+func newSharedStream(upstream io.ReadCloser) (*sharedStream, error) {
+	file, err := os.CreateTemp(variantCache.dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// the caller that fetched it is the first reader
+	s := &sharedStream{upstream: upstream, file: file, readers: 1}
+	s.cond = sync.NewCond(&s.mu)
+	go s.spool()
+
+	return s, nil
+}
+
+func (s *sharedStream) spool() {
+	defer s.upstream.Close()
+
+	buf := make([]byte, 32<<10)
+	var size int64
+	for {
+		n, err := s.upstream.Read(buf)
+		if n > 0 {
+			if _, werr := s.file.WriteAt(buf[:n], size); werr != nil {
+				err = werr
+			}
+			size += int64(n)
+		}
+
+		s.mu.Lock()
+		if err == nil && s.readers == 0 {
+			err = errors.New("every reader went away")
+		}
+		s.size = size
+		if err != nil {
+			s.done = true
+			if err != io.EOF {
+				s.err = err
+			}
+		}
+		s.cond.Broadcast()
+		s.removeIfUnused()
+		s.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// removeIfUnused deletes the file once nothing will read or write it.
+// s.mu is held.
+func (s *sharedStream) removeIfUnused() {
+	if s.done && s.readers == 0 && s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
+
+// sharedStreamReader is one caller's read of a sharedStream.
+type sharedStreamReader struct {
+	s      *sharedStream
+	off    int64
+	closed bool
+}
+
+func (r *sharedStreamReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	for r.off >= s.size && !s.done {
+		s.cond.Wait()
+	}
+	if r.off >= s.size {
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	// the file stays open while this reader is registered
+	n, err := s.file.ReadAt(p[:min(int64(len(p)), s.size-r.off)], r.off)
+	s.mu.Unlock()
+	r.off += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *sharedStreamReader) Close() error {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		s.readers--
+		s.removeIfUnused()
+	}
+
+	return nil
+}
+
+// coalescable reports whether any two instances of req are guaranteed to
+// receive the same response.
+func coalescable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+
+	for _, h := range []string{"Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if req.Header.Get(h) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+var audioFilenameGroup singleflight.Group
+
+// lookupAudioFilename coalesces concurrent filename lookups for the same song.
+func lookupAudioFilename(ctx context.Context, userID, hash string) (string, error) {
+	ran := false
+	v, err, _ := audioFilenameGroup.Do(userID+"/"+hash, func() (any, error) {
+		ran = true
+
+		// as with profiles, the shared lookup outlives the caller that
+		// started it
+		lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+		defer cancel()
+
+		return getAudioFilename(lookupCtx, userID, hash)
+	})
+	if !ran {
+		recordCacheStatus(ctx, profileCacheName, "collapsed")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return v.(string), nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// bodies smaller than this aren't worth a Content-Encoding
+const minCompressBytes = 512
+
+// compressibleTypes are the text formats the proxy serves itself: error
+// bodies, metadata, waveforms and manifests. Media is already compressed
+// and event streams have to reach the client as they're written, so both
+// are left alone.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"text/xml":               true,
+	"text/plain":             true,
+	"text/html":              true,
+	"text/css":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"image/svg+xml":          true,
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return zw
+	}}
+	zstdWriters = sync.Pool{New: func() any {
+		zw, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return zw
+	}}
+)
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return compressibleTypes[mediaType] || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// negotiateEncoding picks zstd over gzip from Accept-Encoding, skipping any
+// the client refuses with q=0. It returns "" for neither.
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	switch {
+	case accepted["zstd"]:
+		return "zstd"
+	case accepted["gzip"], accepted["*"]:
+		return "gzip"
+	}
+
+	return ""
+}
+
+// compressResponses encodes compressible responses with the best encoding
+// the client accepts. Range requests are served uncompressed, since ranges
+// are of the identity encoding the proxy advertises them on.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !featureEnabled("compression") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding")), uri: r.URL.RequestURI()}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+		// a handler that panicked may have left a truncated body
+		cw.complete = true
+	})
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding    string
+	uri         string
+	wroteHeader bool
+	enc         io.WriteCloser
+	release     func()
+
+	// a body found in encodedResponses is written instead of the
+	// handler's; otherwise capture collects it for next time
+	cached   []byte
+	cacheKey string
+	capture  *captureWriter
+	complete bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status < http.StatusOK {
+		// informational, with the final header still to come
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	if h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		// the body depends on Accept-Encoding whether or not this client
+		// gets it compressed
+		h.Add("Vary", "Accept-Encoding")
+
+		length, err := strconv.Atoi(h.Get("Content-Length"))
+		switch {
+		case cw.encoding == "" || (err == nil && length < minCompressBytes):
+		case status != http.StatusNoContent && status != http.StatusPartialContent && status != http.StatusNotModified:
+			if status == http.StatusOK && cw.serveEncoded() {
+				cw.ResponseWriter.WriteHeader(status)
+				cw.ResponseWriter.Write(cw.cached)
+				return
+			}
+			cw.startEncoder()
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// serveEncoded looks the response up in encodedResponses by its ETag, weak
+// ones included since the proxy only gives those to bodies it generated
+// deterministically, setting the headers for the cached body when it's there and
+// arranging for it to be captured when it isn't.
+func (cw *compressWriter) serveEncoded() bool {
+	h := cw.Header()
+	etag := h.Get("ETag")
+	if encodedResponses.maxBytes <= 0 || etag == "" {
+		return false
+	}
+
+	cw.cacheKey = encodedKey(cw.encoding, cw.uri, etag)
+	data, ok := encodedResponses.get(cw.cacheKey)
+	if !ok {
+		cw.capture = &captureWriter{limit: encodedResponses.maxEntryBytes()}
+		return false
+	}
+
+	cw.cached = data
+	h.Set("Content-Encoding", cw.encoding)
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	h.Del("Accept-Ranges")
+	if !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	return true
+}
+
+func (cw *compressWriter) startEncoder() {
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	// the encoded body is a different representation, but If-None-Match
+	// still matches it against the identity one
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	var out io.Writer = cw.ResponseWriter
+	if cw.capture != nil {
+		out = io.MultiWriter(cw.ResponseWriter, cw.capture)
+	}
+
+	switch cw.encoding {
+	case "zstd":
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(out)
+		cw.enc, cw.release = zw, func() { zstdWriters.Put(zw) }
+	default:
+		zw := gzipWriters.Get().(*gzip.Writer)
+		zw.Reset(out)
+		cw.enc, cw.release = zw, func() { gzipWriters.Put(zw) }
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.cached != nil {
+		return len(b), nil
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+
+	return cw.enc.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if cw.enc == nil {
+		return
+	}
+
+	err := cw.enc.Close()
+	cw.release()
+	cw.enc = nil
+
+	if err == nil && cw.complete && cw.capture != nil && !cw.capture.over {
+		encodedResponses.put(cw.cacheKey, cw.capture.buf.Bytes())
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// configSetting describes one environment variable the proxy reads. Type is
+// one of string, int, float, duration, url, urls, dsn (a URL whose password
+// is redacted), cidrs (comma-separated CIDRs or addresses) or enum.
+type configSetting struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Default  string   `json:"default,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	Required bool     `json:"required,omitempty"`
+	Secret   bool     `json:"secret,omitempty"`
+}
+
+// configSchema lists every setting main reads. Keep the two in step.
+var configSchema = []configSetting{
+	{Name: "VALKEY_ADDR", Type: "string", Required: true},
+	{Name: "VALKEY_PASSWORD", Type: "string", Secret: true},
+	{Name: "POSTGRES_CONN", Type: "dsn", Required: true},
+	{Name: "STORAGE_BACKEND", Type: "enum", Values: []string{"s3", "fs", "http"}, Default: "s3"},
+	{Name: "STORAGE_DIR", Type: "string"},
+	{Name: "STORAGE_ORIGIN", Type: "url"},
+	{Name: "MINIO_ENDPOINT", Type: "urls"},
+	{Name: "MINIO_BUCKET", Type: "string", Required: true},
+	{Name: "LISTEN_ADDR", Type: "string", Default: ":5000"},
+	{Name: "TLS_CERT_FILE", Type: "string"},
+	{Name: "TLS_KEY_FILE", Type: "string"},
+	{Name: "HTTP3", Type: "enum", Values: []string{"on"}},
+	{Name: "HTTP3_ALT_SVC_PORT", Type: "int"},
+	{Name: "HTTP3_ALT_SVC_MAX_AGE", Type: "duration", Default: defaultAltSvcMaxAge.String()},
+	{Name: "READ_HEADER_TIMEOUT", Type: "duration", Default: defaultReadHeaderTimeout.String()},
+	{Name: "IDLE_TIMEOUT", Type: "duration", Default: defaultIdleTimeout.String()},
+	{Name: "WRITE_TIMEOUT", Type: "duration", Default: defaultWriteTimeout.String()},
+
+	{Name: "MINIO_LOAD_BALANCE", Type: "enum", Values: []string{"round-robin"}},
+	{Name: "MINIO_EJECT_AFTER", Type: "int", Default: strconv.Itoa(defaultEjectAfter)},
+	{Name: "MINIO_EJECT_DURATION", Type: "duration", Default: defaultEjectDuration.String()},
+	{Name: "MINIO_HEALTH_INTERVAL", Type: "duration", Default: defaultHealthInterval.String()},
+	{Name: "UPSTREAM_RETRIES", Type: "int", Default: strconv.Itoa(defaultUpstreamRetries)},
+	{Name: "UPSTREAM_RETRY_DELAY", Type: "duration", Default: defaultUpstreamRetryDelay.String()},
+	{Name: "UPSTREAM_RETRY_BUDGET", Type: "duration", Default: defaultUpstreamRetryBudget.String()},
+	{Name: "UPSTREAM_TIMEOUT", Type: "duration", Default: defaultUpstreamTimeout.String()},
+	{Name: "UPSTREAM_STREAM_TIMEOUT", Type: "duration", Default: defaultUpstreamStreamTimeout.String()},
+	{Name: "UPSTREAM_IMAGE_CONCURRENCY", Type: "int", Default: strconv.Itoa(defaultUpstreamImageConcurrency)},
+	{Name: "UPSTREAM_STREAM_CONCURRENCY", Type: "int", Default: strconv.Itoa(defaultUpstreamStreamConcurrency)},
+	{Name: "UPSTREAM_QUEUE_TIMEOUT", Type: "duration", Default: defaultUpstreamQueueTimeout.String()},
+	{Name: "SHADOW_ENDPOINT", Type: "url"},
+	{Name: "SHADOW_BUCKET", Type: "string"},
+	{Name: "SHADOW_PERCENT", Type: "float", Default: "0"},
+	{Name: "SHADOW_ACCESS_KEY", Type: "string"},
+	{Name: "SHADOW_SECRET_KEY", Type: "string", Secret: true},
+
+	{Name: "CACHE_DIR", Type: "string"},
+	{Name: "CACHE_MIN_FREE_PERCENT", Type: "float", Default: "0"},
+	{Name: "CACHE_MAX_BYTES", Type: "int", Default: strconv.Itoa(defaultCacheMaxBytes)},
+	{Name: "LIMITS_MAX_GOROUTINES", Type: "int", Default: strconv.Itoa(defaultMaxGoroutines)},
+	{Name: "ROUTES_FILE", Type: "string"},
+	{Name: "COALESCE_MAX_BYTES", Type: "int", Default: strconv.Itoa(defaultCoalesceMaxBytes)},
+	{Name: "CACHE_MAX_OBJECT_BYTES", Type: "int", Default: strconv.Itoa(defaultMaxCachedObjectBytes)},
+	{Name: "ENCODED_CACHE_BYTES", Type: "int", Default: strconv.Itoa(defaultEncodedCacheBytes)},
+	{Name: "CACHE_POLICIES_FILE", Type: "string"},
+	{Name: "CORS_POLICIES_FILE", Type: "string"},
+	{Name: "PURGE_RULES_FILE", Type: "string"},
+	{Name: "BUCKET_EVENTS_KEY", Type: "string"},
+	{Name: "BUCKET_EVENTS_WARM_AVATARS", Type: "string"},
+	{Name: "WEBHOOK_URL", Type: "url"},
+	{Name: "WEBHOOK_SECRET", Type: "string", Secret: true},
+	{Name: "WEBHOOK_COOLDOWN", Type: "duration", Default: defaultWebhookCooldown.String()},
+	{Name: "SLOS_FILE", Type: "string"},
+	{Name: "SLO_SHED_BURN_RATE", Type: "float", Default: "0"},
+	{Name: "METRICS_ADDR", Type: "string"},
+	{Name: "POSTGRES_MAX_OPEN_CONNS", Type: "int", Default: "20"},
+	{Name: "POSTGRES_MAX_IDLE_CONNS", Type: "int", Default: "10"},
+	{Name: "POSTGRES_CONN_MAX_LIFETIME", Type: "duration", Default: (30 * time.Minute).String()},
+	{Name: "POSTGRES_CONN_MAX_IDLE_TIME", Type: "duration", Default: (5 * time.Minute).String()},
+	{Name: "LOOKUP_TIMEOUT", Type: "duration", Default: (500 * time.Millisecond).String()},
+	{Name: "PROFILE_CACHE_TTL", Type: "duration", Default: defaultProfileCacheTTL.String()},
+	{Name: "PROFILE_STALE_TTL", Type: "duration", Default: defaultProfileStaleTTL.String()},
+	{Name: "OBJECT_META_TTL", Type: "duration", Default: defaultObjectMetaTTL.String()},
+	{Name: "SONG_THROTTLE_MULTIPLIER", Type: "float", Default: "0"},
+	{Name: "SONG_THROTTLE_BURST", Type: "int", Default: strconv.Itoa(defaultSongThrottleBurst)},
+	{Name: "SONG_DEFAULT_BITRATE", Type: "int", Default: strconv.Itoa(defaultSongDefaultBitrate)},
+	{Name: "SESSION_JWT_SECRET", Type: "string", Secret: true},
+	{Name: "SESSION_JWT_KEYS", Type: "string", Secret: true},
+	{Name: "SESSION_INTROSPECTION_URL", Type: "url"},
+	{Name: "SESSION_INTROSPECTION_TOKEN", Type: "string", Secret: true},
+	{Name: "SESSION_COOKIE", Type: "string", Default: defaultSessionCookie},
+	{Name: "GRANT_KEYS", Type: "string", Secret: true},
+	{Name: "BREAKER_THRESHOLD", Type: "int", Default: strconv.Itoa(defaultBreakerThreshold)},
+	{Name: "BREAKER_COOLDOWN", Type: "duration", Default: defaultBreakerCooldown.String()},
+	{Name: "HASH_LENGTH", Type: "int", Default: strconv.Itoa(defaultHashLength)},
+	{Name: "MAX_URL_LENGTH", Type: "int", Default: strconv.Itoa(defaultMaxURLLength)},
+	{Name: "EXPORT_RATE_LIMIT", Type: "int", Default: strconv.Itoa(defaultExportRateLimit)},
+	{Name: "BANDWIDTH_ACCOUNTING", Type: "enum", Values: []string{"on"}},
+	{Name: "BANDWIDTH_PERSIST_INTERVAL", Type: "duration", Default: defaultBandwidthPersistInterval.String()},
+	{Name: "BANDWIDTH_QUOTA", Type: "int", Default: "0"},
+	{Name: "BANDWIDTH_QUOTA_STATUS", Type: "enum", Values: []string{"429", "402"}, Default: "429"},
+	{Name: "PROFILE_MANIFEST_PREFETCH", Type: "enum", Values: []string{"on"}},
+	{Name: "DEFAULT_AVATARS", Type: "enum", Values: []string{"identicon"}},
+	{Name: "TOMBSTONES", Type: "enum", Values: []string{"on"}},
+	{Name: "TOMBSTONE_STATES", Type: "string", Default: defaultTombstoneStates},
+	{Name: "FFMPEG_PATH", Type: "string", Default: "ffmpeg"},
+	{Name: "WAVEFORM_PEAKS", Type: "int", Default: strconv.Itoa(defaultWaveformPeaks)},
+	{Name: "CHUNK_SIZE", Type: "int", Default: strconv.Itoa(defaultChunkSize)},
+	{Name: "TRUSTED_PROXIES", Type: "cidrs"},
+	{Name: "IP_ALLOW", Type: "cidrs"},
+	{Name: "IP_DENY", Type: "cidrs"},
+	{Name: "IP_BLOCKLIST_KEY", Type: "string"},
+	{Name: "IP_BLOCKLIST_REFRESH", Type: "duration", Default: defaultBlocklistRefresh.String()},
+	{Name: "GEO_REGIONS_FILE", Type: "string"},
+	{Name: "GEO_LOCAL_REGION", Type: "string"},
+	{Name: "GEOIP_DATABASE", Type: "string"},
+	{Name: "GEO_REDIRECT_MIN_BYTES", Type: "int", Default: strconv.Itoa(defaultGeoRedirectMinBytes)},
+	{Name: "NEGATIVE_CACHE_TTL", Type: "duration", Default: defaultNegativeCacheTTL.String()},
+	{Name: "PROBE_THRESHOLD", Type: "int", Default: "0"},
+	{Name: "PROBE_WINDOW", Type: "duration", Default: defaultProbeWindow.String()},
+	{Name: "PROBE_BAN_DURATION", Type: "duration", Default: defaultProbeBanDuration.String()},
+	{Name: "TRANSFORM_WORKERS", Type: "int", Default: strconv.Itoa(runtime.GOMAXPROCS(0))},
+	{Name: "TRANSFORM_QUEUE", Type: "int", Default: strconv.Itoa(4 * runtime.GOMAXPROCS(0))},
+	{Name: "TRANSFORM_TIMEOUT", Type: "duration", Default: (10 * time.Second).String()},
+	{Name: "STRIP_METADATA_ROUTES", Type: "string", Default: "avatars,banners,emojis"},
+	{Name: "ICC_PROFILES", Type: "enum", Default: iccConvert, Values: []string{iccConvert, iccPreserve, iccStrip}},
+	{Name: "MAX_IMAGE_PIXELS", Type: "int", Default: strconv.Itoa(defaultMaxImagePixels)},
+	{Name: "MAX_LOSSLESS_PIXELS", Type: "int", Default: strconv.Itoa(defaultMaxLosslessPixels)},
+	{Name: "MAX_ANIMATION_FRAMES", Type: "int", Default: strconv.Itoa(defaultMaxAnimationFrames)},
+	{Name: "MAX_ANIMATION_PIXELS", Type: "int", Default: strconv.Itoa(defaultMaxAnimationPixels)},
+
+	{Name: "MINIO_ACCESS_KEY", Type: "string"},
+	{Name: "MINIO_SECRET_KEY", Type: "string", Secret: true},
+	{Name: "MINIO_REGION", Type: "string", Default: defaultMinioRegion},
+	{Name: "UPLOAD_TOKEN", Type: "string", Secret: true},
+	{Name: "ATTACHMENT_MAX_BYTES", Type: "int", Default: strconv.Itoa(defaultAttachmentMaxBytes)},
+	{Name: "DERIVATIVES_BUCKET", Type: "string"},
+	{Name: "DERIVATIVE_IDLE_TTL", Type: "duration", Default: (30 * 24 * time.Hour).String()},
+	{Name: "DERIVATIVE_GC_INTERVAL", Type: "duration", Default: time.Hour.String()},
+
+	{Name: "ADMIN_ADDR", Type: "string"},
+	{Name: "ADMIN_GRPC_ADDR", Type: "string"},
+	{Name: "ADMIN_TOKEN", Type: "string", Secret: true},
+
+	{Name: "IMGPROXY_URL", Type: "string"},
+	{Name: "IMGPROXY_KEY", Type: "string", Secret: true},
+	{Name: "IMGPROXY_SALT", Type: "string", Secret: true},
+
+	{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Type: "url"},
+	{Name: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", Type: "url"},
+
+	{Name: "VAULT_ADDR", Type: "url"},
+	{Name: "VAULT_SECRET_PATH", Type: "string"},
+	{Name: "VAULT_NAMESPACE", Type: "string"},
+	{Name: "VAULT_TOKEN", Type: "string", Secret: true},
+	{Name: "SECRETS_REFRESH_INTERVAL", Type: "duration", Default: defaultSecretsRefreshInterval.String()},
+}
+
+type configValue struct {
+	configSetting
+	Value string `json:"value,omitempty"`
+	Set   bool   `json:"set"`
+}
+
+// redact hides secrets, and the password in connection strings, from
+// anything reporting config back.
+func (s configSetting) redact(v string) string {
+	switch {
+	case v == "":
+		return ""
+	case s.Secret:
+		return "[redacted]"
+	case s.Type == "dsn":
+		if u, err := url.Parse(v); err == nil {
+			return u.Redacted()
+		}
+		return "[redacted]"
+	}
+
+	return v
+}
+
+// check reports what is wrong with v for s, if anything. Empty values mean
+// the default.
+func (s configSetting) check(v string) error {
+	if v == "" {
+		if s.Required {
+			return fmt.Errorf("%s is not set", s.Name)
+		}
+		return nil
+	}
+
+	switch s.Type {
+	case "int":
+		if _, err := strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", s.Name, err)
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("invalid %s: %v", s.Name, err)
+		}
+	case "duration":
+		if _, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", s.Name, err)
+		}
+	case "url", "dsn":
+		if u, err := url.Parse(v); err != nil || u.Scheme == "" {
+			return fmt.Errorf("invalid %s: not an absolute URL", s.Name)
+		}
+	case "urls":
+		endpoints, err := parseEndpoints(v)
+		if err != nil || len(endpoints) == 0 {
+			return fmt.Errorf("invalid %s: %v", s.Name, err)
+		}
+	case "cidrs":
+		if _, err := parsePrefixes(s.Name, v); err != nil {
+			return err
+		}
+	case "enum":
+		if !slices.Contains(s.Values, v) {
+			return fmt.Errorf("invalid %s %q", s.Name, v)
+		}
+	}
+
+	return nil
+}
+
+// handleConfig reports the effective configuration: every setting with its
+// value or default, and the loaded routes and policies.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	settings := make([]configValue, 0, len(configSchema))
+	for _, s := range configSchema {
+		v := setting(s.Name)
+		cv := configValue{configSetting: s, Set: v != "", Value: s.redact(v)}
+		if v == "" {
+			cv.Value = s.Default
+		}
+		settings = append(settings, cv)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"settings":       settings,
+		"routes":         routes,
+		"cache_policies": cachePolicies,
+		"cors_policies":  corsPolicies,
+	})
+}
+
+// candidateConfig is a full environment plus the contents, rather than
+// paths, of the policy files.
+type candidateConfig struct {
+	Env           map[string]string      `json:"env"`
+	Routes        []route                `json:"routes"`
+	CachePolicies map[string]routePolicy `json:"cache_policies"`
+	CORSPolicies  map[string]*corsPolicy `json:"cors_policies"`
+	SLOs          map[string]*routeSLO   `json:"slos"`
+}
+
+type configProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// handleConfigValidate checks a candidate config against this binary the
+// way startup would, without applying it.
+func handleConfigValidate(w http.ResponseWriter, r *http.Request) {
+	var c candidateConfig
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRouteTestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+		return
+	}
+
+	errs, warnings := validateConfig(c)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"valid":    len(errs) == 0,
+		"errors":   errs,
+		"warnings": warnings,
+	})
+}
+
+func validateConfig(c candidateConfig) (errs, warnings []configProblem) {
+	errs, warnings = []configProblem{}, []configProblem{}
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, configProblem{field, fmt.Sprintf(format, args...)})
+	}
+
+	hasSecret := func(name string) bool {
+		return c.Env[name] != "" || c.Env[name+"_FILE"] != "" || c.Env["VAULT_ADDR"] != ""
+	}
+
+	known := make(map[string]bool, len(configSchema))
+	for _, s := range configSchema {
+		known[s.Name] = true
+
+		// secrets may come from a file or Vault instead, which we can't
+		// read from here
+		if slices.Contains(secretNames, s.Name) || s.Name == "VAULT_TOKEN" {
+			known[s.Name+"_FILE"] = true
+			if c.Env[s.Name] == "" && hasSecret(s.Name) {
+				continue
+			}
+		}
+
+		if err := s.check(c.Env[s.Name]); err != nil {
+			fail("env."+s.Name, "%v", err)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Env)) {
+		if !known[name] {
+			warnings = append(warnings, configProblem{"env." + name, "not a setting this version reads"})
+		}
+	}
+
+	switch c.Env["STORAGE_BACKEND"] {
+	case "", "s3":
+		if c.Env["MINIO_ENDPOINT"] == "" {
+			fail("env.MINIO_ENDPOINT", "MINIO_ENDPOINT is not set")
+		}
+	case "fs":
+		if c.Env["STORAGE_DIR"] == "" {
+			fail("env.STORAGE_DIR", "STORAGE_BACKEND is fs but STORAGE_DIR is not set")
+		}
+		if c.Env["IMGPROXY_URL"] != "" {
+			fail("env.IMGPROXY_URL", "IMGPROXY_URL needs the s3 or http storage backend")
+		}
+	case "http":
+		if c.Env["STORAGE_ORIGIN"] == "" {
+			fail("env.STORAGE_ORIGIN", "STORAGE_BACKEND is http but STORAGE_ORIGIN is not set")
+		}
+	}
+	if c.Env["ADMIN_ADDR"] != "" && !hasSecret("ADMIN_TOKEN") {
+		fail("env.ADMIN_TOKEN", "ADMIN_ADDR is set but ADMIN_TOKEN is not")
+	}
+	if c.Env["ADMIN_GRPC_ADDR"] != "" && !hasSecret("ADMIN_TOKEN") {
+		fail("env.ADMIN_TOKEN", "ADMIN_GRPC_ADDR is set but ADMIN_TOKEN is not")
+	}
+	if _, err := newSessionValidator(func(name string) string { return c.Env[name] }); err != nil {
+		fail("env.SESSION_JWT_SECRET", "%v", err)
+	}
+	if err := parseGrantKeys(c.Env["GRANT_KEYS"]).err; err != nil {
+		fail("env.GRANT_KEYS", "%v", err)
+	}
+	if hasSecret("MINIO_ACCESS_KEY") != hasSecret("MINIO_SECRET_KEY") {
+		warnings = append(warnings, configProblem{"env.MINIO_ACCESS_KEY", "only one of MINIO_ACCESS_KEY and MINIO_SECRET_KEY is set, so requests go unsigned"})
+	}
+	if c.Env["DERIVATIVES_BUCKET"] != "" && !hasSecret("MINIO_ACCESS_KEY") {
+		warnings = append(warnings, configProblem{"env.DERIVATIVES_BUCKET", "needs MINIO_ACCESS_KEY and MINIO_SECRET_KEY"})
+	}
+	if p, _ := strconv.ParseFloat(c.Env["CACHE_MIN_FREE_PERCENT"], 64); p < 0 || p >= 100 {
+		fail("env.CACHE_MIN_FREE_PERCENT", "must be at least 0 and under 100")
+	}
+	if p, _ := strconv.ParseFloat(c.Env["SHADOW_PERCENT"], 64); p > 0 && c.Env["SHADOW_ENDPOINT"] == "" {
+		fail("env.SHADOW_ENDPOINT", "SHADOW_PERCENT is set but SHADOW_ENDPOINT is not")
+	} else if p > 100 {
+		fail("env.SHADOW_PERCENT", "must be at most 100")
+	}
+	if c.Env["GEO_REGIONS_FILE"] != "" && c.Env["GEOIP_DATABASE"] == "" {
+		fail("env.GEOIP_DATABASE", "GEO_REGIONS_FILE is set but GEOIP_DATABASE is not")
+	}
+	if n, _ := strconv.Atoi(c.Env["GEO_REDIRECT_MIN_BYTES"]); n < 0 {
+		fail("env.GEO_REDIRECT_MIN_BYTES", "must not be negative")
+	}
+	if hasSecret("SHADOW_ACCESS_KEY") != hasSecret("SHADOW_SECRET_KEY") {
+		warnings = append(warnings, configProblem{"env.SHADOW_ACCESS_KEY", "only one of SHADOW_ACCESS_KEY and SHADOW_SECRET_KEY is set, so mirrored requests go unsigned"})
+	}
+
+	if c.Routes != nil {
+		if _, err := parseRoutes(c.Routes); err != nil {
+			fail("routes", "%v", err)
+		}
+	}
+	if c.CachePolicies != nil {
+		if _, err := mergeCachePolicies(c.CachePolicies); err != nil {
+			fail("cache_policies", "%v", err)
+		}
+	}
+	if c.CORSPolicies != nil {
+		if _, err := checkCORSPolicies(c.CORSPolicies); err != nil {
+			fail("cors_policies", "%v", err)
+		}
+	}
+	if c.SLOs != nil {
+		if _, err := checkSLOs(c.SLOs); err != nil {
+			fail("slos", "%v", err)
+		}
+	}
+
+	return errs, warnings
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultCORSRoute holds the policy for routes without their own entry.
+const defaultCORSRoute = "*"
+
+// corsPolicy controls which web origins may read a route's responses.
+// Origins are exact ("https://colourlabs.net"), a wildcard subdomain
+// ("https://*.colourlabs.net", which does not match the apex) or "*".
+type corsPolicy struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	MaxAge           int      `json:"max_age,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+}
+
+var (
+	// corsPolicies is keyed by route name, with defaultCORSRoute as the
+	// fallback. Nil leaves CORS to the origin.
+	corsPolicies map[string]*corsPolicy
+
+	defaultCORSHeaders = []string{"Range", "If-None-Match", "If-Modified-Since"}
+
+	defaultCORSExposedHeaders = []string{
+		"Accept-Ranges", "Content-Disposition", "Content-Length", "Content-Range", "ETag", requestIDHeader,
+	}
+)
+
+func loadCORSPolicies(path string) (map[string]*corsPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies map[string]*corsPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return checkCORSPolicies(policies)
+}
+
+// checkCORSPolicies validates policies and fills in defaults.
+func checkCORSPolicies(policies map[string]*corsPolicy) (map[string]*corsPolicy, error) {
+	for name, p := range policies {
+		if len(p.AllowedOrigins) == 0 {
+			return nil, fmt.Errorf("route %q: no allowed origins", name)
+		}
+
+		for _, origin := range p.AllowedOrigins {
+			if origin == "*" {
+				if p.AllowCredentials {
+					return nil, fmt.Errorf("route %q: credentials cannot be allowed for every origin", name)
+				}
+				continue
+			}
+
+			pattern := strings.Replace(origin, "://*.", "://", 1)
+			u, err := url.Parse(pattern)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || strings.Contains(pattern, "*") {
+				return nil, fmt.Errorf("route %q: invalid origin %q", name, origin)
+			}
+		}
+
+		if len(p.AllowedMethods) == 0 {
+			p.AllowedMethods = publicMethods
+		}
+		for _, m := range p.AllowedMethods {
+			if !slices.Contains(publicMethods, m) {
+				return nil, fmt.Errorf("route %q: method %s is never served", name, m)
+			}
+		}
+
+		if p.AllowedHeaders == nil {
+			p.AllowedHeaders = defaultCORSHeaders
+		}
+		if p.ExposedHeaders == nil {
+			p.ExposedHeaders = defaultCORSExposedHeaders
+		}
+		if p.MaxAge == 0 {
+			p.MaxAge = 600
+		}
+	}
+
+	return policies, nil
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		if scheme, suffix, ok := strings.Cut(allowed, "://*."); ok {
+			rest, ok := strings.CutPrefix(origin, scheme+"://")
+			if ok && strings.HasSuffix(rest, "."+suffix) && !strings.ContainsAny(rest, "/?#@") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *corsPolicy) allowsHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !slices.ContainsFunc(p.AllowedHeaders, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func corsPolicyFor(route string) *corsPolicy {
+	if p, ok := corsPolicies[route]; ok {
+		return p
+	}
+
+	return corsPolicies[defaultCORSRoute]
+}
+
+// applyCORS answers preflights itself, since MinIO would only reject them,
+// and adds CORS headers to responses for allowed origins.
+func applyCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := corsPolicyFor(routeNameFrom(r.Context()))
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		allowed := origin != "" && p.allowsOrigin(origin)
+
+		if allowed {
+			if slices.Contains(p.AllowedOrigins, "*") && !p.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if p.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			if allowed && len(p.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// a rejected preflight gets no allow headers, which the browser
+		// reports as a CORS failure
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		requested := r.Header.Get("Access-Control-Request-Headers")
+		if !allowed || !slices.Contains(p.AllowedMethods, method) || !p.allowsHeaders(requested) {
+			w.Header().Del("Access-Control-Allow-Origin")
+			w.Header().Del("Access-Control-Allow-Credentials")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+		if requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAge))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// stripUpstreamCORS drops CORS headers from MinIO when the proxy manages
+// them, so responses never carry two conflicting sets.
+func stripUpstreamCORS(h http.Header) {
+	if corsPolicies == nil {
+		return
+	}
+
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			h.Del(name)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// debugParam asks for a decision trace instead of the asset. Its value must
+// be the admin token.
+const debugParam = "__debug"
+
+type debugTraceKey struct{}
+
+// debugTrace records the decisions made for one request in the order they
+// happened.
+type debugTrace struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []debugEvent
+}
+
+type debugEvent struct {
+	AtMS       float64 `json:"at_ms"`
+	Step       string  `json:"step"`
+	Detail     string  `json:"detail,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// traceDecision adds a step to the request's debug trace, if it has one.
+func traceDecision(ctx context.Context, step, detail string) {
+	traceTimed(ctx, step, detail, time.Now(), nil)
+}
+
+// traceTimed adds a step that started at start and just finished.
+func traceTimed(ctx context.Context, step, detail string, start time.Time, err error) {
+	dt, ok := ctx.Value(debugTraceKey{}).(*debugTrace)
+	if !ok {
+		return
+	}
+
+	e := debugEvent{
+		AtMS:       milliseconds(start.Sub(dt.start)),
+		Step:       step,
+		Detail:     detail,
+		DurationMS: milliseconds(time.Since(start)),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	dt.mu.Lock()
+	dt.events = append(dt.events, e)
+	dt.mu.Unlock()
+}
+
+// debugWriter keeps the status and headers of a debugged response and throws
+// the body away.
+type debugWriter struct {
+	header http.Header
+	status int
+	bytes  int64
+}
+
+func (w *debugWriter) Header() http.Header { return w.header }
+
+func (w *debugWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *debugWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.bytes += int64(len(b))
+	return len(b), nil
+}
+
+// debugRequests answers ?__debug=<admin token> requests with a JSON trace of
+// how the request was handled: route, cache keys and tiers, Redis and
+// Postgres timings, upstream attempts and the response headers. The request
+// runs through the normal pipeline, but the body never reaches the client.
+func debugRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if !q.Has(debugParam) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := q.Get(debugParam)
+		want := adminToken()
+		if want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			writeError(w, r, proxyError{http.StatusUnauthorized, "unauthorized"})
+			return
+		}
+
+		q.Del(debugParam)
+		r.URL.RawQuery = q.Encode()
+		r.RequestURI = r.URL.RequestURI()
+
+		dt := &debugTrace{start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), debugTraceKey{}, dt))
+
+		route := "none"
+		var vars map[string]string
+		if rt, v := matchRoute(r.URL.Path); rt != nil {
+			route, vars = rt.Name, v
+		}
+		traceDecision(r.Context(), "route", route)
+
+		rec := &debugWriter{header: http.Header{}}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		dt.mu.Lock()
+		defer dt.mu.Unlock()
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]any{
+			"method":      r.Method,
+			"url":         r.URL.RequestURI(),
+			"route":       route,
+			"vars":        vars,
+			"status":      rec.status,
+			"headers":     rec.header,
+			"body_bytes":  rec.bytes,
+			"duration_ms": milliseconds(time.Since(dt.start)),
+			"events":      dt.events,
+		})
+	})
+}
+
+// debugTransport records each round trip to MinIO, including retries and
+// failover attempts.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	detail := req.Method + " " + req.URL.Host + req.URL.Path
+	if err == nil {
+		detail += " -> " + strconv.Itoa(resp.StatusCode)
+	}
+	traceTimed(req.Context(), "upstream", detail, start, err)
+
+	return resp, err
+}
+
+// debugRedisHook times Redis commands for debugged requests.
+type debugRedisHook struct{}
+
+func (debugRedisHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (debugRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+
+		result := err
+		if err == redis.Nil {
+			result = nil
+		}
+		traceTimed(ctx, "redis", cmd.Name()+" "+redisKey(cmd), start, result)
+
+		return err
+	}
+}
+
+func (debugRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		traceTimed(ctx, "redis", "pipeline of "+strconv.Itoa(len(cmds)), start, err)
+
+		return err
+	}
+}
+
+func redisKey(cmd redis.Cmder) string {
+	if args := cmd.Args(); len(args) > 1 {
+		if key, ok := args[1].(string); ok {
+			return key
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	derivativeCacheName = "cdn-proxy-derivatives"
+
+	// how long to wait for another replica that holds the job lock before
+	// rendering ourselves
+	derivativeWaitTimeout  = 5 * time.Second
+	derivativePollInterval = 200 * time.Millisecond
+
+	// last access lives in a sorted set scored by unix time, sizes in a hash
+	// so reclaimable space can be estimated without listing the bucket
+	derivativeAccessKey = "derivatives:access"
+	derivativeSizesKey  = "derivatives:size"
+	derivativeBytesKey  = "derivatives:bytes"
+
+	// each replica records an access at most this often per derivative
+	derivativeTouchInterval = 10 * time.Minute
+)
+
+var (
+	// derivativesBucket, when set, persists rendered variants to MinIO so
+	// they survive restarts and are shared between replicas.
+	derivativesBucket string
+
+	variantRenders singleflight.Group
+
+	// derivativeIdleTTL is how long a derivative may go unrequested before
+	// GC removes it; zero disables collection.
+	derivativeIdleTTL = 30 * 24 * time.Hour
+
+	derivativeTouches sync.Map
+)
+
+var (
+	gcRemovedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_gc_removed_total",
+		Help: "Idle derivatives removed by GC, by store.",
+	}, []string{"store"})
+
+	gcFreedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_gc_freed_bytes_total",
+		Help: "Bytes freed by derivative GC, by store.",
+	}, []string{"store"})
+)
+
+// derivativeKey keeps the owner and source hash in the object path so
+// derivatives can be listed and purged by prefix.
+func derivativeKey(kind, ownerID, hash string, p imageParams) string {
+	sum := sha256.Sum256([]byte(p.key()))
+	return "variants/" + kind + "/" + ownerID + "/" + hash + "/" + hex.EncodeToString(sum[:8]) + "." + p.format
+}
+
+func loadDerivative(ctx context.Context, key string) ([]byte, bool) {
+	obj, err := s3Client.GetObject(ctx, derivativesBucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, false
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			log.Printf("derivative fetch error for %s: %v", key, err)
+		}
+		return nil, false
+	}
+
+	return data, true
+}
+
+func storeDerivative(ctx context.Context, key, contentType string, data []byte) {
+	_, err := s3Client.PutObject(ctx, derivativesBucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		log.Printf("derivative store error for %s: %v", key, err)
+		return
+	}
+
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, derivativeAccessKey, redis.Z{Score: float64(time.Now().Unix()), Member: key})
+		pipe.HSet(ctx, derivativeSizesKey, key, len(data))
+		pipe.IncrBy(ctx, derivativeBytesKey, int64(len(data)))
+		return nil
+	})
+	if err != nil {
+		log.Printf("derivative tracking error for %s: %v", key, err)
+	}
+}
+
+// touchDerivative records that a derivative was served, whichever tier it
+// came from.
+func touchDerivative(ctx context.Context, key string) {
+	now := time.Now()
+	if last, ok := derivativeTouches.Load(key); ok && now.Sub(last.(time.Time)) < derivativeTouchInterval {
+		return
+	}
+	derivativeTouches.Store(key, now)
+
+	err := redisClient.ZAddXX(ctx, derivativeAccessKey, redis.Z{Score: float64(now.Unix()), Member: key}).Err()
+	if err != nil {
+		log.Printf("valkey ZADD error: %v", err)
+	}
+}
+
+type derivativeStats struct {
+	Entries            int64 `json:"entries"`
+	Bytes              int64 `json:"bytes"`
+	ReclaimableEntries int64 `json:"reclaimable_entries"`
+	ReclaimableBytes   int64 `json:"reclaimable_bytes"`
+}
+
+func idleDerivatives(ctx context.Context, idle time.Duration) ([]string, error) {
+	return redisClient.ZRangeByScore(ctx, derivativeAccessKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(time.Now().Add(-idle).Unix(), 10),
+	}).Result()
+}
+
+func bucketDerivativeStats(ctx context.Context, idle time.Duration) (derivativeStats, error) {
+	var st derivativeStats
+
+	entries, err := redisClient.ZCard(ctx, derivativeAccessKey).Result()
+	if err != nil {
+		return st, err
+	}
+	st.Entries = entries
+
+	total, err := redisClient.Get(ctx, derivativeBytesKey).Int64()
+	if err != nil && err != redis.Nil {
+		return st, err
+	}
+	st.Bytes = total
+
+	if idle <= 0 {
+		return st, nil
+	}
+
+	keys, err := idleDerivatives(ctx, idle)
+	if err != nil || len(keys) == 0 {
+		return st, err
+	}
+
+	sizes, err := redisClient.HMGet(ctx, derivativeSizesKey, keys...).Result()
+	if err != nil {
+		return st, err
+	}
+
+	st.ReclaimableEntries = int64(len(keys))
+	for _, v := range sizes {
+		if s, ok := v.(string); ok {
+			n, _ := strconv.ParseInt(s, 10, 64)
+			st.ReclaimableBytes += n
+		}
+	}
+
+	return st, nil
+}
+
+func gcBucketDerivatives(ctx context.Context, idle time.Duration) (int, int64, error) {
+	keys, err := idleDerivatives(ctx, idle)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var removed int
+	var freed int64
+	for _, key := range keys {
+		size, err := removeDerivative(ctx, key)
+		if err != nil {
+			log.Printf("derivative remove error for %s: %v", key, err)
+			continue
+		}
+
+		removed++
+		freed += size
+	}
+
+	return removed, freed, nil
+}
+
+// removeDerivative deletes a derivative and its bookkeeping, returning its
+// recorded size.
+func removeDerivative(ctx context.Context, key string) (int64, error) {
+	if err := s3Client.RemoveObject(ctx, derivativesBucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return 0, err
+	}
+
+	size, _ := redisClient.HGet(ctx, derivativeSizesKey, key).Int64()
+	redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, derivativeAccessKey, key)
+		pipe.HDel(ctx, derivativeSizesKey, key)
+		pipe.DecrBy(ctx, derivativeBytesKey, size)
+		return nil
+	})
+
+	return size, nil
+}
+
+// runDerivativeGC periodically removes idle variants from the local disk
+// cache and, on one replica at a time, from the derivatives bucket.
+func runDerivativeGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		collectDerivatives(ctx)
+	}
+}
+
+// collectDerivatives is one GC pass.
+func collectDerivatives(ctx context.Context) {
+	derivativeTouches.Range(func(k, v any) bool {
+		if time.Since(v.(time.Time)) >= derivativeTouchInterval {
+			derivativeTouches.Delete(k)
+		}
+		return true
+	})
+
+	if derivativeIdleTTL <= 0 {
+		return
+	}
+
+	removed, freed, err := variantCache.gc(derivativeIdleTTL)
+	if err != nil {
+		log.Printf("variant cache gc error: %v", err)
+	}
+	gcRemovedTotal.WithLabelValues("disk").Add(float64(removed))
+	gcFreedBytesTotal.WithLabelValues("disk").Add(float64(freed))
+
+	if derivativesBucket == "" {
+		return
+	}
+
+	release, ok := acquireJobLock(ctx, "gc:derivatives")
+	if !ok {
+		return
+	}
+
+	removed, freed, err = gcBucketDerivatives(ctx, derivativeIdleTTL)
+	release()
+	if err != nil {
+		log.Printf("derivatives bucket gc error: %v", err)
+	}
+	gcRemovedTotal.WithLabelValues("bucket").Add(float64(removed))
+	gcFreedBytesTotal.WithLabelValues("bucket").Add(float64(freed))
+
+	if removed > 0 {
+		log.Printf("derivative gc removed %d objects (%d bytes) from %s", removed, freed, derivativesBucket)
+	}
+}
+
+func waitForDerivative(ctx context.Context, key string) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(ctx, derivativeWaitTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(derivativePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-ticker.C:
+			if data, ok := loadDerivative(ctx, key); ok {
+				return data, true
+			}
+		}
+	}
+}
+
+// generateVariant renders a variant once per process, and once per cluster
+// when the derivatives bucket is enabled.
+func generateVariant(ctx context.Context, kind, ownerID, hash string, p imageParams) ([]byte, error) {
+	key := derivativeKey(kind, ownerID, hash, p)
+
+	v, err, _ := variantRenders.Do(key, func() (any, error) {
+		if derivativesBucket == "" {
+			return renderVariant(ctx, kind, ownerID, hash, p)
+		}
+
+		if data, ok := loadDerivative(ctx, key); ok {
+			recordCacheStatus(ctx, derivativeCacheName, "hit")
+			return data, nil
+		}
+		recordCacheStatus(ctx, derivativeCacheName, "fwd=uri-miss")
+
+		release, locked := acquireJobLock(ctx, "variant:"+key)
+		if !locked {
+			if data, ok := waitForDerivative(ctx, key); ok {
+				return data, nil
+			}
+		} else {
+			defer release()
+		}
+
+		data, err := renderVariant(ctx, kind, ownerID, hash, p)
+		if err != nil {
+			return nil, err
+		}
+
+		storeDerivative(ctx, key, imageContentTypes[p.format], data)
+		recordCacheStatus(ctx, derivativeCacheName, "stored")
+
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
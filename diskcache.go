@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// diskCache stores generated objects as files named by the hash of their key.
+// A file's mtime is its last access, refreshed at most every
+// diskTouchInterval, so idle entries can be collected.
+type diskCache struct {
+	dir string
+
+	// minFreePercent is the share of the disk left free below which puts
+	// are refused; 0 never refuses
+	minFreePercent float64
+
+	// maxBytes caps the entries' total size; past it the least recently
+	// accessed are evicted down to diskEvictRatio of it. 0 is unbounded.
+	maxBytes int64
+
+	mu       sync.Mutex
+	bytes    int64
+	evicting bool
+	checked  time.Time
+	free     uint64
+	total    uint64
+	refusing bool
+}
+
+const (
+	diskTouchInterval = time.Hour
+
+	// eviction frees a margin below maxBytes, so it doesn't run again on
+	// the next write
+	diskEvictRatio = 0.9
+)
+
+// diskCacheStats describes a cache directory; reclaimable counts entries idle
+// for longer than the GC threshold.
+type diskCacheStats struct {
+	Entries            int   `json:"entries"`
+	Bytes              int64 `json:"bytes"`
+	ReclaimableEntries int   `json:"reclaimable_entries"`
+	ReclaimableBytes   int64 `json:"reclaimable_bytes"`
+}
+
+func newDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{dir: dir}
+	st, err := c.stats(0)
+	if err != nil {
+		return nil, err
+	}
+	c.bytes = st.Bytes
+
+	return c, nil
+}
+
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+func (c *diskCache) get(key string) (*os.File, os.FileInfo, bool) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, false
+	}
+
+	if now := time.Now(); now.Sub(info.ModTime()) > diskTouchInterval {
+		os.Chtimes(f.Name(), now, now)
+	}
+
+	return f, info, true
+}
+
+// put writes a whole entry at once.
+func (c *diskCache) put(key string, data []byte) error {
+	w, err := c.create(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.abort()
+		return err
+	}
+
+	return w.commit()
+}
+
+// create starts an entry to be written as it streams in. It goes through a
+// temp file renamed on commit, so readers never observe a partially written
+// entry.
+func (c *diskCache) create(key string) (*diskCacheWriter, error) {
+	if c.minFreePercent > 0 {
+		if free, total, err := c.space(false); err == nil && c.lowOnSpace(free, total) {
+			cacheWritesRefusedTotal.Inc()
+			return nil, errCacheDiskLow
+		}
+	}
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, c.checkFull(err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return nil, c.checkFull(err)
+	}
+
+	return &diskCacheWriter{c: c, tmp: tmp, path: path}, nil
+}
+
+// added counts n more bytes stored, evicting if that takes the cache past
+// maxBytes.
+func (c *diskCache) added(n int64) {
+	c.mu.Lock()
+	c.bytes += n
+	evict := c.maxBytes > 0 && c.bytes > c.maxBytes && !c.evicting
+	c.evicting = c.evicting || evict
+	c.mu.Unlock()
+
+	if !evict {
+		return
+	}
+
+	removed, freed, err := c.evict(int64(float64(c.maxBytes) * diskEvictRatio))
+	if err != nil {
+		log.Printf("variant cache eviction error: %v", err)
+	}
+	cacheEvictedTotal.Add(float64(removed))
+	cacheEvictedBytesTotal.Add(float64(freed))
+
+	c.mu.Lock()
+	c.evicting = false
+	c.mu.Unlock()
+}
+
+// evict removes the least recently accessed entries until the rest fit in
+// target bytes, and recounts the cache's size from what's left.
+func (c *diskCache) evict(target int64) (int, int64, error) {
+	type entry struct {
+		path     string
+		size     int64
+		accessed time.Time
+	}
+
+	var entries []entry
+	var total int64
+	err := c.walk(func(path string, info fs.FileInfo) {
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int { return a.accessed.Compare(b.accessed) })
+
+	var removed int
+	var freed int64
+	for _, e := range entries {
+		if total-freed <= target {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			removed++
+			freed += e.size
+		}
+	}
+
+	c.mu.Lock()
+	c.bytes = total - freed
+	c.mu.Unlock()
+
+	return removed, freed, nil
+}
+
+// checkFull notifies when err is the cache disk filling up.
+func (c *diskCache) checkFull(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		notify("cache_disk_full", c.dir, "cache disk is full at "+c.dir, map[string]any{"dir": c.dir, "error": err.Error()})
+	}
+
+	return err
+}
+
+// diskCacheWriter is an entry being written. Exactly one of commit and
+// abort must be called.
+type diskCacheWriter struct {
+	c    *diskCache
+	tmp  *os.File
+	path string
+}
+
+func (w *diskCacheWriter) Write(p []byte) (int, error) {
+	n, err := w.tmp.Write(p)
+	return n, w.c.checkFull(err)
+}
+
+func (w *diskCacheWriter) commit() error {
+	info, statErr := w.tmp.Stat()
+	if err := w.tmp.Close(); err != nil {
+		os.Remove(w.tmp.Name())
+		return w.c.checkFull(err)
+	}
+
+	if err := os.Rename(w.tmp.Name(), w.path); err != nil {
+		return err
+	}
+
+	if statErr == nil {
+		w.c.added(info.Size())
+	}
+	return nil
+}
+
+func (w *diskCacheWriter) abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// space is the free and total bytes on the cache's filesystem, as of the
+// last lookup within diskSpaceInterval unless fresh.
+func (c *diskCache) space(fresh bool) (free, total uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if fresh || time.Since(c.checked) > diskSpaceInterval {
+		if c.free, c.total, err = diskSpace(c.dir); err != nil {
+			return 0, 0, err
+		}
+		c.checked = time.Now()
+	}
+
+	return c.free, c.total, nil
+}
+
+// lowOnSpace reports whether free is under minFreePercent of total, and
+// notifies when that starts.
+func (c *diskCache) lowOnSpace(free, total uint64) bool {
+	low := c.minFreePercent > 0 && total > 0 && float64(free)/float64(total)*100 < c.minFreePercent
+
+	c.mu.Lock()
+	started := low && !c.refusing
+	c.refusing = low
+	c.mu.Unlock()
+
+	if started {
+		notify("cache_disk_low", c.dir, "refusing variant cache writes at "+c.dir,
+			map[string]any{"dir": c.dir, "free_bytes": free, "total_bytes": total, "min_free_percent": c.minFreePercent})
+	}
+
+	return low
+}
+
+// walk visits every entry, skipping in-progress temp files.
+func (c *diskCache) walk(fn func(path string, info fs.FileInfo)) error {
+	return filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		fn(path, info)
+		return nil
+	})
+}
+
+func (c *diskCache) stats(idle time.Duration) (diskCacheStats, error) {
+	var st diskCacheStats
+	cutoff := time.Now().Add(-idle)
+
+	err := c.walk(func(_ string, info fs.FileInfo) {
+		st.Entries++
+		st.Bytes += info.Size()
+		if idle > 0 && info.ModTime().Before(cutoff) {
+			st.ReclaimableEntries++
+			st.ReclaimableBytes += info.Size()
+		}
+	})
+
+	return st, err
+}
+
+// clear removes every entry.
+func (c *diskCache) clear() (int, int64, error) {
+	var removed int
+	var freed int64
+	err := c.walk(func(path string, info fs.FileInfo) {
+		if os.Remove(path) == nil {
+			removed++
+			freed += info.Size()
+		}
+	})
+	c.removed(freed)
+
+	return removed, freed, err
+}
+
+// gc removes entries not accessed within idle.
+func (c *diskCache) gc(idle time.Duration) (int, int64, error) {
+	var removed int
+	var freed int64
+	cutoff := time.Now().Add(-idle)
+
+	err := c.walk(func(path string, info fs.FileInfo) {
+		if info.ModTime().Before(cutoff) && os.Remove(path) == nil {
+			removed++
+			freed += info.Size()
+		}
+	})
+	c.removed(freed)
+
+	return removed, freed, err
+}
+
+func (c *diskCache) removed(n int64) {
+	c.mu.Lock()
+	c.bytes = max(c.bytes-n, 0)
+	c.mu.Unlock()
+}
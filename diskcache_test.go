@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheEvictsOldest(t *testing.T) {
+	c, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxBytes = 250
+
+	entry := bytes.Repeat([]byte("x"), 100)
+	for i, key := range []string{"old", "recent"} {
+		if err := c.put(key, entry); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(-time.Duration(2-i) * time.Hour)
+		os.Chtimes(c.path(key), at, at)
+	}
+
+	if err := c.put("new", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"old": false, "recent": true, "new": true} {
+		f, _, ok := c.get(key)
+		if ok {
+			f.Close()
+		}
+		if ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	st, err := c.stats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Bytes != 200 || c.bytes != st.Bytes {
+		t.Errorf("bytes = %d counted, %d on disk, want 200", c.bytes, st.Bytes)
+	}
+}
+
+func TestDiskCacheCountsExisting(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.put("a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.bytes != 5 {
+		t.Errorf("bytes = %d, want the 5 already on disk", reopened.bytes)
+	}
+}
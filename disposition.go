@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxFilenameBytes = 255
+
+// setSongDisposition names a song response after the stored filename, or the
+// sanitized ?filename= override, and serves it as an attachment with
+// ?download=1.
+func setSongDisposition(resp *http.Response) {
+	parts := strings.SplitN(strings.TrimPrefix(resp.Request.URL.Path, "/"+minioBucket+"/songs/"), "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	userID := parts[0]
+	hashWithExt := parts[1]
+
+	ext := filepath.Ext(hashWithExt)
+	hash := strings.TrimSuffix(hashWithExt, ext)
+
+	disposition, name := requestedDisposition(resp.Request.URL.Query(), ext)
+
+	// HEAD is how players probe media before playback; the filename isn't
+	// worth a Postgres round trip there
+	if name == "" && resp.Request.Method != http.MethodHead {
+		lookupCtx, cancel := context.WithTimeout(resp.Request.Context(), lookupTimeout)
+		defer cancel()
+
+		audioName, err := lookupAudioFilename(lookupCtx, userID, hash)
+		if err != nil && err != sql.ErrNoRows && err != errCircuitOpen {
+			log.Printf("audio filename lookup failed for %s/%s: %v", userID, hash, err)
+		}
+		if err == nil {
+			name = sanitizeFilename(audioName)
+		}
+	}
+
+	if name == "" && disposition == "inline" {
+		return
+	}
+
+	resp.Header.Set("Content-Disposition", contentDisposition(disposition, name))
+}
+
+// requestedDisposition is what the query asks for: attachment with
+// ?download=1, and the sanitized ?filename=, given ext if it has none.
+func requestedDisposition(q url.Values, ext string) (string, string) {
+	disposition := "inline"
+	if download, _ := strconv.ParseBool(q.Get("download")); download {
+		disposition = "attachment"
+	}
+
+	name := sanitizeFilename(q.Get("filename"))
+	if name != "" && filepath.Ext(name) == "" {
+		name += ext
+	}
+
+	return disposition, name
+}
+
+// sanitizeFilename strips what a filename can't safely carry: control
+// characters, path separators and leading dots. It returns "" if nothing
+// usable is left.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r) || r == utf8.RuneError:
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	for len(name) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	return strings.TrimSpace(name)
+}
+
+// contentDisposition formats the header per RFC 6266: a quoted ASCII
+// filename for every client, plus an RFC 5987 filename* when the name
+// isn't plain ASCII.
+func contentDisposition(disposition, name string) string {
+	if name == "" {
+		return disposition
+	}
+
+	var fallback strings.Builder
+	ascii := true
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('_')
+		case r > unicode.MaxASCII:
+			ascii = false
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+
+	header := disposition + `; filename="` + fallback.String() + `"`
+	if !ascii || fallback.String() != name {
+		header += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+
+	return header
+}
+
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		// attr-char from RFC 5987
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+
+	return b.String()
+}
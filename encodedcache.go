@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+const defaultEncodedCacheBytes = 16 << 20
+
+// encodedCache keeps the compressed bodies of responses with an ETag,
+// so popular JSON such as waveforms is compressed once per encoding rather
+// than on every request. Entries are evicted least recently used first.
+type encodedCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type encodedEntry struct {
+	key  string
+	data []byte
+}
+
+var encodedResponses = newEncodedCache(defaultEncodedCacheBytes)
+
+func newEncodedCache(maxBytes int64) *encodedCache {
+	return &encodedCache{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// encodedKey names a body by its path, query and ETag. The query is part of
+// it because a handler's ETag needn't cover every parameter it reads.
+func encodedKey(encoding, uri, etag string) string {
+	return encoding + " " + uri + " " + etag
+}
+
+func (c *encodedCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+
+	return el.Value.(*encodedEntry).data, true
+}
+
+func (c *encodedCache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok || int64(len(data)) > c.maxEntryBytes() {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&encodedEntry{key, data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		el := c.order.Back()
+		e := el.Value.(*encodedEntry)
+		c.order.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.data))
+	}
+}
+
+// clear empties the cache, returning how many entries went.
+func (c *encodedCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	c.order.Init()
+	clear(c.entries)
+	c.size = 0
+
+	return n
+}
+
+// maxEntryBytes keeps one large body from pushing out everything else.
+func (c *encodedCache) maxEntryBytes() int64 {
+	return c.maxBytes / 8
+}
+
+// captureWriter copies what's written through it until it passes limit,
+// then stops copying without failing the write.
+type captureWriter struct {
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.over {
+		if int64(cw.buf.Len()+len(b)) > cw.limit {
+			cw.over = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(b)
+		}
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the ID a request is answered and logged under.
+// One set by a load balancer in front is kept; otherwise it's the trace ID,
+// or random when the request isn't traced.
+const requestIDHeader = "X-Request-Id"
+
+const maxRequestIDLength = 64
+
+// errorVary names every header wantsHTML looks at, so shared caches don't
+// hand a browser's error page to a fetch or the other way round.
+const errorVary = "Accept, Sec-Fetch-Mode, X-Requested-With"
+
+type requestIDKey struct{}
+
+// errorBody is the JSON error API and XHR clients get.
+type errorBody struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}} · colourlabs</title>
+<style>
+body{margin:0;min-height:100vh;display:grid;place-items:center;font:16px/1.5 system-ui,sans-serif;background:#14121a;color:#eee}
+main{max-width:32rem;padding:2rem;text-align:center}
+h1{margin:0 0 .5rem;font-size:1.5rem;background:linear-gradient(90deg,#f472b6,#a78bfa,#60a5fa);-webkit-background-clip:text;background-clip:text;color:transparent}
+p{margin:0 0 1.5rem;color:#aaa}
+small{color:#777;font-family:ui-monospace,monospace}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<small>{{.Status}} {{.Code}}{{with .RequestID}} · request {{.}}{{end}}</small>
+</main>
+</body>
+</html>
+`))
+
+// errorMessages are what the HTML page says, by status. Others get
+// errorMessageClient or errorMessageServer.
+var errorMessages = map[int]string{
+	http.StatusNotFound:                     "This file doesn't exist, or it has been removed.",
+	http.StatusForbidden:                    "You don't have access to this file.",
+	http.StatusUnauthorized:                 "You need to be signed in to see this file.",
+	http.StatusRequestedRangeNotSatisfiable: "The requested part of this file is out of range.",
+	http.StatusTooManyRequests:              "Too many requests. Wait a moment and try again.",
+	http.StatusServiceUnavailable:           "We're busy right now. Try again in a moment.",
+	http.StatusGatewayTimeout:               "Storage took too long to answer. Try again in a moment.",
+}
+
+const (
+	errorMessageClient = "This link isn't valid."
+	errorMessageServer = "Something went wrong on our end. Try again in a moment."
+)
+
+// assignRequestIDs gives every request an ID, echoed in the response and
+// included in error bodies so a report can be matched to the logs.
+func assignRequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID(r.Context())
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDFrom is the ID assignRequestIDs gave the request, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// wantsHTML reports whether r is a browser navigating to the URL, rather
+// than an API client, XHR or an <img> or <audio> fetch, all of which get
+// JSON.
+func wantsHTML(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality is the q value accept gives mediaType by name, ignoring
+// wildcards, which every client sends and so say nothing about preference.
+func acceptQuality(accept, mediaType string) float64 {
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		return q
+	}
+
+	return 0
+}
+
+// renderError is the body and content type r should get for perr.
+func renderError(r *http.Request, perr proxyError) ([]byte, string) {
+	id := requestIDFrom(r.Context())
+
+	if !wantsHTML(r) {
+		body, _ := json.Marshal(errorBody{Error: perr.code, RequestID: id})
+		return body, "application/json"
+	}
+
+	message, ok := errorMessages[perr.status]
+	if !ok {
+		message = errorMessageClient
+		if perr.status >= 500 {
+			message = errorMessageServer
+		}
+	}
+
+	var buf bytes.Buffer
+	errorPage.Execute(&buf, struct {
+		Title, Message, Code, RequestID string
+		Status                          int
+	}{http.StatusText(perr.status), message, perr.code, id, perr.status})
+
+	return buf.Bytes(), "text/html; charset=utf-8"
+}
+
+// writeError answers r with perr, as JSON or as an HTML page for a browser
+// that navigated to the URL.
+func writeError(w http.ResponseWriter, r *http.Request, perr proxyError) {
+	body, contentType := renderError(r, perr)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Add("Vary", errorVary)
+	if perr == errUpstreamBusy {
+		w.Header().Set("Retry-After", strconv.Itoa(int(upstreamRetryAfter.Seconds())))
+	}
+	w.WriteHeader(perr.status)
+	w.Write(body)
+}
+
+// setError replaces resp's body with perr, negotiated against the request
+// it answers.
+func setError(resp *http.Response, perr proxyError) {
+	body, contentType := renderError(resp.Request, perr)
+
+	resp.StatusCode = perr.status
+	resp.Status = strconv.Itoa(perr.status) + " " + http.StatusText(perr.status)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Add("Vary", errorVary)
+	resp.Header.Del("ETag")
+	resp.Header.Del("Last-Modified")
+}
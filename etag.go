@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// generatedETag is the validator for a response the proxy builds itself,
+// derived from what went into it rather than from the bytes. It's weak:
+// the same inputs promise an equivalent body, not an identical one, since
+// the encoding of the JSON may change between releases.
+func generatedETag(inputs ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(inputs, "\x00")))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified answers 304 itself, with etag and cacheControl, when the
+// request's If-None-Match already has etag. Otherwise the caller goes on
+// to build the response and sets both headers on it.
+func notModified(w http.ResponseWriter, r *http.Request, etag, cacheControl string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		// If-None-Match compares weakly. "*" is left to the full response,
+		// since it hinges on there being one
+		tag = strings.TrimSpace(tag)
+		if tag != "" && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.Header().Set("ETag", etag)
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeGeneratedJSON serves v with an ETag of its encoding, for responses
+// whose inputs aren't known until they're built.
+func writeGeneratedJSON(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, r, proxyError{http.StatusInternalServerError, "internal_error"})
+		return
+	}
+	etag := generatedETag(string(body))
+	if notModified(w, r, etag, "") {
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// excerpts are held in memory while they're cut, so they're kept short
+	maxExcerptDuration = 5 * time.Minute
+
+	maxFFmpegOutput = 64 << 20
+)
+
+var (
+	excerptRenders singleflight.Group
+
+	errFFmpegOutputTooLarge = errors.New("ffmpeg output too large")
+)
+
+// excerptFormat is how ffmpeg writes an excerpt of a song with extension
+// ext without re-encoding it.
+type excerptFormat struct {
+	muxer       string
+	contentType string
+	args        []string
+}
+
+var excerptFormats = map[string]excerptFormat{
+	".mp3":  {muxer: "mp3", contentType: "audio/mpeg"},
+	".ogg":  {muxer: "ogg", contentType: "audio/ogg"},
+	".opus": {muxer: "opus", contentType: "audio/opus"},
+	".flac": {muxer: "flac", contentType: "audio/flac"},
+	".wav":  {muxer: "wav", contentType: "audio/wav"},
+	// mp4 is written to a pipe fragmented, with the index up front
+	".m4a":  {muxer: "mp4", contentType: "audio/mp4", args: []string{"-movflags", "frag_keyframe+empty_moov"}},
+	".aac":  {muxer: "adts", contentType: "audio/aac"},
+	".weba": {muxer: "webm", contentType: "audio/webm"},
+}
+
+// parseTimeRange parses ?t=start-end in seconds.
+func parseTimeRange(s string) (start, end time.Duration, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid t %q", s)
+	}
+
+	a, err := strconv.ParseFloat(from, 64)
+	if err != nil || a < 0 {
+		return 0, 0, fmt.Errorf("invalid t %q", s)
+	}
+	b, err := strconv.ParseFloat(to, 64)
+	if err != nil || b <= a {
+		return 0, 0, fmt.Errorf("invalid t %q", s)
+	}
+
+	start, end = time.Duration(a*float64(time.Second)), time.Duration(b*float64(time.Second))
+	if end-start > maxExcerptDuration {
+		return 0, 0, fmt.Errorf("excerpts are limited to %s", maxExcerptDuration)
+	}
+
+	return start, end, nil
+}
+
+// serveExcerpts answers ?t=start-end on songs with just that part of the
+// track, cut by ffmpeg from the stored file, so a timestamped link plays
+// from its timestamp whatever the player. Without ffmpeg the whole song is
+// served.
+func serveExcerpts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := r.URL.Query().Get("t")
+		rt, vars := matchRoute(r.URL.Path)
+		if t == "" || rt == nil || rt.Name != "songs" || ffmpegPath == "" ||
+			(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID, file := vars["userID"], vars["file"]
+		ext := filepath.Ext(file)
+		format, ok := excerptFormats[ext]
+		if !ok || strings.Contains(file, "/") {
+			writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+			return
+		}
+
+		start, end, err := parseTimeRange(t)
+		if err != nil {
+			writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+			return
+		}
+
+		hash := strings.TrimSuffix(file, ext)
+		key := "songs/" + userID + "/" + hash + "?" + excerptKey(start, end)
+		traceDecision(r.Context(), "excerpt key", key)
+
+		if f, _, ok := variantCache.get(key); ok {
+			defer f.Close()
+			recordCacheStatus(r.Context(), objectCacheName, "hit")
+			writeAudio(w, r, key, format, f)
+			return
+		}
+		recordCacheStatus(r.Context(), objectCacheName, "fwd=uri-miss")
+
+		v, err, _ := excerptRenders.Do(key, func() (any, error) {
+			return cutExcerpt(r.Context(), "/"+minioBucket+"/songs/"+userID+"/"+file, format, start, end)
+		})
+		if err != nil {
+			var perr proxyError
+			if !errors.As(err, &perr) {
+				log.Printf("excerpt of %s failed: %v", key, err)
+				perr = proxyError{http.StatusUnprocessableEntity, "unprocessable_audio"}
+			}
+			writeError(w, r, perr)
+			return
+		}
+		data := v.([]byte)
+
+		if err := variantCache.put(key, data); errors.Is(err, errCacheDiskLow) {
+			// counted, and served uncached
+		} else if err != nil {
+			log.Printf("variant cache write error: %v", err)
+		} else {
+			recordCacheStatus(r.Context(), objectCacheName, "stored")
+			indexVariant(r.Context(), "songs", userID, hash, key)
+		}
+
+		writeAudio(w, r, key, format, bytes.NewReader(data))
+	})
+}
+
+func excerptKey(start, end time.Duration) string {
+	return "t=" + strconv.FormatFloat(start.Seconds(), 'f', -1, 64) + "-" + strconv.FormatFloat(end.Seconds(), 'f', -1, 64)
+}
+
+// cutExcerpt copies the packets between start and end out of the song at
+// objectPath. Cuts land on the nearest packet, which for compressed audio is
+// a few milliseconds at most.
+func cutExcerpt(ctx context.Context, objectPath string, format excerptFormat, start, end time.Duration) ([]byte, error) {
+	args := []string{"-ss", strconv.FormatFloat(start.Seconds(), 'f', -1, 64),
+		"-t", strconv.FormatFloat((end - start).Seconds(), 'f', -1, 64),
+		"-i", "pipe:0", "-map", "0:a", "-c", "copy"}
+	args = append(args, format.args...)
+	args = append(args, "-f", format.muxer, "pipe:1")
+
+	data, err := ffmpegObject(ctx, objectPath, args)
+	// a start past the end of the track leaves nothing to play
+	if err == nil && len(data) == 0 {
+		return nil, proxyErrorForStatus(http.StatusRequestedRangeNotSatisfiable)
+	}
+
+	return data, err
+}
+
+// ffmpegObject runs ffmpeg with args over the object at objectPath, which
+// it reads from pipe:0, and returns what it writes to pipe:1.
+func ffmpegObject(ctx context.Context, objectPath string, args []string) ([]byte, error) {
+	resp, err := fetchObject(ctx, objectPath)
+	if errors.Is(err, errUpstreamBusy) {
+		return nil, errUpstreamBusy
+	} else if err != nil {
+		return nil, proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBody))
+		return nil, parseS3Error(resp.StatusCode, body)
+	}
+
+	return transforms.do(ctx, func() ([]byte, error) {
+		cmd := exec.CommandContext(ctx, ffmpegPath, append([]string{"-v", "error"}, args...)...)
+		cmd.Stdin = resp.Body
+		out := &limitedBuffer{limit: maxFFmpegOutput}
+		var stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = out, &stderr
+		if err := cmd.Run(); err != nil {
+			if out.exceeded {
+				return nil, errFFmpegOutputTooLarge
+			}
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+
+		return out.Bytes(), nil
+	})
+}
+
+// limitedBuffer fails writes past limit, which stops ffmpeg on a broken
+// pipe rather than letting it fill memory.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		b.exceeded = true
+		return 0, errFFmpegOutputTooLarge
+	}
+
+	return b.Buffer.Write(p)
+}
+
+func writeAudio(w http.ResponseWriter, r *http.Request, key string, format excerptFormat, content io.ReadSeeker) {
+	sum := sha256.Sum256([]byte(key))
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Cache-Control", variantCacheControl)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stripMetadataRoutes lists the routes whose images lose their EXIF, XMP
+// and text metadata on the way out, set by STRIP_METADATA_ROUTES. Colour
+// profiles stay, as does the EXIF orientation, which browsers still apply.
+var stripMetadataRoutes = map[string]bool{"avatars": true, "banners": true, "emojis": true}
+
+// parseStripMetadataRoutes reads STRIP_METADATA_ROUTES, a comma-separated
+// list of route names or "none".
+func parseStripMetadataRoutes(s string) map[string]bool {
+	routes := map[string]bool{}
+	if s == "none" {
+		return routes
+	}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			routes[name] = true
+		}
+	}
+
+	return routes
+}
+
+var strippedContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/avif": true,
+	"image/heic": true,
+	"image/heif": true,
+}
+
+// sanitizeImageResponse strips metadata from an image the proxy passes
+// through from storage. Range requests to these routes are sent upstream
+// without their range, since offsets into the stored file don't hold for
+// the stripped one.
+func sanitizeImageResponse(resp *http.Response) error {
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !stripMetadataRoutes[routeNameFrom(resp.Request.Context())] || resp.StatusCode != http.StatusOK ||
+		!strippedContentTypes[strings.TrimSpace(strings.ToLower(mediaType))] {
+		return nil
+	}
+
+	// the stripped size isn't known without the body
+	if resp.Request.Method == http.MethodHead {
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceImageBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) > maxSourceImageBytes {
+		return fmt.Errorf("image too large to strip metadata from: %s", resp.Request.URL.Path)
+	}
+
+	data = stripMetadata(data)
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	return nil
+}
+
+// stripMetadata removes EXIF, XMP, IPTC and text metadata from a JPEG, PNG,
+// WebP or HEIF/AVIF image. Anything it can't parse is returned as it is.
+func stripMetadata(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return stripJPEGMetadata(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNGMetadata(data)
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return stripWebPMetadata(data)
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return blankISOBMFFMetadata(data)
+	}
+
+	return data
+}
+
+// exifOrientation reads the orientation tag from a TIFF-structured EXIF
+// block, returning 1 (upright) when there isn't one.
+func exifOrientation(tiff []byte) int {
+	tiff = bytes.TrimPrefix(tiff, []byte("Exif\x00\x00"))
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := range n {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+
+	return 1
+}
+
+// orientationTIFF is the smallest EXIF block holding just an orientation.
+func orientationTIFF(orientation int) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = append(tiff, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	return append(tiff, 0, 0, 0, 0, 0, 0)
+}
+
+// stripJPEGMetadata drops APP1 (EXIF and XMP), APP13 (IPTC) and comment
+// segments before the scan, keeping JFIF, ICC and Adobe colour segments.
+func stripJPEGMetadata(data []byte) []byte {
+	out := slices.Clone(data[:2])
+	orientation := 1
+
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return data
+		}
+
+		seg := data[i : i+2+n]
+		switch {
+		case marker == 0xe1:
+			if bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(seg[4:])
+			}
+		case marker == 0xed, marker == 0xfe:
+		default:
+			out = append(out, seg...)
+		}
+		i += 2 + n
+	}
+
+	if orientation != 1 {
+		exif := append([]byte("Exif\x00\x00"), orientationTIFF(orientation)...)
+		app1 := append([]byte{0xff, 0xe1}, binary.BigEndian.AppendUint16(nil, uint16(2+len(exif)))...)
+		app1 = append(app1, exif...)
+
+		// after JFIF, which has to come first when there is one
+		at := 2
+		if len(out) > 4 && out[3] == 0xe0 {
+			at += 2 + int(binary.BigEndian.Uint16(out[4:]))
+		}
+		out = slices.Insert(out, at, app1...)
+	}
+
+	return append(out, data[i:]...)
+}
+
+// stripPNGMetadata drops eXIf, text and timestamp chunks.
+func stripPNGMetadata(data []byte) []byte {
+	out := slices.Clone(data[:8])
+	orientation := 1
+
+	for i := 8; i < len(data); {
+		if i+12 > len(data) {
+			return data
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if n < 0 || i+12+n > len(data) {
+			return data
+		}
+
+		chunk := data[i : i+12+n]
+		switch typ := string(chunk[4:8]); typ {
+		case "eXIf":
+			orientation = exifOrientation(chunk[8 : 8+n])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		case "IDAT":
+			// eXIf has to come before the image data
+			if orientation != 1 {
+				tiff := orientationTIFF(orientation)
+				exif := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+				exif = append(exif, "eXIf"...)
+				exif = append(exif, tiff...)
+				exif = binary.BigEndian.AppendUint32(exif, crc32.ChecksumIEEE(exif[4:]))
+				out = append(out, exif...)
+				orientation = 1
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, chunk...)
+		}
+		i += 12 + n
+	}
+
+	return out
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of an extended WebP and
+// clears their VP8X flags.
+func stripWebPMetadata(data []byte) []byte {
+	out := slices.Clone(data[:12])
+	orientation := 1
+	vp8x := -1
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return data
+		}
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n + n&1
+		if i+8+n > len(data) {
+			return data
+		}
+		end = min(end, len(data))
+
+		switch string(data[i : i+4]) {
+		case "EXIF":
+			orientation = exifOrientation(data[i+8 : i+8+n])
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(out)
+			out = append(out, data[i:end]...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	if vp8x >= 0 && vp8x+9 <= len(out) {
+		// XMP (0x04) is gone either way, EXIF (0x08) unless it's rewritten
+		out[vp8x+8] &^= 0x0c
+		if orientation != 1 {
+			out[vp8x+8] |= 0x08
+			out = append(out, riffChunk("EXIF", orientationTIFF(orientation))...)
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+
+	return out
+}
+
+// blankISOBMFFMetadata zeroes the Exif and XMP items of a HEIF or AVIF
+// file where they lie. The items' offsets are all absolute, so removing
+// them would mean rewriting the location table; zeroed data reads as no
+// metadata. Orientation in HEIF is a property of the image, not EXIF.
+func blankISOBMFFMetadata(data []byte) []byte {
+	meta := isoBox(data, "meta")
+	if meta == nil || len(meta) < 4 {
+		return data
+	}
+	children := meta[4:]
+
+	blanked := slices.Clone(data)
+	for _, id := range isoMetadataItems(isoBox(children, "iinf")) {
+		for _, ext := range isoItemExtents(isoBox(children, "iloc"), id) {
+			if ext[0] >= 0 && ext[1] > 0 && ext[0]+ext[1] <= int64(len(blanked)) {
+				clear(blanked[ext[0] : ext[0]+ext[1]])
+			}
+		}
+	}
+
+	return blanked
+}
+
+// isoBox returns the payload of the first box of type typ among boxes.
+func isoBox(boxes []byte, typ string) []byte {
+	for i := 0; i+8 <= len(boxes); {
+		size := int64(binary.BigEndian.Uint32(boxes[i:]))
+		header := int64(8)
+		switch size {
+		case 0:
+			size = int64(len(boxes) - i)
+		case 1:
+			if i+16 > len(boxes) {
+				return nil
+			}
+			size, header = int64(binary.BigEndian.Uint64(boxes[i+8:])), 16
+		}
+		if size < header || int64(i)+size > int64(len(boxes)) {
+			return nil
+		}
+
+		if string(boxes[i+4:i+8]) == typ {
+			return boxes[int64(i)+header : int64(i)+size]
+		}
+		i += int(size)
+	}
+
+	return nil
+}
+
+// isoMetadataItems lists the IDs of Exif and XMP items in an iinf box.
+func isoMetadataItems(iinf []byte) []uint32 {
+	if len(iinf) < 6 {
+		return nil
+	}
+	entries := iinf[6:]
+	if iinf[0] != 0 {
+		if len(iinf) < 8 {
+			return nil
+		}
+		entries = iinf[8:]
+	}
+
+	var ids []uint32
+	for i := 0; i+8 <= len(entries); {
+		size := int(binary.BigEndian.Uint32(entries[i:]))
+		if size < 8 || i+size > len(entries) {
+			break
+		}
+		typ, infe := string(entries[i+4:i+8]), entries[i+8:i+size]
+		i += size
+		if typ != "infe" || len(infe) < 4 {
+			continue
+		}
+
+		var id uint32
+		var rest []byte
+		switch version := infe[0]; {
+		case version == 2 && len(infe) >= 12:
+			id, rest = uint32(binary.BigEndian.Uint16(infe[4:])), infe[8:]
+		case version == 3 && len(infe) >= 14:
+			id, rest = binary.BigEndian.Uint32(infe[4:]), infe[10:]
+		default:
+			continue
+		}
+
+		switch string(rest[:4]) {
+		case "Exif":
+			ids = append(ids, id)
+		case "mime":
+			// item_name, then content_type
+			fields := bytes.SplitN(rest[4:], []byte{0}, 3)
+			if len(fields) >= 2 && string(fields[1]) == "application/rdf+xml" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// isoItemExtents returns the file offset and length of each extent of item
+// id in an iloc box. Extents stored in other ways are left out.
+func isoItemExtents(iloc []byte, id uint32) [][2]int64 {
+	if len(iloc) < 8 {
+		return nil
+	}
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0x0f)
+	baseSize, indexSize := int(iloc[5]>>4), int(iloc[5]&0x0f)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	r := bytes.NewReader(iloc[6:])
+	read := func(n int) (int64, bool) {
+		var v int64
+		for range n {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, false
+			}
+			v = v<<8 | int64(b)
+		}
+		return v, true
+	}
+
+	countSize := 2
+	if version == 2 {
+		countSize = 4
+	}
+	count, ok := read(countSize)
+	if !ok {
+		return nil
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	for range count {
+		itemID, ok := read(idSize)
+		if !ok {
+			return nil
+		}
+		method := int64(0)
+		if version == 1 || version == 2 {
+			if method, ok = read(2); !ok {
+				return nil
+			}
+			method &= 0x0f
+		}
+		if _, ok := read(2); !ok { // data_reference_index
+			return nil
+		}
+		base, ok := read(baseSize)
+		if !ok {
+			return nil
+		}
+		extents, ok := read(2)
+		if !ok {
+			return nil
+		}
+
+		var out [][2]int64
+		for range extents {
+			if _, ok := read(indexSize); !ok {
+				return nil
+			}
+			offset, ok1 := read(offsetSize)
+			length, ok2 := read(lengthSize)
+			if !ok1 || !ok2 {
+				return nil
+			}
+			out = append(out, [2]int64{base + offset, length})
+		}
+
+		if uint32(itemID) == id {
+			if method != 0 {
+				return nil
+			}
+			return out
+		}
+	}
+
+	return nil
+}
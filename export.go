@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	defaultExportRateLimit = 3
+	exportRateWindow       = time.Hour
+)
+
+// exportRateLimit is how many exports a user may start per hour.
+var exportRateLimit = defaultExportRateLimit
+
+// exportFile is one entry in a profile export.
+type exportFile struct {
+	name, objectPath string
+}
+
+// handleExport serves GET /profiles/{id}/export.zip, the user's current
+// avatar, banner and song as a zip streamed straight from storage. Only the
+// user themselves may export.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	if _, err := strconv.ParseInt(userID, 10, 64); err != nil || sessions == nil || !featureEnabled("exports") {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	token := sessionToken(r)
+	if token == "" {
+		writeError(w, r, proxyError{http.StatusUnauthorized, "unauthorized"})
+		return
+	}
+
+	lookupCtx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	defer cancel()
+
+	viewer, err := sessions.validate(lookupCtx, token)
+	if err != nil {
+		if err != errInvalidSession {
+			log.Printf("session validation failed: %v", err)
+		}
+		writeError(w, r, proxyError{http.StatusUnauthorized, "unauthorized"})
+		return
+	}
+	if viewer != userID {
+		writeError(w, r, proxyError{http.StatusForbidden, "forbidden"})
+		return
+	}
+	markPrivate(r.Context())
+
+	if retry, ok := allowExport(lookupCtx, userID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+		writeError(w, r, proxyError{http.StatusTooManyRequests, "rate_limited"})
+		return
+	}
+
+	files, err := exportFiles(lookupCtx, userID)
+	if err != nil {
+		log.Printf("export listing failed for %s: %v", userID, err)
+		writeError(w, r, proxyError{http.StatusServiceUnavailable, "unavailable"})
+		return
+	}
+	cancel()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "profile-"+userID+".zip"))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+
+	// media is already compressed, so entries are stored as they are
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		if err := writeExportFile(r.Context(), zw, f); err != nil {
+			// the status is gone; a truncated zip is all the client can get
+			log.Printf("export of %s failed at %s: %v", userID, f.name, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("export of %s failed: %v", userID, err)
+	}
+}
+
+// allowExport counts an export against the user's hourly limit, reporting
+// how long until the next one is allowed when over it. Exports are refused
+// while Valkey can't count them.
+func allowExport(ctx context.Context, userID string) (time.Duration, bool) {
+	key := "export:rate:" + userID
+	n, err := redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		log.Printf("valkey INCR error: %v", err)
+		return exportRateWindow, false
+	}
+	if n == 1 {
+		if err := redisClient.Expire(ctx, key, exportRateWindow).Err(); err != nil {
+			log.Printf("valkey EXPIRE error: %v", err)
+		}
+	}
+	if n <= int64(exportRateLimit) {
+		return 0, true
+	}
+
+	ttl, err := redisClient.TTL(ctx, key).Result()
+	if err != nil || ttl <= 0 {
+		ttl = exportRateWindow
+	}
+
+	return ttl, false
+}
+
+// exportFiles lists what an export holds. Images are exported as uploaded,
+// from their original format; the song keeps the name it was uploaded with.
+func exportFiles(ctx context.Context, userID string) ([]exportFile, error) {
+	profile, err := fetchProfile(ctx, userID)
+	if err == sql.ErrNoRows {
+		profile = &UserProfile{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var files []exportFile
+	image := func(kind, name, hash string) error {
+		ext, err := lookupOriginalExt(ctx, kind, userID, hash)
+		if err != nil {
+			return err
+		}
+		files = append(files, exportFile{name + "." + ext, "/" + minioBucket + "/" + kind + "/" + userID + "/" + hash + "." + ext})
+		return nil
+	}
+
+	if hash, err := newestAvatar(ctx, userID); err != nil {
+		return nil, err
+	} else if hash != "" {
+		if err := image("avatars", "avatar", hash); err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.BannerHash != "" {
+		if err := image("banners", "banner", profile.BannerHash); err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.AudioHash != "" {
+		ext := audioExtensions[profile.AudioMimeType]
+		if ext == "" {
+			return nil, fmt.Errorf("no extension for song type %q", profile.AudioMimeType)
+		}
+
+		name := sanitizeFilename(profile.AudioName)
+		if name == "" {
+			name = "song" + ext
+		} else if filepath.Ext(name) == "" {
+			name += ext
+		}
+		files = append(files, exportFile{name, "/" + minioBucket + "/songs/" + userID + "/" + profile.AudioHash + ext})
+	}
+
+	return files, nil
+}
+
+// newestAvatar returns the hash of userID's current avatar, or "" for none
+// or when there's no S3 client to list with. Avatars aren't on the profile
+// row; the newest upload is the current one.
+func newestAvatar(ctx context.Context, userID string) (string, error) {
+	if s3Client == nil {
+		return "", nil
+	}
+
+	var newest minio.ObjectInfo
+	for obj := range s3Client.ListObjects(ctx, minioBucket, minio.ListObjectsOptions{Prefix: "avatars/" + userID + "/", Recursive: true}) {
+		if obj.Err != nil {
+			return "", obj.Err
+		}
+		if strings.HasSuffix(obj.Key, ".webp") && obj.LastModified.After(newest.LastModified) {
+			newest = obj
+		}
+	}
+	if newest.Key == "" {
+		return "", nil
+	}
+
+	return strings.TrimSuffix(filepath.Base(newest.Key), ".webp"), nil
+}
+
+func writeExportFile(ctx context.Context, zw *zip.Writer, f exportFile) error {
+	resp, err := fetchObject(ctx, f.objectPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// an object deleted since the profile was read is left out
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, resp.Body)
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultEjectAfter     = 3
+	defaultEjectDuration  = 30 * time.Second
+	defaultHealthInterval = 10 * time.Second
+
+	healthCheckTimeout = 2 * time.Second
+)
+
+// upstreams is set when MINIO_ENDPOINT lists more than one replica.
+var upstreams *failoverTransport
+
+var upstreamEndpointUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cdn_proxy_upstream_endpoint_up",
+	Help: "Whether a MinIO endpoint is currently in rotation.",
+}, []string{"endpoint"})
+
+type upstreamEndpoint struct {
+	url *url.URL
+
+	failures     atomic.Int32
+	ejectedUntil atomic.Int64
+}
+
+func (e *upstreamEndpoint) available(now time.Time) bool {
+	return e.ejectedUntil.Load() <= now.UnixNano()
+}
+
+// failoverTransport spreads upstream requests over MinIO replicas. Requests
+// are addressed to the primary endpoint and rewritten here, so everything
+// outside it (coalescing keys, route expansion) sees a single upstream.
+// Endpoints that fail ejectAfter times in a row, or fail a health check, sit
+// out for ejectFor.
+type failoverTransport struct {
+	next       http.RoundTripper
+	endpoints  []*upstreamEndpoint
+	roundRobin bool
+	ejectAfter int32
+	ejectFor   time.Duration
+
+	counter atomic.Uint64
+}
+
+func newFailoverTransport(next http.RoundTripper, endpoints []*url.URL, roundRobin bool) *failoverTransport {
+	t := &failoverTransport{
+		next:       next,
+		roundRobin: roundRobin,
+		ejectAfter: defaultEjectAfter,
+		ejectFor:   defaultEjectDuration,
+	}
+
+	for _, u := range endpoints {
+		t.endpoints = append(t.endpoints, &upstreamEndpoint{url: u})
+		upstreamEndpointUp.WithLabelValues(u.Host).Set(1)
+	}
+
+	return t
+}
+
+// parseEndpoints splits a comma-separated MINIO_ENDPOINT.
+func parseEndpoints(raw string) ([]*url.URL, error) {
+	var endpoints []*url.URL
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimSuffix(s, "/"))
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, u)
+	}
+
+	return endpoints, nil
+}
+
+// bucketURL is bucket on endpoint. JoinPath leaves the path of a host-only
+// endpoint relative, which the reverse proxy would forward as is.
+func bucketURL(endpoint *url.URL, bucket string) *url.URL {
+	u := endpoint.JoinPath(bucket)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+
+	return u
+}
+
+// order returns endpoints in the order to try them, skipping ejected ones
+// unless nothing else is left.
+func (t *failoverTransport) order() []*upstreamEndpoint {
+	start := 0
+	if t.roundRobin {
+		start = int(t.counter.Add(1) % uint64(len(t.endpoints)))
+	}
+
+	now := time.Now()
+	ordered := make([]*upstreamEndpoint, 0, len(t.endpoints))
+	for i := range t.endpoints {
+		if e := t.endpoints[(start+i)%len(t.endpoints)]; e.available(now) {
+			ordered = append(ordered, e)
+		}
+	}
+
+	if len(ordered) == 0 {
+		return t.endpoints
+	}
+
+	return ordered
+}
+
+// pick returns the endpoint the next request would go to first.
+func (t *failoverTransport) pick() *url.URL {
+	return t.order()[0].url
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// bodies can't be replayed, and nothing the proxy sends upstream through
+	// here has one
+	retryable := req.Body == nil || req.Body == http.NoBody
+
+	endpoints := t.order()
+	for i := 0; ; i++ {
+		e := endpoints[i]
+
+		attempt := req.Clone(req.Context())
+		attempt.URL.Scheme = e.url.Scheme
+		attempt.URL.Host = e.url.Host
+		attempt.Host = e.url.Host
+
+		resp, err := t.next.RoundTrip(attempt)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if err == nil && resp.StatusCode < 500 {
+			t.succeeded(e)
+			resp.Request = req
+			return resp, nil
+		}
+
+		t.failed(e)
+		if !retryable || i == len(endpoints)-1 {
+			if resp != nil {
+				resp.Request = req
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxS3ErrorBody))
+			resp.Body.Close()
+		}
+	}
+}
+
+func (t *failoverTransport) succeeded(e *upstreamEndpoint) {
+	e.failures.Store(0)
+}
+
+func (t *failoverTransport) failed(e *upstreamEndpoint) {
+	if e.failures.Add(1) >= t.ejectAfter {
+		t.eject(e)
+	}
+}
+
+func (t *failoverTransport) eject(e *upstreamEndpoint) {
+	if e.available(time.Now()) {
+		log.Printf("ejecting upstream %s for %s", e.url.Host, t.ejectFor)
+		notify("upstream_ejected", e.url.Host, "ejecting upstream "+e.url.Host+" for "+t.ejectFor.String(), map[string]any{"endpoint": e.url.Host, "failures": e.failures.Load()})
+	}
+
+	e.ejectedUntil.Store(time.Now().Add(t.ejectFor).UnixNano())
+	upstreamEndpointUp.WithLabelValues(e.url.Host).Set(0)
+}
+
+func (t *failoverTransport) reinstate(e *upstreamEndpoint) {
+	if !e.available(time.Now()) {
+		log.Printf("upstream %s is healthy again", e.url.Host)
+	}
+
+	e.failures.Store(0)
+	e.ejectedUntil.Store(0)
+	upstreamEndpointUp.WithLabelValues(e.url.Host).Set(1)
+}
+
+// checkHealth probes MinIO's liveness endpoint on every replica each
+// interval, ejecting the ones that don't answer and bringing back the ones
+// that recovered.
+func (t *failoverTransport) checkHealth(ctx context.Context, interval time.Duration) {
+	client := &http.Client{Timeout: healthCheckTimeout}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, e := range t.endpoints {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url.Scheme+"://"+e.url.Host+"/minio/health/live", nil)
+			if err != nil {
+				continue
+			}
+
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.eject(e)
+			} else {
+				t.reinstate(e)
+			}
+		}
+	}
+}
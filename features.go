@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// admin:features is a hash of feature name to "0" or "1", and the channel
+// replicas reload it on, so a toggle reaches every replica and survives
+// restarts.
+const featuresKey = "admin:features"
+
+// features can be switched off at runtime to shed load or route around a
+// misbehaving dependency, and all start on: transforms (off, image routes
+// serve the stored webp), variant_fill, imgproxy (off, renders happen
+// here), song_throttle, exports and compression.
+var features = map[string]*atomic.Bool{
+	"transforms":    new(atomic.Bool),
+	"variant_fill":  new(atomic.Bool),
+	"imgproxy":      new(atomic.Bool),
+	"song_throttle": new(atomic.Bool),
+	"exports":       new(atomic.Bool),
+	"compression":   new(atomic.Bool),
+}
+
+func init() {
+	for _, f := range features {
+		f.Store(true)
+	}
+}
+
+func featureEnabled(name string) bool {
+	return features[name].Load()
+}
+
+func featureStates() map[string]bool {
+	states := make(map[string]bool, len(features))
+	for name, f := range features {
+		states[name] = f.Load()
+	}
+
+	return states
+}
+
+// loadFeatures applies the stored toggles. Features without one are on.
+func loadFeatures(ctx context.Context) error {
+	stored, err := redisClient.HGetAll(ctx, featuresKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for name, f := range features {
+		f.Store(stored[name] != "0")
+	}
+
+	return nil
+}
+
+func setFeatures(ctx context.Context, changes map[string]bool) error {
+	if len(changes) == 0 {
+		return fmt.Errorf("%w: no features given", errInvalidAdmin)
+	}
+
+	values := make([]any, 0, 2*len(changes))
+	for name, on := range changes {
+		if features[name] == nil {
+			return fmt.Errorf("%w: unknown feature %q, want one of %s", errInvalidAdmin, name, strings.Join(slices.Sorted(maps.Keys(features)), ", "))
+		}
+		v := "0"
+		if on {
+			v = "1"
+		}
+		values = append(values, name, v)
+	}
+
+	if err := redisClient.HSet(ctx, featuresKey, values...).Err(); err != nil {
+		return err
+	}
+	for name, on := range changes {
+		features[name].Store(on)
+		log.Printf("feature %s turned %s", name, map[bool]string{true: "on", false: "off"}[on])
+	}
+	if err := redisClient.Publish(ctx, featuresKey, "").Err(); err != nil {
+		log.Printf("valkey PUBLISH error: %v", err)
+	}
+
+	return nil
+}
+
+// subscribeFeatures reloads the toggles whenever another replica changes
+// them.
+func subscribeFeatures(ctx context.Context) {
+	sub := redisClient.Subscribe(ctx, featuresKey)
+	defer sub.Close()
+
+	for range sub.Channel() {
+		if err := loadFeatures(ctx); err != nil {
+			log.Printf("feature reload failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultGeoRedirectMinBytes = 8 << 20
+
+	// the GeoIP database is reread when geoipupdate replaces it
+	geoDatabaseCheckInterval = time.Minute
+)
+
+var (
+	// geoRegions is nil unless GEO_REGIONS_FILE is set
+	geoRegions map[string]*geoRegion
+
+	// localRegion is the region this proxy serves, which isn't redirected
+	localRegion string
+
+	// geoRedirectMinBytes is the smallest object redirected or fetched from
+	// a region's endpoint; smaller ones, and those whose size isn't known
+	// yet, are served as usual
+	geoRedirectMinBytes int64 = defaultGeoRedirectMinBytes
+
+	geoDatabase atomic.Pointer[maxminddb.Reader]
+
+	geoRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_geo_requests_total",
+		Help: "Streaming route requests sent to a region, by region and action: redirected or endpoint.",
+	}, []string{"region", "action"})
+)
+
+// geoRegion is where clients in its countries or continents are sent for
+// streaming routes. With Redirect, a 302 to that base URL; otherwise
+// objects are fetched from the MinIO replica at Endpoint. Countries are ISO
+// 3166 codes and continents MaxMind's two-letter codes, such as EU.
+type geoRegion struct {
+	Countries  []string `json:"countries"`
+	Continents []string `json:"continents"`
+	Redirect   string   `json:"redirect"`
+	Endpoint   string   `json:"endpoint"`
+
+	name     string
+	redirect *url.URL
+	endpoint *url.URL
+}
+
+type geoRegionKey struct{}
+
+func loadGeoRegions(path string) (map[string]*geoRegion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var regions map[string]*geoRegion
+	if err := json.Unmarshal(data, &regions); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return checkGeoRegions(regions)
+}
+
+func checkGeoRegions(regions map[string]*geoRegion) (map[string]*geoRegion, error) {
+	for name, region := range regions {
+		if region == nil || (region.Redirect == "" && region.Endpoint == "") {
+			return nil, fmt.Errorf("region %q: needs a redirect or an endpoint", name)
+		}
+		if len(region.Countries) == 0 && len(region.Continents) == 0 {
+			return nil, fmt.Errorf("region %q: lists no countries or continents", name)
+		}
+		region.name = name
+
+		for _, u := range []struct {
+			field string
+			raw   string
+			dst   **url.URL
+		}{{"redirect", region.Redirect, &region.redirect}, {"endpoint", region.Endpoint, &region.endpoint}} {
+			if u.raw == "" {
+				continue
+			}
+			parsed, err := url.Parse(u.raw)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("region %q: invalid %s %q", name, u.field, u.raw)
+			}
+			*u.dst = parsed
+		}
+	}
+
+	return regions, nil
+}
+
+// openGeoDatabase reads the MaxMind database at path into memory, so it can
+// be swapped for a newer one while lookups are in flight.
+func openGeoDatabase(path string) (*maxminddb.Reader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return maxminddb.OpenBytes(data)
+}
+
+func watchGeoDatabase(ctx context.Context, path string) {
+	ticker := time.NewTicker(geoDatabaseCheckInterval)
+	defer ticker.Stop()
+
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+
+		db, err := openGeoDatabase(path)
+		if err != nil {
+			log.Printf("GeoIP database reload failed: %v", err)
+			continue
+		}
+		geoDatabase.Store(db)
+		modified = info.ModTime()
+		log.Printf("reloaded GeoIP database %s", path)
+	}
+}
+
+// regionFor is the region r's client is in, if any.
+func regionFor(r *http.Request) *geoRegion {
+	db := geoDatabase.Load()
+	addr := clientIP(r)
+	if db == nil || !addr.IsValid() {
+		return nil
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Continent struct {
+			Code string `maxminddb:"code"`
+		} `maxminddb:"continent"`
+	}
+	if err := db.Lookup(addr).Decode(&record); err != nil {
+		return nil
+	}
+
+	// a country beats a continent, and regions are tried by name so an
+	// overlap always goes the same way
+	var byContinent *geoRegion
+	for _, name := range slices.Sorted(maps.Keys(geoRegions)) {
+		region := geoRegions[name]
+		if slices.Contains(region.Countries, record.Country.ISOCode) && record.Country.ISOCode != "" {
+			return region
+		}
+		if byContinent == nil && slices.Contains(region.Continents, record.Continent.Code) && record.Continent.Code != "" {
+			byContinent = region
+		}
+	}
+
+	return byContinent
+}
+
+// routeRegions sends clients fetching a large object on a streaming route
+// to their region: redirected to its hostname, or served here from its
+// MinIO replica. An owner's private media stays here, since a session
+// cookie wouldn't follow the redirect.
+func routeRegions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt, vars := matchRoute(r.URL.Path)
+		if geoRegions == nil || rt == nil || !rt.Streaming || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		region := regionFor(r)
+		if region == nil || !largeObject(r, rt, vars) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		traceDecision(r.Context(), "geo region", region.name)
+
+		if region.redirect != nil && region.name != localRegion && region.redirect.Host != r.Host &&
+			!markedPrivate(r.Context()) {
+			geoRequestsTotal.WithLabelValues(region.name, "redirected").Inc()
+			w.Header().Set("Cache-Control", "private, no-cache")
+			http.Redirect(w, r, strings.TrimSuffix(region.redirect.String(), "/")+r.URL.RequestURI(), http.StatusFound)
+			return
+		}
+
+		if region.endpoint != nil {
+			r = r.WithContext(context.WithValue(r.Context(), geoRegionKey{}, region))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// largeObject reports whether the object behind r is known, from its
+// remembered metadata, to be at least geoRedirectMinBytes.
+func largeObject(r *http.Request, rt *route, vars map[string]string) bool {
+	if geoRedirectMinBytes <= 0 {
+		return true
+	}
+
+	q := r.URL.Query()
+	path := "/" + minioBucket + rt.expand(vars, q)
+
+	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	defer cancel()
+
+	meta, ok := cachedObjectMeta(ctx, objectMetaKey(path, q.Encode()))
+	return ok && meta.Size >= geoRedirectMinBytes
+}
+
+// regionTransport sends upstream requests from clients in a region with an
+// endpoint to that MinIO replica, falling back to the endpoint the failover
+// transport picked if it can't be reached.
+type regionTransport struct {
+	next http.RoundTripper
+}
+
+func (t *regionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	region, _ := req.Context().Value(geoRegionKey{}).(*geoRegion)
+	if region == nil || region.endpoint == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	attempt := req.Clone(req.Context())
+	attempt.URL.Scheme = region.endpoint.Scheme
+	attempt.URL.Host = region.endpoint.Host
+	attempt.Host = region.endpoint.Host
+
+	resp, err := t.next.RoundTrip(attempt)
+	if err == nil {
+		geoRequestsTotal.WithLabelValues(region.name, "endpoint").Inc()
+		resp.Request = req
+		return resp, nil
+	}
+	if req.Context().Err() != nil || (req.Body != nil && req.Body != http.NoBody) {
+		return nil, err
+	}
+
+	log.Printf("region %s endpoint failed, falling back: %v", region.name, err)
+	return t.next.RoundTrip(req)
+}
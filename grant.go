@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const maxGrantTTL = 7 * 24 * time.Hour
+
+var errInvalidGrant = errors.New("invalid grant")
+
+// Grants are encrypted tokens the main app mints to let a viewer fetch
+// private assets without the proxy looking anything up. A grant is
+//
+//	kid "." base64url(nonce || XChaCha20-Poly1305(plaintext, aad = kid))
+//
+// where the 24-byte nonce is random and the plaintext is the expiry as a
+// big-endian uint64 of Unix seconds, the viewer's user ID prefixed with its
+// uvarint length, then the scope. The scope is a public path, or a path
+// prefix when it ends in "/", such as /songs/42/.
+//
+// Keys come from GRANT_KEYS as kid:key pairs, each key 32 bytes of base64.
+// Grants are minted with the first key and accepted with any listed one.
+type grantKeySet struct {
+	raw     string
+	current string
+	keys    map[string][]byte
+	err     error
+}
+
+var grantKeysCache atomic.Pointer[grantKeySet]
+
+// grantKeys parses GRANT_KEYS, reusing the last parse while it is
+// unchanged.
+func grantKeys() *grantKeySet {
+	raw := setting("GRANT_KEYS")
+	if ks := grantKeysCache.Load(); ks != nil && ks.raw == raw {
+		return ks
+	}
+
+	ks := parseGrantKeys(raw)
+	grantKeysCache.Store(ks)
+	return ks
+}
+
+func parseGrantKeys(raw string) *grantKeySet {
+	ks := &grantKeySet{raw: raw, keys: map[string][]byte{}}
+
+	pairs, err := parseKeyList("GRANT_KEYS", raw)
+	ks.err = err
+	for kid, encoded := range pairs {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != chacha20poly1305.KeySize || strings.Contains(kid, ".") {
+			ks.err = fmt.Errorf("invalid GRANT_KEYS key %q, want a kid without dots and 32 bytes of base64", kid)
+			continue
+		}
+		ks.keys[kid] = key
+	}
+
+	if entries := splitKeyList(raw); len(entries) > 0 {
+		kid, _, _ := strings.Cut(entries[0], ":")
+		if ks.keys[kid] != nil {
+			ks.current = kid
+		}
+	}
+
+	return ks
+}
+
+func mintGrant(viewer, scope string, expires time.Time) (string, error) {
+	ks := grantKeys()
+	if ks.current == "" {
+		return "", errors.New("GRANT_KEYS has no usable first key")
+	}
+
+	aead, err := chacha20poly1305.NewX(ks.keys[ks.current])
+	if err != nil {
+		return "", err
+	}
+
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	plaintext = binary.AppendUvarint(plaintext, uint64(len(viewer)))
+	plaintext = append(append(plaintext, viewer...), scope...)
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(ks.current))
+	return ks.current + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// verifyGrant returns the viewer a grant was minted for, if it is current
+// and its scope covers path.
+func verifyGrant(token, path string) (string, error) {
+	kid, encoded, ok := strings.Cut(token, ".")
+	key := grantKeys().keys[kid]
+	if !ok || key == nil {
+		return "", errInvalidGrant
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < chacha20poly1305.NonceSizeX {
+		return "", errInvalidGrant
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", errInvalidGrant
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:chacha20poly1305.NonceSizeX], sealed[chacha20poly1305.NonceSizeX:], []byte(kid))
+	if err != nil || len(plaintext) < 8 {
+		return "", errInvalidGrant
+	}
+
+	if time.Now().Unix() >= int64(binary.BigEndian.Uint64(plaintext)) {
+		return "", errInvalidGrant
+	}
+
+	n, size := binary.Uvarint(plaintext[8:])
+	rest := plaintext[8+max(size, 0):]
+	if size <= 0 || n > uint64(len(rest)) {
+		return "", errInvalidGrant
+	}
+
+	viewer, scope := string(rest[:n]), string(rest[n:])
+	if !grantCovers(scope, path) {
+		return "", errInvalidGrant
+	}
+
+	return viewer, nil
+}
+
+func grantCovers(scope, path string) bool {
+	if strings.HasSuffix(scope, "/") {
+		return strings.HasPrefix(path, scope)
+	}
+
+	return scope != "" && path == scope
+}
+
+type grantKey struct{}
+
+// takeGrants removes ?grant= from every request before anything logs,
+// traces, keys or forwards its URL, so it neither reaches MinIO nor splits
+// cache keys, whether or not the route is private. The token is kept in
+// the request context for authorizeViewer.
+func takeGrants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if !q.Has("grant") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := q.Get("grant")
+		q.Del("grant")
+		r.URL.RawQuery = q.Encode()
+		r.RequestURI = r.URL.RequestURI()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grantKey{}, token)))
+	})
+}
+
+// grantFrom is the token takeGrants removed from r, if any.
+func grantFrom(r *http.Request) string {
+	token, _ := r.Context().Value(grantKey{}).(string)
+	return token
+}
+
+type grantRequest struct {
+	UserID string `json:"user_id"`
+	Scope  string `json:"scope"`
+	TTL    string `json:"ttl"`
+}
+
+// handleMintGrant serves POST /admin/grants, for services that want grants
+// without implementing the format.
+func handleMintGrant(w http.ResponseWriter, r *http.Request) {
+	var req grantRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRouteTestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 || ttl > maxGrantTTL || !strings.HasPrefix(req.Scope, "/") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": "want a scope path and a ttl of at most " + maxGrantTTL.String()})
+		return
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := mintGrant(req.UserID, req.Scope, expires)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "unavailable", "detail": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"token": token, "expires": expires})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"colourlabs.net/cdn-proxy/adminpb"
+)
+
+// grpcAdmin serves the admin API over gRPC for services that want typed
+// clients and streamed purge progress. It shares every operation with the
+// REST handlers.
+type grpcAdmin struct {
+	adminpb.UnimplementedAdminServer
+}
+
+// serveAdminGRPC runs the gRPC admin API on its own listener, guarded by
+// the same token as the REST one.
+func serveAdminGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := authorizeAdminRPC(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorizeAdminRPC(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	adminpb.RegisterAdminServer(srv, grpcAdmin{})
+
+	return srv.Serve(lis)
+}
+
+func authorizeAdminRPC(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(v, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken())) == 1 {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// rpcError maps an admin operation's failure to a gRPC status, as
+// writeAdminError does for REST.
+func rpcError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidAdmin):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errNoOperation):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errNoBlocklist), errors.Is(err, errNoS3):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		log.Printf("admin operation failed: %v", err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+func (grpcAdmin) GetStats(ctx context.Context, _ *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	disk, err := variantCache.stats(derivativeIdleTTL)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	st := &adminpb.Stats{
+		IdleTtlSeconds: int64(derivativeIdleTTL.Seconds()),
+		Disk: &adminpb.DerivativeStats{
+			Entries:            int64(disk.Entries),
+			Bytes:              disk.Bytes,
+			ReclaimableEntries: int64(disk.ReclaimableEntries),
+			ReclaimableBytes:   disk.ReclaimableBytes,
+		},
+	}
+
+	if derivativesBucket != "" {
+		bucket, err := bucketDerivativeStats(ctx, derivativeIdleTTL)
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		st.Bucket = &adminpb.DerivativeStats{
+			Entries:            bucket.Entries,
+			Bytes:              bucket.Bytes,
+			ReclaimableEntries: bucket.ReclaimableEntries,
+			ReclaimableBytes:   bucket.ReclaimableBytes,
+		}
+	}
+
+	return st, nil
+}
+
+func (grpcAdmin) GetConfig(context.Context, *adminpb.GetConfigRequest) (*adminpb.Config, error) {
+	c := &adminpb.Config{}
+	for _, s := range configSchema {
+		v := setting(s.Name)
+		pb := &adminpb.Setting{
+			Name:     s.Name,
+			Type:     s.Type,
+			Default:  s.Default,
+			Values:   s.Values,
+			Required: s.Required,
+			Secret:   s.Secret,
+			Value:    s.redact(v),
+			Set:      v != "",
+		}
+		if v == "" {
+			pb.Value = s.Default
+		}
+		c.Settings = append(c.Settings, pb)
+	}
+
+	var err error
+	if c.RoutesJson, err = json.Marshal(routes); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if c.CachePoliciesJson, err = json.Marshal(cachePolicies); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if c.CorsPoliciesJson, err = json.Marshal(corsPolicies); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return c, nil
+}
+
+func (grpcAdmin) ValidateConfig(_ context.Context, req *adminpb.CandidateConfig) (*adminpb.ConfigValidation, error) {
+	c := candidateConfig{Env: req.Env}
+	for _, f := range []struct {
+		name string
+		data []byte
+		dst  any
+	}{
+		{"routes_json", req.RoutesJson, &c.Routes},
+		{"cache_policies_json", req.CachePoliciesJson, &c.CachePolicies},
+		{"cors_policies_json", req.CorsPoliciesJson, &c.CORSPolicies},
+	} {
+		if len(f.data) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(f.data, f.dst); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %v", f.name, err)
+		}
+	}
+
+	errs, warnings := validateConfig(c)
+	resp := &adminpb.ConfigValidation{Valid: len(errs) == 0}
+	for _, p := range errs {
+		resp.Errors = append(resp.Errors, &adminpb.ConfigProblem{Field: p.Field, Message: p.Message})
+	}
+	for _, p := range warnings {
+		resp.Warnings = append(resp.Warnings, &adminpb.ConfigProblem{Field: p.Field, Message: p.Message})
+	}
+
+	return resp, nil
+}
+
+func blockEntryProto(e blockEntry) *adminpb.BlockEntry {
+	pb := &adminpb.BlockEntry{Cidr: e.CIDR}
+	if !e.Expires.IsZero() {
+		pb.Expires = timestamppb.New(e.Expires)
+	}
+
+	return pb
+}
+
+func (grpcAdmin) ListBlocks(ctx context.Context, _ *adminpb.ListBlocksRequest) (*adminpb.ListBlocksResponse, error) {
+	entries, err := listBlocks(ctx)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	resp := &adminpb.ListBlocksResponse{}
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, blockEntryProto(e))
+	}
+
+	return resp, nil
+}
+
+func (grpcAdmin) Block(ctx context.Context, req *adminpb.BlockRequest) (*adminpb.BlockEntry, error) {
+	if req.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid ttl")
+	}
+
+	e, err := blockIP(ctx, req.Cidr, time.Duration(req.TtlSeconds)*time.Second)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return blockEntryProto(e), nil
+}
+
+func (grpcAdmin) Unblock(ctx context.Context, req *adminpb.UnblockRequest) (*adminpb.UnblockResponse, error) {
+	removed, err := unblockIP(ctx, req.Cidr)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return &adminpb.UnblockResponse{Removed: removed}, nil
+}
+
+func (grpcAdmin) StartOperation(ctx context.Context, req *adminpb.OperationRequest) (*adminpb.Operation, error) {
+	id, err := startOperation(ctx, operationRequest{Kind: req.Kind, Prefix: req.Prefix, UserID: req.UserId})
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return &adminpb.Operation{Id: id}, nil
+}
+
+func (grpcAdmin) WatchOperation(req *adminpb.WatchOperationRequest, stream grpc.ServerStreamingServer[adminpb.OperationEvent]) error {
+	err := watchOperation(stream.Context(), req.Id, req.After, func(ev opEvent) error {
+		return stream.Send(&adminpb.OperationEvent{
+			Id:    ev.ID,
+			State: ev.State,
+			Stage: ev.Stage,
+			Count: ev.Count,
+			Bytes: ev.Bytes,
+			Done:  ev.Done,
+			Error: ev.Error,
+		})
+	}, nil)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	return nil
+}
+
+func (grpcAdmin) Prefetch(req *adminpb.PrefetchRequest, stream grpc.ServerStreamingServer[adminpb.PrefetchResult]) error {
+	var sendErr error
+	err := prefetch(stream.Context(), req.Paths, func(res prefetchResult) {
+		if sendErr == nil {
+			sendErr = stream.Send(&adminpb.PrefetchResult{
+				Path:        res.Path,
+				Status:      int32(res.Status),
+				Bytes:       res.Bytes,
+				CacheStatus: res.CacheStatus,
+			})
+		}
+	})
+	if err != nil {
+		return rpcError(err)
+	}
+
+	return sendErr
+}
+
+func (grpcAdmin) ListFeatures(context.Context, *adminpb.ListFeaturesRequest) (*adminpb.Features, error) {
+	return &adminpb.Features{Features: featureStates()}, nil
+}
+
+func (grpcAdmin) SetFeature(ctx context.Context, req *adminpb.SetFeatureRequest) (*adminpb.Features, error) {
+	if err := setFeatures(ctx, map[string]bool{req.Name: req.Enabled}); err != nil {
+		return nil, rpcError(err)
+	}
+
+	return &adminpb.Features{Features: featureStates()}, nil
+}
+
+func (grpcAdmin) GetBreakers(context.Context, *adminpb.GetBreakersRequest) (*adminpb.Breakers, error) {
+	resp := &adminpb.Breakers{}
+	for _, b := range breakerStatuses() {
+		pb := &adminpb.Breaker{Name: b.Name, State: b.State, Failures: int32(b.Failures)}
+		if b.OpenedAt != nil {
+			pb.OpenedAt = timestamppb.New(*b.OpenedAt)
+		}
+		resp.Breakers = append(resp.Breakers, pb)
+	}
+
+	return resp, nil
+}
+
+func (grpcAdmin) ListErrorSamples(context.Context, *adminpb.ListErrorSamplesRequest) (*adminpb.ErrorSamples, error) {
+	samples, total := recentErrors()
+
+	resp := &adminpb.ErrorSamples{Total: total}
+	for _, s := range samples {
+		resp.Samples = append(resp.Samples, &adminpb.ErrorSample{
+			Time:        timestamppb.New(s.Time),
+			Method:      s.Method,
+			Path:        s.Path,
+			Route:       s.Route,
+			Status:      int32(s.Status),
+			DurationMs:  s.DurationMS,
+			CacheStatus: s.CacheStatus,
+		})
+	}
+
+	return resp, nil
+}
+
+func (grpcAdmin) FlushCache(ctx context.Context, req *adminpb.FlushCacheRequest) (*adminpb.FlushCacheResponse, error) {
+	n, err := flushCache(ctx, req.Cache)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return &adminpb.FlushCacheResponse{Removed: int64(n)}, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"colourlabs.net/cdn-proxy/adminpb"
+)
+
+func TestGRPCFeatures(t *testing.T) {
+	newTestProxy(t)
+	ctx := context.Background()
+	t.Cleanup(func() { features["compression"].Store(true) })
+
+	resp, err := grpcAdmin{}.SetFeature(ctx, &adminpb.SetFeatureRequest{Name: "compression", Enabled: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on, ok := resp.Features["compression"]; !ok || on {
+		t.Errorf("SetFeature features = %v, want compression off", resp.Features)
+	}
+
+	listed, err := grpcAdmin{}.ListFeatures(ctx, &adminpb.ListFeaturesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed.Features["compression"] || !listed.Features["transforms"] {
+		t.Errorf("ListFeatures = %v, want only compression off", listed.Features)
+	}
+
+	_, err = grpcAdmin{}.SetFeature(ctx, &adminpb.SetFeatureRequest{Name: "warp_drive", Enabled: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown feature: err = %v, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCBreakers(t *testing.T) {
+	resp, err := grpcAdmin{}.GetBreakers(context.Background(), &adminpb.GetBreakersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Breakers) != 2 {
+		t.Fatalf("breakers = %v, want valkey and postgres", resp.Breakers)
+	}
+	for _, b := range resp.Breakers {
+		if b.State == "closed" && b.OpenedAt != nil {
+			t.Errorf("breaker %s is closed but has opened_at", b.Name)
+		}
+	}
+}
+
+func TestGRPCErrorSamples(t *testing.T) {
+	tp := newTestProxy(t)
+	path := "/songs/1/" + testHash("9") + ".mp3"
+	tp.s3.Fail(1, http.StatusInternalServerError, "InternalError")
+
+	if resp, _ := tp.get(t, http.MethodGet, path); resp.StatusCode < 500 {
+		t.Fatalf("status = %d, want a 5xx", resp.StatusCode)
+	}
+
+	resp, err := grpcAdmin{}.ListErrorSamples(context.Background(), &adminpb.ListErrorSamplesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Total < 1 || len(resp.Samples) == 0 {
+		t.Fatalf("samples = %d of %d, want the failed request", len(resp.Samples), resp.Total)
+	}
+	if got := resp.Samples[0]; got.Path != path || got.Status < 500 || got.Time == nil {
+		t.Errorf("newest sample = %v, want %s with its status and time", got, path)
+	}
+}
+
+func TestGRPCFlushCache(t *testing.T) {
+	tp := newTestProxy(t)
+	ctx := context.Background()
+	tp.redis.Set("object:meta:/cdn/songs/1/a.mp3", "{}")
+	tp.redis.Set(profileCacheKey("1"), "{}")
+
+	resp, err := grpcAdmin{}.FlushCache(ctx, &adminpb.FlushCacheRequest{Cache: "metadata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Removed != 1 {
+		t.Errorf("removed = %d, want 1", resp.Removed)
+	}
+	if !tp.redis.Exists(profileCacheKey("1")) {
+		t.Error("flushing metadata removed a profile")
+	}
+
+	_, err = grpcAdmin{}.FlushCache(ctx, &adminpb.FlushCacheRequest{Cache: "everything"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown cache: err = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"colourlabs.net/cdn-proxy/internal/testharness"
+)
+
+const testBucket = "cdn"
+
+// testProxy is the full public pipeline, as main assembles it, in front of
+// the harness fakes. The proxy keeps its state in package variables, so
+// tests using it can't run in parallel.
+type testProxy struct {
+	*httptest.Server
+
+	s3    *testharness.S3
+	redis *miniredis.Miniredis
+	pg    *testharness.Postgres
+
+	adminServer *httptest.Server
+}
+
+// newTestProxy points the proxy at fresh fakes with the default settings,
+// putting the previous globals back when the test ends. Tests change
+// settings by assigning the variables main would, after this returns.
+func newTestProxy(t *testing.T) *testProxy {
+	t.Helper()
+
+	tp := &testProxy{
+		s3: testharness.NewS3(t, testBucket),
+		pg: testharness.NewPostgres(t),
+	}
+	client, mr := testharness.NewRedis(t)
+	tp.redis = mr
+
+	cache, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadRoutes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := url.Parse(tp.s3.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swap(t, &redisClient, client)
+	swap(t, &db, tp.pg.DB())
+	swap(t, &minioURL, bucketURL(endpoint, testBucket))
+	swap(t, &minioBucket, testBucket)
+	swap(t, &variantCache, cache)
+	swap(t, &routes, loaded)
+	swap(t, &encodedResponses, newEncodedCache(defaultEncodedCacheBytes))
+	swap(t, &redisBreaker, newCircuitBreaker("valkey", defaultBreakerThreshold, defaultBreakerCooldown))
+	swap(t, &postgresBreaker, newCircuitBreaker("postgres", defaultBreakerThreshold, defaultBreakerCooldown))
+	t.Cleanup(func() {
+		legacyMisses.Lock()
+		clear(legacyMisses.expires)
+		legacyMisses.Unlock()
+	})
+
+	tp.Server = httptest.NewServer(newPublicHandler(newOriginProxy()))
+	t.Cleanup(tp.Close)
+	// redirects are checked, not followed
+	tp.Client().CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	return tp
+}
+
+const (
+	testUploadToken = "test-upload-token"
+	testAdminToken  = "test-admin-token"
+)
+
+// enableUploads gives the proxy an S3 client for the fake and an upload
+// token, testUploadToken.
+func (tp *testProxy) enableUploads(t *testing.T) {
+	t.Helper()
+
+	endpoint, err := url.Parse(tp.s3.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newS3Client(endpoint, credentials.NewStaticV4("test", "test-secret", ""), defaultMinioRegion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &s3Client, client)
+	setSecrets(t, "UPLOAD_TOKEN", testUploadToken)
+}
+
+// setSecrets sets secrets, given as name, value pairs, for the rest of the
+// test.
+func setSecrets(t *testing.T, pairs ...string) {
+	secrets.mu.Lock()
+	old := secrets.values
+	secrets.values = maps.Clone(old)
+	if secrets.values == nil {
+		secrets.values = map[string]string{}
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		secrets.values[pairs[i]] = pairs[i+1]
+	}
+	secrets.mu.Unlock()
+	t.Cleanup(func() {
+		secrets.mu.Lock()
+		secrets.values = old
+		secrets.mu.Unlock()
+	})
+}
+
+// admin calls the admin API, as main serves it, with testAdminToken and
+// returns the response with its body read.
+func (tp *testProxy) admin(t *testing.T, method, path string, body io.Reader) (*http.Response, string) {
+	t.Helper()
+
+	if tp.adminServer == nil {
+		setSecrets(t, "ADMIN_TOKEN", testAdminToken)
+		tp.adminServer = httptest.NewServer(newAdminHandler())
+		t.Cleanup(tp.adminServer.Close)
+	}
+
+	req, err := http.NewRequest(method, tp.adminServer.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	resp, err := tp.adminServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(data)
+}
+
+// swap sets *v for the rest of the test.
+func swap[T any](t *testing.T, v *T, to T) {
+	old := *v
+	*v = to
+	t.Cleanup(func() { *v = old })
+}
+
+// addProfile answers the profile lookup for a user with the given song.
+func (tp *testProxy) addProfile(id int64, audioHash, audioMimeType, audioName string) {
+	tp.pg.AddRows("FROM user_profiles WHERE id = $1",
+		[]string{"id", "bio", "banner_hash", "audio_hash", "audio_mime_type", "audio_name", "is_private"},
+		[]any{id, "", "", audioHash, audioMimeType, audioName, false})
+}
+
+// addPrivateProfile answers the profile lookup for a user whose profile is
+// private.
+func (tp *testProxy) addPrivateProfile(id int64) {
+	tp.pg.AddRows("FROM user_profiles WHERE id = $1",
+		[]string{"id", "bio", "banner_hash", "audio_hash", "audio_mime_type", "audio_name", "is_private"},
+		[]any{id, "", "", "", "", "", true})
+}
+
+// testJWT is an HS256 session token for sub signed with key, carrying kid
+// in its header unless it's empty.
+func testJWT(key, kid, sub string, expires time.Time) string {
+	header := map[string]string{"alg": "HS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(map[string]any{"sub": sub, "exp": expires.Unix()})
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// get requests path with the headers given as name, value pairs, and
+// returns the response with its body read.
+func (tp *testProxy) get(t *testing.T, method, path string, headers ...string) (*http.Response, string) {
+	t.Helper()
+
+	return tp.do(t, method, path, nil, headers...)
+}
+
+// do is get with a request body.
+func (tp *testProxy) do(t *testing.T, method, path string, body io.Reader, headers ...string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, tp.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := tp.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(data)
+}
+
+// waitFor polls until cond holds, failing the test if it doesn't within
+// a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testHash is a content hash of the configured length made of c.
+func testHash(c string) string {
+	return strings.Repeat(c, hashLength)
+}
+
+// metricValue is the value of the counter or gauge called name with the
+// given labels, as name, value pairs, or 0 if it hasn't been recorded.
+func metricValue(t *testing.T, name string, labels ...string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			have := map[string]string{}
+			for _, l := range m.GetLabel() {
+				have[l.GetName()] = l.GetValue()
+			}
+			for i := 0; i+1 < len(labels); i += 2 {
+				if have[labels[i]] != labels[i+1] {
+					continue metrics
+				}
+			}
+
+			return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+
+	return 0
+}
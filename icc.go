@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"slices"
+)
+
+// ICC_PROFILES picks what happens to embedded colour profiles when an image
+// is re-encoded: convert to sRGB (the default), preserve the profile in the
+// output, or strip it as older versions did.
+const (
+	iccConvert  = "convert"
+	iccPreserve = "preserve"
+	iccStrip    = "strip"
+
+	maxICCProfileBytes = 4 << 20
+)
+
+var iccMode = iccConvert
+
+// xyzD50ToSRGB maps PCS XYZ to linear sRGB, Bradford-adapted to D50.
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// iccProfile extracts the embedded ICC profile from a JPEG, PNG or WebP, or
+// returns nil.
+func iccProfile(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return jpegICCProfile(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngICCProfile(data)
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return webpChunk(data, "ICCP")
+	}
+
+	return nil
+}
+
+func jpegICCProfile(data []byte) []byte {
+	chunks := map[byte][]byte{}
+	var count byte
+
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+
+		seg := data[i+4 : i+2+n]
+		if marker == 0xe2 && len(seg) > 14 && string(seg[:12]) == "ICC_PROFILE\x00" {
+			chunks[seg[12]] = seg[14:]
+			count = seg[13]
+		}
+		i += 2 + n
+	}
+
+	var profile []byte
+	for seq := byte(1); seq <= count; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+
+	return profile
+}
+
+func pngICCProfile(data []byte) []byte {
+	for i := 8; i+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if n < 0 || i+12+n > len(data) || typ == "IDAT" {
+			return nil
+		}
+
+		if typ == "iCCP" {
+			chunk := data[i+8 : i+8+n]
+			name := bytes.IndexByte(chunk, 0)
+			if name < 0 || name+2 > len(chunk) {
+				return nil
+			}
+
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(io.LimitReader(zr, maxICCProfileBytes))
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		i += 12 + n
+	}
+
+	return nil
+}
+
+func webpChunk(data []byte, fourcc string) []byte {
+	for i := 12; i+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if i+8+n > len(data) {
+			return nil
+		}
+		if string(data[i:i+4]) == fourcc {
+			return data[i+8 : i+8+n]
+		}
+		i += 8 + n + n&1
+	}
+
+	return nil
+}
+
+// matrixShaper is an RGB profile described by per-channel tone curves and
+// primaries, which covers Display P3, Adobe RGB and most camera profiles.
+// LUT-based profiles are left alone.
+type matrixShaper struct {
+	toLinear [3][256]float64
+	toSRGB   [3][3]float64
+}
+
+func parseMatrixShaper(profile []byte) (*matrixShaper, bool) {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, false
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+12*(i+1) <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, false
+		}
+		tags[string(entry[:4])] = profile[offset : offset+size]
+	}
+
+	var src [3][3]float64
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := parseXYZ(tags[sig])
+		if !ok {
+			return nil, false
+		}
+		for r := range 3 {
+			src[r][c] = xyz[r]
+		}
+	}
+
+	m := &matrixShaper{}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, ok := parseCurve(tags[sig])
+		if !ok {
+			return nil, false
+		}
+		for v := range 256 {
+			m.toLinear[c][v] = curve(float64(v) / 255)
+		}
+	}
+
+	for r := range 3 {
+		for c := range 3 {
+			for k := range 3 {
+				m.toSRGB[r][c] += xyzD50ToSRGB[r][k] * src[k][c]
+			}
+		}
+	}
+
+	return m, true
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+func parseCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1 && len(tag) >= 14:
+			g := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				pos := x * float64(n-1)
+				i := min(int(pos), n-2)
+				return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+			}, true
+		}
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:])
+		params := []int{1, 3, 4, 5, 7}
+		if int(kind) >= len(params) || len(tag) < 12+4*params[kind] {
+			return nil, false
+		}
+
+		var p [7]float64
+		for i := range params[kind] {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+		switch kind {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, true
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, true
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, true
+		case 4:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, true
+		}
+	}
+
+	return nil, false
+}
+
+// isSRGB reports whether converting would be a no-op, within rounding.
+func (m *matrixShaper) isSRGB() bool {
+	for r := range 3 {
+		for c := range 3 {
+			want := 0.0
+			if r == c {
+				want = 1
+			}
+			if math.Abs(m.toSRGB[r][c]-want) > 0.01 {
+				return false
+			}
+		}
+	}
+
+	for c := range 3 {
+		for _, v := range []int{32, 128, 224} {
+			if math.Abs(m.toLinear[c][v]-srgbToLinear(uint32(v))) > 0.005 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (m *matrixShaper) convert(src image.Image) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		px := dst.Pix[i : i+3 : i+3]
+		lin := [3]float64{m.toLinear[0][px[0]], m.toLinear[1][px[1]], m.toLinear[2][px[2]]}
+		for c := range 3 {
+			v := m.toSRGB[c][0]*lin[0] + m.toSRGB[c][1]*lin[1] + m.toSRGB[c][2]*lin[2]
+			px[c] = uint8(linearToSRGB(v))
+		}
+	}
+
+	return dst
+}
+
+// colorManage converts img to sRGB when convert mode is on and profile is a
+// non-sRGB matrix/shaper profile. Browsers treat untagged images as sRGB, so
+// the output needs no profile of its own.
+func colorManage(img image.Image, profile []byte) image.Image {
+	if iccMode != iccConvert || profile == nil {
+		return img
+	}
+
+	m, ok := parseMatrixShaper(profile)
+	if !ok || m.isSRGB() {
+		return img
+	}
+
+	return m.convert(img)
+}
+
+// tagICCProfile embeds profile into encoded output in preserve mode. AVIF
+// output is left untagged.
+func tagICCProfile(data []byte, format string, bounds image.Rectangle, profile []byte) []byte {
+	if iccMode != iccPreserve || profile == nil {
+		return data
+	}
+
+	switch format {
+	case "webp":
+		return embedWebPICC(data, bounds, profile)
+	case "jpg", "jpeg":
+		return embedJPEGICC(data, profile)
+	case "png":
+		return embedPNGICC(data, profile)
+	}
+
+	return data
+}
+
+func riffChunk(fourcc string, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload)+1)
+	copy(chunk, fourcc)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)&1 == 1 {
+		chunk = append(chunk, 0)
+	}
+
+	return chunk
+}
+
+// embedWebPICC inserts an ICCP chunk, upgrading simple VP8/VP8L files to the
+// extended format that can carry one.
+func embedWebPICC(data []byte, bounds image.Rectangle, profile []byte) []byte {
+	if len(data) < 20 || webpChunk(data, "ICCP") != nil {
+		return data
+	}
+
+	body := data[12:]
+	var vp8x []byte
+	if string(body[:4]) == "VP8X" {
+		n := int(binary.LittleEndian.Uint32(body[4:]))
+		if 8+n > len(body) {
+			return data
+		}
+		vp8x = slices.Clone(body[8 : 8+n])
+		body = body[8+n+n&1:]
+	} else {
+		vp8x = make([]byte, 10)
+		w, h := bounds.Dx()-1, bounds.Dy()-1
+		vp8x[4], vp8x[5], vp8x[6] = byte(w), byte(w>>8), byte(w>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(h), byte(h>>8), byte(h>>16)
+
+		// VP8L keeps the alpha flag in its header
+		if string(body[:4]) == "VP8L" && len(body) >= 13 && binary.LittleEndian.Uint32(body[9:])&(1<<28) != 0 {
+			vp8x[0] |= 0x10
+		}
+	}
+	vp8x[0] |= 0x20
+
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	out = append(out, riffChunk("VP8X", vp8x)...)
+	out = append(out, riffChunk("ICCP", profile)...)
+	out = append(out, body...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+
+	return out
+}
+
+func embedJPEGICC(data, profile []byte) []byte {
+	const maxChunk = 65519
+	if len(data) < 2 {
+		return data
+	}
+
+	count := (len(profile) + maxChunk - 1) / maxChunk
+	if count > 255 {
+		return data
+	}
+
+	out := slices.Clone(data[:2])
+	for seq := range count {
+		chunk := profile[seq*maxChunk : min(len(profile), (seq+1)*maxChunk)]
+		out = append(out, 0xff, 0xe2)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+14+len(chunk)))
+		out = append(out, "ICC_PROFILE\x00"...)
+		out = append(out, byte(seq+1), byte(count))
+		out = append(out, chunk...)
+	}
+
+	return append(out, data[2:]...)
+}
+
+func embedPNGICC(data, profile []byte) []byte {
+	// signature plus the IHDR chunk, which must come first
+	const ihdrEnd = 8 + 12 + 13
+	if len(data) < ihdrEnd {
+		return data
+	}
+
+	var payload bytes.Buffer
+	payload.WriteString("icc\x00\x00")
+	zw := zlib.NewWriter(&payload)
+	zw.Write(profile)
+	zw.Close()
+
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(payload.Len()))
+	chunk = append(chunk, "iCCP"...)
+	chunk = append(chunk, payload.Bytes()...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := slices.Clone(data[:ihdrEnd])
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAvatarSize = 256
+
+	// identicons are a 5x5 grid mirrored about the middle column, inside half
+	// a cell of margin
+	identiconCells = 5
+
+	// a user's placeholder URL stops being requested once they upload, so it
+	// only needs to outlive a page view or two
+	defaultAvatarCacheControl = "public, max-age=3600"
+)
+
+// defaultAvatars serves users without an avatar an identicon instead of a
+// 404, set by DEFAULT_AVATARS=identicon.
+var defaultAvatars bool
+
+var identiconBackground = color.NRGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+// identicon draws userID's identicon at width x height. The same user always
+// gets the same pattern and colour, whatever size they're drawn at.
+func identicon(userID string, width, height int) image.Image {
+	sum := sha256.Sum256([]byte(userID))
+	fg := hslColor(float64(uint16(sum[0])<<8|uint16(sum[1]))/65536, 0.45+float64(sum[2])/255*0.2, 0.5+float64(sum[3])/255*0.15)
+
+	// 15 bits fill the left three columns, the rest is their mirror image
+	var filled [identiconCells][identiconCells]bool
+	for i := range 15 {
+		x, y := i/identiconCells, i%identiconCells
+		on := sum[4+i/8]>>(i%8)&1 == 1
+		filled[x][y], filled[identiconCells-1-x][y] = on, on
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	side := min(width, height)
+	left, top := (width-side)/2, (height-side)/2
+	for y := range height {
+		// positions are counted in half cells so the margin is one unit
+		v := (y - top) * (2*identiconCells + 2) / side
+		for x := range width {
+			u := (x - left) * (2*identiconCells + 2) / side
+			c := identiconBackground
+			if u >= 1 && v >= 1 && u <= 2*identiconCells && v <= 2*identiconCells && filled[(u-1)/2][(v-1)/2] {
+				c = fg
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func hslColor(h, s, l float64) color.NRGBA {
+	hue := func(t float64) uint8 {
+		q := l + s - l*s
+		if l < 0.5 {
+			q = l * (1 + s)
+		}
+		p := 2*l - q
+
+		t -= float64(int(t))
+		if t < 0 {
+			t++
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 0.5:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(v*255 + 0.5)
+	}
+
+	return color.NRGBA{hue(h + 1.0/3), hue(h), hue(h - 1.0/3), 0xff}
+}
+
+// renderDefaultAvatar encodes userID's identicon, returning it with an ETag
+// that changes with everything that went into it.
+func renderDefaultAvatar(userID string, width, height int, format string) ([]byte, string, error) {
+	data, err := encodeImage(identicon(userID, width, height), format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256([]byte("identicon:" + userID + "?" + strconv.Itoa(width) + "x" + strconv.Itoa(height) + "&format=" + format))
+	return data, `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// writeDefaultAvatar answers a transform of an avatar that doesn't exist. It
+// reports whether it did.
+func writeDefaultAvatar(w http.ResponseWriter, r *http.Request, userID string, p imageParams) bool {
+	width, height := p.width, p.height
+	if width == 0 {
+		width, height = defaultAvatarSize, defaultAvatarSize
+	}
+
+	var etag string
+	data, err := transforms.do(r.Context(), func() ([]byte, error) {
+		data, tag, err := renderDefaultAvatar(userID, width, height, p.format)
+		etag = tag
+		return data, err
+	})
+	if err != nil {
+		return false
+	}
+
+	w.Header().Set("Content-Type", imageContentTypes[p.format])
+	w.Header().Set("Cache-Control", defaultAvatarCacheControl)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Default-Avatar", "true")
+	traceDecision(r.Context(), "missing avatar", "identicon")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+
+	return true
+}
+
+// fillDefaultAvatar replaces a 404 for an untransformed avatar with the
+// owner's identicon at defaultAvatarSize, in the format that was asked for.
+// It reports whether resp was replaced.
+func fillDefaultAvatar(resp *http.Response) bool {
+	if !defaultAvatars || resp.StatusCode != http.StatusNotFound ||
+		(resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead) {
+		return false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(resp.Request.URL.Path, "/"+minioBucket+"/"), "/", 3)
+	if len(parts) != 3 || parts[0] != "avatars" {
+		return false
+	}
+	dot := strings.LastIndexByte(parts[2], '.')
+	if dot < 0 {
+		return false
+	}
+	format := parts[2][dot+1:]
+	if _, ok := imageContentTypes[format]; !ok {
+		return false
+	}
+
+	data, etag, err := renderDefaultAvatar(parts[1], defaultAvatarSize, defaultAvatarSize, format)
+	if err != nil {
+		return false
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxS3ErrorBody))
+	resp.Body.Close()
+
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header = http.Header{}
+	resp.Header.Set("Content-Type", imageContentTypes[format])
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Header.Set("Cache-Control", defaultAvatarCacheControl)
+	resp.Header.Set("ETag", etag)
+	resp.Header.Set("X-Default-Avatar", "true")
+	resp.ContentLength = int64(len(data))
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if resp.Request.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+
+	traceDecision(resp.Request.Context(), "missing avatar", "identicon")
+
+	return true
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	_ "image/gif"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/heic"
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+const (
+	webpQuality = 80
+	jpegQuality = 85
+	avifQuality = 60
+
+	// smart gravity scores crop windows on a downscaled copy of the image
+	smartCropSampleSize = 256
+
+	defaultMaxImagePixels = 64 << 20
+
+	defaultMaxLosslessPixels = 1 << 20
+)
+
+var (
+	// maxImagePixels caps declared width×height, since decoding allocates
+	// for the whole image up front regardless of how small the file is.
+	maxImagePixels = defaultMaxImagePixels
+
+	// maxLosslessPixels caps the output box for lossless webp, which can be
+	// many times the size of lossy output.
+	maxLosslessPixels = defaultMaxLosslessPixels
+
+	errImageTooLarge = proxyError{http.StatusUnprocessableEntity, "image_too_large"}
+)
+
+var imageContentTypes = map[string]string{
+	"webp": "image/webp",
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"avif": "image/avif",
+}
+
+func init() {
+	// heic only registers the heic brand; iPhones and other encoders also
+	// write these
+	for _, brand := range []string{"heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, heic.Decode, heic.DecodeConfig)
+	}
+}
+
+func decodeImage(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// checkImageLimits reads only headers and container structure, rejecting
+// images that would be too expensive to decode. It leaves r at an unspecified
+// offset.
+func checkImageLimits(r io.ReadSeeker) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return errMalformedImage
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxImagePixels) {
+		return errImageTooLarge
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return checkAnimation(r)
+}
+
+// imageQuality is the lossy quality each output format is encoded at.
+type imageQuality struct {
+	webp, jpeg, avif int
+}
+
+var (
+	defaultQuality = imageQuality{webp: webpQuality, jpeg: jpegQuality, avif: avifQuality}
+	// saveDataQuality is for clients that sent Save-Data: on
+	saveDataQuality = imageQuality{webp: 50, jpeg: 60, avif: 40}
+)
+
+func (q imageQuality) forFormat(format string) int {
+	switch format {
+	case "jpg", "jpeg":
+		return q.jpeg
+	case "avif":
+		return q.avif
+	default:
+		return q.webp
+	}
+}
+
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	return encodeImageQuality(img, format, defaultQuality)
+}
+
+func encodeImageQuality(img image.Image, format string, q imageQuality) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpg", "jpeg":
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: q.jpeg})
+	case "avif":
+		err = avif.Encode(&buf, img, avif.Options{Quality: q.avif, QualityAlpha: q.avif, Speed: avif.DefaultSpeed})
+	default:
+		err = webp.Encode(&buf, img, webp.Options{Quality: q.webp})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// progressiveFormats can be written progressively: progressive JPEG and
+// Adam7-interlaced PNG.
+var progressiveFormats = map[string]bool{"jpg": true, "jpeg": true, "png": true}
+
+// progressiveImage reports whether data is a progressive jpeg or an
+// interlaced png.
+func progressiveImage(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		// the interlace method is the last byte of IHDR, the first chunk
+		return len(data) > 28 && data[28] == 1
+	}
+
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return false
+	}
+
+	// walk the jpeg markers up to the frame header: SOF2 is progressive
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		switch {
+		case marker == 0xc2:
+			return true
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return false
+		}
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+	}
+
+	return false
+}
+
+// losslessWebP reports whether data is a webp with a lossless (VP8L) image.
+func losslessWebP(data []byte) bool {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return false
+	}
+
+	for i := 12; i+8 <= len(data); {
+		switch string(data[i : i+4]) {
+		case "VP8L":
+			return true
+		case "VP8 ":
+			return false
+		}
+		// chunks are padded to an even size
+		i += 8 + (int(binary.LittleEndian.Uint32(data[i+4:]))+1)&^1
+	}
+
+	return false
+}
+
+// encodeProgressive is encodeImage for formats in progressiveFormats.
+func encodeProgressive(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case "png":
+		err = encodeInterlacedPNG(&buf, img)
+	case "jpg", "jpeg":
+		err = encodeProgressiveJPEG(&buf, flatten(img), jpegQuality)
+	default:
+		return encodeImage(img, format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeLossless writes lossless webp, after near-lossless preprocessing
+// when level is below 100.
+func encodeLossless(img image.Image, level int) ([]byte, error) {
+	if level < 100 {
+		img = nearLossless(img, level)
+	}
+
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, webp.Options{Lossless: true}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// cropFill scales src to cover a width×height box and crops the overflow,
+// using gravity to decide which part of the image to keep.
+func cropFill(src image.Image, width, height int, gravity string) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	scale := max(float64(width)/float64(sw), float64(height)/float64(sh))
+	cw := min(sw, int(float64(width)/scale+0.5))
+	ch := min(sh, int(float64(height)/scale+0.5))
+
+	var x, y int
+	switch gravity {
+	case "top":
+		x, y = (sw-cw)/2, 0
+	case "smart":
+		x, y = smartCropOrigin(src, cw, ch)
+	default:
+		x, y = (sw-cw)/2, (sh-ch)/2
+	}
+
+	region := image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+cw, b.Min.Y+y+ch)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, region, draw.Src, nil)
+
+	return dst
+}
+
+// fitImage scales src to fit inside a width×height box, keeping its aspect
+// ratio.
+func fitImage(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	scale := min(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+	w := max(1, int(float64(b.Dx())*scale+0.5))
+	h := max(1, int(float64(b.Dy())*scale+0.5))
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	return dst
+}
+
+// smartCropOrigin picks the cw×ch window with the most edge energy. Only one
+// axis ever has slack in a fill crop, so this is a 1D search over prefix sums.
+func smartCropOrigin(src image.Image, cw, ch int) (int, int) {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if cw >= sw && ch >= sh {
+		return 0, 0
+	}
+
+	ratio := min(1, float64(smartCropSampleSize)/float64(max(sw, sh)))
+	tw, th := max(1, int(float64(sw)*ratio)), max(1, int(float64(sh)*ratio))
+
+	sample := image.NewGray(image.Rect(0, 0, tw, th))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), src, b, draw.Src, nil)
+
+	horizontal := sw-cw > sh-ch
+	n := th
+	if horizontal {
+		n = tw
+	}
+
+	energy := make([]float64, n)
+	for y := 1; y < th-1; y++ {
+		for x := 1; x < tw-1; x++ {
+			dx := int(sample.GrayAt(x+1, y).Y) - int(sample.GrayAt(x-1, y).Y)
+			dy := int(sample.GrayAt(x, y+1).Y) - int(sample.GrayAt(x, y-1).Y)
+			e := float64(abs(dx) + abs(dy))
+
+			if horizontal {
+				energy[x] += e
+			} else {
+				energy[y] += e
+			}
+		}
+	}
+
+	prefix := make([]float64, n+1)
+	for i, e := range energy {
+		prefix[i+1] = prefix[i] + e
+	}
+
+	window := int(float64(ch) * ratio)
+	slack := sh - ch
+	if horizontal {
+		window = int(float64(cw) * ratio)
+		slack = sw - cw
+	}
+	window = min(max(window, 1), n)
+
+	best, bestScore := 0, -1.0
+	for start := 0; start+window <= n; start++ {
+		if score := prefix[start+window] - prefix[start]; score > bestScore {
+			best, bestScore = start, score
+		}
+	}
+
+	offset := min(slack, int(float64(best)/ratio))
+	if horizontal {
+		return offset, (sh - ch) / 2
+	}
+
+	return (sw - cw) / 2, offset
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// flatten composites transparent images onto white for formats without alpha.
+func flatten(img image.Image) image.Image {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
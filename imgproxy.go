@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imgproxyPresignExpiry only needs to cover imgproxy fetching the source.
+const imgproxyPresignExpiry = 5 * time.Minute
+
+// imgproxyClient delegates image transforms to an imgproxy sidecar, which
+// fetches the original from MinIO itself. Set IMGPROXY_URL to an http(s) URL
+// or to unix:///path/to/imgproxy.sock.
+type imgproxyClient struct {
+	baseURL string
+	client  *http.Client
+	key     []byte
+	salt    []byte
+}
+
+var imgproxy *imgproxyClient
+
+var imgproxyGravity = map[string]string{
+	"center": "ce",
+	"top":    "no",
+	"smart":  "sm",
+}
+
+func newImgproxyClient(rawURL, keyHex, saltHex string) (*imgproxyClient, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IMGPROXY_KEY: %w", err)
+	}
+
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IMGPROXY_SALT: %w", err)
+	}
+
+	c := &imgproxyClient{baseURL: strings.TrimSuffix(rawURL, "/"), client: http.DefaultClient, key: key, salt: salt}
+
+	if socket, ok := strings.CutPrefix(rawURL, "unix://"); ok {
+		c.baseURL = "http://imgproxy"
+		c.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+	}
+
+	return c, nil
+}
+
+// sign returns the URL signature imgproxy expects, or the placeholder it
+// accepts when running without a key.
+func (c *imgproxyClient) sign(path string) string {
+	if len(c.key) == 0 {
+		return "_"
+	}
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(c.salt)
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c *imgproxyClient) options(p imageParams) []string {
+	var opts []string
+
+	switch {
+	case p.width > 0:
+		w, h := p.width, p.height
+		if p.size > 0 {
+			// a crop followed by a fit is a fill to the fitted dimensions
+			scale := min(1, float64(p.size)/float64(max(w, h)))
+			w, h = max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+		}
+		opts = append(opts, fmt.Sprintf("rs:fill:%d:%d:1", w, h), "g:"+imgproxyGravity[p.gravity])
+	case p.size > 0:
+		opts = append(opts, fmt.Sprintf("rs:fit:%d:%d:1", p.size, p.size))
+	case p.bounded():
+		opts = append(opts, fmt.Sprintf("rs:fit:%d:%d:0", saveDataMaxSize, saveDataMaxSize))
+	}
+	if p.saveData {
+		opts = append(opts, "q:"+strconv.Itoa(saveDataQuality.forFormat(p.format)))
+	}
+
+	return opts
+}
+
+// imgproxySource is the URL imgproxy fetches an original from.
+func imgproxySource(ctx context.Context, objectPath string) (string, error) {
+	return storage.sourceURL(ctx, objectPath)
+}
+
+func (c *imgproxyClient) render(ctx context.Context, objectPath string, p imageParams) ([]byte, error) {
+	source, err := imgproxySource(ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + strings.Join(c.options(p), "/") + "/plain/" + url.PathEscape(source) + "@" + p.format
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/"+c.sign(path)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, proxyError{http.StatusNotFound, "not_found"}
+	case resp.StatusCode == http.StatusUnprocessableEntity:
+		return nil, proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("imgproxy returned %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxSourceImageBytes))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxErrorSamples = 100
+
+	// cacheFlushChannel carries flushes of a whole cache to every replica
+	cacheFlushChannel = "cache:flush"
+)
+
+// errorSample is a 5xx the public listener sent, kept for the admin API.
+type errorSample struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Route       string    `json:"route"`
+	Status      int       `json:"status"`
+	DurationMS  float64   `json:"duration_ms"`
+	CacheStatus string    `json:"cache_status,omitempty"`
+}
+
+// errorSamples is a ring of the most recent samples on this replica.
+var errorSamples = struct {
+	sync.Mutex
+	ring  [maxErrorSamples]errorSample
+	next  int
+	total int64
+}{}
+
+func recordErrorSample(r *http.Request, rec *responseRecorder, route string, start time.Time) {
+	if rec.status < 500 {
+		return
+	}
+
+	errorSamples.Lock()
+	defer errorSamples.Unlock()
+
+	errorSamples.ring[errorSamples.next] = errorSample{
+		Time:        start,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Route:       route,
+		Status:      rec.status,
+		DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+		CacheStatus: rec.Header().Get("Cache-Status"),
+	}
+	errorSamples.next = (errorSamples.next + 1) % maxErrorSamples
+	errorSamples.total++
+}
+
+// recentErrors returns the samples newest first, with how many there have
+// been since start.
+func recentErrors() ([]errorSample, int64) {
+	errorSamples.Lock()
+	defer errorSamples.Unlock()
+
+	n := min(errorSamples.total, maxErrorSamples)
+	out := make([]errorSample, 0, n)
+	for i := int64(1); i <= n; i++ {
+		out = append(out, errorSamples.ring[(int64(errorSamples.next)-i+maxErrorSamples)%maxErrorSamples])
+	}
+
+	return out, errorSamples.total
+}
+
+func breakerStatuses() []breakerStatus {
+	return []breakerStatus{redisBreaker.status(), postgresBreaker.status()}
+}
+
+// handleStatus serves GET /admin/status, what this replica is doing and how
+// its dependencies look to it.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	type endpointStatus struct {
+		Endpoint string `json:"endpoint"`
+		Up       bool   `json:"up"`
+		Failures int32  `json:"failures"`
+	}
+
+	_, errorsTotal := recentErrors()
+	resp := map[string]any{
+		"breakers":       breakerStatuses(),
+		"features":       featureStates(),
+		"errors_total":   errorsTotal,
+		"serve_watchers": serveWatchers.count.Load(),
+	}
+
+	if upstreams != nil {
+		now := time.Now()
+		eps := make([]endpointStatus, 0, len(upstreams.endpoints))
+		for _, e := range upstreams.endpoints {
+			eps = append(eps, endpointStatus{e.url.Redacted(), e.available(now), e.failures.Load()})
+		}
+		resp["upstreams"] = eps
+	}
+
+	disk, err := variantCache.stats(derivativeIdleTTL)
+	if err != nil {
+		writeError(w, r, proxyError{http.StatusInternalServerError, "internal_error"})
+		return
+	}
+	resp["caches"] = map[string]any{"variants": disk}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleErrors serves GET /admin/errors, the recent 5xx samples.
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	samples, total := recentErrors()
+	writeJSON(w, http.StatusOK, map[string]any{"total": total, "samples": samples})
+}
+
+// flushCache empties one cache: variants on every replica's disk, the
+// object metadata or profiles held in Valkey, or this replica's compressed
+// responses. It returns how many entries went, counting only this replica's
+// disk for variants.
+func flushCache(ctx context.Context, cache string) (int, error) {
+	switch cache {
+	case "variants":
+		n, _, err := variantCache.clear()
+		if err != nil {
+			return n, err
+		}
+		if err := redisClient.Publish(ctx, cacheFlushChannel, cache).Err(); err != nil {
+			log.Printf("valkey PUBLISH error: %v", err)
+		}
+		// nothing is left for the indexes to point at
+		_, err = deleteKeys(ctx, variantIndexPrefix+"*")
+		return n, err
+	case "metadata":
+		return deleteKeys(ctx, "object:meta:*")
+	case "profiles":
+		return deleteKeys(ctx, profileCacheKey("*"))
+	case "encoded":
+		return encodedResponses.clear(), nil
+	default:
+		return 0, fmt.Errorf("%w: cache must be variants, metadata, profiles or encoded", errInvalidAdmin)
+	}
+}
+
+func deleteKeys(ctx context.Context, pattern string) (int, error) {
+	var n int
+	err := scanKeys(ctx, pattern, func(key string) error {
+		if err := redisClient.Del(ctx, key).Err(); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// subscribeCacheFlushes empties this replica's disk cache when another
+// replica flushes it.
+func subscribeCacheFlushes(ctx context.Context) {
+	sub := redisClient.Subscribe(ctx, cacheFlushChannel)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		if msg.Payload != "variants" {
+			continue
+		}
+
+		n, freed, err := variantCache.clear()
+		if err != nil {
+			log.Printf("variant cache flush failed: %v", err)
+		} else if n > 0 {
+			log.Printf("variant cache flush removed %d variants (%d bytes)", n, freed)
+		}
+	}
+}
+
+// handleFlushCache serves POST /admin/caches/flush with {"cache": name}.
+func handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Cache string `json:"cache"`
+	}
+	if err := decodeAdminRequest(w, r, &req); err != nil {
+		return
+	}
+
+	n, err := flushCache(r.Context(), req.Cache)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"cache": req.Cache, "removed": n})
+}
+
+// handleFeatures serves GET /admin/features, and PUT with a map of
+// features to turn on or off everywhere.
+func handleFeatures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var changes map[string]bool
+		if err := decodeAdminRequest(w, r, &changes); err != nil {
+			return
+		}
+		if err := setFeatures(r.Context(), changes); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeError(w, r, proxyError{http.StatusMethodNotAllowed, "method_not_allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, featureStates())
+}
@@ -0,0 +1,4510 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/quic-go/quic-go/http3"
+
+	"colourlabs.net/cdn-proxy/internal/testharness"
+)
+
+func TestSongRangeRequest(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 not really an mp3"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "My Song.mp3")
+
+	resp, body := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3", "Range", "bytes=0-2")
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", resp.StatusCode)
+	}
+	if body != "ID3" {
+		t.Errorf("body = %q, want %q", body, "ID3")
+	}
+	if got, want := resp.Header.Get("Content-Range"), "bytes 0-2/21"; got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), `inline; filename="My Song.mp3"`; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+}
+
+func TestUnsatisfiableRange(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("short"), "audio/mpeg")
+
+	resp, body := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3", "Range", "bytes=100-")
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status = %d, want 416", resp.StatusCode)
+	}
+	if !strings.Contains(body, `"error"`) {
+		t.Errorf("body = %q, want a JSON error", body)
+	}
+}
+
+func TestMissingObjectNegativeCached(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("b")
+	path := "/songs/1/" + hash + ".mp3"
+
+	for range 2 {
+		resp, body := tp.get(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("status = %d, want 404", resp.StatusCode)
+		}
+		if want := `{"error":"not_found","request_id":"` + resp.Header.Get("X-Request-Id") + `"}`; body != want {
+			t.Errorf("body = %q, want %q", body, want)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		for name := range resp.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+				t.Errorf("upstream header %s leaked", name)
+			}
+		}
+	}
+
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+path); n != 1 {
+		t.Errorf("bucket asked %d times, want once", n)
+	}
+}
+
+func TestErrorPageNegotiated(t *testing.T) {
+	tp := newTestProxy(t)
+	path := "/songs/1/" + testHash("c") + ".mp3"
+
+	resp, body := tp.get(t, http.MethodGet, path, "Accept", "text/html,application/xhtml+xml,*/*;q=0.8", "X-Request-Id", "abc-123")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want an HTML page", ct)
+	}
+	if !strings.Contains(body, "not_found") || !strings.Contains(body, "abc-123") {
+		t.Errorf("body = %q, want the error code and request ID", body)
+	}
+	if got, want := strings.Join(resp.Header.Values("Vary"), ", "), "Accept, Sec-Fetch-Mode, X-Requested-With"; !strings.Contains(got, want) {
+		t.Errorf("Vary = %q, want it to include %q", got, want)
+	}
+
+	resp, body = tp.get(t, http.MethodGet, path, "Accept", "text/html", "Sec-Fetch-Mode", "cors")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("fetch: Content-Type = %q, want application/json", ct)
+	}
+	if !strings.Contains(body, `"request_id"`) {
+		t.Errorf("fetch: body = %q, want a request ID", body)
+	}
+	if got, want := strings.Join(resp.Header.Values("Vary"), ", "), "Accept, Sec-Fetch-Mode, X-Requested-With"; !strings.Contains(got, want) {
+		t.Errorf("fetch: Vary = %q, want it to include %q", got, want)
+	}
+}
+
+func TestInvalidRouteVarsRejected(t *testing.T) {
+	tp := newTestProxy(t)
+
+	for _, path := range []string{
+		"/songs/not-a-user/" + testHash("a") + ".mp3",
+		"/songs/1/short.mp3",
+		"/avatars/1/" + testHash("a") + "?format=exe",
+	} {
+		resp, _ := tp.get(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", path, resp.StatusCode)
+		}
+	}
+
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/songs/1/short.mp3"); n != 0 {
+		t.Errorf("bucket asked %d times for an invalid path", n)
+	}
+}
+
+func TestHeadAnsweredFromObjectMeta(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("c")
+	key := "songs/1/" + hash + ".ogg"
+	tp.s3.Put(testBucket, key, []byte("OggS"), "audio/ogg")
+
+	if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+".ogg"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d, want 200", resp.StatusCode)
+	}
+
+	resp, _ := tp.get(t, http.MethodHead, "/songs/1/"+hash+".ogg")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD status = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "audio/ogg" {
+		t.Errorf("Content-Type = %q, want audio/ogg", ct)
+	}
+	if n := tp.s3.Requests(http.MethodHead, "/"+testBucket+"/"+key); n != 0 {
+		t.Errorf("HEAD reached the bucket %d times", n)
+	}
+}
+
+func TestGenericSongTypeFromProfile(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("d")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".flac", []byte("not sniffable"), "application/octet-stream")
+	tp.addProfile(1, hash, "audio/flac", "")
+
+	resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+".flac")
+
+	if ct := resp.Header.Get("Content-Type"); ct != "audio/flac" {
+		t.Errorf("Content-Type = %q, want audio/flac", ct)
+	}
+}
+
+func TestAttachmentUploadAndServe(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+
+	content := "meeting notes"
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	resp, body := tp.do(t, http.MethodPut, "/upload/attachments/1?filename=notes.txt", strings.NewReader(content),
+		"Authorization", "Bearer "+testUploadToken, "Content-Type", "text/plain")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want 201: %s", resp.StatusCode, body)
+	}
+	if obj, ok := tp.s3.Object(testBucket, "attachments/1/"+hash+".txt"); !ok || string(obj.Body) != content {
+		t.Fatalf("stored object = %+v, want the upload", obj)
+	}
+	if n := tp.pg.Count("INSERT INTO attachments"); n != 1 {
+		t.Errorf("attachment rows inserted = %d, want 1", n)
+	}
+
+	tp.pg.AddRows("FROM attachments WHERE user_id = $1 AND hash = $2",
+		[]string{"filename", "mime_type", "size"}, []any{"notes.txt", "text/plain", len(content)})
+
+	resp, body = tp.get(t, http.MethodGet, "/attachments/1/"+hash+".txt")
+	if resp.StatusCode != http.StatusOK || body != content {
+		t.Fatalf("GET = %d %q, want 200 with the upload", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), `inline; filename="notes.txt"`; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+}
+
+func TestAttachmentTypeNotAllowed(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+
+	resp, _ := tp.do(t, http.MethodPut, "/upload/attachments/1?filename=x.html", strings.NewReader("<script>"),
+		"Authorization", "Bearer "+testUploadToken, "Content-Type", "text/html")
+
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("status = %d, want 415", resp.StatusCode)
+	}
+}
+
+func TestTombstonedUserGone(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &tombstones, true)
+	hash := testHash("d")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 still in the bucket"), "audio/mpeg")
+	tp.pg.AddRows("deleted_at IS NOT NULL", []string{"deleted", "moderation_state"}, []any{false, "banned"})
+
+	for range 2 {
+		resp, body := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3")
+		if resp.StatusCode != http.StatusGone {
+			t.Fatalf("status = %d, want 410", resp.StatusCode)
+		}
+		if !strings.Contains(body, `"gone"`) {
+			t.Errorf("body = %q, want the gone error", body)
+		}
+	}
+
+	resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+hash)
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("avatar: status = %d, want 410", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/webp" {
+		t.Errorf("avatar: Content-Type = %q, want a placeholder image", ct)
+	}
+
+	if n := tp.pg.Count("deleted_at IS NOT NULL"); n != 1 {
+		t.Errorf("Postgres asked %d times, want once", n)
+	}
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/songs/1/"+hash+".mp3"); n != 0 {
+		t.Errorf("bucket asked %d times, want never", n)
+	}
+}
+
+func TestOriginPaths(t *testing.T) {
+	newTestProxy(t)
+	proxy := newOriginProxy()
+	hash := testHash("e")
+
+	for _, tc := range []struct {
+		name, path, wantPath, wantQuery string
+	}{
+		{"avatar default format", "/avatars/1/" + hash, "/avatars/1/" + hash + ".webp", ""},
+		{"avatar format from query", "/avatars/1/" + hash + "?format=png", "/avatars/1/" + hash + ".png", ""},
+		{"other query kept", "/emojis/9/" + hash + "?size=64", "/emojis/9/" + hash + ".webp", "size=64"},
+		{"song file as is", "/songs/1/" + hash + ".mp3", "/songs/1/" + hash + ".mp3", ""},
+		{"banner video", "/banners/1/" + hash + ".mp4", "/banners/1/" + hash + ".mp4", ""},
+		{"no route", "/static/app.css", "/static/app.css", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			proxy.Director(req)
+
+			if want := "/" + testBucket + tc.wantPath; req.URL.Path != want {
+				t.Errorf("path = %q, want %q", req.URL.Path, want)
+			}
+			if req.URL.RawQuery != tc.wantQuery {
+				t.Errorf("query = %q, want %q", req.URL.RawQuery, tc.wantQuery)
+			}
+			if req.URL.Host != minioURL.Host {
+				t.Errorf("host = %q, want the bucket's %q", req.URL.Host, minioURL.Host)
+			}
+		})
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	hash := testHash("f")
+
+	for _, tc := range []struct {
+		name    string
+		setup   func(tp *testProxy)
+		path    string
+		headers []string
+
+		// an empty value means the header must be absent
+		want map[string]string
+
+		// freshRequestID means the X-Request-Id sent is rejected, and the
+		// response carries one generated in its place
+		freshRequestID bool
+	}{
+		{
+			name: "song",
+			setup: func(tp *testProxy) {
+				tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+				tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+			},
+			path: "/songs/1/" + hash + ".mp3",
+			want: map[string]string{
+				"Content-Type":        "audio/mpeg",
+				"Content-Disposition": `inline; filename="Tune.mp3"`,
+			},
+		},
+		{
+			name: "attachment",
+			setup: func(tp *testProxy) {
+				tp.s3.Put(testBucket, "attachments/1/"+hash+".bin", []byte("data"), "text/html")
+			},
+			path: "/attachments/1/" + hash + ".bin",
+			want: map[string]string{
+				"Content-Type":           "application/octet-stream",
+				"X-Content-Type-Options": "nosniff",
+			},
+		},
+		{
+			name: "upstream error",
+			path: "/songs/1/" + hash + ".mp3",
+			want: map[string]string{
+				"Content-Type":     "application/json",
+				"X-Amz-Request-Id": "",
+			},
+		},
+		{
+			name:    "request ID kept",
+			path:    "/songs/1/" + hash + ".mp3",
+			headers: []string{"X-Request-Id", "req-1"},
+			want:    map[string]string{"X-Request-Id": "req-1"},
+		},
+		{
+			name:           "request ID replaced",
+			path:           "/songs/1/" + hash + ".mp3",
+			headers:        []string{"X-Request-Id", "<script>"},
+			freshRequestID: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			if tc.setup != nil {
+				tc.setup(tp)
+			}
+
+			resp, _ := tp.get(t, http.MethodGet, tc.path, tc.headers...)
+
+			for name, want := range tc.want {
+				if got := resp.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tc.freshRequestID {
+				if got := resp.Header.Get("X-Request-Id"); got == "" || got == tc.headers[1] {
+					t.Errorf("X-Request-Id = %q, want a fresh ID", got)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileCacheDisabled(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &profileCacheTTL, 0)
+	hash := testHash("7")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	for range 2 {
+		if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+
+	if tp.redis.Exists(profileCacheKey("1")) {
+		t.Error("profile cached with PROFILE_CACHE_TTL=0")
+	}
+	if n := tp.pg.Count("FROM user_profiles WHERE id = $1"); n != 2 {
+		t.Errorf("profile queried %d times, want once per request", n)
+	}
+}
+
+func TestProfileLoadOutlivesCaller(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.addProfile(1, testHash("a"), "audio/mpeg", "Tune.mp3")
+
+	// the caller that starts a shared load has already gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	profile, err := fetchProfile(ctx, "1")
+	if err != nil {
+		t.Fatalf("fetchProfile: %v, want the profile", err)
+	}
+	if profile.ID != 1 {
+		t.Errorf("profile ID = %d, want 1", profile.ID)
+	}
+	if st := postgresBreaker.status(); st.Failures != 0 {
+		t.Errorf("breaker failures = %d, want 0", st.Failures)
+	}
+}
+
+func TestAttachmentLoadOutlivesCaller(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.pg.AddRows("FROM attachments WHERE user_id = $1 AND hash = $2",
+		[]string{"filename", "mime_type", "size"}, []any{"notes.txt", "text/plain", 5})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a, err := lookupAttachment(ctx, "1", hash)
+	if err != nil {
+		t.Fatalf("lookupAttachment: %v, want the row", err)
+	}
+	if a.Filename != "notes.txt" {
+		t.Errorf("filename = %q, want notes.txt", a.Filename)
+	}
+}
+
+func TestGrantStrippedOnPublicRoutes(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("c")
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", []byte("RIFF not really a webp"), "image/webp")
+
+	resp, _ := tp.get(t, http.MethodGet, "/emojis/9/"+hash+"?v=3&grant=not-for-minio")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	upstream := "/" + testBucket + "/emojis/9/" + hash + ".webp"
+	q := tp.s3.Query(http.MethodGet, upstream)
+	if q == nil {
+		t.Fatalf("no GET for %s", upstream)
+	}
+	if q.Has("grant") || q.Get("v") != "3" {
+		t.Errorf("upstream query = %v, want v=3 without the grant", q)
+	}
+	if !tp.redis.Exists(objectMetaKey(upstream, "v=3")) {
+		t.Error("object metadata isn't keyed without the grant")
+	}
+}
+
+func TestObjectCacheSizeLimit(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &objectCache.maxBytes, 64)
+
+	for _, tc := range []struct {
+		name, hash string
+		size       int
+		requests   int
+	}{
+		{"under the limit", testHash("1"), 64, 1},
+		{"over the limit", testHash("2"), 65, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/songs/1/" + tc.hash + ".mp3"
+			body := strings.Repeat("x", tc.size)
+			tp.s3.Put(testBucket, strings.TrimPrefix(path, "/"), []byte(body), "audio/mpeg")
+
+			for range 2 {
+				resp, got := tp.get(t, http.MethodGet, path)
+				if resp.StatusCode != http.StatusOK || got != body {
+					t.Fatalf("status = %d with %d bytes, want 200 with %d", resp.StatusCode, len(got), tc.size)
+				}
+			}
+
+			if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+path); n != tc.requests {
+				t.Errorf("upstream GETs = %d, want %d", n, tc.requests)
+			}
+		})
+	}
+}
+
+func TestObjectCacheAbortedDownload(t *testing.T) {
+	tp := newTestProxy(t)
+	path := "/songs/1/" + testHash("d") + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(path, "/"), bytes.Repeat([]byte("x"), 32<<20), "audio/mpeg")
+
+	resp, err := tp.Client().Get(tp.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	key := objectCachePrefix + "/" + testBucket + path + "?"
+	if _, filling := objectCache.filling.Load(key); !filling {
+		t.Fatal("the download isn't being written to the cache")
+	}
+
+	// hang up with the rest of the body unread
+	tp.Client().Transport.(*http.Transport).CloseIdleConnections()
+	resp.Body.Close()
+
+	waitFor(t, "the aborted download to stop being written", func() bool {
+		_, filling := objectCache.filling.Load(key)
+		return !filling
+	})
+
+	if f, _, ok := variantCache.get(key); ok {
+		f.Close()
+		t.Error("a partial download was committed to the cache")
+	}
+	filepath.WalkDir(variantCache.dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("left behind in the cache dir: %s", d.Name())
+		}
+		return err
+	})
+}
+
+func TestUpstreamLimitSheds(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &coalescer.next, http.RoundTripper(newLimitTransport(coalescer.next, 0, 1, 10*time.Millisecond)))
+	held, shed := "/songs/1/"+testHash("3")+".mp3", "/songs/1/"+testHash("4")+".mp3"
+	for _, path := range []string{held, shed} {
+		tp.s3.Put(testBucket, strings.TrimPrefix(path, "/"), []byte("ID3"), "audio/mpeg")
+	}
+
+	// the only song slot waits on a slow bucket
+	tp.s3.Stall(1, 500*time.Millisecond)
+	done := make(chan int)
+	go func() {
+		resp, err := tp.Client().Get(tp.URL + held)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	waitFor(t, "the held request to reach the bucket", func() bool {
+		return tp.s3.Requests(http.MethodGet, "/"+testBucket+held) > 0
+	})
+
+	resp, body := tp.get(t, http.MethodGet, shed)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if !strings.Contains(body, `"upstream_busy"`) {
+		t.Errorf("body = %q, want upstream_busy", body)
+	}
+
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("held request status = %d, want 200", status)
+	}
+	if resp, _ := tp.get(t, http.MethodGet, shed); resp.StatusCode != http.StatusOK {
+		t.Errorf("once the slot is free, status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &coalescer.next, http.RoundTripper(&timeoutTransport{next: coalescer.next}))
+	swap(t, &upstreamTimeout, 50*time.Millisecond)
+	hash := testHash("5")
+	path := "/emojis/9/" + hash
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", []byte("RIFF not really a webp"), "image/webp")
+
+	tp.s3.Stall(1, time.Second)
+	started := time.Now()
+	resp, body := tp.get(t, http.MethodGet, path)
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", resp.StatusCode)
+	}
+	if !strings.Contains(body, `"upstream_timeout"`) {
+		t.Errorf("body = %q, want upstream_timeout", body)
+	}
+	if elapsed := time.Since(started); elapsed >= time.Second {
+		t.Errorf("answered after %v, want it cut off at the timeout", elapsed)
+	}
+
+	if resp, _ := tp.get(t, http.MethodGet, path); resp.StatusCode != http.StatusOK {
+		t.Errorf("with the bucket back to speed, status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestBannerVideoRange(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("6")
+	video := make([]byte, 1000)
+	for i := range video {
+		video[i] = byte(i)
+	}
+	tp.s3.Put(testBucket, "banners/1/"+hash+".mp4", video, "application/octet-stream")
+
+	for _, tc := range []struct {
+		rng, contentRange string
+		from, to          int
+	}{
+		{"bytes=100-199", "bytes 100-199/1000", 100, 200},
+		{"bytes=990-", "bytes 990-999/1000", 990, 1000},
+		{"bytes=-10", "bytes 990-999/1000", 990, 1000},
+	} {
+		t.Run(tc.rng, func(t *testing.T) {
+			resp, body := tp.get(t, http.MethodGet, "/banners/1/"+hash+".mp4", "Range", tc.rng)
+
+			if resp.StatusCode != http.StatusPartialContent {
+				t.Fatalf("status = %d, want 206", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tc.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tc.contentRange)
+			}
+			if body != string(video[tc.from:tc.to]) {
+				t.Errorf("body is %d bytes, not bytes %d-%d of the video", len(body), tc.from, tc.to-1)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "video/mp4" {
+				t.Errorf("Content-Type = %q, want video/mp4", got)
+			}
+		})
+	}
+}
+
+func TestBannerPoster(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("8")
+	video := []byte("not really a webm")
+	tp.s3.Put(testBucket, "banners/1/"+hash+".webm", video, "video/webm")
+
+	// ffmpeg stands in as a script that keeps what it was fed and answers
+	// with a fixed frame
+	dir := t.TempDir()
+	var frame bytes.Buffer
+	if err := jpeg.Encode(&frame, image.NewGray(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "frame.jpg"), frame.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\ncat > " + dir + "/input\necho run >> " + dir + "/runs\ncat " + dir + "/frame.jpg\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &ffmpegPath, filepath.Join(dir, "ffmpeg"))
+
+	for range 2 {
+		resp, body := tp.get(t, http.MethodGet, "/banners/1/"+hash+"/poster")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		if body != frame.String() {
+			t.Errorf("body is %d bytes, want the %d byte frame", len(body), frame.Len())
+		}
+		if got := resp.Header.Get("Content-Type"); got != "image/jpeg" {
+			t.Errorf("Content-Type = %q, want image/jpeg", got)
+		}
+	}
+
+	if input, _ := os.ReadFile(filepath.Join(dir, "input")); !bytes.Equal(input, video) {
+		t.Errorf("ffmpeg was fed %q, want the webm", input)
+	}
+	if runs, _ := os.ReadFile(filepath.Join(dir, "runs")); strings.Count(string(runs), "run") != 1 {
+		t.Errorf("ffmpeg ran %d times, want once with the poster cached", strings.Count(string(runs), "run"))
+	}
+
+	if resp, _ := tp.get(t, http.MethodGet, "/banners/1/"+testHash("9")+"/poster"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poster of a missing video: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestLargeSongsSentToRegion(t *testing.T) {
+	tp := newTestProxy(t)
+	db, err := maxminddb.OpenBytes(testharness.GeoIP("DE", "EU"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := geoDatabase.Swap(db)
+	t.Cleanup(func() { geoDatabase.Store(old) })
+	swap(t, &localRegion, "us")
+	swap(t, &geoRedirectMinBytes, 100)
+	swap(t, &coalescer.next, http.RoundTripper(&regionTransport{next: coalescer.next}))
+	// a song on this proxy's disk is served from there, wherever the client is
+	swap(t, &objectCache.maxBytes, 0)
+
+	replica := testharness.NewS3(t, testBucket)
+	large, small := "/songs/1/"+testHash("a")+".mp3", "/songs/1/"+testHash("b")+".mp3"
+	for _, s3 := range []*testharness.S3{tp.s3, replica} {
+		s3.Put(testBucket, strings.TrimPrefix(large, "/"), bytes.Repeat([]byte("x"), 100), "audio/mpeg")
+		s3.Put(testBucket, strings.TrimPrefix(small, "/"), bytes.Repeat([]byte("x"), 99), "audio/mpeg")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		region geoRegion
+	}{
+		{"redirect", geoRegion{Continents: []string{"EU"}, Redirect: "https://eu.cdn.example"}},
+		{"endpoint", geoRegion{Countries: []string{"DE"}, Endpoint: replica.URL}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			regions, err := checkGeoRegions(map[string]*geoRegion{"eu": &tc.region})
+			if err != nil {
+				t.Fatal(err)
+			}
+			swap(t, &geoRegions, regions)
+			tp.redis.FlushAll()
+			replica.ResetRequests()
+
+			for _, path := range []string{large, small} {
+				// the first download is served here, and tells the proxy its size
+				if resp, _ := tp.get(t, http.MethodGet, path); resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: first status = %d, want 200", path, resp.StatusCode)
+				}
+			}
+
+			resp, _ := tp.get(t, http.MethodGet, large)
+			switch tc.name {
+			case "redirect":
+				if resp.StatusCode != http.StatusFound {
+					t.Fatalf("large song: status = %d, want 302", resp.StatusCode)
+				}
+				if got, want := resp.Header.Get("Location"), "https://eu.cdn.example"+large; got != want {
+					t.Errorf("Location = %q, want %q", got, want)
+				}
+			case "endpoint":
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("large song: status = %d, want 200", resp.StatusCode)
+				}
+				if n := replica.Requests(http.MethodGet, "/"+testBucket+large); n != 1 {
+					t.Errorf("replica GETs for the large song = %d, want 1", n)
+				}
+			}
+
+			if resp, _ := tp.get(t, http.MethodGet, small); resp.StatusCode != http.StatusOK {
+				t.Errorf("small song: status = %d, want 200 from here", resp.StatusCode)
+			}
+			if n := replica.Requests(http.MethodGet, "/"+testBucket+small); n != 0 {
+				t.Errorf("replica GETs for the small song = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestShadowDiffsRecorded(t *testing.T) {
+	tp := newTestProxy(t)
+	shadow := testharness.NewS3(t, "next")
+	endpoint, err := url.Parse(shadow.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &coalescer.next, http.RoundTripper(newShadowTransport(coalescer.next, endpoint, "next", 100)))
+
+	same, longer, missing := "songs/1/"+testHash("1")+".mp3", "songs/1/"+testHash("2")+".mp3", "songs/1/"+testHash("3")+".mp3"
+	for _, key := range []string{same, longer, missing} {
+		tp.s3.Put(testBucket, key, []byte("ID3"), "audio/mpeg")
+	}
+	shadow.Put("next", same, []byte("ID3"), "audio/mpeg")
+	shadow.Put("next", longer, []byte("ID3 and more"), "audio/mpeg")
+
+	shadowDiffs.Lock()
+	before := shadowDiffs.total
+	shadowDiffs.Unlock()
+
+	for _, key := range []string{same, longer, missing} {
+		// clients only ever see the primary
+		if resp, body := tp.get(t, http.MethodGet, "/"+key); resp.StatusCode != http.StatusOK || body != "ID3" {
+			t.Fatalf("/%s: status = %d, body = %q, want the primary's 200", key, resp.StatusCode, body)
+		}
+	}
+
+	// a mirrored request is compared after the client has been answered
+	waitFor(t, "the mirrored requests", func() bool {
+		shadowDiffs.Lock()
+		defer shadowDiffs.Unlock()
+		return shadowDiffs.total-before >= 2
+	})
+	for _, key := range []string{same, longer, missing} {
+		waitFor(t, "a mirrored GET of "+key, func() bool { return shadow.Requests(http.MethodGet, "/next/"+key) == 1 })
+	}
+
+	shadowDiffs.Lock()
+	defer shadowDiffs.Unlock()
+	if n := shadowDiffs.total - before; n != 2 {
+		t.Fatalf("diffs recorded = %d, want 2", n)
+	}
+	results := map[string]string{}
+	for i := 1; i <= 2; i++ {
+		d := shadowDiffs.ring[(shadowDiffs.next-i+maxShadowDiffs)%maxShadowDiffs]
+		results[d.Path] = d.Result
+	}
+	for path, want := range map[string]string{"/next/" + longer: "length_mismatch", "/next/" + missing: "status_mismatch"} {
+		if results[path] != want {
+			t.Errorf("diff for %s = %q, want %q", path, results[path], want)
+		}
+	}
+}
+
+func TestLegacyRedirect(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.pg.AddRows("FROM legacy_urls WHERE old_path = $1", []string{"new_path"}, []any{"/avatars/1/" + testHash("a")})
+
+	for range 2 {
+		resp, _ := tp.get(t, http.MethodGet, "/uploads/me.png?v=2")
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("status = %d, want 301", resp.StatusCode)
+		}
+		if got, want := resp.Header.Get("Location"), "/avatars/1/"+testHash("a")+"?v=2"; got != want {
+			t.Errorf("Location = %q, want %q", got, want)
+		}
+	}
+
+	if n := tp.pg.Count("FROM legacy_urls"); n != 1 {
+		t.Errorf("legacy_urls queried %d times, want once with the mapping cached", n)
+	}
+}
+
+func TestLegacyRedirectMiss(t *testing.T) {
+	tp := newTestProxy(t)
+
+	for range 2 {
+		if resp, _ := tp.get(t, http.MethodGet, "/uploads/nobody.png"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("status = %d, want 404", resp.StatusCode)
+		}
+	}
+	if n := tp.pg.Count("FROM legacy_urls"); n != 1 {
+		t.Errorf("legacy_urls queried %d times, want once with the miss remembered", n)
+	}
+	if keys := tp.redis.Keys(); slices.ContainsFunc(keys, func(k string) bool { return strings.HasPrefix(k, "legacy:url:") }) {
+		t.Errorf("misses written to Valkey: %v", keys)
+	}
+
+	// paths that don't look like old assets aren't looked up at all
+	for _, path := range []string{"/wp-login.php", "/uploads/../etc/passwd.png", "/" + strings.Repeat("a", 300) + ".png"} {
+		tp.get(t, http.MethodGet, path)
+	}
+	if n := tp.pg.Count("FROM legacy_urls"); n != 1 {
+		t.Errorf("legacy_urls queried %d times, want only for the asset path", n)
+	}
+}
+
+func TestLegacyRedirectPostgresDown(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.pg.Fail(errors.New("connection refused"))
+
+	for i := range defaultBreakerThreshold + 2 {
+		if resp, _ := tp.get(t, http.MethodGet, "/uploads/"+strconv.Itoa(i)+".png"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("status = %d, want the request to carry on to a 404", resp.StatusCode)
+		}
+	}
+
+	if n := tp.pg.Count("FROM legacy_urls"); n != defaultBreakerThreshold {
+		t.Errorf("legacy_urls queried %d times, want %d before the breaker opened", n, defaultBreakerThreshold)
+	}
+}
+
+func TestConcurrentGetsCoalesced(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+	}{
+		{"buffered", 1 << 10},
+		{"streamed", 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			swap(t, &coalescer.maxBytes, 64<<10)
+			path := "/songs/1/" + testHash("c") + ".mp3"
+			body := bytes.Repeat([]byte("x"), tc.size)
+			tp.s3.Put(testBucket, strings.TrimPrefix(path, "/"), body, "audio/mpeg")
+
+			// the first fetch waits on the bucket while the rest pile up
+			tp.s3.Stall(1, 300*time.Millisecond)
+			const clients = 8
+			errs := make(chan error, clients)
+			for range clients {
+				go func() {
+					resp, err := tp.Client().Get(tp.URL + path)
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer resp.Body.Close()
+					got, err := io.ReadAll(resp.Body)
+					if err == nil && !bytes.Equal(got, body) {
+						err = fmt.Errorf("status %d with %d bytes, want the %d byte song", resp.StatusCode, len(got), len(body))
+					}
+					errs <- err
+				}()
+			}
+			for range clients {
+				if err := <-errs; err != nil {
+					t.Error(err)
+				}
+			}
+
+			if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+path); n != 1 {
+				t.Errorf("upstream GETs = %d, want 1", n)
+			}
+			waitFor(t, "the spool file to be removed", func() bool {
+				spools, _ := filepath.Glob(filepath.Join(variantCache.dir, ".tmp-*"))
+				return len(spools) == 0
+			})
+		})
+	}
+}
+
+func TestAudioFilenameLookupOutlivesCaller(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	name, err := lookupAudioFilename(ctx, "1", hash)
+	if err != nil || name != "Tune.mp3" {
+		t.Errorf("lookupAudioFilename = %q, %v, want Tune.mp3", name, err)
+	}
+	if st := redisBreaker.status(); st.Failures != 0 {
+		t.Errorf("valkey breaker failures = %d, want 0", st.Failures)
+	}
+}
+
+func TestCacheStatusOneOutcomePerCache(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("e")
+	path := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	// with sessions enforced, the privacy check and the filename lookup
+	// both consult the profile cache
+	swap(t, &sessions, sessionValidator(&jwtValidator{
+		secret: func() string { return "secret" },
+		keys:   func() string { return "" },
+	}))
+
+	for _, want := range []string{
+		"cdn-proxy-profile; fwd=uri-miss; stored, cdn-proxy; fwd=bypass; fwd-status=200",
+		"cdn-proxy-profile; hit, cdn-proxy; hit; detail=disk",
+	} {
+		resp, _ := tp.get(t, http.MethodGet, path)
+		if got := resp.Header.Get("Cache-Status"); got != want {
+			t.Errorf("Cache-Status = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestStagedUploadNotServed(t *testing.T) {
+	tp := newTestProxy(t)
+	staged := uploadStagingPrefix + strings.Repeat("0", 32)
+	tp.s3.Put(testBucket, staged, []byte("ID3"), "audio/mpeg")
+
+	for _, path := range []string{"/" + staged, "/" + testBucket + "/" + staged} {
+		if resp, _ := tp.get(t, http.MethodGet, path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s status = %d, want 404", path, resp.StatusCode)
+		}
+	}
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/"+staged); n != 0 {
+		t.Errorf("bucket asked %d times for a staged upload", n)
+	}
+}
+
+func TestGIFOriginRendersAnimation(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "avatars/1/"+hash+".gif", testGIF(t, 3), "image/gif")
+	tp.pg.AddRows("FROM original_uploads", []string{"ext"}, []any{"gif"})
+
+	for _, tc := range []struct {
+		query  string
+		frames int
+	}{
+		{"", 3},
+		{"?animated=false", 1},
+	} {
+		resp, body := tp.get(t, http.MethodGet, "/avatars/1/"+hash+tc.query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET%s status = %d, want 200: %s", tc.query, resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "image/webp" {
+			t.Errorf("GET%s Content-Type = %q, want image/webp", tc.query, ct)
+		}
+		frames, _, _, err := scanAnimation(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("GET%s: %v", tc.query, err)
+		}
+		// a still webp has no animation frames to count
+		if frames = max(frames, 1); frames != tc.frames {
+			t.Errorf("GET%s frames = %d, want %d", tc.query, frames, tc.frames)
+		}
+	}
+}
+
+func TestOriginalLookupPostgresDown(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("b")
+	still, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 8, 8)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/1/"+hash+".webp", still, "image/webp")
+	tp.pg.Fail(errors.New("connection refused"))
+
+	for range defaultBreakerThreshold + 3 {
+		// the stored webp is served as it is
+		if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+hash); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	if n := tp.pg.Count("FROM original_uploads"); n != defaultBreakerThreshold {
+		t.Errorf("original_uploads queried %d times, want %d before the breaker opened", n, defaultBreakerThreshold)
+	}
+}
+
+// testGIF is an 8x8 GIF of alternating black and white frames.
+func testGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+
+	anim := &gif.GIF{}
+	for i := range frames {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White})
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % 2)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCompressedResponses(t *testing.T) {
+	hash := testHash("c")
+	path := "/songs/1/" + hash + "/waveform.json"
+	waveform := []byte(`{"peaks":[` + strings.Repeat("0.5,", 400) + `0.5]}`)
+	etag := generatedETag("waveform", "1", hash, strconv.Itoa(waveformPeaks))
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		headers  []string
+		status   int
+		encoding string
+		body     []byte
+	}{
+		{"zstd", http.MethodGet, path, []string{"Accept-Encoding", "gzip, zstd"}, http.StatusOK, "zstd", waveform},
+		{"gzip", http.MethodGet, path, []string{"Accept-Encoding", "gzip"}, http.StatusOK, "gzip", waveform},
+		{"under 512 bytes", http.MethodGet, "/profiles/1/manifest.json", []string{"Accept-Encoding", "gzip"}, http.StatusOK, "", nil},
+		{"range", http.MethodGet, path, []string{"Accept-Encoding", "gzip", "Range", "bytes=0-9"}, http.StatusPartialContent, "", waveform[:10]},
+		{"head", http.MethodHead, path, []string{"Accept-Encoding", "gzip"}, http.StatusOK, "", nil},
+		{"not modified", http.MethodGet, path, []string{"Accept-Encoding", "gzip", "If-None-Match", etag}, http.StatusNotModified, "", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			tp.addProfile(1, hash, "audio/mpeg", "")
+			swap(t, &ffmpegPath, "ffmpeg")
+			tp.redis.Set(waveformKey("1", hash, waveformPeaks), string(waveform))
+
+			resp, body := tp.get(t, tc.method, tc.path, tc.headers...)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tc.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tc.encoding)
+			}
+			if tc.method == http.MethodGet && tc.status == http.StatusOK && !slices.Contains(resp.Header.Values("Vary"), "Accept-Encoding") {
+				t.Errorf("Vary = %q, want Accept-Encoding", resp.Header.Values("Vary"))
+			}
+			if tc.body == nil {
+				return
+			}
+
+			var decoded []byte
+			var err error
+			switch tc.encoding {
+			case "zstd":
+				var zr *zstd.Decoder
+				if zr, err = zstd.NewReader(strings.NewReader(body)); err == nil {
+					decoded, err = io.ReadAll(zr)
+					zr.Close()
+				}
+			case "gzip":
+				var zr *gzip.Reader
+				if zr, err = gzip.NewReader(strings.NewReader(body)); err == nil {
+					decoded, err = io.ReadAll(zr)
+				}
+			default:
+				decoded = []byte(body)
+			}
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !bytes.Equal(decoded, tc.body) {
+				t.Errorf("body = %q, want %q", decoded, tc.body)
+			}
+		})
+	}
+}
+
+func TestEncodedResponseCached(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("d")
+	path := "/songs/1/" + hash + "/waveform.json"
+	key := waveformKey("1", hash, waveformPeaks)
+	swap(t, &ffmpegPath, "ffmpeg")
+
+	first := `{"peaks":[` + strings.Repeat("0.1,", 400) + `0.1]}`
+	second := strings.ReplaceAll(first, "0.1", "0.9")
+
+	get := func(query string) string {
+		t.Helper()
+
+		resp, body := tp.get(t, http.MethodGet, path+query, "Accept-Encoding", "gzip")
+		if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf("GET%s Content-Encoding = %q, want gzip", query, ce)
+		}
+		zr, err := gzip.NewReader(strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(decoded)
+	}
+
+	tp.redis.Set(key, first)
+	if got := get("?v=1"); got != first {
+		t.Fatalf("first GET = %q, want the stored waveform", got)
+	}
+
+	// the ETag is unchanged, so the encoded body kept from the first
+	// request is what the same URL gets, while another query renders anew
+	tp.redis.Set(key, second)
+	if got := get("?v=1"); got != first {
+		t.Errorf("repeat GET = %q, want the cached body", got)
+	}
+	if got := get("?v=2"); got != second {
+		t.Errorf("GET with another query = %q, want the current waveform", got)
+	}
+}
+
+func TestPrivateProfileAccess(t *testing.T) {
+	const secret = "session-secret"
+	hash := testHash("a")
+	path := "/songs/1/" + hash + ".mp3"
+	valid := testJWT(secret, "", "2", time.Now().Add(time.Hour))
+
+	for _, tc := range []struct {
+		name    string
+		private bool
+		down    bool
+		headers []string
+		status  int
+	}{
+		{"public profile", false, false, nil, http.StatusOK},
+		{"no session", true, false, nil, http.StatusForbidden},
+		{"bearer token", true, false, []string{"Authorization", "Bearer " + valid}, http.StatusOK},
+		{"session cookie", true, false, []string{"Cookie", "session=" + valid}, http.StatusOK},
+		{"expired token", true, false, []string{"Authorization", "Bearer " + testJWT(secret, "", "2", time.Now().Add(-time.Minute))}, http.StatusForbidden},
+		{"wrong secret", true, false, []string{"Authorization", "Bearer " + testJWT("other", "", "2", time.Now().Add(time.Hour))}, http.StatusForbidden},
+		{"privacy unknown", true, true, []string{"Authorization", "Bearer " + valid}, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+			if tc.private {
+				tp.addPrivateProfile(1)
+			} else {
+				tp.addProfile(1, hash, "audio/mpeg", "")
+			}
+			if tc.down {
+				tp.pg.Fail(errors.New("connection refused"))
+			}
+
+			setSecrets(t, "SESSION_JWT_SECRET", secret)
+			validator, err := newSessionValidator(setting)
+			if err != nil {
+				t.Fatal(err)
+			}
+			swap(t, &sessions, validator)
+
+			resp, _ := tp.get(t, http.MethodGet, path, tc.headers...)
+			if resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if tc.private && resp.StatusCode == http.StatusOK && !strings.Contains(resp.Header.Get("Cache-Control"), "private") {
+				t.Errorf("Cache-Control = %q, want private", resp.Header.Get("Cache-Control"))
+			}
+			if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+path); tc.status != http.StatusOK && n != 0 {
+				t.Errorf("bucket asked %d times for a refused request", n)
+			}
+		})
+	}
+}
+
+func TestSessionKeySelectedByKid(t *testing.T) {
+	hash := testHash("b")
+	path := "/songs/1/" + hash + ".mp3"
+	expires := time.Now().Add(time.Hour)
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"current key", testJWT("key-2", "k2", "2", expires), http.StatusOK},
+		{"previous key", testJWT("key-1", "k1", "2", expires), http.StatusOK},
+		{"no kid uses the secret", testJWT("shared", "", "2", expires), http.StatusOK},
+		{"kid with another key", testJWT("key-2", "k1", "2", expires), http.StatusForbidden},
+		{"kid with the secret", testJWT("shared", "k1", "2", expires), http.StatusForbidden},
+		{"unknown kid", testJWT("key-3", "k3", "2", expires), http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+			tp.addPrivateProfile(1)
+
+			setSecrets(t, "SESSION_JWT_SECRET", "shared", "SESSION_JWT_KEYS", "k2:key-2, k1:key-1")
+			validator, err := newSessionValidator(setting)
+			if err != nil {
+				t.Fatal(err)
+			}
+			swap(t, &sessions, validator)
+
+			if resp, _ := tp.get(t, http.MethodGet, path, "Authorization", "Bearer "+tc.token); resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
+
+func TestSessionKeysRotateWithoutRestart(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("b")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+	tp.addPrivateProfile(1)
+
+	setSecrets(t, "SESSION_JWT_KEYS", "k1:key-1")
+	validator, err := newSessionValidator(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &sessions, validator)
+
+	token := testJWT("key-2", "k2", "2", time.Now().Add(time.Hour))
+	for _, tc := range []struct {
+		keys   string
+		status int
+	}{
+		{"k1:key-1", http.StatusForbidden},
+		{"k2:key-2, k1:key-1", http.StatusOK},
+	} {
+		setSecrets(t, "SESSION_JWT_KEYS", tc.keys)
+		if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3", "Authorization", "Bearer "+token); resp.StatusCode != tc.status {
+			t.Errorf("with keys %q status = %d, want %d", tc.keys, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestPrivateGrants(t *testing.T) {
+	hash := testHash("c")
+	path := "/songs/1/" + hash + ".mp3"
+	current := "k2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	previous := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	retired := "k0:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	hour := time.Now().Add(time.Hour)
+
+	for _, tc := range []struct {
+		name    string
+		mintKey string
+		scope   string
+		expires time.Time
+		tamper  bool
+		status  int
+	}{
+		{"prefix scope", current, "/songs/1/", hour, false, http.StatusOK},
+		{"exact scope", current, path, hour, false, http.StatusOK},
+		{"another path", current, "/songs/1/" + testHash("d") + ".mp3", hour, false, http.StatusForbidden},
+		{"another user", current, "/songs/2/", hour, false, http.StatusForbidden},
+		{"expired", current, "/songs/1/", time.Now().Add(-time.Minute), false, http.StatusForbidden},
+		{"previous key", previous, "/songs/1/", hour, false, http.StatusOK},
+		{"retired key", retired, "/songs/1/", hour, false, http.StatusForbidden},
+		{"tampered", current, "/songs/1/", hour, true, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := newTestProxy(t)
+			tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+			tp.addPrivateProfile(1)
+
+			setSecrets(t, "GRANT_KEYS", tc.mintKey)
+			grant, err := mintGrant("2", tc.scope, tc.expires)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.tamper {
+				// the last character may only carry padding bits, so change
+				// one in the middle
+				i := len(grant) / 2
+				flipped := "A"
+				if grant[i:i+1] == flipped {
+					flipped = "B"
+				}
+				grant = grant[:i] + flipped + grant[i+1:]
+			}
+			setSecrets(t, "GRANT_KEYS", current+","+previous)
+
+			if resp, _ := tp.get(t, http.MethodGet, path+"?grant="+url.QueryEscape(grant)); resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	swap(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+
+	for _, tc := range []struct {
+		name   string
+		peer   string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"untrusted peer", "198.51.100.9:1234", "198.51.100.1", "", "198.51.100.9"},
+		{"trusted peer", "10.0.0.9:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"trusted chain", "10.0.0.9:1234", "198.51.100.1, 10.0.0.5", "", "198.51.100.1"},
+		{"spoofed leftmost hop", "10.0.0.9:1234", "203.0.113.66, 198.51.100.1, 10.0.0.5", "", "198.51.100.1"},
+		{"only trusted hops", "10.0.0.9:1234", "10.0.0.5", "", "10.0.0.5"},
+		{"unparsable hop", "10.0.0.9:1234", "198.51.100.1, junk", "", "10.0.0.9"},
+		{"real IP without XFF", "10.0.0.9:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"real IP with XFF", "10.0.0.9:1234", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"real IP from untrusted peer", "198.51.100.9:1234", "", "198.51.100.2", "198.51.100.9"},
+		{"mapped peer", "[::ffff:198.51.100.9]:1234", "", "", "198.51.100.9"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.peer
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			if got := clientIP(r); got != netip.MustParseAddr(tc.want) {
+				t.Errorf("clientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("e")
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", []byte("RIFF"), "image/webp")
+
+	// the test client connects from loopback, standing in for the load
+	// balancer
+	swap(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")})
+	swap(t, &blocklistKey, "ip:blocklist")
+	old := blocklist.Load()
+	t.Cleanup(func() { blocklist.Store(old) })
+
+	now := time.Now()
+	tp.redis.ZAdd(blocklistKey, 0, "198.51.100.1")
+	tp.redis.ZAdd(blocklistKey, float64(now.Add(-time.Minute).Unix()), "198.51.100.2")
+	tp.redis.ZAdd(blocklistKey, float64(now.Add(time.Hour).Unix()), "198.51.100.3")
+	tp.redis.ZAdd(blocklistKey, 0, "192.0.2.0/24")
+	tp.redis.ZAdd(blocklistKey, 0, "not an address")
+	if err := loadBlocklist(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		client string
+		status int
+	}{
+		{"198.51.100.1", http.StatusForbidden},
+		{"198.51.100.2", http.StatusOK},
+		{"198.51.100.3", http.StatusForbidden},
+		{"192.0.2.77", http.StatusForbidden},
+		{"198.51.100.4", http.StatusOK},
+	} {
+		resp, _ := tp.get(t, http.MethodGet, "/emojis/9/"+hash, "X-Forwarded-For", tc.client)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s status = %d, want %d", tc.client, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestBandwidthQuota(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &bandwidthAccounting, true)
+	swap(t, &bandwidthQuota, 100)
+	swap(t, &publicHandler, tp.Config.Handler)
+	resetBandwidth := func() {
+		bandwidth.Lock()
+		bandwidth.month, bandwidth.pending, bandwidth.used, bandwidth.exceeded = "", map[string]int64{}, map[string]int64{}, map[string]bool{}
+		bandwidth.Unlock()
+	}
+	resetBandwidth()
+	t.Cleanup(resetBandwidth)
+
+	hash := testHash("f")
+	song := bytes.Repeat([]byte("a"), 60)
+	for _, owner := range []string{"1", "2"} {
+		tp.s3.Put(testBucket, "songs/"+owner+"/"+hash+".mp3", song, "audio/mpeg")
+	}
+	pending := func(owner string) int64 {
+		bandwidth.Lock()
+		defer bandwidth.Unlock()
+		return bandwidth.pending[owner]
+	}
+
+	// owner 1 used their quota on other replicas
+	tp.redis.HSet(bandwidthKey(bandwidthMonth(time.Now())), "1", "100")
+	resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over quota status = %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("no Retry-After until the month turns over")
+	}
+
+	// a prefetch warms the cache without counting against owner 2
+	path := "/songs/2/" + hash + ".mp3"
+	err := prefetch(context.Background(), []string{path}, func(res prefetchResult) {
+		if res.Status != http.StatusOK {
+			t.Errorf("prefetch status = %d, want 200", res.Status)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pending("2"); n != 0 {
+		t.Errorf("prefetch counted %d bytes", n)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if resp, _ := tp.get(t, http.MethodGet, path); resp.StatusCode != want {
+			t.Errorf("GET %d status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	if n := pending("2"); n != 2*int64(len(song)) {
+		t.Errorf("counted %d bytes, want %d", n, 2*len(song))
+	}
+}
+
+func TestCustomRoutes(t *testing.T) {
+	tp := newTestProxy(t)
+	custom, err := parseRoutes([]route{
+		{Name: "static", Pattern: "/static/**", Origin: "/site/static/{path=index.html}"},
+		{Name: "legacy-avatars", Pattern: `~^/u/(?P<userID>\d+)\.png$`, Origin: "/avatars/{userID}/current.{format=png}"},
+		{Name: "docs", Pattern: "/docs/*/{page...}", Origin: "/site/docs/{page}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &routes, custom)
+
+	tp.s3.Put(testBucket, "site/static/app.css", []byte("body{}"), "text/css")
+	tp.s3.Put(testBucket, "site/static/index.html", []byte("<!doctype html>"), "text/html")
+	tp.s3.Put(testBucket, "avatars/7/current.jpg", []byte("\xff\xd8\xff"), "image/jpeg")
+	tp.s3.Put(testBucket, "site/docs/guide/intro.md", []byte("# intro"), "text/markdown")
+
+	for _, tc := range []struct {
+		path, upstream string
+	}{
+		{"/static/whatever?path=app.css", "/site/static/app.css"},
+		{"/static/whatever", "/site/static/index.html"},
+		{"/u/7.png?format=jpg", "/avatars/7/current.jpg"},
+		{"/docs/v2/guide/intro.md", "/site/docs/guide/intro.md"},
+	} {
+		resp, body := tp.get(t, http.MethodGet, tc.path)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s status = %d, want 200: %s", tc.path, resp.StatusCode, body)
+			continue
+		}
+		if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+tc.upstream); n == 0 {
+			t.Errorf("GET %s didn't fetch %s", tc.path, tc.upstream)
+		}
+	}
+
+	// a pattern must match the whole path
+	if resp, _ := tp.get(t, http.MethodGet, "/u/7.png/extra"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("partial regex match status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestCachePolicyExperiment(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", []byte("RIFF"), "image/webp")
+	tp.s3.Put(testBucket, "avatars/1/"+hash+".webp", []byte("RIFF"), "image/webp")
+
+	policies, err := mergeCachePolicies(map[string]routePolicy{
+		"emojis": {
+			Cache:       &cachePolicy{MaxAge: 3600},
+			Experiments: []cacheExperiment{{Name: "swr", Percent: 100, Cache: cachePolicy{MaxAge: 60, StaleWhileRevalidate: 600}}},
+		},
+		"avatars": {Cache: &cachePolicy{MaxAge: 300, SMaxAge: 3600}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &cachePolicies, policies)
+
+	for _, tc := range []struct {
+		route, path, arm, cacheControl string
+	}{
+		{"emojis", "/emojis/9/" + hash, "swr", "public, max-age=60, stale-while-revalidate=600"},
+		{"avatars", "/avatars/1/" + hash, controlArm, "public, max-age=300, s-maxage=3600"},
+	} {
+		before := metricValue(t, "cdn_proxy_requests_total", "route", tc.route, "arm", tc.arm, "code", "200")
+
+		resp, _ := tp.get(t, http.MethodGet, tc.path)
+		if got := resp.Header.Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s Cache-Control = %q, want %q", tc.route, got, tc.cacheControl)
+		}
+		wantArm := tc.arm
+		if wantArm == controlArm {
+			wantArm = ""
+		}
+		if got := resp.Header.Get("X-Cache-Policy"); got != wantArm {
+			t.Errorf("%s X-Cache-Policy = %q, want %q", tc.route, got, wantArm)
+		}
+		if after := metricValue(t, "cdn_proxy_requests_total", "route", tc.route, "arm", tc.arm, "code", "200"); after != before+1 {
+			t.Errorf("%s requests in arm %s went from %v to %v, want one more", tc.route, tc.arm, before, after)
+		}
+	}
+}
+
+func TestBytesCountedPerRoute(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("b")
+	path := "/songs/1/" + hash + ".mp3"
+	song := bytes.Repeat([]byte("a"), 1000)
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", song, "audio/mpeg")
+
+	served := func() float64 {
+		return metricValue(t, "cdn_proxy_response_bytes_total", "route", "songs", "code", "200")
+	}
+	fetched := func() float64 {
+		return metricValue(t, "cdn_proxy_upstream_bytes_total", "route", "songs")
+	}
+
+	for i, fromUpstream := range []bool{true, false} {
+		servedBefore, fetchedBefore := served(), fetched()
+		if resp, _ := tp.get(t, http.MethodGet, path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %d status = %d, want 200", i+1, resp.StatusCode)
+		}
+
+		if got := served() - servedBefore; got != float64(len(song)) {
+			t.Errorf("GET %d served %v bytes, want %d", i+1, got, len(song))
+		}
+		want := 0.0
+		if fromUpstream {
+			want = float64(len(song))
+		}
+		if got := fetched() - fetchedBefore; got != want {
+			t.Errorf("GET %d read %v bytes upstream, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestAbortedTransferCounted(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("c")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", bytes.Repeat([]byte("a"), 8<<20), "audio/mpeg")
+	before := metricValue(t, "cdn_proxy_aborted_transfers_total", "route", "songs")
+
+	// a small receive window keeps the body from fitting in socket buffers,
+	// so the proxy is still writing when the client hangs up
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				err = conn.(*net.TCPConn).SetReadBuffer(16 << 10)
+			}
+			return conn, err
+		},
+	}}
+	resp, err := client.Get(tp.URL + "/songs/1/" + hash + ".mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	waitFor(t, "the abort to be counted", func() bool {
+		return metricValue(t, "cdn_proxy_aborted_transfers_total", "route", "songs") == before+1
+	})
+
+	// a transfer that completes isn't an abort
+	if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3", "Range", "bytes=0-1023"); resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range status = %d, want 206", resp.StatusCode)
+	}
+	if got := metricValue(t, "cdn_proxy_aborted_transfers_total", "route", "songs"); got != before+1 {
+		t.Errorf("aborted transfers = %v, want %v", got, before+1)
+	}
+}
+
+func TestRequestRestrictions(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("d")
+	path := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		resp, _ := tp.get(t, method, path)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s status = %d, want 405", method, resp.StatusCode)
+		}
+		if allow := resp.Header.Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("%s Allow = %q, want GET, HEAD", method, allow)
+		}
+	}
+
+	resp, _ := tp.get(t, http.MethodGet, path+"?pad="+strings.Repeat("x", maxURLLength))
+	if resp.StatusCode != http.StatusRequestURITooLong {
+		t.Errorf("long URI status = %d, want 414", resp.StatusCode)
+	}
+
+	resp, _ = tp.do(t, http.MethodGet, path, strings.NewReader("smuggled"))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("GET with a body status = %d, want 413", resp.StatusCode)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		if n := tp.s3.Requests(method, "/"+testBucket+"/songs/1/"+hash+".mp3"); n != 0 {
+			t.Errorf("bucket saw %d refused %s requests", n, method)
+		}
+	}
+}
+
+func TestTransformPoolLimits(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("e")
+	path := "/emojis/9/" + hash + "?size=64"
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", original, "image/webp")
+
+	// occupy takes the pool's only worker, as a long transform would
+	occupy := func() (release func()) {
+		transforms.queue <- struct{}{}
+		transforms.slots <- struct{}{}
+		return func() {
+			<-transforms.slots
+			<-transforms.queue
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		maxQueue int
+		code     string
+	}{
+		{"queue full", 0, "transform_busy"},
+		{"queued too long", 1, "transform_timeout"},
+	} {
+		swap(t, &transforms, newWorkerPool(1, tc.maxQueue, 50*time.Millisecond))
+		release := occupy()
+
+		resp, body := tp.get(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, tc.code) {
+			t.Errorf("%s: status = %d %s, want 503 %s", tc.name, resp.StatusCode, body, tc.code)
+		}
+		release()
+	}
+
+	resp, body := tp.get(t, http.MethodGet, path)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("free pool status = %d, want 200", resp.StatusCode)
+	}
+	if cfg, _, err := image.DecodeConfig(strings.NewReader(body)); err != nil || cfg.Width != 64 {
+		t.Errorf("variant = %+v, %v, want 64 wide", cfg, err)
+	}
+}
+
+func TestImgproxyDelegation(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("f")
+	original := []byte("RIFF original")
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", original, "image/webp")
+
+	key, salt := []byte("imgproxy-key"), []byte("imgproxy-salt")
+	rendered := []byte("RIFF rendered by imgproxy")
+	var gotOptions, gotSource string
+	sidecar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature, path, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+		mac := hmac.New(sha256.New, key)
+		mac.Write(salt)
+		mac.Write([]byte("/" + path))
+		if signature != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+
+		options, source, _ := strings.Cut(path, "/plain/")
+		source, _ = url.PathUnescape(strings.TrimSuffix(source, "@webp"))
+		gotOptions, gotSource = options, source
+
+		// imgproxy fetches the original itself
+		resp, err := http.Get(source)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			http.Error(w, "source unavailable", http.StatusNotFound)
+			return
+		}
+		resp.Body.Close()
+
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write(rendered)
+	}))
+	t.Cleanup(sidecar.Close)
+
+	client, err := newImgproxyClient(sidecar.URL, hex.EncodeToString(key), hex.EncodeToString(salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &imgproxy, client)
+
+	resp, body := tp.get(t, http.MethodGet, "/emojis/9/"+hash+"?size=64")
+	if resp.StatusCode != http.StatusOK || body != string(rendered) {
+		t.Fatalf("GET = %d %q, want imgproxy's rendering", resp.StatusCode, body)
+	}
+	if gotOptions != "rs:fit:64:64:1" {
+		t.Errorf("imgproxy options = %q, want rs:fit:64:64:1", gotOptions)
+	}
+	if want := "/" + testBucket + "/emojis/9/" + hash + ".webp"; !strings.HasSuffix(gotSource, want) {
+		t.Errorf("imgproxy source = %q, want the original at %s", gotSource, want)
+	}
+}
+
+func TestDerivativesPersisted(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	tp.s3.AddBucket("derivatives")
+	swap(t, &derivativesBucket, "derivatives")
+
+	hash := testHash("a")
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", original, "image/webp")
+	path := "/emojis/9/" + hash + "?size=64"
+
+	resp, rendered := tp.get(t, http.MethodGet, path)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d, want 200", resp.StatusCode)
+	}
+	if cs := resp.Header.Get("Cache-Status"); !strings.Contains(cs, derivativeCacheName+"; fwd=uri-miss; stored") {
+		t.Errorf("Cache-Status = %q, want the derivative stored", cs)
+	}
+
+	_, _, _, ir, _ := matchImageRoute("/emojis/9/" + hash)
+	p, _, err := parseImageParams(ir, url.Values{"size": {"64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := derivativeKey("emojis", "9", hash, p)
+	obj, ok := tp.s3.Object("derivatives", key)
+	if !ok || string(obj.Body) != rendered || obj.ContentType != "image/webp" {
+		t.Fatalf("derivative %s = %v, want the rendered webp", key, ok)
+	}
+	if size, _ := tp.redis.Get(derivativeBytesKey); size != strconv.Itoa(len(rendered)) {
+		t.Errorf("tracked derivative bytes = %s, want %d", size, len(rendered))
+	}
+
+	// after a restart, with the original gone, the variant still comes from
+	// the bucket rather than a render
+	fresh, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &variantCache, fresh)
+	tp.s3.Delete(testBucket, "emojis/9/"+hash+".webp")
+
+	resp, body := tp.get(t, http.MethodGet, path)
+	if resp.StatusCode != http.StatusOK || body != rendered {
+		t.Fatalf("GET after restart = %d, want the stored derivative", resp.StatusCode)
+	}
+	if cs := resp.Header.Get("Cache-Status"); !strings.Contains(cs, derivativeCacheName+"; hit") {
+		t.Errorf("Cache-Status after restart = %q, want a derivative hit", cs)
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("b")
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	original, err := encodeImage(img, "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/9/"+hash+".webp", original, "image/webp")
+	path := "/avatars/9/" + hash
+
+	resp, body := tp.get(t, http.MethodGet, path+"?placeholder=blurhash")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("blurhash = %d %s, want 200 JSON", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var bh struct {
+		BlurHash      string `json:"blurhash"`
+		Width, Height int
+	}
+	if err := json.Unmarshal([]byte(body), &bh); err != nil {
+		t.Fatal(err)
+	}
+	// 4×3 components encode to 28 characters
+	if len(bh.BlurHash) != 28 || bh.Width != 64 || bh.Height != 32 {
+		t.Errorf("blurhash = %+v, want 28 characters for 64×32", bh)
+	}
+
+	resp, body = tp.get(t, http.MethodGet, path+"?placeholder=image")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/webp" {
+		t.Fatalf("image placeholder = %d %s, want 200 webp", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if cfg, _, err := image.DecodeConfig(strings.NewReader(body)); err != nil || cfg.Width != 16 || cfg.Height != 8 {
+		t.Errorf("image placeholder = %+v, %v, want 16×8", cfg, err)
+	}
+
+	// placeholders are kept in Valkey, so repeats don't need the original
+	key := "placeholder:image:avatars:9:" + hash
+	if cached, err := tp.redis.Get(key); err != nil || cached != body {
+		t.Errorf("valkey %s = %d bytes, %v, want the placeholder", key, len(cached), err)
+	}
+	tp.s3.Delete(testBucket, "avatars/9/"+hash+".webp")
+	resp, cached := tp.get(t, http.MethodGet, path+"?placeholder=image")
+	if resp.StatusCode != http.StatusOK || cached != body {
+		t.Errorf("repeat = %d, want the cached placeholder", resp.StatusCode)
+	}
+	if cs := resp.Header.Get("Cache-Status"); !strings.Contains(cs, "cdn-proxy; hit") {
+		t.Errorf("Cache-Status = %q, want a hit", cs)
+	}
+
+	resp, _ = tp.get(t, http.MethodGet, path+"?placeholder=image", "If-None-Match", resp.Header.Get("ETag"))
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want 304", resp.StatusCode)
+	}
+
+	resp, _ = tp.get(t, http.MethodGet, path+"?placeholder=sepia")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown placeholder status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestDerivativeGC(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	tp.s3.AddBucket("derivatives")
+	swap(t, &derivativesBucket, "derivatives")
+	swap(t, &derivativeIdleTTL, time.Hour)
+
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, busy := testHash("c"), testHash("d")
+	for _, hash := range []string{idle, busy} {
+		tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", original, "image/webp")
+		if resp, _ := tp.get(t, http.MethodGet, "/emojis/9/"+hash+"?size=64"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200", hash, resp.StatusCode)
+		}
+	}
+
+	_, _, _, ir, _ := matchImageRoute("/emojis/9/" + idle)
+	p, _, err := parseImageParams(ir, url.Values{"size": {"64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idleKey, busyKey := derivativeKey("emojis", "9", idle, p), derivativeKey("emojis", "9", busy, p)
+
+	// the idle variant was last served two hours ago, everywhere
+	old := time.Now().Add(-2 * time.Hour)
+	tp.redis.ZAdd(derivativeAccessKey, float64(old.Unix()), idleKey)
+	idleVariant := "emojis/9/" + idle + "?" + p.key()
+	if err := os.Chtimes(variantCache.path(idleVariant), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := tp.admin(t, http.MethodGet, "/admin/derivatives", nil)
+	var stats struct {
+		IdleTTL int64           `json:"idle_ttl_seconds"`
+		Disk    diskCacheStats  `json:"disk"`
+		Bucket  derivativeStats `json:"bucket"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("derivative stats = %d %s, want 200 JSON", resp.StatusCode, body)
+	}
+	if stats.IdleTTL != 3600 || stats.Disk.ReclaimableEntries != 1 ||
+		stats.Bucket.Entries != 2 || stats.Bucket.ReclaimableEntries != 1 || stats.Bucket.ReclaimableBytes == 0 {
+		t.Errorf("derivative stats = %+v, want one entry reclaimable in each store", stats)
+	}
+
+	collectDerivatives(context.Background())
+
+	if _, ok := tp.s3.Object("derivatives", idleKey); ok {
+		t.Error("idle derivative still in the bucket after GC")
+	}
+	if _, ok := tp.s3.Object("derivatives", busyKey); !ok {
+		t.Error("recent derivative removed by GC")
+	}
+	if f, _, ok := variantCache.get(idleVariant); ok {
+		f.Close()
+		t.Error("idle variant still on disk after GC")
+	}
+	if st, err := variantCache.stats(0); err != nil || st.Entries != stats.Disk.Entries-1 {
+		t.Errorf("disk cache after GC = %+v, %v, want one entry fewer", st, err)
+	}
+	if members, _ := tp.redis.ZMembers(derivativeAccessKey); len(members) != 1 {
+		t.Errorf("tracked derivatives after GC = %v, want the recent one", members)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tp := newTestProxy(t)
+	policies, err := checkCORSPolicies(map[string]*corsPolicy{
+		"songs":          {AllowedOrigins: []string{"https://*.colourlabs.net"}, AllowCredentials: true},
+		defaultCORSRoute: {AllowedOrigins: []string{"*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &corsPolicies, policies)
+
+	song := "/songs/1/" + testHash("a") + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(song, "/"), []byte("ID3 song"), "audio/mpeg")
+
+	for _, tc := range []struct {
+		name, origin, method, headers string
+		allowed                       bool
+	}{
+		{"subdomain", "https://app.colourlabs.net", http.MethodGet, "Range", true},
+		{"apex", "https://colourlabs.net", http.MethodGet, "", false},
+		{"other site", "https://colourlabs.net.example", http.MethodGet, "", false},
+		{"method", "https://app.colourlabs.net", http.MethodPut, "", false},
+		{"header", "https://app.colourlabs.net", http.MethodGet, "Range, X-Debug", false},
+	} {
+		resp, _ := tp.get(t, http.MethodOptions, song,
+			"Origin", tc.origin, "Access-Control-Request-Method", tc.method, "Access-Control-Request-Headers", tc.headers)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: preflight status = %d, want 204", tc.name, resp.StatusCode)
+		}
+
+		h := resp.Header
+		if !tc.allowed {
+			if h.Get("Access-Control-Allow-Origin") != "" || h.Get("Access-Control-Allow-Methods") != "" {
+				t.Errorf("%s: rejected preflight has allow headers %v", tc.name, h)
+			}
+			continue
+		}
+		if h.Get("Access-Control-Allow-Origin") != tc.origin || h.Get("Access-Control-Allow-Credentials") != "true" ||
+			h.Get("Access-Control-Allow-Headers") != tc.headers || h.Get("Access-Control-Max-Age") != "600" ||
+			!strings.Contains(h.Get("Access-Control-Allow-Methods"), http.MethodGet) {
+			t.Errorf("%s: preflight headers = %v, want %s allowed with credentials", tc.name, h, tc.origin)
+		}
+	}
+	if n := tp.s3.Requests(http.MethodOptions, "/"+testBucket+song); n != 0 {
+		t.Errorf("%d preflights reached the bucket, want 0", n)
+	}
+
+	resp, _ := tp.get(t, http.MethodGet, song, "Origin", "https://app.colourlabs.net")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.colourlabs.net" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "Content-Range") {
+		t.Errorf("GET = %d %v, want the origin allowed and Content-Range exposed", resp.StatusCode, resp.Header)
+	}
+	if !slices.Contains(resp.Header.Values("Vary"), "Origin") {
+		t.Errorf("Vary = %v, want Origin", resp.Header.Values("Vary"))
+	}
+
+	// routes without their own policy use the default
+	emoji := "/emojis/9/" + testHash("b")
+	tp.s3.Put(testBucket, "emojis/9/"+testHash("b")+".webp", []byte("RIFF emoji"), "image/webp")
+	resp, _ = tp.get(t, http.MethodGet, emoji, "Origin", "https://anywhere.example")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("emoji CORS = %v, want any origin without credentials", resp.Header)
+	}
+}
+
+func TestAnimationLimits(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	hash := testHash("c")
+	anim := testGIF(t, 3)
+	tp.s3.Put(testBucket, "avatars/1/"+hash+".gif", anim, "image/gif")
+	tp.pg.AddRows("FROM original_uploads", []string{"ext"}, []any{"gif"})
+
+	for _, tc := range []struct {
+		name           string
+		frames, pixels int
+		status         int
+	}{
+		{"within limits", defaultMaxAnimationFrames, defaultMaxAnimationPixels, http.StatusOK},
+		{"too many frames", 2, defaultMaxAnimationPixels, http.StatusUnprocessableEntity},
+		// 3 frames of 8×8 decode to 192 pixels
+		{"too many pixels", defaultMaxAnimationFrames, 191, http.StatusUnprocessableEntity},
+	} {
+		swap(t, &maxAnimationFrames, tc.frames)
+		swap(t, &maxAnimationPixels, tc.pixels)
+		// each case renders afresh rather than from the variant cache
+		cache, err := newDiskCache(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		swap(t, &variantCache, cache)
+
+		resp, body := tp.get(t, http.MethodGet, "/avatars/1/"+hash+"?size=64")
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: GET status = %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+		if tc.status != http.StatusOK && !strings.Contains(body, "animation_too_large") {
+			t.Errorf("%s: GET body = %s, want animation_too_large", tc.name, body)
+		}
+
+		resp, body = tp.do(t, http.MethodPut, "/upload/banners/1", bytes.NewReader(anim),
+			"Authorization", "Bearer "+testUploadToken, "Content-Type", "image/gif")
+		if tc.status == http.StatusOK {
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("%s: upload status = %d, want 201: %s", tc.name, resp.StatusCode, body)
+			}
+			continue
+		}
+		if resp.StatusCode != tc.status || !strings.Contains(body, "animation_too_large") {
+			t.Errorf("%s: upload = %d %s, want %d animation_too_large", tc.name, resp.StatusCode, body, tc.status)
+		}
+	}
+}
+
+func TestDecompressionBombRefused(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	hash := testHash("d")
+	// a few dozen bytes declaring 40000×40000, which decoding would
+	// allocate 6 GiB for
+	bomb := testPNGHeader(40000, 40000)
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", bomb, "image/webp")
+	tp.s3.Put(testBucket, "avatars/9/"+hash+".webp", bomb, "image/webp")
+
+	for _, path := range []string{
+		"/emojis/9/" + hash + "?size=64",
+		"/avatars/9/" + hash + "?placeholder=blurhash",
+	} {
+		resp, body := tp.get(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(body, "image_too_large") {
+			t.Errorf("GET %s = %d %s, want 422 image_too_large", path, resp.StatusCode, body)
+		}
+	}
+
+	resp, body := tp.do(t, http.MethodPut, "/upload/banners/9", bytes.NewReader(bomb),
+		"Authorization", "Bearer "+testUploadToken, "Content-Type", "image/png")
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(body, "image_too_large") {
+		t.Errorf("upload = %d %s, want 422 image_too_large", resp.StatusCode, body)
+	}
+
+	// the same header within the budget gets as far as decoding, which
+	// fails on the missing pixel data
+	swap(t, &maxImagePixels, 40000*40000)
+	resp, body = tp.get(t, http.MethodGet, "/emojis/9/"+hash+"?size=64")
+	if resp.StatusCode != http.StatusUnprocessableEntity || strings.Contains(body, "image_too_large") {
+		t.Errorf("GET within budget = %d %s, want a 422 for the truncated image", resp.StatusCode, body)
+	}
+}
+
+// testPNGHeader is the signature and IHDR chunk of a width×height RGBA PNG,
+// with no image data.
+func testPNGHeader(width, height uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ihdr)-4))
+	b = append(b, ihdr...)
+
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestUpstreamRequestsSigned(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	tp.s3.RequireSigV4("test", "test-secret")
+	creds := credentials.NewStaticV4("test", "test-secret", "")
+	swap[http.RoundTripper](t, &coalescer.next, &signingTransport{next: coalescer.next, creds: creds, region: defaultMinioRegion})
+
+	song := "songs/1/" + testHash("a") + ".mp3"
+	tp.s3.Put(testBucket, song, []byte("ID3 private song"), "audio/mpeg")
+	emoji := "emojis/9/" + testHash("b") + ".webp"
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, emoji, original, "image/webp")
+
+	// the bucket is private
+	resp, err := http.Get(tp.s3.URL + "/" + testBucket + "/" + song)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("anonymous GET status = %d, want 403", resp.StatusCode)
+	}
+
+	// proxied, fetched directly for a render, presigned for imgproxy and
+	// uploaded
+	if resp, body := tp.get(t, http.MethodGet, "/"+song, "Range", "bytes=4-10"); resp.StatusCode != http.StatusPartialContent || body != "private" {
+		t.Errorf("proxied GET = %d %q, want the signed range", resp.StatusCode, body)
+	}
+	if resp, _ := tp.get(t, http.MethodGet, "/"+strings.TrimSuffix(emoji, ".webp")+"?size=64"); resp.StatusCode != http.StatusOK {
+		t.Errorf("variant GET status = %d, want 200", resp.StatusCode)
+	}
+	source, err := imgproxySource(context.Background(), "/"+testBucket+"/"+emoji)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("presigned GET status = %d, want 200", resp.StatusCode)
+	}
+
+	resp, body := tp.do(t, http.MethodPut, "/upload/attachments/1?filename=notes.txt", strings.NewReader("notes"),
+		"Authorization", "Bearer "+testUploadToken, "Content-Type", "text/plain")
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload status = %d, want 201: %s", resp.StatusCode, body)
+	}
+
+	// a signature made with the wrong secret is refused, not served
+	wrong := credentials.NewStaticV4("test", "wrong-secret", "")
+	swap[http.RoundTripper](t, &coalescer.next, &signingTransport{next: coalescer.next.(*signingTransport).next, creds: wrong, region: defaultMinioRegion})
+	if resp, body := tp.get(t, http.MethodGet, "/"+song, "Range", "bytes=0-3"); resp.StatusCode < 400 || strings.Contains(body, "ID3") {
+		t.Errorf("GET signed with the wrong secret = %d %q, want an error", resp.StatusCode, body)
+	}
+}
+
+func TestFailoverToReplica(t *testing.T) {
+	tp := newTestProxy(t)
+	replica := testharness.NewS3(t, testBucket)
+	primaryURL, err := url.Parse(tp.s3.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicaURL, err := url.Parse(replica.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failover := newFailoverTransport(coalescer.next, []*url.URL{primaryURL, replicaURL}, false)
+	failover.ejectAfter = 2
+	swap(t, &upstreams, failover)
+	swap[http.RoundTripper](t, &coalescer.next, failover)
+
+	songs := make([]string, 3)
+	for i := range songs {
+		songs[i] = "songs/1/" + testHash(strconv.Itoa(i)) + ".mp3"
+		for _, s3 := range []*testharness.S3{tp.s3, replica} {
+			s3.Put(testBucket, songs[i], []byte("ID3 song "+strconv.Itoa(i)), "audio/mpeg")
+		}
+	}
+
+	// the primary fails twice in a row, and is ejected after the second
+	tp.s3.Fail(2, http.StatusServiceUnavailable, "SlowDown")
+	for i, song := range songs {
+		resp, body := tp.get(t, http.MethodGet, "/"+song)
+		if resp.StatusCode != http.StatusOK || body != "ID3 song "+strconv.Itoa(i) {
+			t.Errorf("GET %s = %d %q, want it served by the replica", song, resp.StatusCode, body)
+		}
+		if n := replica.Requests(http.MethodGet, "/"+testBucket+"/"+song); n != 1 {
+			t.Errorf("replica served %s %d times, want 1", song, n)
+		}
+	}
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/"+songs[2]); n != 0 {
+		t.Errorf("ejected primary asked for %s %d times, want 0", songs[2], n)
+	}
+	if up := metricValue(t, "cdn_proxy_upstream_endpoint_up", "endpoint", primaryURL.Host); up != 0 {
+		t.Errorf("primary up = %v, want 0 while ejected", up)
+	}
+
+	failover.reinstate(failover.endpoints[0])
+	song := "songs/1/" + testHash("3") + ".mp3"
+	tp.s3.Put(testBucket, song, []byte("ID3 song 3"), "audio/mpeg")
+	if resp, _ := tp.get(t, http.MethodGet, "/"+song); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET after reinstating = %d, want 200", resp.StatusCode)
+	}
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/"+song); n != 1 {
+		t.Errorf("reinstated primary asked %d times, want 1", n)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	tp := newTestProxy(t)
+	retrying := &retryTransport{next: coalescer.next, maxRetries: 2, baseDelay: 10 * time.Millisecond, budget: time.Second}
+	swap[http.RoundTripper](t, &coalescer.next, retrying)
+
+	for i, tc := range []struct {
+		name     string
+		failures int
+		status   int
+		code     string
+		budget   time.Duration
+		want     int
+		attempts int
+		retries  string
+	}{
+		{"recovers", 2, http.StatusServiceUnavailable, "SlowDown", time.Second, http.StatusOK, 3, "2"},
+		{"out of retries", 3, http.StatusServiceUnavailable, "SlowDown", time.Second, http.StatusServiceUnavailable, 3, "2"},
+		{"not retryable", 1, http.StatusInternalServerError, "InternalError", time.Second, http.StatusBadGateway, 1, ""},
+		{"out of budget", 1, http.StatusServiceUnavailable, "SlowDown", time.Millisecond, http.StatusServiceUnavailable, 1, ""},
+	} {
+		song := "songs/1/" + testHash(strconv.Itoa(i)) + ".mp3"
+		tp.s3.Put(testBucket, song, []byte("ID3 song"), "audio/mpeg")
+		tp.s3.Fail(tc.failures, tc.status, tc.code)
+		retrying.budget = tc.budget
+
+		resp, _ := tp.get(t, http.MethodGet, "/"+song)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+		if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/"+song); n != tc.attempts {
+			t.Errorf("%s: upstream attempts = %d, want %d", tc.name, n, tc.attempts)
+		}
+		if got := resp.Header.Get("X-Proxy-Retries"); got != tc.retries {
+			t.Errorf("%s: X-Proxy-Retries = %q, want %q", tc.name, got, tc.retries)
+		}
+	}
+}
+
+func TestBreakerOpensOnPostgresFailures(t *testing.T) {
+	tp := newTestProxy(t)
+	const threshold, cooldown = 3, 50 * time.Millisecond
+	swap(t, &postgresBreaker, newCircuitBreaker("postgres", threshold, cooldown))
+
+	hash := testHash("a")
+	song := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(song, "/"), []byte("ID3 song"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+	tp.pg.Fail(errors.New("connection refused"))
+	rejected := metricValue(t, "cdn_proxy_circuit_breaker_rejected_total", "breaker", "postgres")
+
+	// songs are still served, without their filename
+	for range threshold + 2 {
+		resp, _ := tp.get(t, http.MethodGet, song)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") != "" {
+			t.Fatalf("GET = %d %q, want 200 without a filename", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+		}
+	}
+	if n := tp.pg.Count("FROM user_profiles"); n != threshold {
+		t.Errorf("profile queried %d times, want %d before the breaker opened", n, threshold)
+	}
+	if st := postgresBreaker.status(); st.State != "open" {
+		t.Errorf("breaker state = %s, want open", st.State)
+	}
+	if got := metricValue(t, "cdn_proxy_circuit_breaker_rejected_total", "breaker", "postgres") - rejected; got != 2 {
+		t.Errorf("rejected lookups = %v, want 2", got)
+	}
+
+	// after the cooldown one probe goes through, and closes it
+	tp.pg.Fail(nil)
+	time.Sleep(cooldown)
+	resp, _ := tp.get(t, http.MethodGet, song)
+	if got, want := resp.Header.Get("Content-Disposition"), `inline; filename="Tune.mp3"`; got != want {
+		t.Errorf("Content-Disposition after recovery = %q, want %q", got, want)
+	}
+	if st := postgresBreaker.status(); st.State != "closed" {
+		t.Errorf("breaker state after the probe = %s, want closed", st.State)
+	}
+}
+
+func TestProfileCacheInvalidated(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	song := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(song, "/"), []byte("ID3 song"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Before.mp3")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		subscribeProfileInvalidations(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	filename := func() string {
+		t.Helper()
+		resp, _ := tp.get(t, http.MethodGet, song)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET status = %d, want 200", resp.StatusCode)
+		}
+		return resp.Header.Get("Content-Disposition")
+	}
+
+	if got := filename(); got != `inline; filename="Before.mp3"` {
+		t.Fatalf("Content-Disposition = %q, want Before.mp3", got)
+	}
+	tp.addProfile(1, hash, "audio/mpeg", "After.mp3")
+
+	// until the app announces the change, the cached profile is used
+	if got := filename(); got != `inline; filename="Before.mp3"` {
+		t.Errorf("cached Content-Disposition = %q, want Before.mp3", got)
+	}
+	if n := tp.pg.Count("FROM user_profiles"); n != 1 {
+		t.Errorf("profile queried %d times, want 1", n)
+	}
+
+	waitFor(t, "the invalidation subscription", func() bool {
+		return tp.redis.PubSubNumSub(profileInvalidateChannel)[profileInvalidateChannel] == 1
+	})
+	tp.redis.Publish(profileInvalidateChannel, "1")
+	waitFor(t, "the profile to be evicted", func() bool { return !tp.redis.Exists(profileCacheKey("1")) })
+
+	if got := filename(); got != `inline; filename="After.mp3"` {
+		t.Errorf("Content-Disposition after invalidation = %q, want After.mp3", got)
+	}
+}
+
+func TestSongDownloadDisposition(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	song := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(song, "/"), []byte("ID3 song"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	for _, tc := range []struct {
+		method, query, want string
+	}{
+		{http.MethodGet, "", `inline; filename="Tune.mp3"`},
+		{http.MethodGet, "?download=1", `attachment; filename="Tune.mp3"`},
+		{http.MethodGet, "?download=false", `inline; filename="Tune.mp3"`},
+		// the override gets the song's extension unless it has one
+		{http.MethodGet, "?filename=Live+Take", `inline; filename="Live Take.mp3"`},
+		{http.MethodGet, "?download=1&filename=take.ogg", `attachment; filename="take.ogg"`},
+		{http.MethodGet, "?download=1&filename=..%2F..%2Fetc%2Fpasswd%07", `attachment; filename="_.._etc_passwd"`},
+		{http.MethodGet, "?filename=B%C3%A9b%C3%A9", `inline; filename="B_b_.mp3"; filename*=UTF-8''B%C3%A9b%C3%A9.mp3`},
+		// HEAD doesn't look the filename up, but still honours the query,
+		// whether it's answered upstream or from remembered metadata
+		{http.MethodHead, "?download=1&filename=take", `attachment; filename="take.mp3"`},
+		{http.MethodHead, "?download=1", "attachment"},
+	} {
+		resp, _ := tp.get(t, tc.method, song+tc.query)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s %s status = %d, want 200", tc.method, tc.query, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Disposition"); got != tc.want {
+			t.Errorf("%s %s Content-Disposition = %q, want %q", tc.method, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestDebugTrace(t *testing.T) {
+	tp := newTestProxy(t)
+	setSecrets(t, "ADMIN_TOKEN", testAdminToken)
+	redisClient.AddHook(debugRedisHook{})
+
+	hash := testHash("a")
+	song := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(song, "/"), []byte("ID3 song"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	resp, body := tp.get(t, http.MethodGet, song+"?download=1&__debug="+testAdminToken)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" ||
+		resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("trace = %d %v, want uncached JSON", resp.StatusCode, resp.Header)
+	}
+	var trace struct {
+		URL       string              `json:"url"`
+		Route     string              `json:"route"`
+		Vars      map[string]string   `json:"vars"`
+		Status    int                 `json:"status"`
+		Headers   map[string][]string `json:"headers"`
+		BodyBytes int64               `json:"body_bytes"`
+		Events    []debugEvent        `json:"events"`
+	}
+	if err := json.Unmarshal([]byte(body), &trace); err != nil {
+		t.Fatal(err)
+	}
+
+	// the trace is of the request without the token, and holds no body
+	if trace.URL != song+"?download=1" || trace.Route != "songs" || trace.Vars["userID"] != "1" ||
+		trace.Status != http.StatusOK || trace.BodyBytes != int64(len("ID3 song")) || strings.Contains(body, "ID3 song") {
+		t.Errorf("trace = %+v, want the song's route, status and body size", trace)
+	}
+	if got := trace.Headers["Content-Disposition"]; len(got) != 1 || got[0] != `attachment; filename="Tune.mp3"` {
+		t.Errorf("traced Content-Disposition = %v, want the song's", got)
+	}
+	steps := map[string]string{}
+	for _, e := range trace.Events {
+		steps[e.Step] += e.Detail + "\n"
+	}
+	if !strings.Contains(steps["upstream"], "GET "+tp.s3.Listener.Addr().String()+"/"+testBucket+song+" -> 200") {
+		t.Errorf("upstream steps = %q, want the song's fetch", steps["upstream"])
+	}
+	if !strings.Contains(steps["redis"], profileCacheKey("1")) || steps["postgres"] == "" {
+		t.Errorf("steps = %v, want the profile lookups", steps)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if resp, _ := tp.get(t, http.MethodGet, song+"?__debug="+token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("trace with token %q status = %d, want 401", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminRouteTest(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	stickers := `[{"name":"stickers","pattern":"/stickers/{guildID}/{file...}","origin":"/stickers/{guildID}/{file}"}]`
+
+	for _, tc := range []struct {
+		name, request string
+		want          routeTestResult
+	}{
+		{"variant", `{"path":"/emojis/9/` + hash + `?size=64"}`, routeTestResult{
+			Method: "GET", Path: "/emojis/9/" + hash + "?size=64", Route: "emojis",
+			Vars:      map[string]string{"guildID": "9", "hash": hash},
+			OriginURL: tp.s3.URL + "/" + testBucket + "/emojis/9/" + hash + ".webp",
+			Transform: "crop=0x0&gravity=center&format=webp&size=64", CachePolicy: "control", Coalescable: true,
+		}},
+		{"range", `{"path":"/songs/1/` + hash + `.mp3","headers":{"Range":"bytes=0-"}}`, routeTestResult{
+			Method: "GET", Path: "/songs/1/" + hash + ".mp3", Route: "songs",
+			Vars:        map[string]string{"userID": "1", "file": hash + ".mp3"},
+			OriginURL:   tp.s3.URL + "/" + testBucket + "/songs/1/" + hash + ".mp3",
+			CachePolicy: "control",
+		}},
+		{"method", `{"method":"DELETE","path":"/songs/1/` + hash + `.mp3"}`, routeTestResult{
+			Method: "DELETE", Path: "/songs/1/" + hash + ".mp3", Rejected: "method_not_allowed", Route: "songs",
+			Vars:        map[string]string{"userID": "1", "file": hash + ".mp3"},
+			OriginURL:   tp.s3.URL + "/" + testBucket + "/songs/1/" + hash + ".mp3",
+			CachePolicy: "control",
+		}},
+		{"unrouted", `{"path":"/stickers/5/wave.png"}`, routeTestResult{
+			Method: "GET", Path: "/stickers/5/wave.png", Rejected: "not_found", Route: "other", LegacyLookup: true,
+			CachePolicy: "control", Coalescable: true,
+		}},
+		{"candidate routes", `{"path":"/stickers/5/` + hash + `.png","routes":` + stickers + `}`, routeTestResult{
+			Method: "GET", Path: "/stickers/5/" + hash + ".png", Route: "stickers",
+			Vars:        map[string]string{"guildID": "5", "file": hash + ".png"},
+			OriginURL:   tp.s3.URL + "/" + testBucket + "/stickers/5/" + hash + ".png",
+			CachePolicy: "control", Coalescable: true,
+		}},
+		{"candidate route vars", `{"path":"/stickers/5/wave.png","routes":` + stickers + `}`, routeTestResult{
+			Method: "GET", Path: "/stickers/5/wave.png", Rejected: "bad_request", Route: "stickers",
+			Vars:        map[string]string{"guildID": "5", "file": "wave.png"},
+			OriginURL:   tp.s3.URL + "/" + testBucket + "/stickers/5/wave.png",
+			CachePolicy: "control", Coalescable: true,
+		}},
+	} {
+		resp, body := tp.admin(t, http.MethodPost, "/admin/route-test", strings.NewReader(tc.request))
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d %s, want 200", tc.name, resp.StatusCode, body)
+			continue
+		}
+		var got routeTestResult
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: result = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, request := range []string{`{"path":`, `{"path":"no-slash"}`, `{"path":"/x","routes":[{"name":"bad","pattern":"/x/{"}]}`} {
+		if resp, _ := tp.admin(t, http.MethodPost, "/admin/route-test", strings.NewReader(request)); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("route-test %s status = %d, want 400", request, resp.StatusCode)
+		}
+	}
+
+	// nothing was fetched to answer any of it
+	for _, path := range []string{"/emojis/9/" + hash + ".webp", "/songs/1/" + hash + ".mp3"} {
+		if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+path); n != 0 {
+			t.Errorf("%d requests for %s reached the bucket, want 0", n, path)
+		}
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	tp := newTestProxy(t)
+	t.Setenv("TRANSFORM_WORKERS", "")
+	setSecrets(t, "POSTGRES_CONN", "postgres://cdn:hunter2@db:5432/social", "VALKEY_PASSWORD", "valkey-secret")
+
+	resp, body := tp.admin(t, http.MethodGet, "/admin/config", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("config status = %d, want 200", resp.StatusCode)
+	}
+	if strings.Contains(body, "hunter2") || strings.Contains(body, "valkey-secret") || strings.Contains(body, testAdminToken) {
+		t.Fatalf("config leaks a secret: %s", body)
+	}
+	var config struct {
+		Settings []configValue `json:"settings"`
+		Routes   []route       `json:"routes"`
+	}
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]configValue{}
+	for _, s := range config.Settings {
+		values[s.Name] = s
+	}
+	for name, want := range map[string]string{
+		"POSTGRES_CONN":     "postgres://cdn:xxxxx@db:5432/social",
+		"VALKEY_PASSWORD":   "[redacted]",
+		"ADMIN_TOKEN":       "[redacted]",
+		"TRANSFORM_WORKERS": values["TRANSFORM_WORKERS"].Default,
+	} {
+		if got := values[name]; got.Value != want || got.Set != (name != "TRANSFORM_WORKERS") {
+			t.Errorf("%s = %+v, want %q", name, got, want)
+		}
+	}
+	if !slices.ContainsFunc(config.Routes, func(rt route) bool { return rt.Name == "songs" }) {
+		t.Errorf("config routes = %v, want the built-in ones", config.Routes)
+	}
+
+	base := `"VALKEY_ADDR":"valkey:6379","POSTGRES_CONN":"postgres://db/social","MINIO_BUCKET":"cdn"`
+	for _, tc := range []struct {
+		name, candidate string
+		errors          []string
+		warnings        []string
+	}{
+		{"valid", `{"env":{` + base + `,"MINIO_ENDPOINT":"http://minio:9000"}}`, nil, nil},
+		{"problems", `{"env":{` + base + `,"TRANSFORM_WORKERS":"many","ADMIN_ADDR":":9100","WARP_DRIVE":"1"},` +
+			`"routes":[{"name":"bad","pattern":"/x/{"}],"cors_policies":{"songs":{"allowed_origins":[]}}}`,
+			[]string{"env.TRANSFORM_WORKERS", "env.MINIO_ENDPOINT", "env.ADMIN_TOKEN", "routes", "cors_policies"},
+			[]string{"env.WARP_DRIVE"}},
+		// the token may come from a file the proxy can't see from here
+		{"secret file", `{"env":{` + base + `,"MINIO_ENDPOINT":"http://minio:9000","ADMIN_ADDR":":9100","ADMIN_TOKEN_FILE":"/run/secrets/admin"}}`, nil, nil},
+	} {
+		resp, body := tp.admin(t, http.MethodPost, "/admin/config/validate", strings.NewReader(tc.candidate))
+		var result struct {
+			Valid    bool            `json:"valid"`
+			Errors   []configProblem `json:"errors"`
+			Warnings []configProblem `json:"warnings"`
+		}
+		if err := json.Unmarshal([]byte(body), &result); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: validate = %d %s, want 200 JSON", tc.name, resp.StatusCode, body)
+		}
+
+		fields := func(problems []configProblem) []string {
+			var f []string
+			for _, p := range problems {
+				f = append(f, p.Field)
+			}
+			slices.Sort(f)
+			return f
+		}
+		slices.Sort(tc.errors)
+		if got := fields(result.Errors); !slices.Equal(got, tc.errors) || result.Valid != (len(tc.errors) == 0) {
+			t.Errorf("%s: valid = %v, errors = %v, want %v", tc.name, result.Valid, result.Errors, tc.errors)
+		}
+		if got := fields(result.Warnings); !slices.Equal(got, tc.warnings) {
+			t.Errorf("%s: warnings = %v, want %v", tc.name, result.Warnings, tc.warnings)
+		}
+	}
+
+	if resp, _ := tp.admin(t, http.MethodPost, "/admin/config/validate", strings.NewReader(`{"environment":{}}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown field status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestSongThrottle(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &songThrottleMultiplier, 1)
+	swap(t, &songThrottleBurst, 4096)
+
+	// 8 kHz 8-bit mono: 8000 bytes a second
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00\x40\x1f\x00\x00\x40\x1f\x00\x00\x01\x00\x08\x00data\x00\x00\x00\x00")
+	wav = append(wav, bytes.Repeat([]byte{0x80}, 4096+4000-len(wav))...)
+	wavHash, flacHash := testHash("a"), testHash("b")
+	tp.s3.Put(testBucket, "songs/1/"+wavHash+".wav", wav, "audio/wav")
+	tp.s3.Put(testBucket, "songs/2/"+flacHash+".flac", bytes.Repeat([]byte{0}, 8096), "audio/flac")
+	tp.addProfile(1, wavHash, "audio/wav", "Tone.wav")
+	tp.addProfile(2, flacHash, "audio/flac", "Noise.flac")
+
+	start := time.Now()
+	resp, body := tp.get(t, http.MethodGet, "/songs/1/"+wavHash+".wav")
+	elapsed := time.Since(start)
+	if resp.StatusCode != http.StatusOK || body != string(wav) {
+		t.Fatalf("song = %d with %d bytes, want 200 with the song", resp.StatusCode, len(body))
+	}
+	if got, want := resp.Header.Get("X-Bandwidth-Limit"), "rate=8000; burst=4096; bitrate=64000; source=wav-header"; got != want {
+		t.Errorf("X-Bandwidth-Limit = %q, want %q", got, want)
+	}
+	// the 4000 bytes after the burst go out over half a second
+	if elapsed < 350*time.Millisecond {
+		t.Errorf("song took %v, want it paced past the burst", elapsed)
+	}
+
+	// a lossless song without a header to read goes out unpaced
+	resp, _ = tp.get(t, http.MethodGet, "/songs/2/"+flacHash+".flac")
+	if got := resp.Header.Get("X-Bandwidth-Limit"); got != "none; reason=unknown-bitrate" {
+		t.Errorf("headerless flac X-Bandwidth-Limit = %q, want it unthrottled", got)
+	}
+
+	// nor does anything with the feature off
+	features["song_throttle"].Store(false)
+	t.Cleanup(func() { features["song_throttle"].Store(true) })
+	start = time.Now()
+	resp, _ = tp.get(t, http.MethodGet, "/songs/1/"+wavHash+".wav")
+	if got := resp.Header.Get("X-Bandwidth-Limit"); got != "" || time.Since(start) >= 350*time.Millisecond {
+		t.Errorf("with song_throttle off, X-Bandwidth-Limit = %q after %v, want no pacing", got, time.Since(start))
+	}
+}
+
+func TestSecretSources(t *testing.T) {
+	newTestProxy(t)
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("VAULT_TOKEN", "vault-token")
+
+	var vaultDown atomic.Bool
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if vaultDown.Load() || r.Header.Get("X-Vault-Token") != "vault-token" || r.URL.Path != "/v1/secret/data/cdn" {
+			http.Error(w, "{}", http.StatusServiceUnavailable)
+			return
+		}
+		// KV v2
+		w.Write([]byte(`{"data":{"data":{"ADMIN_TOKEN":"from-vault","UPLOAD_TOKEN":"upload-from-vault"},"metadata":{"version":3}}}`))
+	}))
+	t.Cleanup(vault.Close)
+
+	swap(t, &secrets, &secretStore{values: map[string]string{}, vault: newVaultSource(vault.URL, "/secret/data/cdn/")})
+	if _, err := secrets.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		secrets.refresh(ctx, 5*time.Millisecond)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	admin := httptest.NewServer(newAdminHandler())
+	t.Cleanup(admin.Close)
+	accepts := func(token string) bool {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, admin.URL+"/admin/features", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := admin.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	if !accepts("from-vault") || setting("UPLOAD_TOKEN") != "upload-from-vault" {
+		t.Fatalf("admin token from Vault rejected, or UPLOAD_TOKEN = %q", setting("UPLOAD_TOKEN"))
+	}
+
+	// a mounted file beats Vault, and rotating it takes effect on refresh
+	file := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ADMIN_TOKEN_FILE", file)
+	waitFor(t, "the file's token", func() bool { return accepts("from-file") })
+	if accepts("from-vault") {
+		t.Error("Vault's token still accepted over the file's")
+	}
+	if err := os.WriteFile(file, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the rotated token", func() bool { return accepts("rotated") })
+	if accepts("from-file") {
+		t.Error("token accepted after rotation")
+	}
+
+	// the environment beats both
+	t.Setenv("ADMIN_TOKEN", "from-env")
+	waitFor(t, "the environment's token", func() bool { return accepts("from-env") })
+
+	// secrets survive a source going away
+	vaultDown.Store(true)
+	t.Setenv("ADMIN_TOKEN", "")
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secrets.load(context.Background()); err == nil {
+		t.Error("load with Vault down succeeded")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !accepts("from-env") || setting("UPLOAD_TOKEN") != "upload-from-vault" {
+		t.Errorf("secrets dropped while their sources were unavailable")
+	}
+}
+
+func TestSongMetadata(t *testing.T) {
+	tp := newTestProxy(t)
+	current, old := testHash("a"), testHash("b")
+	tp.s3.Put(testBucket, "songs/1/"+current+".mp3", []byte("ID3 current song"), "audio/mpeg")
+	tp.s3.SetMetadata(testBucket, "songs/1/"+current+".mp3", map[string]string{"Duration": "183.5"})
+	tp.s3.Put(testBucket, "songs/1/"+old+".ogg", []byte("OggS"), "audio/ogg")
+	tp.addProfile(1, current, "audio/mpeg", "Tune.mp3")
+
+	duration := 183.5
+	for _, tc := range []struct {
+		path   string
+		status int
+		want   songMetadata
+	}{
+		// the current song needs no extension
+		{"/1/" + current, http.StatusOK, songMetadata{UserID: "1", Hash: current, Path: "/songs/1/" + current + ".mp3",
+			Filename: "Tune.mp3", MimeType: "audio/mpeg", Size: 16, Duration: &duration}},
+		{"/1/" + old + ".ogg", http.StatusOK, songMetadata{UserID: "1", Hash: old, Path: "/songs/1/" + old + ".ogg",
+			MimeType: "audio/ogg", Size: 4}},
+		{"/1/" + old, http.StatusNotFound, songMetadata{}},
+		{"/1/" + old + ".mp3", http.StatusNotFound, songMetadata{}},
+		{"/1/" + current + "?include=lyrics", http.StatusBadRequest, songMetadata{}},
+	} {
+		resp, body := tp.get(t, http.MethodGet, "/metadata/songs"+tc.path)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s status = %d, want %d", tc.path, resp.StatusCode, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var got songMetadata
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s = %+v, want %+v", tc.path, got, tc.want)
+		}
+	}
+
+	// private profiles are checked as the song itself would be
+	tp.s3.Put(testBucket, "songs/2/"+current+".mp3", []byte("ID3"), "audio/mpeg")
+	tp.addPrivateProfile(2)
+	setSecrets(t, "SESSION_JWT_SECRET", "secret")
+	validator, err := newSessionValidator(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &sessions, validator)
+	if resp, _ := tp.get(t, http.MethodGet, "/metadata/songs/2/"+current+".mp3"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("private song metadata without a session = %d, want 403", resp.StatusCode)
+	}
+	token := testJWT("secret", "", "3", time.Now().Add(time.Hour))
+	if resp, _ := tp.get(t, http.MethodGet, "/metadata/songs/2/"+current+".mp3", "Authorization", "Bearer "+token); resp.StatusCode != http.StatusOK {
+		t.Errorf("private song metadata with a session = %d, want 200", resp.StatusCode)
+	}
+}
+
+// sseEvent is one server-sent event.
+type sseEvent struct {
+	id, event, data string
+}
+
+// parseSSE splits a server-sent event stream into its events, skipping
+// comments.
+func parseSSE(stream string) []sseEvent {
+	var events []sseEvent
+	for _, block := range strings.Split(stream, "\n\n") {
+		var ev sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				ev.id = value
+			case "event":
+				ev.event = value
+			case "data":
+				ev.data = value
+			}
+		}
+		if ev != (sseEvent{}) {
+			events = append(events, ev)
+		}
+	}
+
+	return events
+}
+
+func TestOperations(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	hash := testHash("a")
+	for _, key := range []string{"songs/7/" + hash + ".mp3", "avatars/7/" + hash + ".webp", "avatars/7/" + hash + ".png", "avatars/8/" + hash + ".webp"} {
+		tp.s3.Put(testBucket, key, []byte("stored"), "application/octet-stream")
+	}
+
+	resp, body := tp.admin(t, http.MethodPost, "/admin/operations", strings.NewReader(`{"kind":"erase","user_id":"7"}`))
+	var started struct{ ID, Events string }
+	if err := json.Unmarshal([]byte(body), &started); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start = %d %s, want 202 with the operation", resp.StatusCode, body)
+	}
+
+	// the stream ends with the operation
+	resp, body = tp.admin(t, http.MethodGet, started.Events, nil)
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	events := parseSSE(body)
+	if len(events) < 3 || events[0].event != "running" || events[len(events)-1].event != "done" {
+		t.Fatalf("events = %v, want running through done", events)
+	}
+	var objects opEvent
+	for _, ev := range events {
+		var got opEvent
+		if err := json.Unmarshal([]byte(ev.data), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != ev.id {
+			t.Errorf("event %s carries ID %q", ev.id, got.ID)
+		}
+		if got.Stage == "objects" && got.Done {
+			objects = got
+		}
+	}
+	if objects.Count != 3 || objects.Bytes != 3*int64(len("stored")) {
+		t.Errorf("objects stage = %+v, want the user's 3 objects", objects.stageProgress)
+	}
+	for key, want := range map[string]bool{"songs/7/" + hash + ".mp3": false, "avatars/7/" + hash + ".png": false, "avatars/8/" + hash + ".webp": true} {
+		if _, ok := tp.s3.Object(testBucket, key); ok != want {
+			t.Errorf("%s stored = %v after the erasure, want %v", key, ok, want)
+		}
+	}
+	if tp.pg.Count("DELETE FROM original_uploads") != 1 {
+		t.Error("recorded originals not deleted")
+	}
+
+	// a watcher that reconnects gets only what it missed
+	req, _ := http.NewRequest(http.MethodGet, tp.adminServer.URL+started.Events, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Last-Event-ID", events[len(events)-2].id)
+	resp, err := tp.adminServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := parseSSE(string(data)); !reflect.DeepEqual(got, events[len(events)-1:]) {
+		t.Errorf("resumed events = %v, want %v", got, events[len(events)-1:])
+	}
+
+	resp, body = tp.admin(t, http.MethodGet, "/admin/operations/"+started.ID, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"state":"done"`) {
+		t.Errorf("operation = %d %s, want done", resp.StatusCode, body)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/admin/operations", `{"kind":"shred","user_id":"7"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/operations", `{"kind":"erase","user_id":"seven"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/operations", `{"kind":"purge","prefix":"avatars"}`, http.StatusBadRequest},
+		{http.MethodGet, "/admin/operations/missing", "", http.StatusNotFound},
+		{http.MethodGet, "/admin/operations/missing/events", "", http.StatusNotFound},
+	} {
+		if resp, body := tp.admin(t, tc.method, tc.path, strings.NewReader(tc.body)); resp.StatusCode != tc.status {
+			t.Errorf("%s %s %s = %d %s, want %d", tc.method, tc.path, tc.body, resp.StatusCode, body, tc.status)
+		}
+	}
+}
+
+func TestPurgeRules(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	tp.s3.AddBucket("derivatives")
+	swap(t, &derivativesBucket, "derivatives")
+
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(file, []byte(`[
+		{"name": "idle-emojis", "prefix": "/emojis/9/", "target": "variants", "idle": "1h", "every": "6h"},
+		{"name": "old-songs", "prefix": "songs/", "target": "objects", "age": "720h", "every": "24h", "dry_run": true}
+	]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadPurgeRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &purgeRules, rules)
+
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, busy := testHash("c"), testHash("d")
+	for _, hash := range []string{idle, busy} {
+		tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", original, "image/webp")
+		if resp, _ := tp.get(t, http.MethodGet, "/emojis/9/"+hash+"?size=64"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200", hash, resp.StatusCode)
+		}
+	}
+	tp.s3.Put(testBucket, "songs/1/"+busy+".mp3", []byte("ID3"), "audio/mpeg")
+
+	_, _, _, ir, _ := matchImageRoute("/emojis/9/" + idle)
+	p, _, err := parseImageParams(ir, url.Values{"size": {"64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idleKey, busyKey := derivativeKey("emojis", "9", idle, p), derivativeKey("emojis", "9", busy, p)
+	old := time.Now().Add(-2 * time.Hour)
+	tp.redis.ZAdd(derivativeAccessKey, float64(old.Unix()), idleKey)
+	idleVariant := "emojis/9/" + idle + "?" + p.key()
+	if err := os.Chtimes(variantCache.path(idleVariant), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(path string) ruleResult {
+		t.Helper()
+		resp, body := tp.admin(t, http.MethodPost, path, nil)
+		var res ruleResult
+		if err := json.Unmarshal([]byte(body), &res); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s = %d %s, want 200 with the result", path, resp.StatusCode, body)
+		}
+		return res
+	}
+	// stat rather than get, which would count as a request
+	onDisk := func(variant string) bool {
+		_, err := os.Stat(variantCache.path(variant))
+		return err == nil
+	}
+	removed := func(res ruleResult) []int64 {
+		var counts []int64
+		for _, st := range res.Stages {
+			counts = append(counts, st.Count)
+		}
+		return counts
+	}
+
+	// a dry run counts the idle variant in each store and keeps it
+	dryRuns := metricValue(t, "cdn_proxy_rule_removed_total", "rule", "idle-emojis", "store", "disk", "mode", "dry_run")
+	res := run("/admin/rules/idle-emojis/run?dry_run=1")
+	if !res.DryRun || res.Error != "" || !slices.Equal(removed(res), []int64{1, 1}) {
+		t.Errorf("dry run = %+v, want the idle variant counted on disk and in the bucket", res)
+	}
+	if _, ok := tp.s3.Object("derivatives", idleKey); !ok || !onDisk(idleVariant) {
+		t.Error("dry run removed the idle variant")
+	}
+	if got := metricValue(t, "cdn_proxy_rule_removed_total", "rule", "idle-emojis", "store", "disk", "mode", "dry_run"); got != dryRuns+1 {
+		t.Errorf("dry run disk removals metric = %v, want %v", got, dryRuns+1)
+	}
+
+	res = run("/admin/rules/idle-emojis/run")
+	if res.DryRun || res.Error != "" || !slices.Equal(removed(res), []int64{1, 1}) {
+		t.Errorf("run = %+v, want the idle variant removed from disk and the bucket", res)
+	}
+	if _, ok := tp.s3.Object("derivatives", idleKey); ok || onDisk(idleVariant) {
+		t.Error("idle variant kept by the rule")
+	}
+	if _, ok := tp.s3.Object("derivatives", busyKey); !ok || !onDisk("emojis/9/"+busy+"?"+p.key()) {
+		t.Error("recently served variant removed by the rule")
+	}
+
+	// a rule marked dry_run stays one; nothing here is 30 days old anyway
+	if res := run("/admin/rules/old-songs/run"); !res.DryRun || !slices.Equal(removed(res), []int64{0}) {
+		t.Errorf("old-songs run = %+v, want a dry run finding nothing", res)
+	}
+	if _, ok := tp.s3.Object(testBucket, "songs/1/"+busy+".mp3"); !ok {
+		t.Error("song removed by a dry run")
+	}
+
+	resp, body := tp.admin(t, http.MethodGet, "/admin/rules", nil)
+	var listed struct {
+		Rules []struct {
+			Name string      `json:"name"`
+			Last *ruleResult `json:"last"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal([]byte(body), &listed); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("rules = %d %s, want 200 JSON", resp.StatusCode, body)
+	}
+	if len(listed.Rules) != 2 || listed.Rules[0].Last == nil || listed.Rules[0].Last.DryRun {
+		t.Errorf("rules = %s, want both with idle-emojis's last, real run", body)
+	}
+
+	if resp, _ := tp.admin(t, http.MethodPost, "/admin/rules/missing/run", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown rule run = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	for _, user := range []string{"1", "2"} {
+		tp.s3.Put(testBucket, "songs/"+user+"/"+hash+".mp3", []byte("ID3 song"), "audio/mpeg")
+	}
+	tp.admin(t, http.MethodGet, "/admin/features", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, tp.adminServer.URL+"/admin/events?user_id=1", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := tp.adminServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events = %d %s, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		var block strings.Builder
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				block.WriteString(scanner.Text() + "\n")
+				continue
+			}
+			for _, ev := range parseSSE(block.String()) {
+				events <- ev
+			}
+			block.Reset()
+		}
+		close(events)
+	}()
+	next := func() serveEvent {
+		t.Helper()
+		select {
+		case ev, ok := <-events:
+			var got serveEvent
+			if !ok || ev.event != "serve" || json.Unmarshal([]byte(ev.data), &got) != nil {
+				t.Fatalf("event = %+v, want a serve event", ev)
+			}
+			return got
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a serve event")
+		}
+		return serveEvent{}
+	}
+
+	// only user 1's responses are watched, and without their query strings
+	tp.get(t, http.MethodGet, "/songs/2/"+hash+".mp3")
+	tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3?grant=secret-grant")
+	ev := next()
+	if ev.Method != http.MethodGet || ev.Path != "/songs/1/"+hash+".mp3" || ev.Route != "songs" || ev.UserID != "1" ||
+		ev.Status != http.StatusOK || ev.Bytes != int64(len("ID3 song")) || ev.Client == "" {
+		t.Errorf("serve event = %+v, want user 1's song", ev)
+	}
+	tp.get(t, http.MethodGet, "/songs/1/"+testHash("b")+".mp3")
+	if ev := next(); ev.Status != http.StatusNotFound {
+		t.Errorf("serve event = %+v, want the 404", ev)
+	}
+
+	// the watcher goes with its client
+	cancel()
+	waitFor(t, "the watcher to go", func() bool { return serveWatchers.count.Load() == 0 })
+}
+
+func TestMetadataIncludes(t *testing.T) {
+	tp := newTestProxy(t)
+	hash, broken := testHash("a"), testHash("b")
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	avatar, err := encodeImage(img, "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/9/"+hash+".webp", avatar, "image/webp")
+
+	resp, body := tp.get(t, http.MethodGet, "/metadata/avatars/9/"+hash+"?include=blurhash,colors,placeholder")
+	var meta imageMetadata
+	if err := json.Unmarshal([]byte(body), &meta); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("avatar metadata = %d %s, want 200 JSON", resp.StatusCode, body)
+	}
+	if meta.Path != "/avatars/9/"+hash || meta.MimeType != "image/webp" || meta.Size != int64(len(avatar)) ||
+		len(meta.BlurHash) != 28 || meta.Width != 64 || meta.Height != 32 || meta.Colors == nil || meta.Colors.Dominant == "" {
+		t.Errorf("avatar metadata = %+v, want it expanded", meta)
+	}
+	placeholder, ok := strings.CutPrefix(meta.Placeholder, "data:image/webp;base64,")
+	if data, err := base64.StdEncoding.DecodeString(placeholder); !ok || err != nil || !bytes.HasPrefix(data, []byte("RIFF")) {
+		t.Errorf("placeholder = %.40q, want a webp data URI", meta.Placeholder)
+	}
+
+	// nothing is computed unless asked for
+	if _, body := tp.get(t, http.MethodGet, "/metadata/avatars/9/"+hash); strings.Contains(body, "blurhash") || strings.Contains(body, "colors") {
+		t.Errorf("plain avatar metadata = %s, want no includes", body)
+	}
+	if resp, _ := tp.get(t, http.MethodGet, "/metadata/avatars/9/"+hash+"?include=exif"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown include status = %d, want 400", resp.StatusCode)
+	}
+
+	// a song's artwork is its owner's banner; fields that can't be worked
+	// out are listed rather than failing the response
+	tp.s3.Put(testBucket, "banners/1/"+broken+".webp", []byte("not an image"), "image/webp")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3"), "audio/mpeg")
+	tp.pg.AddRows("FROM user_profiles WHERE id = $1",
+		[]string{"id", "bio", "banner_hash", "audio_hash", "audio_mime_type", "audio_name", "is_private"},
+		[]any{int64(1), "", broken, hash, "audio/mpeg", "Tune.mp3", false})
+
+	for _, tc := range []struct {
+		include string
+		want    *imageInfo
+		missing []string
+	}{
+		{"duration", nil, nil},
+		{"duration,blurhash,colors", &imageInfo{Path: "/banners/1/" + broken}, []string{"blurhash", "colors"}},
+	} {
+		resp, body := tp.get(t, http.MethodGet, "/metadata/songs/1/"+hash+"?include="+tc.include)
+		var song songMetadata
+		if err := json.Unmarshal([]byte(body), &song); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("song metadata = %d %s, want 200 JSON", resp.StatusCode, body)
+		}
+		if !reflect.DeepEqual(song.Artwork, tc.want) || !slices.Equal(song.Unavailable, tc.missing) {
+			t.Errorf("include=%s artwork = %+v, unavailable %v, want %+v and %v", tc.include, song.Artwork, song.Unavailable, tc.want, tc.missing)
+		}
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	hash := testHash("a")
+	song := "/songs/1/" + hash + ".mp3"
+
+	use := func(t *testing.T, kind string) {
+		t.Helper()
+		backend, err := newStorageBackend(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		swap(t, &storage, backend)
+		swap[http.RoundTripper](t, &coalescer.next, upstreamChain(backend))
+		swap(t, &minioURL, &url.URL{Scheme: "http", Host: "storage.invalid", Path: "/" + minioBucket})
+	}
+
+	t.Run("fs", func(t *testing.T) {
+		tp := newTestProxy(t)
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "songs", "1"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "songs", "1", hash+".mp3"), []byte("ID3 song on disk"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("STORAGE_DIR", dir)
+		use(t, "fs")
+
+		resp, body := tp.get(t, http.MethodGet, song)
+		if resp.StatusCode != http.StatusOK || body != "ID3 song on disk" || resp.Header.Get("ETag") == "" {
+			t.Fatalf("song = %d %q, want it from the directory with an ETag", resp.StatusCode, body)
+		}
+		for _, tc := range []struct {
+			method  string
+			path    string
+			headers []string
+			status  int
+			body    string
+		}{
+			{http.MethodGet, song, []string{"Range", "bytes=4-7"}, http.StatusPartialContent, "song"},
+			{http.MethodGet, song, []string{"If-None-Match", resp.Header.Get("ETag")}, http.StatusNotModified, ""},
+			{http.MethodHead, song, nil, http.StatusOK, ""},
+			{http.MethodGet, "/songs/1/" + testHash("b") + ".mp3", nil, http.StatusNotFound, ""},
+		} {
+			resp, body := tp.get(t, tc.method, tc.path, tc.headers...)
+			if resp.StatusCode != tc.status || (tc.body != "" && body != tc.body) {
+				t.Errorf("%s %s %v = %d %q, want %d %q", tc.method, tc.path, tc.headers, resp.StatusCode, body, tc.status, tc.body)
+			}
+		}
+		if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+song); n != 0 {
+			t.Errorf("S3 asked %d times with the fs backend", n)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		tp := newTestProxy(t)
+		// keys are appended to the origin's path
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/media/songs/1/"+hash+".mp3" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.Write([]byte("ID3 song from the origin"))
+		}))
+		t.Cleanup(origin.Close)
+		t.Setenv("STORAGE_ORIGIN", origin.URL+"/media/")
+		use(t, "http")
+
+		if resp, body := tp.get(t, http.MethodGet, song); resp.StatusCode != http.StatusOK || body != "ID3 song from the origin" {
+			t.Errorf("song = %d %q, want it from the origin", resp.StatusCode, body)
+		}
+		if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+testHash("b")+".mp3"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("missing song status = %d, want 404", resp.StatusCode)
+		}
+	})
+
+	for _, tc := range []struct{ kind, env, value string }{
+		{"fs", "STORAGE_DIR", ""},
+		{"http", "STORAGE_ORIGIN", "not a url"},
+		{"ftp", "", ""},
+	} {
+		if tc.env != "" {
+			t.Setenv(tc.env, tc.value)
+		}
+		if _, err := newStorageBackend(tc.kind); err == nil {
+			t.Errorf("%s backend with %s=%q accepted", tc.kind, tc.env, tc.value)
+		}
+	}
+}
+
+func TestMissingVariantConverted(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	hash := testHash("a")
+	stored, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 16, 16)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/9/"+hash+".webp", stored, "image/webp")
+	path := "/avatars/9/" + hash + "?format=png"
+
+	resp, body := tp.get(t, http.MethodGet, path)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("png = %d %s, want it converted from the webp", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if img, err := png.Decode(strings.NewReader(body)); err != nil || img.Bounds().Dx() != 16 {
+		t.Errorf("converted png doesn't decode as the avatar: %v", err)
+	}
+	if !strings.Contains(resp.Header.Get("Cache-Status"), "detail=converted") {
+		t.Errorf("Cache-Status = %q, want the conversion noted", resp.Header.Get("Cache-Status"))
+	}
+
+	// it's written back, so the next miss finds it
+	waitFor(t, "the png to be written back", func() bool {
+		obj, ok := tp.s3.Object(testBucket, "avatars/9/"+hash+".png")
+		return ok && obj.ContentType == "image/png" && string(obj.Body) == body
+	})
+
+	// nothing to convert from, or the feature off, is still a 404
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/9/"+testHash("b")+"?format=png"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("png without a source status = %d, want 404", resp.StatusCode)
+	}
+	features["variant_fill"].Store(false)
+	t.Cleanup(func() { features["variant_fill"].Store(true) })
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/9/"+hash+"?format=jpg"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("with variant_fill off, jpg status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestProfileExport(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	setSecrets(t, "SESSION_JWT_SECRET", "secret")
+	validator, err := newSessionValidator(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &sessions, validator)
+	swap(t, &exportRateLimit, 2)
+
+	avatar, banner, song := testHash("a"), testHash("b"), testHash("c")
+	tp.s3.Put(testBucket, "avatars/5/"+avatar+".webp", []byte("served avatar"), "image/webp")
+	tp.s3.Put(testBucket, "avatars/5/"+avatar+".png", []byte("uploaded avatar"), "image/png")
+	tp.redis.Set(originalExtKey("avatars", "5", avatar), "png")
+	tp.s3.Put(testBucket, "banners/5/"+banner+".webp", []byte("banner"), "image/webp")
+	tp.s3.Put(testBucket, "songs/5/"+song+".mp3", []byte("ID3 song"), "audio/mpeg")
+	tp.pg.AddRows("FROM user_profiles WHERE id = $1",
+		[]string{"id", "bio", "banner_hash", "audio_hash", "audio_mime_type", "audio_name", "is_private"},
+		[]any{int64(5), "", banner, song, "audio/mpeg", "My Song", false})
+
+	own := "Bearer " + testJWT("secret", "", "5", time.Now().Add(time.Hour))
+	other := "Bearer " + testJWT("secret", "", "6", time.Now().Add(time.Hour))
+	for _, tc := range []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"someone else", []string{"Authorization", other}, http.StatusForbidden},
+	} {
+		if resp, _ := tp.get(t, http.MethodGet, "/profiles/5/export.zip", tc.headers...); resp.StatusCode != tc.status {
+			t.Errorf("%s export status = %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+
+	resp, body := tp.get(t, http.MethodGet, "/profiles/5/export.zip", "Authorization", own)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" ||
+		resp.Header.Get("Content-Disposition") != `attachment; filename="profile-5.zip"` || !strings.Contains(resp.Header.Get("Cache-Control"), "private") {
+		t.Fatalf("export = %d %v, want a private zip attachment", resp.StatusCode, resp.Header)
+	}
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(data)
+		if f.Method != zip.Store {
+			t.Errorf("%s compressed with method %d, want stored", f.Name, f.Method)
+		}
+	}
+	// images as uploaded, and the song under its own name
+	if want := map[string]string{"avatar.png": "uploaded avatar", "banner.webp": "banner", "My Song.mp3": "ID3 song"}; !maps.Equal(got, want) {
+		t.Errorf("export holds %v, want %v", got, want)
+	}
+
+	tp.get(t, http.MethodGet, "/profiles/5/export.zip", "Authorization", own)
+	resp, _ = tp.get(t, http.MethodGet, "/profiles/5/export.zip", "Authorization", own)
+	if retry, _ := strconv.Atoi(resp.Header.Get("Retry-After")); resp.StatusCode != http.StatusTooManyRequests || retry <= 0 {
+		t.Errorf("third export = %d, Retry-After %q, want 429 until the hour is up", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	features["exports"].Store(false)
+	t.Cleanup(func() { features["exports"].Store(true) })
+	if resp, _ := tp.get(t, http.MethodGet, "/profiles/5/export.zip", "Authorization", own); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("with exports off, status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestWaveform(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	song := []byte("ID3 song")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", song, "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	// ffmpeg stands in as a script that decodes to two seconds of PCM, the
+	// first at half volume and the second at full
+	dir := t.TempDir()
+	pcm := make([]byte, 0, 2*2*waveformSampleRate)
+	for i := range 2 * waveformSampleRate {
+		sample := uint16(math.MaxInt16 / 2)
+		if i >= waveformSampleRate {
+			sample = math.MaxInt16
+		}
+		pcm = binary.LittleEndian.AppendUint16(pcm, sample)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pcm"), pcm, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\ncat > " + dir + "/input\necho run >> " + dir + "/runs\ncat " + dir + "/pcm\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &ffmpegPath, filepath.Join(dir, "ffmpeg"))
+
+	path := "/songs/1/" + hash + "/waveform.json?peaks=16"
+	resp, body := tp.get(t, http.MethodGet, path)
+	var got waveform
+	if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("waveform = %d %s, want 200 JSON", resp.StatusCode, body)
+	}
+	want := waveform{Duration: 2, Peaks: []float64{0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 1, 1, 1, 1, 1, 1, 1, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("waveform = %+v, want %+v", got, want)
+	}
+	if input, _ := os.ReadFile(filepath.Join(dir, "input")); !bytes.Equal(input, song) {
+		t.Errorf("ffmpeg was fed %q, want the song", input)
+	}
+
+	// drawn once, then served from Valkey or the client's copy
+	if _, again := tp.get(t, http.MethodGet, path); again != body {
+		t.Errorf("second waveform = %s, want the first", again)
+	}
+	if resp, _ := tp.get(t, http.MethodGet, path, "If-None-Match", resp.Header.Get("ETag")); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want 304", resp.StatusCode)
+	}
+	if runs, _ := os.ReadFile(filepath.Join(dir, "runs")); strings.Count(string(runs), "run") != 1 {
+		t.Errorf("ffmpeg ran %d times, want once", strings.Count(string(runs), "run"))
+	}
+	if !tp.redis.Exists(waveformKey("1", hash, 16)) {
+		t.Error("waveform not kept in Valkey")
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/songs/1/" + hash + "/waveform.json?peaks=8", http.StatusBadRequest},
+		{"/songs/1/" + testHash("b") + "/waveform.json", http.StatusNotFound},
+	} {
+		if resp, _ := tp.get(t, http.MethodGet, tc.path); resp.StatusCode != tc.status {
+			t.Errorf("%s status = %d, want %d", tc.path, resp.StatusCode, tc.status)
+		}
+	}
+	swap(t, &ffmpegPath, "")
+	if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+"/waveform.json"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("waveform without ffmpeg status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestChunkManifest(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &chunkSize, 4)
+	hash := testHash("a")
+	song := "ID3 song data"
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte(song), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	resp, body := tp.get(t, http.MethodGet, "/songs/1/"+hash+"/chunks.json")
+	var m chunkManifest
+	if err := json.Unmarshal([]byte(body), &m); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("manifest = %d %s, want 200 JSON", resp.StatusCode, body)
+	}
+	obj, _ := tp.s3.Object(testBucket, "songs/1/"+hash+".mp3")
+	if m.Path != "/songs/1/"+hash+".mp3" || m.Size != int64(len(song)) || m.ETag != obj.ETag || m.ChunkSize != 4 || len(m.Chunks) != 4 {
+		t.Fatalf("manifest = %+v, want four chunks of the song", m)
+	}
+
+	// each chunk is a range of the song's own URL that matches its hash
+	var whole strings.Builder
+	for _, c := range m.Chunks {
+		resp, data := tp.get(t, http.MethodGet, m.Path, "Range", fmt.Sprintf("bytes=%d-%d", c.Offset, c.Offset+c.Length-1))
+		sum := sha256.Sum256([]byte(data))
+		if resp.StatusCode != http.StatusPartialContent || hex.EncodeToString(sum[:]) != c.SHA256 {
+			t.Errorf("chunk %+v = %d %q, doesn't match its hash", c, resp.StatusCode, data)
+		}
+		whole.WriteString(data)
+	}
+	if whole.String() != song {
+		t.Errorf("chunks join to %q, want the song", whole.String())
+	}
+
+	if !tp.redis.Exists(chunkManifestKey("1", hash)) {
+		t.Error("manifest not kept in Valkey")
+	}
+	if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+hash+"/chunks.json", "If-None-Match", resp.Header.Get("ETag")); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want 304", resp.StatusCode)
+	}
+	if resp, _ := tp.get(t, http.MethodGet, "/songs/1/"+testHash("b")+"/chunks.json"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("manifest of another song status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDefaultAvatars(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &defaultAvatars, true)
+	missing := testHash("a")
+	stored, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 16, 16)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/3/"+testHash("b")+".webp", stored, "image/webp")
+
+	identicon := func(path string, width, height int) string {
+		t.Helper()
+		resp, body := tp.get(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Default-Avatar") != "true" || resp.Header.Get("Cache-Control") != defaultAvatarCacheControl {
+			t.Fatalf("%s = %d %v, want an identicon", path, resp.StatusCode, resp.Header)
+		}
+		img, err := decodeImage(strings.NewReader(body))
+		if err != nil || img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+			t.Fatalf("%s isn't a %dx%d image: %v", path, width, height, err)
+		}
+		return body
+	}
+
+	// the same user always gets the same picture, and others another
+	first := identicon("/avatars/3/"+missing, defaultAvatarSize, defaultAvatarSize)
+	if again := identicon("/avatars/3/"+testHash("c"), defaultAvatarSize, defaultAvatarSize); again != first {
+		t.Error("user 3's identicon changed between avatars")
+	}
+	if other := identicon("/avatars/4/"+missing, defaultAvatarSize, defaultAvatarSize); other == first {
+		t.Error("users 3 and 4 got the same identicon")
+	}
+	// transforms are drawn at the size asked for
+	identicon("/avatars/3/"+missing+"?crop=64x32&format=png", 64, 32)
+
+	// only missing avatars get one
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/3/"+testHash("b")); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Default-Avatar") != "" {
+		t.Errorf("stored avatar = %d %v, want it served", resp.StatusCode, resp.Header)
+	}
+	if resp, _ := tp.get(t, http.MethodGet, "/banners/3/"+missing); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing banner status = %d, want 404", resp.StatusCode)
+	}
+	swap(t, &defaultAvatars, false)
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/3/"+testHash("d")); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("with default avatars off, status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSongExcerpts(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	song := "ID3 the whole song"
+	path := "/songs/1/" + hash + ".mp3"
+	tp.s3.Put(testBucket, strings.TrimPrefix(path, "/"), []byte(song), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+
+	// ffmpeg stands in as a script that notes its arguments and answers with
+	// a fixed excerpt, or nothing for a start past the end of the track
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$*\" >> " + dir + "/runs\ncat > " + dir + "/input\n" +
+		"case \"$*\" in *\"-ss 900 \"*) exit 0;; esac\nprintf EXCERPT\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &ffmpegPath, filepath.Join(dir, "ffmpeg"))
+
+	for range 2 {
+		resp, body := tp.get(t, http.MethodGet, path+"?t=10-22.5")
+		if resp.StatusCode != http.StatusOK || body != "EXCERPT" || resp.Header.Get("Content-Type") != "audio/mpeg" {
+			t.Fatalf("excerpt = %d %q %s, want the cut as mp3", resp.StatusCode, body, resp.Header.Get("Content-Type"))
+		}
+	}
+	runs, _ := os.ReadFile(filepath.Join(dir, "runs"))
+	if lines := strings.Split(strings.TrimSpace(string(runs)), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], "-ss 10 -t 12.5 -i pipe:0 -map 0:a -c copy -f mp3 pipe:1") {
+		t.Errorf("ffmpeg ran with %q, want one stream copy of 10s to 22.5s", runs)
+	}
+	if input, _ := os.ReadFile(filepath.Join(dir, "input")); string(input) != song {
+		t.Errorf("ffmpeg was fed %q, want the song", input)
+	}
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"?t=20-10", http.StatusBadRequest},
+		{"?t=0-301", http.StatusBadRequest},
+		{"?t=900-910", http.StatusRequestedRangeNotSatisfiable},
+	} {
+		if resp, _ := tp.get(t, http.MethodGet, path+tc.query); resp.StatusCode != tc.status {
+			t.Errorf("%s status = %d, want %d", tc.query, resp.StatusCode, tc.status)
+		}
+	}
+
+	// without ffmpeg the player gets the whole song to seek in
+	swap(t, &ffmpegPath, "")
+	if resp, body := tp.get(t, http.MethodGet, path+"?t=30-40"); resp.StatusCode != http.StatusOK || body != song {
+		t.Errorf("excerpt without ffmpeg = %d %q, want the whole song", resp.StatusCode, body)
+	}
+}
+
+func TestSaveData(t *testing.T) {
+	tp := newTestProxy(t)
+	hash, other := testHash("a"), testHash("b")
+	stored, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 1024, 512)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/1/"+hash+".webp", stored, "image/webp")
+
+	for _, tc := range []struct {
+		query, saveData string
+		width           int
+	}{
+		{"", "", 1024},
+		// images without a size of their own are bounded
+		{"", "on", saveDataMaxSize},
+		{"?crop=800x400", "on", 800},
+		// lossless asks for the exact pixels, which Save-Data leaves alone
+		{"?lossless=1", "on", 1024},
+	} {
+		resp, body := tp.get(t, http.MethodGet, "/avatars/1/"+hash+tc.query, "Save-Data", tc.saveData)
+		img, err := decodeImage(strings.NewReader(body))
+		if resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("%s Save-Data %q = %d, %v, want an image", tc.query, tc.saveData, resp.StatusCode, err)
+		}
+		if img.Bounds().Dx() != tc.width {
+			t.Errorf("%s Save-Data %q is %d wide, want %d", tc.query, tc.saveData, img.Bounds().Dx(), tc.width)
+		}
+		if !slices.Contains(resp.Header.Values("Vary"), "Save-Data") {
+			t.Errorf("%s Vary = %v, want Save-Data", tc.query, resp.Header.Values("Vary"))
+		}
+	}
+
+	// songs are re-encoded once, by ffmpeg, to small AAC; when that fails the
+	// stored song is served
+	song := "ID3 the whole song"
+	for _, h := range []string{hash, other} {
+		tp.s3.Put(testBucket, "songs/1/"+h+".mp3", []byte(song), "audio/mpeg")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$*\" >> " + dir + "/runs\ncat > /dev/null\n[ -f " + dir + "/fail ] && exit 1\nprintf AAC\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &ffmpegPath, filepath.Join(dir, "ffmpeg"))
+
+	for range 2 {
+		resp, body := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3", "Save-Data", "on")
+		if resp.StatusCode != http.StatusOK || body != "AAC" || resp.Header.Get("Content-Type") != "audio/mp4" {
+			t.Fatalf("Save-Data song = %d %q %s, want the AAC copy", resp.StatusCode, body, resp.Header.Get("Content-Type"))
+		}
+		if !slices.Contains(resp.Header.Values("Vary"), "Save-Data") {
+			t.Errorf("song Vary = %v, want Save-Data", resp.Header.Values("Vary"))
+		}
+	}
+	runs, _ := os.ReadFile(filepath.Join(dir, "runs"))
+	if lines := strings.Split(strings.TrimSpace(string(runs)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "-c:a aac -b:a 64k") {
+		t.Errorf("ffmpeg ran with %q, want one 64k AAC encode", runs)
+	}
+	if _, body := tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3"); body != song {
+		t.Errorf("song without Save-Data = %q, want it as stored", body)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "fail"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := tp.get(t, http.MethodGet, "/songs/1/"+other+".mp3", "Save-Data", "on"); resp.StatusCode != http.StatusOK || body != song {
+		t.Errorf("Save-Data song with ffmpeg failing = %d %q, want it as stored", resp.StatusCode, body)
+	}
+}
+
+func TestImageMetadataStripped(t *testing.T) {
+	tp := newTestProxy(t)
+	jpgHash, pngHash := testHash("a"), testHash("b")
+
+	// a JPEG rotated by EXIF, which also holds more than it should, and
+	// a comment
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := append([]byte("Exif\x00\x00"), orientationTIFF(6)...)
+	exif = append(exif, "secret GPS position"...)
+	segment := func(marker byte, payload []byte) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{0xff, marker}, uint16(2+len(payload))), payload...)
+	}
+	withExif := slices.Concat(encoded.Bytes()[:2], segment(0xe1, exif), segment(0xfe, []byte("secret comment")), encoded.Bytes()[2:])
+	tp.s3.Put(testBucket, "avatars/1/"+jpgHash+".jpg", withExif, "image/jpeg")
+
+	// a PNG with a text chunk
+	encoded.Reset()
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 4))); err != nil {
+		t.Fatal(err)
+	}
+	text := binary.BigEndian.AppendUint32(nil, uint32(len("Comment\x00secret")))
+	text = append(text, "tEXtComment\x00secret"...)
+	text = binary.BigEndian.AppendUint32(text, crc32.ChecksumIEEE(text[4:]))
+	withText := slices.Concat(encoded.Bytes()[:33], text, encoded.Bytes()[33:])
+	tp.s3.Put(testBucket, "avatars/1/"+pngHash+".png", withText, "image/png")
+
+	resp, body := tp.get(t, http.MethodGet, "/avatars/1/"+jpgHash+"?format=jpg")
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "secret") {
+		t.Fatalf("jpeg = %d, secret kept: %v", resp.StatusCode, strings.Contains(body, "secret"))
+	}
+	if _, err := jpeg.Decode(strings.NewReader(body)); err != nil {
+		t.Errorf("stripped jpeg doesn't decode: %v", err)
+	}
+	// the orientation is all that's left of the EXIF
+	if i := strings.Index(body, "Exif\x00\x00"); i < 0 || exifOrientation([]byte(body[i:])) != 6 {
+		t.Error("EXIF orientation dropped with the rest")
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("Content-Length = %d for a %d byte body", resp.ContentLength, len(body))
+	}
+	// offsets into the stored file don't hold, so ranges get it all
+	if resp, whole := tp.get(t, http.MethodGet, "/avatars/1/"+jpgHash+"?format=jpg", "Range", "bytes=0-49"); resp.StatusCode != http.StatusOK || whole != body {
+		t.Errorf("range = %d with %d bytes, want the whole stripped image", resp.StatusCode, len(whole))
+	}
+
+	resp, body = tp.get(t, http.MethodGet, "/avatars/1/"+pngHash+"?format=png")
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "secret") {
+		t.Fatalf("png = %d, secret kept: %v", resp.StatusCode, strings.Contains(body, "secret"))
+	}
+	if _, err := png.Decode(strings.NewReader(body)); err != nil {
+		t.Errorf("stripped png doesn't decode: %v", err)
+	}
+
+	// routes left out of STRIP_METADATA_ROUTES are served as stored
+	swap(t, &stripMetadataRoutes, parseStripMetadataRoutes("none"))
+	if _, body := tp.get(t, http.MethodGet, "/avatars/1/"+jpgHash+"?format=jpg"); body != string(withExif) {
+		t.Error("jpeg changed with stripping off")
+	}
+}
+
+func TestGeneratedETags(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 song data"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+	waveform := `{"peaks":[` + strings.Repeat("0.5,", 400) + `0.5]}`
+	tp.redis.Set(waveformKey("1", hash, waveformPeaks), waveform)
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho run >> " + dir + "/runs\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &ffmpegPath, filepath.Join(dir, "ffmpeg"))
+
+	paths := []string{
+		"/songs/1/" + hash + "/waveform.json",
+		"/songs/1/" + hash + "/chunks.json",
+		"/metadata/songs/1/" + hash,
+	}
+	etags := map[string]string{}
+	for _, path := range paths {
+		resp, _ := tp.get(t, http.MethodGet, path, "Accept-Encoding", "gzip")
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+			t.Fatalf("%s = %d with ETag %q, want 200 with a weak one", path, resp.StatusCode, etag)
+		}
+		etags[path] = etag
+	}
+
+	// the song and everything cached from it are gone, but clients holding
+	// the tags are still answered, strong or weak
+	tp.s3.Delete(testBucket, "songs/1/"+hash+".mp3")
+	tp.redis.FlushAll()
+	for _, path := range paths[:2] {
+		for _, tag := range []string{etags[path], strings.TrimPrefix(etags[path], "W/"), `"other", ` + etags[path]} {
+			resp, body := tp.get(t, http.MethodGet, path, "If-None-Match", tag)
+			if resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etags[path] || body != "" {
+				t.Errorf("%s If-None-Match %s = %d with ETag %q, want 304 with %q", path, tag, resp.StatusCode, resp.Header.Get("ETag"), etags[path])
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != variantCacheControl {
+				t.Errorf("%s 304 Cache-Control = %q, want %q", path, cc, variantCacheControl)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "runs")); err == nil {
+		t.Error("ffmpeg ran for a waveform the client had")
+	}
+	for _, path := range paths[:2] {
+		if resp, _ := tp.get(t, http.MethodGet, path, "If-None-Match", `W/"other"`); resp.StatusCode == http.StatusNotModified {
+			t.Errorf("%s with another tag = 304, want the full response", path)
+		}
+	}
+
+	// metadata is tagged by what it says, so it changes with the song
+	meta := paths[2]
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 song data"), "audio/mpeg")
+	if resp, _ := tp.get(t, http.MethodGet, meta, "If-None-Match", etags[meta]); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("unchanged metadata status = %d, want 304", resp.StatusCode)
+	}
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 longer song data"), "audio/mpeg")
+	resp, _ := tp.get(t, http.MethodGet, meta, "If-None-Match", etags[meta])
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etags[meta] {
+		t.Errorf("changed metadata = %d with ETag %q, want 200 with a new tag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// placeholders are tagged by their kind
+	imgHash := testHash("b")
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 8, 8)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/1/"+imgHash+".webp", original, "image/webp")
+	blurhash, _ := tp.get(t, http.MethodGet, "/avatars/1/"+imgHash+"?placeholder=blurhash")
+	preview, _ := tp.get(t, http.MethodGet, "/avatars/1/"+imgHash+"?placeholder=image")
+	if tag := blurhash.Header.Get("ETag"); !strings.HasPrefix(tag, `W/"`) || tag == preview.Header.Get("ETag") {
+		t.Errorf("placeholder ETags = %q and %q, want distinct weak tags", tag, preview.Header.Get("ETag"))
+	}
+	tp.s3.Delete(testBucket, "avatars/1/"+imgHash+".webp")
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+imgHash+"?placeholder=blurhash", "If-None-Match", blurhash.Header.Get("ETag")); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("placeholder revalidation status = %d, want 304", resp.StatusCode)
+	}
+}
+
+func TestServeHTTPS(t *testing.T) {
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 song"), "audio/mpeg")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+	path := "/songs/1/" + hash + ".mp3"
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	roots := x509.NewCertPool()
+	roots.AddCert(writeTestCert(t, certFile, keyFile, "first"))
+
+	// QUIC and TLS share the port, as they do in production
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udp.LocalAddr().String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		t.Skipf("TCP port of %s is taken: %v", addr, err)
+	}
+	srv, h3, err := publicServers(listenConfig{addr: addr, certFile: certFile, keyFile: keyFile, http3: true, altSvcMaxAge: time.Hour}, tp.Config.Handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.ReadHeaderTimeout != readHeaderTimeout || srv.IdleTimeout != idleTimeout || h3.IdleTimeout != idleTimeout || srv.ConnState == nil {
+		t.Error("public servers lack the listener timeouts or connection counting")
+	}
+	go srv.ServeTLS(ln, "", "")
+	go h3.Serve(udp)
+	t.Cleanup(func() {
+		srv.Close()
+		h3.Close()
+		udp.Close()
+	})
+
+	get := func(rt http.RoundTripper) *http.Response {
+		t.Helper()
+
+		resp, err := (&http.Client{Transport: rt}).Get("https://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ID3 song" {
+			t.Fatalf("HTTP/%d song = %d %q, want the song", resp.ProtoMajor, resp.StatusCode, body)
+		}
+
+		return resp
+	}
+	tcp := func() *http.Transport {
+		return &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	resp := get(tcp())
+	if resp.ProtoMajor != 2 {
+		t.Errorf("TLS protocol = %s, want HTTP/2", resp.Proto)
+	}
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":`+port+`"; ma=3600`; got != want {
+		t.Errorf("Alt-Svc = %q, want %q", got, want)
+	}
+
+	quic := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer quic.Close()
+	if resp := get(quic); resp.ProtoMajor != 3 || resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("QUIC = %s with Alt-Svc %q, want HTTP/3 without", resp.Proto, resp.Header.Get("Alt-Svc"))
+	}
+
+	// a renewed certificate is served to new connections
+	swap(t, &certCheckInterval, 0)
+	roots.AddCert(writeTestCert(t, certFile, keyFile, "second"))
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if cn := get(tcp()).TLS.PeerCertificates[0].Subject.CommonName; cn != "second" {
+		t.Errorf("certificate after renewal = %q, want second", cn)
+	}
+
+	// the advertised port can differ from the listener's, behind a proxy
+	if got, err := altSvcHeader(listenConfig{addr: ":5000", altSvcPort: 443, altSvcMaxAge: defaultAltSvcMaxAge}); got != `h3=":443"; ma=86400` || err != nil {
+		t.Errorf("Alt-Svc with a port = %q, %v", got, err)
+	}
+	if _, err := altSvcHeader(listenConfig{addr: "localhost"}); err == nil {
+		t.Error("Alt-Svc for an address without a port succeeded")
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 named cn,
+// and its key, returning the certificate.
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestSLOs(t *testing.T) {
+	for _, tc := range []struct {
+		name, file, err string
+	}{
+		{"empty", `{"songs": null}`, "SLO is empty"},
+		{"no objective", `{"songs": {"priority": 1}}`, "needs an availability or latency objective"},
+		{"whole", `{"songs": {"availability": 100}}`, "percentages below 100"},
+		{"no threshold", `{"songs": {"latency": 99}}`, "latency_threshold"},
+		{"short window", `{"songs": {"availability": 99, "window": "90s"}}`, "whole minutes"},
+	} {
+		path := filepath.Join(t.TempDir(), "slos.json")
+		if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSLOs(path); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.err)
+		}
+	}
+
+	tp := newTestProxy(t)
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 song"), "audio/mpeg")
+	tp.s3.Put(testBucket, "avatars/1/"+hash+".webp", []byte("RIFF avatar"), "image/webp")
+	tp.addProfile(1, hash, "audio/mpeg", "Tune.mp3")
+	song, avatar := "/songs/1/"+hash+".mp3", "/avatars/1/"+hash
+
+	path := filepath.Join(t.TempDir(), "slos.json")
+	file := `{
+		"songs": {"availability": 99.9, "priority": 2},
+		"avatars": {"latency": 99, "latency_threshold": "1s", "window": "30m", "priority": 1}
+	}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadSLOs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &slos, loaded)
+	swap(t, &sloShedBurnRate, 10)
+	t.Cleanup(func() { shedding.Store(nil) })
+
+	type report struct {
+		Routes map[string]struct {
+			Window     string
+			Priority   int
+			Objectives []sloReport
+		}
+		Shedding *struct {
+			Burning       string
+			BelowPriority int `json:"below_priority"`
+		}
+	}
+	status := func() report {
+		t.Helper()
+
+		resp, body := tp.admin(t, http.MethodGet, "/admin/slos", nil)
+		var got report
+		if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("slos = %d %s, want 200 JSON", resp.StatusCode, body)
+		}
+
+		return got
+	}
+
+	for range 5 {
+		tp.get(t, http.MethodGet, song)
+	}
+	tp.get(t, http.MethodGet, avatar)
+	evaluateSLOs(time.Now())
+	got := status()
+	songs, avatars := got.Routes["songs"], got.Routes["avatars"]
+	if len(songs.Objectives) != 1 || songs.Objectives[0].Objective != "availability" || songs.Objectives[0].Requests != 5 || songs.Objectives[0].Compliance != 1 {
+		t.Errorf("healthy songs = %+v, want 5 requests all available", songs)
+	}
+	if avatars.Window != "30m0s" || len(avatars.Objectives) != 1 || avatars.Objectives[0].Objective != "latency" || avatars.Objectives[0].Requests != 1 {
+		t.Errorf("avatars = %+v, want one request against the latency objective", avatars)
+	}
+	if got.Shedding != nil {
+		t.Errorf("shedding while healthy: %+v", got.Shedding)
+	}
+
+	// songs fail fast enough to burn their budget, and routes of lower
+	// priority make way
+	tp.s3.Fail(1000, http.StatusInternalServerError, "InternalError")
+	// a song never fetched, so there's no stale copy to fall back on
+	unfetched := "/songs/1/" + testHash("b") + ".mp3"
+	for range sloShedMinRequests {
+		if resp, _ := tp.get(t, http.MethodGet, unfetched); resp.StatusCode < 500 {
+			t.Fatalf("failing song status = %d, want 5xx", resp.StatusCode)
+		}
+	}
+	evaluateSLOs(time.Now())
+	if remaining := metricValue(t, "cdn_proxy_slo_error_budget_remaining_ratio", "route", "songs", "objective", "availability"); remaining >= 0 {
+		t.Errorf("songs budget remaining = %v, want overspent", remaining)
+	}
+	if rate := metricValue(t, "cdn_proxy_slo_burn_rate", "route", "songs", "objective", "availability", "window", "fast"); rate <= 10 {
+		t.Errorf("songs fast burn rate = %v, want over 10", rate)
+	}
+
+	before := metricValue(t, "cdn_proxy_shed_requests_total", "route", "avatars", "burning", "songs")
+	for _, path := range []string{avatar, "/banners/1/" + hash} {
+		resp, body := tp.get(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "overloaded") || resp.Header.Get("Retry-After") != "10" {
+			t.Errorf("%s while songs burn = %d %s, want 503 overloaded", path, resp.StatusCode, body)
+		}
+	}
+	if after := metricValue(t, "cdn_proxy_shed_requests_total", "route", "avatars", "burning", "songs"); after-before != 1 {
+		t.Errorf("shed avatar requests = %v, want 1", after-before)
+	}
+	if _, body := tp.get(t, http.MethodGet, song); strings.Contains(body, "overloaded") {
+		t.Error("the burning route shed its own requests")
+	}
+
+	got = status()
+	if got.Shedding == nil || got.Shedding.Burning != "songs" || got.Shedding.BelowPriority != 2 {
+		t.Errorf("shedding = %+v, want below priority 2 for songs", got.Shedding)
+	}
+	// shed requests don't count against the route's own objectives
+	if n := got.Routes["avatars"].Objectives[0].Requests; n != 1 {
+		t.Errorf("avatar requests counted = %d, want 1", n)
+	}
+
+	// shedding only looks at the last few minutes
+	evaluateSLOs(time.Now().Add(sloShedWindow + time.Minute))
+	if got := status(); got.Shedding != nil {
+		t.Errorf("shedding after the burn = %+v, want none", got.Shedding)
+	}
+}
+
+func TestProfileManifest(t *testing.T) {
+	tp := newTestProxy(t)
+	tp.enableUploads(t)
+	swap(t, &prefetchManifests, true)
+	swap(t, &publicHandler, tp.Config.Handler)
+	t.Cleanup(func() {
+		recentPrefetches.Lock()
+		clear(recentPrefetches.at)
+		recentPrefetches.Unlock()
+	})
+
+	avatar, banner, song := testHash("a"), testHash("b"), testHash("c")
+	tp.s3.Put(testBucket, "avatars/1/"+avatar+".webp", []byte("RIFF avatar"), "image/webp")
+	tp.s3.Put(testBucket, "banners/1/"+banner+".webp", []byte("RIFF banner"), "image/webp")
+	tp.s3.Put(testBucket, "songs/1/"+song+".mp3", []byte("ID3 song"), "audio/mpeg")
+	tp.pg.AddRows("FROM user_profiles WHERE id = $1",
+		[]string{"id", "bio", "banner_hash", "audio_hash", "audio_mime_type", "audio_name", "is_private"},
+		[]any{int64(1), "", banner, song, "audio/mpeg", "Tune.mp3", false})
+
+	resp, body := tp.get(t, http.MethodGet, "/profiles/1/manifest.json")
+	var got profileManifest
+	if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("manifest = %d %s, want 200 JSON", resp.StatusCode, body)
+	}
+	want := profileManifest{UserID: "1", Avatar: "/avatars/1/" + avatar, Banner: "/banners/1/" + banner, Song: "/songs/1/" + song + ".mp3"}
+	if got != want {
+		t.Errorf("manifest = %+v, want %+v", got, want)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", cc)
+	}
+	if again, _ := tp.get(t, http.MethodGet, "/profiles/1/manifest.json", "If-None-Match", resp.Header.Get("ETag")); again.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want 304", again.StatusCode)
+	}
+
+	// the images are warmed without the page asking, but the song isn't
+	waitFor(t, "the images to be prefetched", func() bool {
+		return tp.s3.Requests(http.MethodGet, "/"+testBucket+"/avatars/1/"+avatar+".webp") > 0 &&
+			tp.s3.Requests(http.MethodGet, "/"+testBucket+"/banners/1/"+banner+".webp") > 0
+	})
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/songs/1/"+song+".mp3"); n != 0 {
+		t.Errorf("song fetched %d times, want it left to the player", n)
+	}
+	// and only once a minute
+	tp.s3.ResetRequests()
+	prefetchManifest([]string{want.Avatar, want.Banner})
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/avatars/1/"+avatar+".webp"); n != 0 {
+		t.Errorf("avatar prefetched again %d times within a minute", n)
+	}
+
+	// the avatar listing is kept until the profile changes
+	if hash, _ := tp.redis.Get(avatarCacheKey("1")); hash != avatar {
+		t.Errorf("cached avatar = %q, want %q", hash, avatar)
+	}
+	tp.s3.Delete(testBucket, "avatars/1/"+avatar+".webp")
+	if _, body := tp.get(t, http.MethodGet, "/profiles/1/manifest.json"); !strings.Contains(body, avatar) {
+		t.Errorf("manifest before invalidation = %s, want the cached avatar", body)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		subscribeProfileInvalidations(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the invalidation subscription", func() bool {
+		return tp.redis.PubSubNumSub(profileInvalidateChannel)[profileInvalidateChannel] == 1
+	})
+	tp.redis.Publish(profileInvalidateChannel, "1")
+	waitFor(t, "the avatar to be evicted", func() bool { return !tp.redis.Exists(avatarCacheKey("1")) })
+	if _, body := tp.get(t, http.MethodGet, "/profiles/1/manifest.json"); strings.Contains(body, avatar) {
+		t.Errorf("manifest after invalidation = %s, want no avatar", body)
+	}
+
+	if resp, _ := tp.get(t, http.MethodGet, "/profiles/x/manifest.json"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bad id status = %d, want 404", resp.StatusCode)
+	}
+
+	// a private profile's images need the viewer's session, so a viewer
+	// allowed to see the manifest doesn't get them prefetched
+	tp.addPrivateProfile(2)
+	setSecrets(t, "SESSION_JWT_SECRET", "session-secret")
+	validator, err := newSessionValidator(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap(t, &sessions, validator)
+	tp.s3.Put(testBucket, "avatars/2/"+avatar+".webp", []byte("RIFF avatar"), "image/webp")
+	tp.s3.ResetRequests()
+	if resp, _ := tp.get(t, http.MethodGet, "/profiles/2/manifest.json"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("private manifest without a session = %d, want 403", resp.StatusCode)
+	}
+	token := testJWT("session-secret", "", "2", time.Now().Add(time.Hour))
+	resp, body = tp.get(t, http.MethodGet, "/profiles/2/manifest.json", "Authorization", "Bearer "+token)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"private":true`) {
+		t.Fatalf("private manifest = %d %s, want 200 marked private", resp.StatusCode, body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/avatars/2/"+avatar+".webp"); n != 0 {
+		t.Errorf("private avatar prefetched %d times", n)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &postgresBreaker, newCircuitBreaker("postgres", 3, time.Minute))
+	swap(t, &blocklistKey, "ip:blocklist")
+	old := blocklist.Load()
+	t.Cleanup(func() { blocklist.Store(old) })
+
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 16)
+	var statuses atomic.Value
+	statuses.Store([]int{http.StatusServiceUnavailable})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header.Clone(), body}
+		// answers with the queued statuses, then 200s
+		if queued := statuses.Load().([]int); len(queued) > 0 {
+			statuses.Store(queued[1:])
+			w.WriteHeader(queued[0])
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	swap(t, &webhookURL, receiver.URL)
+	swap(t, &webhookQueue, make(chan webhookEvent, webhookQueueSize))
+	setSecrets(t, "WEBHOOK_SECRET", "hook-secret")
+	t.Cleanup(func() {
+		webhookSent.Lock()
+		clear(webhookSent.at)
+		webhookSent.Unlock()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runWebhooks(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	next := func() webhookEvent {
+		t.Helper()
+
+		select {
+		case d := <-deliveries:
+			ts := d.header.Get("X-Timestamp")
+			mac := hmac.New(sha256.New, []byte("hook-secret"))
+			mac.Write([]byte(ts + "." + string(d.body)))
+			if got, want := d.header.Get("X-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+				t.Errorf("X-Signature = %q, want %q", got, want)
+			}
+			var event webhookEvent
+			if err := json.Unmarshal(d.body, &event); err != nil {
+				t.Fatal(err)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a webhook")
+		}
+		return webhookEvent{}
+	}
+
+	// the breaker opening is reported, the first attempt's 503 retried
+	sent := metricValue(t, "cdn_proxy_webhook_deliveries_total", "type", "circuit_open", "result", "sent")
+	hash := testHash("a")
+	tp.s3.Put(testBucket, "songs/1/"+hash+".mp3", []byte("ID3 song"), "audio/mpeg")
+	tp.pg.Fail(errors.New("connection refused"))
+	for range 3 {
+		tp.get(t, http.MethodGet, "/songs/1/"+hash+".mp3")
+	}
+	first, retried := next(), next()
+	if first.Type != "circuit_open" || first.Details["breaker"] != "postgres" || first.Replica != replicaName || !strings.Contains(first.Text, "postgres") {
+		t.Errorf("event = %+v, want the postgres breaker opening", first)
+	}
+	if retried.Type != first.Type || !retried.Time.Equal(first.Time) {
+		t.Errorf("retry = %+v, want the same event", retried)
+	}
+	waitFor(t, "the delivery to be counted", func() bool {
+		return metricValue(t, "cdn_proxy_webhook_deliveries_total", "type", "circuit_open", "result", "sent")-sent == 1
+	})
+
+	// repeats within the cooldown are held back, other subjects aren't
+	for _, cidr := range []string{"198.51.100.0/24", "198.51.100.0/24", "203.0.113.7"} {
+		if resp, body := tp.admin(t, http.MethodPost, "/admin/blocklist", strings.NewReader(`{"cidr": "`+cidr+`"}`)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("block %s = %d %s", cidr, resp.StatusCode, body)
+		}
+	}
+	for _, want := range []string{"198.51.100.0/24", "203.0.113.7/32"} {
+		if event := next(); event.Type != "ip_blocked" || event.Details["cidr"] != want {
+			t.Errorf("event = %+v, want %s blocked", event, want)
+		}
+	}
+
+	// a refusal isn't retried
+	failed := metricValue(t, "cdn_proxy_webhook_deliveries_total", "type", "ip_blocked", "result", "failed")
+	statuses.Store([]int{http.StatusBadRequest})
+	tp.admin(t, http.MethodPost, "/admin/blocklist", strings.NewReader(`{"cidr": "192.0.2.1"}`))
+	next()
+	waitFor(t, "the failure to be counted", func() bool {
+		return metricValue(t, "cdn_proxy_webhook_deliveries_total", "type", "ip_blocked", "result", "failed")-failed == 1
+	})
+	select {
+	case d := <-deliveries:
+		t.Errorf("refused webhook sent again: %s", d.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tp := newTestProxy(t)
+
+	type report struct {
+		Status      string
+		Checks      map[string]limitCheck
+		Cache       map[string]any
+		Connections map[string]int64
+	}
+	limits := func() report {
+		t.Helper()
+
+		resp, body := tp.admin(t, http.MethodGet, "/admin/limits", nil)
+		var got report
+		if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("limits = %d %s, want 200 JSON", resp.StatusCode, body)
+		}
+
+		return got
+	}
+
+	got := limits()
+	for _, name := range []string{"goroutines", "file_descriptors", "memory", "cache_disk"} {
+		if c, ok := got.Checks[name]; !ok || c.Status == "unknown" {
+			t.Errorf("%s check = %+v, want it measured", name, c)
+		}
+	}
+	if c := got.Checks["goroutines"]; c.Used < 1 || c.Limit != float64(maxGoroutines) {
+		t.Errorf("goroutines = %+v, want measured against %d", c, maxGoroutines)
+	}
+	if got.Status != "ok" || got.Cache["refusing_writes"] != nil {
+		t.Errorf("limits = %+v, want ok", got)
+	}
+
+	// the worst check decides the status
+	swap(t, &maxGoroutines, 1)
+	if got := limits(); got.Status != "critical" || got.Checks["goroutines"].Status != "critical" {
+		t.Errorf("over the goroutine limit = %s with %+v, want critical", got.Status, got.Checks["goroutines"])
+	}
+	swap(t, &maxGoroutines, defaultMaxGoroutines)
+
+	// the connections the public listener and the upstream transport hold
+	inbound, upstream := inboundConns.Load(), upstreamConns.Load()
+	public := httptest.NewUnstartedServer(tp.Config.Handler)
+	public.Config.ConnState = trackInbound
+	public.Start()
+	defer public.Close()
+	transport := &http.Transport{}
+	countUpstreamConns(transport)
+	for _, get := range []struct {
+		client *http.Client
+		url    string
+	}{
+		{public.Client(), public.URL + "/metrics"},
+		{&http.Client{Transport: transport}, tp.s3.URL + "/" + testBucket + "/missing"},
+	} {
+		resp, err := get.client.Get(get.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	waitFor(t, "the connections to be counted", func() bool {
+		conns := limits().Connections
+		return conns["inbound"]-inbound == 1 && conns["upstream"]-upstream == 1
+	})
+	public.Client().CloseIdleConnections()
+	transport.CloseIdleConnections()
+	waitFor(t, "the connections to close", func() bool {
+		conns := limits().Connections
+		return conns["inbound"] == inbound && conns["upstream"] == upstream
+	})
+
+	// under the free space floor, variants are served but not cached
+	variantCache.minFreePercent = 99.999
+	hash := testHash("a")
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "emojis/9/"+hash+".webp", original, "image/webp")
+	refused := metricValue(t, "cdn_proxy_cache_writes_refused_total")
+	if resp, _ := tp.get(t, http.MethodGet, "/emojis/9/"+hash+"?size=64"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("variant with the disk low = %d, want 200", resp.StatusCode)
+	}
+	// the original's copy and the variant
+	if n := metricValue(t, "cdn_proxy_cache_writes_refused_total") - refused; n != 2 {
+		t.Errorf("refused writes = %v, want 2", n)
+	}
+	entries := 0
+	filepath.WalkDir(variantCache.dir, func(_ string, d fs.DirEntry, _ error) error {
+		if d != nil && !d.IsDir() {
+			entries++
+		}
+		return nil
+	})
+	if entries != 0 {
+		t.Errorf("%d variants cached with the disk low", entries)
+	}
+	got = limits()
+	if got.Status != "critical" || got.Checks["cache_disk"].Status != "critical" || got.Cache["refusing_writes"] != true {
+		t.Errorf("limits with the disk low = %+v, want the cache disk critical and refusing", got)
+	}
+}
+
+func TestBucketEvents(t *testing.T) {
+	tp := newTestProxy(t)
+	swap(t, &publicHandler, tp.Config.Handler)
+	avatar, missing := testHash("a"), testHash("b")
+	original, err := encodeImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.s3.Put(testBucket, "avatars/1/"+avatar+".webp", original, "image/webp")
+
+	cached := func() int {
+		n := 0
+		filepath.WalkDir(variantCache.dir, func(_ string, d fs.DirEntry, _ error) error {
+			if d != nil && !d.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	event := func(name, bucket, key string) string {
+		return `{"eventName": "` + name + `", "s3": {"bucket": {"name": "` + bucket + `"}, "object": {"key": "` + url.QueryEscape(key) + `"}}}`
+	}
+	post := func(records ...string) {
+		t.Helper()
+
+		resp, body := tp.admin(t, http.MethodPost, "/admin/bucket-events", strings.NewReader(`{"Records": [`+strings.Join(records, ",")+`]}`))
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("bucket events = %d %s, want 204", resp.StatusCode, body)
+		}
+	}
+
+	// a variant and where the original is are cached, and a 404 remembered
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+avatar+"?size=64"); resp.StatusCode != http.StatusOK || cached() == 0 {
+		t.Fatalf("variant = %d with %d cached, want 200 and cached", resp.StatusCode, cached())
+	}
+	tp.redis.Set(originalExtKey("avatars", "1", avatar), "png")
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+missing); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing avatar = %d, want 404", resp.StatusCode)
+	}
+
+	// an avatar written over purges what was cached, and warms the
+	// configured variants
+	swap(t, &warmAvatarQueries, []string{"size=32"})
+	created := metricValue(t, "cdn_proxy_bucket_events_total", "action", "created")
+	tp.s3.ResetRequests()
+	post(event("s3:ObjectCreated:Put", testBucket, "avatars/1/"+avatar+".webp"))
+	// warming looks the original up afresh
+	if ext, _ := tp.redis.Get(originalExtKey("avatars", "1", avatar)); ext == "png" {
+		t.Error("original's old extension still cached")
+	}
+	if n := tp.s3.Requests(http.MethodGet, "/"+testBucket+"/avatars/1/"+avatar+".webp"); n != 1 {
+		t.Errorf("original fetched %d times, want once to warm", n)
+	}
+	tp.s3.ResetRequests()
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+avatar+"?size=64"); resp.StatusCode != http.StatusOK || tp.s3.Requests(http.MethodGet, "/"+testBucket+"/avatars/1/"+avatar+".webp") != 1 {
+		t.Errorf("purged variant = %d, want it rendered again from the original", resp.StatusCode)
+	}
+	tp.s3.ResetRequests()
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+avatar+"?size=32"); resp.StatusCode != http.StatusOK || tp.s3.Requests(http.MethodGet, "/"+testBucket+"/avatars/1/"+avatar+".webp") != 0 {
+		t.Errorf("warmed variant = %d, want it served from the cache", resp.StatusCode)
+	}
+
+	// the missing avatar arriving is served straight away
+	tp.s3.Put(testBucket, "avatars/1/"+missing+".webp", original, "image/webp")
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+missing); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("remembered missing avatar = %d, want 404", resp.StatusCode)
+	}
+	post(event("s3:ObjectCreated:CompleteMultipartUpload", testBucket, "avatars/1/"+missing+".webp"))
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+missing); resp.StatusCode != http.StatusOK {
+		t.Errorf("missing avatar after it was written = %d, want 200", resp.StatusCode)
+	}
+	if n := metricValue(t, "cdn_proxy_bucket_events_total", "action", "created") - created; n != 2 {
+		t.Errorf("created events = %v, want 2", n)
+	}
+
+	// removals purge too, and the rest is ignored
+	removed := metricValue(t, "cdn_proxy_bucket_events_total", "action", "removed")
+	ignored := metricValue(t, "cdn_proxy_bucket_events_total", "action", "ignored")
+	tp.s3.Delete(testBucket, "avatars/1/"+avatar+".webp")
+	post(
+		event("s3:ObjectRemoved:Delete", testBucket, "avatars/1/"+avatar+".webp"),
+		event("s3:ObjectCreated:Put", "other", "avatars/1/"+avatar+".webp"),
+		event("s3:ObjectAccessed:Get", testBucket, "avatars/1/"+avatar+".webp"),
+		event("s3:ObjectCreated:Put", testBucket, "unrouted/"+avatar),
+	)
+	if resp, _ := tp.get(t, http.MethodGet, "/avatars/1/"+avatar+"?size=64"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("variant after the avatar was removed = %d, want 404", resp.StatusCode)
+	}
+	if n := metricValue(t, "cdn_proxy_bucket_events_total", "action", "removed") - removed; n != 1 {
+		t.Errorf("removed events = %v, want 1", n)
+	}
+	if n := metricValue(t, "cdn_proxy_bucket_events_total", "action", "ignored") - ignored; n != 3 {
+		t.Errorf("ignored events = %v, want 3", n)
+	}
+	if resp, _ := tp.admin(t, http.MethodPost, "/admin/bucket-events", strings.NewReader("not json")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed events = %d, want 400", resp.StatusCode)
+	}
+
+	// MinIO's redis target pushes the same records, in the access format
+	swap(t, &bucketEventsKey, "bucket-events")
+	// BLPOP waits a second at least
+	swap(t, &bucketEventsPollTimeout, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumeBucketEvents(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	tp.redis.Set(originalExtKey("avatars", "1", missing), "png")
+	tp.redis.Lpush(bucketEventsKey, `[{"Event": [`+event("s3:ObjectCreated:Put", testBucket, "avatars/1/"+missing+".webp")+`], "EventTime": "2026-10-15T00:00:00Z"}]`)
+	waitFor(t, "the queued event to be handled", func() bool {
+		ext, _ := tp.redis.Get(originalExtKey("avatars", "1", missing))
+		return ext != "png"
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+// adam7 lists each pass's x/y origin and step.
+var adam7 = [7][4]int{
+	{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8},
+	{2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2},
+}
+
+// encodeInterlacedPNG writes an Adam7-interlaced 8-bit PNG, RGB when img is
+// opaque and RGBA otherwise. image/png only writes non-interlaced files.
+func encodeInterlacedPNG(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	bpp, colorType := 4, byte(6)
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		bpp, colorType = 3, 2
+	}
+
+	var idat bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&idat, zlib.BestCompression)
+
+	for _, pass := range adam7 {
+		x0, y0, dx, dy := pass[0], pass[1], pass[2], pass[3]
+		if x0 >= width || y0 >= height {
+			continue
+		}
+
+		rowLen := (width - x0 + dx - 1) / dx * bpp
+		prev, cur := make([]byte, rowLen), make([]byte, rowLen)
+		var filtered [5][]byte
+		for f := range filtered {
+			filtered[f] = make([]byte, rowLen+1)
+		}
+
+		for y := y0; y < height; y += dy {
+			for i, x := 0, x0; x < width; i, x = i+bpp, x+dx {
+				c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+				copy(cur[i:i+bpp], []byte{c.R, c.G, c.B, c.A}[:bpp])
+			}
+
+			zw.Write(filterRow(filtered, cur, prev, bpp))
+			prev, cur = cur, prev
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("\x89PNG\r\n\x1a\n")
+
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(width))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(height))
+	ihdr = append(ihdr, 8, colorType, 0, 0, 1)
+
+	writePNGChunk(bw, "IHDR", ihdr)
+	writePNGChunk(bw, "IDAT", idat.Bytes())
+	writePNGChunk(bw, "IEND", nil)
+
+	return bw.Flush()
+}
+
+// filterRow picks the PNG filter with the smallest sum of absolute values,
+// the heuristic the PNG spec recommends.
+func filterRow(out [5][]byte, cur, prev []byte, bpp int) []byte {
+	best, bestSum := 0, -1
+	for f := range out {
+		row := out[f]
+		row[0] = byte(f)
+		sum := 0
+
+		for i := range cur {
+			var a, c byte
+			if i >= bpp {
+				a, c = cur[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+
+			var pred byte
+			switch f {
+			case 1:
+				pred = a
+			case 2:
+				pred = up
+			case 3:
+				pred = byte((int(a) + int(up)) / 2)
+			case 4:
+				pred = paeth(a, up, c)
+			}
+
+			v := cur[i] - pred
+			row[i+1] = v
+			sum += abs(int(int8(v)))
+		}
+
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+
+	return out[best]
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	w.Write(chunk)
+}
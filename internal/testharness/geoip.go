@@ -0,0 +1,94 @@
+package testharness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"slices"
+)
+
+// GeoIP is a MaxMind DB, in the GeoLite2 Country layout, that places every
+// IPv4 address in country on continent.
+func GeoIP(country, continent string) []byte {
+	var db bytes.Buffer
+
+	// one node whose both records point at the first data entry, which is
+	// node count + 16 for the separator + offset 0
+	const nodeCount = 1
+	record := []byte{0, 0, nodeCount + 16}
+	db.Write(record)
+	db.Write(record)
+	db.Write(make([]byte, 16))
+
+	writeMap(&db, map[string]func(*bytes.Buffer){
+		"country":   mapOf(map[string]func(*bytes.Buffer){"iso_code": stringOf(country)}),
+		"continent": mapOf(map[string]func(*bytes.Buffer){"code": stringOf(continent)}),
+	})
+
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	writeMap(&db, map[string]func(*bytes.Buffer){
+		"binary_format_major_version": uintOf(5, 2),
+		"binary_format_minor_version": uintOf(5, 0),
+		"build_epoch":                 uint64Of(0),
+		"database_type":               stringOf("GeoLite2-Country"),
+		"description":                 mapOf(map[string]func(*bytes.Buffer){"en": stringOf("test database")}),
+		"ip_version":                  uintOf(5, 4),
+		"languages":                   arrayOf(stringOf("en")),
+		"node_count":                  uintOf(6, nodeCount),
+		"record_size":                 uintOf(5, 24),
+	})
+
+	return db.Bytes()
+}
+
+// The data section's encoding: a control byte with the type in its top
+// three bits and the size in the rest, types past 7 taking a second byte.
+
+func stringOf(s string) func(*bytes.Buffer) {
+	return func(b *bytes.Buffer) {
+		b.WriteByte(2<<5 | byte(len(s)))
+		b.WriteString(s)
+	}
+}
+
+func uintOf(typ byte, v uint32) func(*bytes.Buffer) {
+	return func(b *bytes.Buffer) {
+		data := binary.BigEndian.AppendUint32(nil, v)
+		for len(data) > 0 && data[0] == 0 {
+			data = data[1:]
+		}
+		b.WriteByte(typ<<5 | byte(len(data)))
+		b.Write(data)
+	}
+}
+
+func uint64Of(v uint64) func(*bytes.Buffer) {
+	return func(b *bytes.Buffer) {
+		b.WriteByte(8)
+		b.WriteByte(9 - 7)
+		b.Write(binary.BigEndian.AppendUint64(nil, v))
+	}
+}
+
+func arrayOf(items ...func(*bytes.Buffer)) func(*bytes.Buffer) {
+	return func(b *bytes.Buffer) {
+		b.WriteByte(byte(len(items)))
+		b.WriteByte(11 - 7)
+		for _, item := range items {
+			item(b)
+		}
+	}
+}
+
+func mapOf(m map[string]func(*bytes.Buffer)) func(*bytes.Buffer) {
+	return func(b *bytes.Buffer) { writeMap(b, m) }
+}
+
+func writeMap(b *bytes.Buffer, m map[string]func(*bytes.Buffer)) {
+	b.WriteByte(7<<5 | byte(len(m)))
+
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		stringOf(k)(b)
+		m[k](b)
+	}
+}
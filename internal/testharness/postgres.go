@@ -0,0 +1,286 @@
+package testharness
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Postgres is a database/sql driver that answers queries from handlers the
+// test registers, matched on a fragment of the SQL. It doesn't parse SQL;
+// it stands in for the few queries the proxy makes, with the rows a test
+// needs. A query nothing matches returns no rows, so QueryRow gets
+// sql.ErrNoRows.
+type Postgres struct {
+	mu       sync.Mutex
+	queries  []queryHandler
+	execs    []execHandler
+	recorded []Query
+	err      error
+
+	db *sql.DB
+}
+
+// Query is a statement the proxy ran, with its arguments.
+type Query struct {
+	SQL  string
+	Args []any
+}
+
+// Rows is the result of a query: rows of values in Columns order.
+type Rows struct {
+	Columns []string
+	Values  [][]any
+}
+
+type queryHandler struct {
+	match string
+	fn    func(args []any) (*Rows, error)
+}
+
+type execHandler struct {
+	match string
+	fn    func(args []any) (int64, error)
+}
+
+// NewPostgres returns a fake with no handlers, closed when the test ends.
+func NewPostgres(t testing.TB) *Postgres {
+	p := &Postgres{}
+	p.db = sql.OpenDB(p)
+	t.Cleanup(func() { p.db.Close() })
+
+	return p
+}
+
+// DB is a handle on the fake.
+func (p *Postgres) DB() *sql.DB {
+	return p.db
+}
+
+// HandleQuery answers queries containing match with fn. Later handlers win
+// over earlier ones, so a test can override a default.
+func (p *Postgres) HandleQuery(match string, fn func(args []any) (*Rows, error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queries = append(p.queries, queryHandler{normalizeSQL(match), fn})
+}
+
+// AddRows answers queries containing match with fixed rows, whatever the
+// arguments.
+func (p *Postgres) AddRows(match string, columns []string, values ...[]any) {
+	p.HandleQuery(match, func([]any) (*Rows, error) {
+		return &Rows{Columns: columns, Values: values}, nil
+	})
+}
+
+// HandleExec answers statements containing match with fn's rows affected.
+// Statements nothing matches affect one row.
+func (p *Postgres) HandleExec(match string, fn func(args []any) (int64, error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.execs = append(p.execs, execHandler{normalizeSQL(match), fn})
+}
+
+// Fail makes every query and statement fail with err, as with Postgres
+// down, until it's called again with nil.
+func (p *Postgres) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.err = err
+}
+
+// Recorded returns the queries and statements run so far, in order.
+func (p *Postgres) Recorded() []Query {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.recorded)
+}
+
+// Count is how many recorded queries or statements contain match.
+func (p *Postgres) Count(match string) int {
+	match = normalizeSQL(match)
+	n := 0
+	for _, q := range p.Recorded() {
+		if strings.Contains(normalizeSQL(q.SQL), match) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func normalizeSQL(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+func (p *Postgres) record(query string, args []driver.NamedValue) ([]any, error) {
+	values := make([]any, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.recorded = append(p.recorded, Query{SQL: query, Args: values})
+	return values, p.err
+}
+
+func (p *Postgres) query(query string, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := p.record(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	query = normalizeSQL(query)
+	p.mu.Lock()
+	var fn func([]any) (*Rows, error)
+	for _, h := range slices.Backward(p.queries) {
+		if strings.Contains(query, h.match) {
+			fn = h.fn
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if fn == nil {
+		return &driverRows{}, nil
+	}
+	rows, err := fn(values)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &driverRows{columns: rows.Columns}
+	for _, row := range rows.Values {
+		converted := make([]driver.Value, len(row))
+		for i, v := range row {
+			if converted[i], err = driver.DefaultParameterConverter.ConvertValue(v); err != nil {
+				return nil, err
+			}
+		}
+		out.values = append(out.values, converted)
+	}
+
+	return out, nil
+}
+
+func (p *Postgres) exec(query string, args []driver.NamedValue) (driver.Result, error) {
+	values, err := p.record(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	query = normalizeSQL(query)
+	p.mu.Lock()
+	var fn func([]any) (int64, error)
+	for _, h := range slices.Backward(p.execs) {
+		if strings.Contains(query, h.match) {
+			fn = h.fn
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if fn == nil {
+		return driver.RowsAffected(1), nil
+	}
+	n, err := fn(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.RowsAffected(n), nil
+}
+
+// Connect and Driver make Postgres a driver.Connector.
+func (p *Postgres) Connect(context.Context) (driver.Conn, error) { return &conn{p}, nil }
+func (p *Postgres) Driver() driver.Driver                        { return fakeDriver{p} }
+
+type fakeDriver struct{ p *Postgres }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &conn{d.p}, nil }
+
+type conn struct{ p *Postgres }
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) { return &stmt{c.p, query}, nil }
+func (c *conn) Close() error                              { return nil }
+func (c *conn) Begin() (driver.Tx, error)                 { return tx{}, nil }
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.p.query(query, args)
+}
+
+func (c *conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.p.exec(query, args)
+}
+
+func (c *conn) Ping(context.Context) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+
+	return c.p.err
+}
+
+func (c *conn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type stmt struct {
+	p     *Postgres
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.p.exec(s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.p.query(s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+
+	return out
+}
+
+type driverRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *driverRows) Columns() []string { return r.columns }
+func (r *driverRows) Close() error      { return nil }
+
+func (r *driverRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	if len(dest) != len(r.values[0]) {
+		return errors.New("testharness: row has a different number of values than columns")
+	}
+
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,21 @@
+package testharness
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// NewRedis starts an in-process Valkey and returns a client for it, along
+// with the server so tests can inspect keys or move its clock with
+// FastForward. Both go away when the test ends.
+func NewRedis(t testing.TB) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return client, srv
+}
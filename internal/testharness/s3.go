@@ -0,0 +1,534 @@
+// Package testharness has in-process stand-ins for the services the proxy
+// talks to, MinIO, Valkey and Postgres, so end-to-end tests run with plain
+// go test. They're fakes, not mocks: each keeps real state and answers the
+// way the real service would for the calls the proxy makes.
+package testharness
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// S3 is an S3 endpoint holding objects in memory. It serves GET and HEAD
+// with ranges and conditional requests, PUT including server-side copies,
+// DELETE, bucket listings and the location lookup minio-go makes first.
+// Errors come back as S3's XML error documents, and signatures are checked
+// once RequireSigV4 is called. Multipart uploads aren't supported.
+type S3 struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*Object
+	requests []request
+	failures []failure
+	delays   []time.Duration
+
+	accessKey, secretKey string
+}
+
+// Object is a stored object.
+type Object struct {
+	Body        []byte
+	ContentType string
+	ETag        string
+	Modified    time.Time
+
+	// Metadata is the user metadata, sent as X-Amz-Meta-<name>
+	Metadata map[string]string
+}
+
+type request struct {
+	method string
+	url    *url.URL
+}
+
+type failure struct {
+	status int
+	code   string
+}
+
+// NewS3 starts an S3 endpoint with the given buckets, closed when the test
+// ends.
+func NewS3(t testing.TB, buckets ...string) *S3 {
+	t.Helper()
+
+	s := &S3{buckets: map[string]map[string]*Object{}}
+	for _, b := range buckets {
+		s.buckets[b] = map[string]*Object{}
+	}
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// AddBucket creates an empty bucket, unless it already exists.
+func (s *S3) AddBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+}
+
+// Put stores an object, replacing any under the same key.
+func (s *S3) Put(bucket, key string, body []byte, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(bucket, key, body, contentType)
+}
+
+func (s *S3) put(bucket, key string, body []byte, contentType string) *Object {
+	sum := md5.Sum(body)
+	obj := &Object{
+		Body:        bytes.Clone(body),
+		ContentType: contentType,
+		ETag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+		// Last-Modified has second precision
+		Modified: time.Now().UTC().Truncate(time.Second),
+	}
+	s.buckets[bucket][key] = obj
+
+	return obj
+}
+
+// SetMetadata replaces the user metadata of the object under key.
+func (s *S3) SetMetadata(bucket, key string, metadata map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj, ok := s.buckets[bucket][key]; ok {
+		obj.Metadata = maps.Clone(metadata)
+	}
+}
+
+// Object returns the object stored under key, if there is one.
+func (s *S3) Object(bucket, key string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.buckets[bucket][key]
+	return obj, ok
+}
+
+// Delete removes an object.
+func (s *S3) Delete(bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buckets[bucket], key)
+}
+
+// Fail makes the next n requests fail with status and the S3 error code,
+// such as 503 and SlowDown.
+func (s *S3) Fail(n, status int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for range n {
+		s.failures = append(s.failures, failure{status, code})
+	}
+}
+
+// Stall makes the next n requests wait d before they're answered, or
+// until the client gives up.
+func (s *S3) Stall(n int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for range n {
+		s.delays = append(s.delays, d)
+	}
+}
+
+// Requests counts the requests made with method for path, the bucket
+// included, like "/cdn/songs/1/abc.mp3". The query isn't compared.
+func (s *S3) Requests(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, r := range s.requests {
+		if r.method == method && r.url.Path == path {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Query is the query of the last request made with method for path, or
+// nil if there was none.
+func (s *S3) Query(method, path string) url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range slices.Backward(s.requests) {
+		if r.method == method && r.url.Path == path {
+			return r.url.Query()
+		}
+	}
+
+	return nil
+}
+
+// ResetRequests forgets the requests counted so far.
+func (s *S3) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = nil
+}
+
+func (s *S3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, request{r.Method, r.URL})
+	var fail *failure
+	if len(s.failures) > 0 {
+		fail = &s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	var delay time.Duration
+	if len(s.delays) > 0 {
+		delay = s.delays[0]
+		s.delays = s.delays[1:]
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if fail != nil {
+		writeS3Error(w, r, fail.status, fail.code)
+		return
+	}
+
+	s.mu.Lock()
+	accessKey, secretKey := s.accessKey, s.secretKey
+	s.mu.Unlock()
+	if accessKey != "" {
+		if code := signatureError(r, accessKey, secretKey); code != "" {
+			writeS3Error(w, r, http.StatusForbidden, code)
+			return
+		}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	s.mu.Unlock()
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	if key == "" {
+		s.serveBucket(w, r, bucket)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.Lock()
+		obj, ok := objects[key]
+		s.mu.Unlock()
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		h := w.Header()
+		h.Set("ETag", obj.ETag)
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("X-Amz-Request-Id", requestID())
+		if obj.ContentType != "" {
+			h.Set("Content-Type", obj.ContentType)
+		}
+		for name, v := range obj.Metadata {
+			h.Set("X-Amz-Meta-"+name, v)
+		}
+		http.ServeContent(&rangeErrorWriter{ResponseWriter: w, r: r}, r, "", obj.Modified, bytes.NewReader(obj.Body))
+	case http.MethodPut:
+		s.putObject(w, r, bucket, key)
+	case http.MethodDelete:
+		s.Delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *S3) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	q := r.URL.Query()
+	if q.Has("uploads") || q.Has("uploadId") {
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+		src, _ = url.PathUnescape(src)
+		srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+
+		s.mu.Lock()
+		from, ok := s.buckets[srcBucket][srcKey]
+		var obj *Object
+		if ok {
+			obj = s.put(bucket, key, from.Body, from.ContentType)
+			obj.Metadata = maps.Clone(from.Metadata)
+		}
+		s.mu.Unlock()
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		writeXML(w, http.StatusOK, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: obj.ETag, LastModified: obj.Modified.Format(time.RFC3339)})
+		return
+	}
+
+	var body io.Reader = r.Body
+	// minio-go signs plain HTTP uploads chunk by chunk
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = &awsChunkedReader{r: bufio.NewReader(r.Body)}
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+
+	s.mu.Lock()
+	obj := s.put(bucket, key, data, contentType)
+	for name, values := range r.Header {
+		if name, ok := strings.CutPrefix(name, "X-Amz-Meta-"); ok {
+			if obj.Metadata == nil {
+				obj.Metadata = map[string]string{}
+			}
+			obj.Metadata[name] = values[0]
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", obj.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && q.Has("location"):
+		writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: "us-east-1"})
+	case r.Method == http.MethodGet:
+		s.listObjects(w, q, bucket)
+	default:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+// listObjects answers ListObjectsV2 in one page.
+func (s *S3) listObjects(w http.ResponseWriter, q url.Values, bucket string) {
+	prefix, delimiter, after := q.Get("prefix"), q.Get("delimiter"), q.Get("start-after")
+
+	s.mu.Lock()
+	var keys []string
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var contents []listEntry
+	var prefixes []listPrefix
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if len(prefixes) == 0 || prefixes[len(prefixes)-1].Prefix != p {
+					prefixes = append(prefixes, listPrefix{p})
+				}
+				continue
+			}
+		}
+
+		obj := s.buckets[bucket][key]
+		contents = append(contents, listEntry{
+			Key:          key,
+			LastModified: obj.Modified.Format(time.RFC3339),
+			ETag:         obj.ETag,
+			Size:         len(obj.Body),
+			StorageClass: "STANDARD",
+		})
+	}
+	s.mu.Unlock()
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []listEntry
+		CommonPrefixes []listPrefix
+	}{
+		Name:           bucket,
+		Prefix:         prefix,
+		KeyCount:       len(contents) + len(prefixes),
+		MaxKeys:        1000,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	})
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("X-Amz-Request-Id", requestID())
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	writeXML(w, status, struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		Resource  string
+		RequestID string `xml:"RequestId"`
+	}{Code: code, Message: http.StatusText(status), Resource: r.URL.Path, RequestID: requestID()})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	body, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+func requestID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 16)
+}
+
+// rangeErrorWriter turns http.ServeContent's plain-text 416 into S3's
+// InvalidRange error.
+type rangeErrorWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	swallow bool
+}
+
+func (w *rangeErrorWriter) WriteHeader(status int) {
+	if status != http.StatusRequestedRangeNotSatisfiable {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.swallow = true
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("X-Content-Type-Options")
+	writeS3Error(w.ResponseWriter, w.r, status, "InvalidRange")
+}
+
+func (w *rangeErrorWriter) Write(b []byte) (int, error) {
+	if w.swallow {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// awsChunkedReader decodes an aws-chunked body: hex sizes with a chunk
+// signature, which isn't checked, each followed by that many bytes.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			// the CRLF closing the previous chunk
+			continue
+		}
+
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad chunk header %q", line)
+		}
+		if n == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = n
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+
+	return n, err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultBlocklistRefresh = 10 * time.Second
+
+var (
+	// trustedProxies may set X-Forwarded-For and X-Real-IP; anyone else's
+	// are ignored.
+	trustedProxies []netip.Prefix
+
+	ipAllow, ipDeny []netip.Prefix
+
+	// blocklistKey is a sorted set the abuse tooling maintains, of IPs or
+	// CIDRs scored by the Unix time their block ends, or 0 for never.
+	blocklistKey string
+	blocklist    atomic.Pointer[[]blockedPrefix]
+)
+
+type blockedPrefix struct {
+	prefix  netip.Prefix
+	expires time.Time
+}
+
+// parsePrefixes reads a comma-separated list of CIDRs or bare addresses.
+func parsePrefixes(name, s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		p, err := parsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	return prefixes, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return p.Masked(), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP is the peer address, or, when the peer is a trusted proxy, the
+// nearest untrusted address in X-Forwarded-For, falling back to X-Real-IP.
+func clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	peer = peer.Unmap()
+
+	if !containsAddr(trustedProxies, peer) {
+		return peer
+	}
+
+	// each proxy appends the address it received from, so the client is
+	// the rightmost hop that isn't one of ours
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = addr.Unmap()
+
+		if !containsAddr(trustedProxies, addr) {
+			return addr
+		}
+		peer = addr
+	}
+
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil && r.Header.Get("X-Forwarded-For") == "" {
+		return addr.Unmap()
+	}
+
+	return peer
+}
+
+// blockedReason reports why addr may not be served, if it may not.
+func blockedReason(addr netip.Addr) string {
+	switch {
+	case !addr.IsValid():
+		return ""
+	case len(ipAllow) > 0 && !containsAddr(ipAllow, addr):
+		return "not allowed"
+	case containsAddr(ipDeny, addr):
+		return "denied"
+	}
+
+	if list := blocklist.Load(); list != nil {
+		now := time.Now()
+		for _, b := range *list {
+			if b.prefix.Contains(addr) && (b.expires.IsZero() || now.Before(b.expires)) {
+				return "blocklisted"
+			}
+		}
+	}
+
+	return ""
+}
+
+// filterIPs refuses clients outside IP_ALLOW, inside IP_DENY or on the
+// Valkey blocklist.
+func filterIPs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := blockedReason(clientIP(r)); reason != "" {
+			traceDecision(r.Context(), "ip filter", reason)
+			writeError(w, r, proxyError{http.StatusForbidden, "forbidden"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadBlocklist replaces the in-memory blocklist with the sorted set's
+// current members. Invalid members are logged and skipped.
+func loadBlocklist(ctx context.Context) error {
+	members, err := redisClient.ZRangeWithScores(ctx, blocklistKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	list := make([]blockedPrefix, 0, len(members))
+	for _, m := range members {
+		s, _ := m.Member.(string)
+		p, err := parsePrefix(s)
+		if err != nil {
+			log.Printf("ignoring invalid blocklist entry %q: %v", s, err)
+			continue
+		}
+
+		b := blockedPrefix{prefix: p}
+		if m.Score > 0 && !math.IsInf(m.Score, 1) {
+			if b.expires = time.Unix(int64(m.Score), 0); !now.Before(b.expires) {
+				continue
+			}
+		}
+		list = append(list, b)
+	}
+
+	blocklist.Store(&list)
+	return nil
+}
+
+// refreshBlocklist reloads the blocklist every interval. On errors the
+// previous list stays in force.
+func refreshBlocklist(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		loadCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		if err := loadBlocklist(loadCtx); err != nil && err != redis.Nil {
+			log.Printf("blocklist refresh failed: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
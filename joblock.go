@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const jobLockTTL = 30 * time.Second
+
+// releaseJobLock only deletes the lock if it still holds our token, so a job
+// that outlived its TTL can't release a lock another replica now owns.
+var releaseJobLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// acquireJobLock takes a cluster-wide lock so a job runs on one replica at a
+// time. If Valkey is unreachable the lock is reported as held by us: running
+// a job twice is better than not running it.
+func acquireJobLock(ctx context.Context, name string) (func(), bool) {
+	key := "job:lock:" + name
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+
+	ok, err := redisClient.SetNX(ctx, key, token, jobLockTTL).Result()
+	if err != nil {
+		log.Printf("valkey SETNX error: %v", err)
+		return func() {}, true
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	return func() {
+		if err := releaseJobLock.Run(context.WithoutCancel(ctx), redisClient, []string{key}, token).Err(); err != nil {
+			log.Printf("job lock release error: %v", err)
+		}
+	}, true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// legacy_urls maps asset URLs from before the hash-addressed layout to their
+// new paths:
+//
+//	CREATE TABLE legacy_urls (old_path TEXT PRIMARY KEY, new_path TEXT NOT NULL);
+const (
+	legacyCacheTTL     = time.Hour
+	legacyMissCacheTTL = 5 * time.Minute
+
+	maxLegacyPathLength = 256
+
+	// misses are remembered in memory, up to this many, since the paths are
+	// the client's choice
+	maxLegacyMisses = 10000
+)
+
+var (
+	// legacyAssetExtensions are what the old layout's asset URLs ended in;
+	// nothing else is looked up
+	legacyAssetExtensions = map[string]bool{
+		".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+		".mp3": true, ".ogg": true, ".wav": true, ".flac": true, ".m4a": true,
+		".mp4": true, ".webm": true,
+	}
+
+	legacyMisses = struct {
+		sync.Mutex
+		expires map[string]time.Time
+	}{expires: map[string]time.Time{}}
+)
+
+// legacyAssetPath reports whether p is shaped like an old asset URL: a clean
+// path to a media file.
+func legacyAssetPath(p string) bool {
+	return len(p) <= maxLegacyPathLength && path.Clean(p) == p &&
+		legacyAssetExtensions[strings.ToLower(path.Ext(p))]
+}
+
+func legacyMissed(oldPath string) bool {
+	legacyMisses.Lock()
+	defer legacyMisses.Unlock()
+
+	at, ok := legacyMisses.expires[oldPath]
+	return ok && time.Now().Before(at)
+}
+
+// rememberLegacyMiss records that oldPath has no mapping. Once the cap is
+// reached expired misses are dropped, and if none have expired the miss
+// isn't remembered.
+func rememberLegacyMiss(oldPath string) {
+	legacyMisses.Lock()
+	defer legacyMisses.Unlock()
+
+	now := time.Now()
+	if len(legacyMisses.expires) >= maxLegacyMisses {
+		maps.DeleteFunc(legacyMisses.expires, func(_ string, at time.Time) bool { return !now.Before(at) })
+		if len(legacyMisses.expires) >= maxLegacyMisses {
+			return
+		}
+	}
+	legacyMisses.expires[oldPath] = now.Add(legacyMissCacheTTL)
+}
+
+// lookupLegacyURL returns the new path for an old asset URL. Mappings are
+// cached in Valkey, and misses in memory so unknown paths don't hit Postgres
+// on every request.
+func lookupLegacyURL(ctx context.Context, oldPath string) (string, bool) {
+	if legacyMissed(oldPath) {
+		return "", false
+	}
+
+	key := "legacy:url:" + oldPath
+	if redisBreaker.allow() {
+		newPath, err := redisClient.Get(ctx, key).Result()
+		if err == nil {
+			redisBreaker.record(nil)
+			return newPath, newPath != ""
+		} else if err != redis.Nil {
+			redisBreaker.record(err)
+			log.Printf("valkey GET error: %v", err)
+		} else {
+			redisBreaker.record(nil)
+		}
+	}
+
+	if !postgresBreaker.allow() {
+		return "", false
+	}
+
+	const query = `SELECT new_path FROM legacy_urls WHERE old_path = $1`
+	queryCtx, span := startQuerySpan(ctx, "postgres legacy_urls", query)
+	var newPath string
+	err := db.QueryRowContext(queryCtx, query, oldPath).Scan(&newPath)
+	endQuerySpan(span, err)
+
+	switch {
+	case err == sql.ErrNoRows:
+		postgresBreaker.record(nil)
+		rememberLegacyMiss(oldPath)
+		return "", false
+	case err != nil:
+		postgresBreaker.record(err)
+		log.Printf("legacy url lookup error: %v", err)
+		return "", false
+	}
+	postgresBreaker.record(nil)
+
+	if err := redisClient.Set(ctx, key, newPath, legacyCacheTTL).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	}
+
+	return newPath, newPath != ""
+}
+
+// legacyRedirect answers requests for old asset URLs that no route matches
+// with a 301 to their new path. If the mapping can't be looked up the
+// request carries on as if there were none.
+func legacyRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasRoute(r.URL.Path) && legacyAssetPath(r.URL.Path) {
+			ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+			newPath, ok := lookupLegacyURL(ctx, r.URL.Path)
+			cancel()
+
+			if ok {
+				if r.URL.RawQuery != "" && !strings.Contains(newPath, "?") {
+					newPath += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, newPath, http.StatusMovedPermanently)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
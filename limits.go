@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// a limit used past these shares is reported as warning or critical
+	limitWarnRatio     = 0.8
+	limitCriticalRatio = 0.95
+
+	defaultMaxGoroutines = 10000
+
+	defaultCacheMaxBytes = 10 << 30
+
+	// free space is looked up at most this often by cache writes
+	diskSpaceInterval = 10 * time.Second
+)
+
+var (
+	// maxGoroutines is the goroutine count /admin/limits measures against;
+	// the runtime has no limit of its own, so it's only an alarm
+	maxGoroutines = defaultMaxGoroutines
+
+	inboundConns  atomic.Int64
+	upstreamConns atomic.Int64
+
+	errCacheDiskLow = errors.New("cache disk headroom is below CACHE_MIN_FREE_PERCENT")
+
+	cacheWritesRefusedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_proxy_cache_writes_refused_total",
+		Help: "Variant cache writes skipped because the cache disk had less free space than CACHE_MIN_FREE_PERCENT.",
+	})
+
+	cacheEvictedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_proxy_cache_evicted_total",
+		Help: "Variant cache entries evicted to keep the cache under CACHE_MAX_BYTES.",
+	})
+
+	cacheEvictedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_proxy_cache_evicted_bytes_total",
+		Help: "Bytes evicted from the variant cache to keep it under CACHE_MAX_BYTES.",
+	})
+)
+
+// limitCheck is how much of one resource is in use against its limit.
+// Limit is 0 when there's none to measure against.
+type limitCheck struct {
+	Used   float64 `json:"used"`
+	Limit  float64 `json:"limit,omitempty"`
+	Ratio  float64 `json:"ratio,omitempty"`
+	Status string  `json:"status"`
+	Error  string  `json:"error,omitempty"`
+}
+
+func newLimitCheck(used, limit float64) limitCheck {
+	c := limitCheck{Used: used, Limit: limit, Status: "ok"}
+	if limit <= 0 {
+		return c
+	}
+
+	c.Ratio = math.Round(used/limit*1000) / 1000
+	switch {
+	case c.Ratio >= limitCriticalRatio:
+		c.Status = "critical"
+	case c.Ratio >= limitWarnRatio:
+		c.Status = "warning"
+	}
+
+	return c
+}
+
+func failedLimitCheck(err error) limitCheck {
+	return limitCheck{Status: "unknown", Error: err.Error()}
+}
+
+// handleLimits serves GET /admin/limits, headroom on the resources a long
+// soak runs out of, with the worst of their statuses. Connection counts have
+// no limit and are reported as they are.
+func handleLimits(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]limitCheck{
+		"goroutines": newLimitCheck(float64(runtime.NumGoroutine()), float64(maxGoroutines)),
+	}
+
+	if open, err := openFDs(); err != nil {
+		checks["file_descriptors"] = failedLimitCheck(err)
+	} else if limit, err := fdLimit(); err != nil {
+		checks["file_descriptors"] = failedLimitCheck(err)
+	} else {
+		checks["file_descriptors"] = newLimitCheck(float64(open), float64(limit))
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	checks["memory"] = newLimitCheck(float64(mem.Sys-mem.HeapReleased), float64(memoryLimit()))
+
+	cache := map[string]any{"min_free_percent": variantCache.minFreePercent, "max_bytes": variantCache.maxBytes}
+	if free, total, err := variantCache.space(true); err != nil {
+		checks["cache_disk"] = failedLimitCheck(err)
+	} else {
+		check := newLimitCheck(float64(total-free), float64(total))
+		if variantCache.lowOnSpace(free, total) {
+			check.Status = "critical"
+			cache["refusing_writes"] = true
+		}
+		checks["cache_disk"] = check
+		cache["free_bytes"] = free
+	}
+
+	status := "ok"
+	for _, c := range checks {
+		if limitSeverity(c.Status) > limitSeverity(status) {
+			status = c.Status
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": status,
+		"checks": checks,
+		"cache":  cache,
+		"connections": map[string]int64{
+			"inbound":  inboundConns.Load(),
+			"upstream": upstreamConns.Load(),
+		},
+	})
+}
+
+func limitSeverity(status string) int {
+	switch status {
+	case "warning", "unknown":
+		return 1
+	case "critical":
+		return 2
+	}
+	return 0
+}
+
+// memoryLimit is the lower of GOMEMLIMIT and the cgroup's memory limit, or
+// 0 with neither.
+func memoryLimit() uint64 {
+	var limit uint64
+	if l := debug.SetMemoryLimit(-1); l > 0 && l < math.MaxInt64 {
+		limit = uint64(l)
+	}
+
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// "max", or cgroup v1's page-aligned MaxInt64, means unlimited
+		if l, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil && l < math.MaxInt64/2 && (limit == 0 || l < limit) {
+			limit = l
+		}
+		break
+	}
+
+	return limit
+}
+
+// trackInbound counts the public listener's open connections, as an
+// http.Server's ConnState.
+func trackInbound(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		inboundConns.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		inboundConns.Add(-1)
+	}
+}
+
+// countUpstreamConns makes t count the connections it holds open, idle
+// ones included.
+func countUpstreamConns(t *http.Transport) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		upstreamConns.Add(1)
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { upstreamConns.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func openFDs() (int, error) { return 0, errors.ErrUnsupported }
+
+func fdLimit() (uint64, error) { return 0, errors.ErrUnsupported }
+
+func diskSpace(string) (free, total uint64, err error) { return 0, 0, errors.ErrUnsupported }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// renewed certificates are picked up this long after they're written
+var certCheckInterval = time.Minute
+
+// listenConfig is how the public listener is served. Without a certificate
+// it's plain HTTP/1.1, for a load balancer that terminates TLS itself.
+type listenConfig struct {
+	addr     string
+	certFile string
+	keyFile  string
+
+	// http3 serves QUIC on addr's port over UDP and advertises it to
+	// HTTP/1.1 and HTTP/2 clients with Alt-Svc
+	http3        bool
+	altSvcPort   int
+	altSvcMaxAge time.Duration
+}
+
+// servePublic serves handler on cfg.addr: over TLS with HTTP/2 when there's
+// a certificate, and over HTTP/3 as well when that's on. It returns when
+// either listener fails.
+func servePublic(cfg listenConfig, handler http.Handler) error {
+	if cfg.certFile == "" {
+		srv := newServer(cfg.addr, handler)
+		srv.ConnState = trackInbound
+		return srv.ListenAndServe()
+	}
+
+	srv, h3, err := publicServers(cfg, handler)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2)
+	if h3 != nil {
+		go func() { errs <- fmt.Errorf("http/3: %w", h3.ListenAndServe()) }()
+	}
+	go func() { errs <- srv.ListenAndServeTLS("", "") }()
+
+	return <-errs
+}
+
+// publicServers are the TLS servers for cfg, which must have a
+// certificate: srv for HTTP/1.1 and HTTP/2, and h3 when HTTP/3 is on.
+func publicServers(cfg listenConfig, handler http.Handler) (srv *http.Server, h3 *http3.Server, err error) {
+	certs, err := newCertReloader(cfg.certFile, cfg.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+
+	if cfg.http3 {
+		altSvc, err := altSvcHeader(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		h3 = &http3.Server{Addr: cfg.addr, Handler: handler, TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()), IdleTimeout: idleTimeout}
+		handler = advertiseHTTP3(altSvc, handler)
+	}
+
+	srv = newServer(cfg.addr, handler)
+	srv.TLSConfig, srv.ConnState = tlsConfig, trackInbound
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+
+	return srv, h3, nil
+}
+
+// altSvcHeader is the Alt-Svc value pointing clients at HTTP/3 on the
+// configured port, or the listener's when that isn't set.
+func altSvcHeader(cfg listenConfig) (string, error) {
+	port := cfg.altSvcPort
+	if port == 0 {
+		_, p, err := net.SplitHostPort(cfg.addr)
+		if err != nil {
+			return "", fmt.Errorf("invalid LISTEN_ADDR %q: %w", cfg.addr, err)
+		}
+		if port, err = net.LookupPort("udp", p); err != nil {
+			return "", fmt.Errorf("invalid LISTEN_ADDR %q: %w", cfg.addr, err)
+		}
+	}
+
+	return `h3=":` + strconv.Itoa(port) + `"; ma=` + strconv.Itoa(int(cfg.altSvcMaxAge.Seconds())), nil
+}
+
+// advertiseHTTP3 adds Alt-Svc to responses sent over TCP, so clients that
+// can switch to QUIC for their next requests. Lossy mobile connections
+// streaming songs gain the most from it.
+func advertiseHTTP3(altSvc string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Add("Alt-Svc", altSvc)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certReloader serves the certificate in certFile, reloading it when the
+// file changes so renewals don't need a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert, c.modTime = &cert, info.ModTime()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		// a renewal caught halfway through writing is retried next check
+		if info, err := os.Stat(c.certFile); err == nil && !info.ModTime().Equal(c.modTime) {
+			if err := c.reload(); err != nil {
+				log.Printf("certificate reload failed: %v", err)
+			} else {
+				log.Printf("reloaded certificate %s", c.certFile)
+			}
+		}
+	}
+
+	return c.cert, nil
+}
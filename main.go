@@ -1,23 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
-	"io"
 	"log"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -26,6 +25,13 @@ var (
 
 	redisClient *redis.Client
 	db          *sql.DB
+
+	// lookupTimeout bounds the Redis/Postgres lookups made while serving a
+	// request; on expiry the response goes out without the looked-up data.
+	lookupTimeout = 500 * time.Millisecond
+
+	minioURL    *url.URL
+	minioBucket string
 )
 
 type UserProfile struct {
@@ -35,34 +41,29 @@ type UserProfile struct {
 	AudioHash     string `json:"audio_hash"`
 	AudioMimeType string `json:"audio_mime_type"`
 	AudioName     string `json:"audio_name"`
+
+	// Private is nil in cache entries written before it existed
+	Private *bool `json:"is_private,omitempty"`
 }
 
 func getAudioFilename(ctx context.Context, userID, hash string) (string, error) {
-	key := "user:profile:" + userID
-
-	jsonStr, err := redisClient.Get(ctx, key).Result()
-	if err == nil {
-		var profile UserProfile
-		if err := json.Unmarshal([]byte(jsonStr), &profile); err == nil {
-			if profile.AudioHash == hash && profile.AudioName != "" {
-				return profile.AudioName, nil
-			}
-		}
-	} else if err != redis.Nil {
-		log.Printf("valkey GET error: %v", err)
+	if profile, ok := cachedProfile(ctx, userID); ok && profile.AudioHash == hash && profile.AudioName != "" {
+		recordCacheStatus(ctx, profileCacheName, "hit")
+		return profile.AudioName, nil
 	}
 
-	var dbFilename string
-	
-	err = db.QueryRowContext(ctx,
-		`SELECT audio_name FROM user_profiles WHERE id = $1 AND audio_hash = $2`,
-		userID, hash).Scan(&dbFilename)
+	recordCacheStatus(ctx, profileCacheName, "fwd=uri-miss")
 
+	profile, err := fetchProfile(ctx, userID)
 	if err != nil {
 		return "", err
 	}
 
-	return dbFilename, nil
+	if profile.AudioHash != hash || profile.AudioName == "" {
+		return "", sql.ErrNoRows
+	}
+
+	return profile.AudioName, nil
 }
 
 func main() {
@@ -70,39 +71,91 @@ func main() {
 		log.Println("no .env file found, reading config from environment")
 	}
 
+	if addr, path := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_SECRET_PATH"); addr != "" && path != "" {
+		secrets.vault = newVaultSource(addr, path)
+	}
+	if _, err := secrets.load(ctx); err != nil {
+		log.Fatalf("failed to load secrets: %v", err)
+	}
+	go secrets.refresh(ctx, envDuration("SECRETS_REFRESH_INTERVAL", defaultSecretsRefreshInterval))
+
 	redisAddr := os.Getenv("VALKEY_ADDR")
 	if redisAddr == "" {
 		log.Fatal("VALKEY_ADDR is not set")
 	}
 
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(ctx)
+
 	redisClient = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "",
-		DB:       0,
+		Addr: redisAddr,
+		CredentialsProvider: func() (string, string) {
+			return "", secrets.get("VALKEY_PASSWORD")
+		},
+		DB: 0,
 	})
 
-	pgConnStr := os.Getenv("POSTGRES_CONN")
-	if pgConnStr == "" {
+	if err := traceRedis(); err != nil {
+		log.Fatalf("failed to instrument valkey client: %v", err)
+	}
+	redisClient.AddHook(debugRedisHook{})
+
+	if secrets.get("POSTGRES_CONN") == "" {
 		log.Fatal("POSTGRES_CONN is not set")
 	}
 
-	var err error
-	db, err = sql.Open("postgres", pgConnStr)
+	db = sql.OpenDB(secretConnector{})
+	defer db.Close()
+
+	db.SetMaxOpenConns(envInt("POSTGRES_MAX_OPEN_CONNS", 20))
+	db.SetMaxIdleConns(envInt("POSTGRES_MAX_IDLE_CONNS", 10))
+	db.SetConnMaxLifetime(envDuration("POSTGRES_CONN_MAX_LIFETIME", 30*time.Minute))
+	db.SetConnMaxIdleTime(envDuration("POSTGRES_CONN_MAX_IDLE_TIME", 5*time.Minute))
+
+	lookupTimeout = envDuration("LOOKUP_TIMEOUT", lookupTimeout)
+	profileCacheTTL = envDuration("PROFILE_CACHE_TTL", defaultProfileCacheTTL)
+	profileStaleTTL = envDuration("PROFILE_STALE_TTL", defaultProfileStaleTTL)
+	objectMetaTTL = envDuration("OBJECT_META_TTL", defaultObjectMetaTTL)
+
+	songThrottleMultiplier = envFloat("SONG_THROTTLE_MULTIPLIER", 0)
+	songThrottleBurst = int64(envInt("SONG_THROTTLE_BURST", defaultSongThrottleBurst))
+	songDefaultBitrate = envInt("SONG_DEFAULT_BITRATE", defaultSongDefaultBitrate)
+
+	sessions, err = newSessionValidator(setting)
 	if err != nil {
-		log.Fatalf("failed to open postgres connection: %v", err)
+		log.Fatalf("invalid session config: %v", err)
+	}
+	if c := os.Getenv("SESSION_COOKIE"); c != "" {
+		sessionCookie = c
+	}
+	if err := grantKeys().err; err != nil {
+		log.Fatalf("invalid grant config: %v", err)
+	}
+
+	for _, b := range []*circuitBreaker{redisBreaker, postgresBreaker} {
+		b.threshold = envInt("BREAKER_THRESHOLD", defaultBreakerThreshold)
+		b.cooldown = envDuration("BREAKER_COOLDOWN", defaultBreakerCooldown)
 	}
-	defer db.Close()
 
 	if err := db.PingContext(ctx); err != nil {
 		log.Fatalf("failed to ping postgres: %v", err)
 	}
 
+	storageKind := os.Getenv("STORAGE_BACKEND")
+	if storage, err = newStorageBackend(storageKind); err != nil {
+		log.Fatalf("invalid storage config: %v", err)
+	}
+	s3Storage := storageKind == "" || storageKind == "s3"
+
 	minioURLStr := os.Getenv("MINIO_ENDPOINT")
-	if minioURLStr == "" {
+	if minioURLStr == "" && s3Storage {
 		log.Fatalf("MINIO_ENDPOINT is not set")
 	}
 
-	minioBucket := os.Getenv("MINIO_BUCKET")
+	minioBucket = os.Getenv("MINIO_BUCKET")
 	if minioBucket == "" {
 		log.Fatalf("MINIO_BUCKET is not set")
 	}
@@ -112,121 +165,378 @@ func main() {
 		listenAddr = ":5000"
 	}
 
-	minioURL, err := url.Parse(minioURLStr + "/" + minioBucket)
+	for _, l := range []struct {
+		name string
+		dst  *[]netip.Prefix
+	}{{"TRUSTED_PROXIES", &trustedProxies}, {"IP_ALLOW", &ipAllow}, {"IP_DENY", &ipDeny}} {
+		if *l.dst, err = parsePrefixes(l.name, os.Getenv(l.name)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if blocklistKey = os.Getenv("IP_BLOCKLIST_KEY"); blocklistKey != "" {
+		go refreshBlocklist(ctx, envDuration("IP_BLOCKLIST_REFRESH", defaultBlocklistRefresh))
+	}
+
+	negativeCacheTTL = envDuration("NEGATIVE_CACHE_TTL", defaultNegativeCacheTTL)
+	if probeThreshold = envInt("PROBE_THRESHOLD", 0); probeThreshold < 0 {
+		log.Fatal("invalid PROBE_THRESHOLD: must not be negative")
+	}
+	probeWindow = envDuration("PROBE_WINDOW", defaultProbeWindow)
+	probeBanDuration = envDuration("PROBE_BAN_DURATION", defaultProbeBanDuration)
+
+	var endpoints []*url.URL
+	if s3Storage {
+		endpoints, err = parseEndpoints(minioURLStr)
+		if err != nil || len(endpoints) == 0 {
+			log.Fatalf("invalid MINIO_ENDPOINT: %v", err)
+		}
+		minioURL = bucketURL(endpoints[0], minioBucket)
+	} else {
+		// other backends ignore the host, which only has to be well formed
+		minioURL = &url.URL{Scheme: "http", Host: "storage.invalid", Path: "/" + minioBucket}
+		coalescer.next = upstreamChain(storage)
+	}
+
+	cacheDir := os.Getenv("CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "cdn-proxy")
+	}
+
+	variantCache, err = newDiskCache(filepath.Join(cacheDir, "variants"))
 	if err != nil {
-		log.Fatalf("invalid MINIO_ENDPOINT: %v", err)
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(minioURL)
-	originalDirector := proxy.Director
-
-	proxy.Director = func(req *http.Request) {
-		switch {
-		case strings.HasPrefix(req.URL.Path, "/avatars/"):
-			parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/avatars/"), "/", 2)
-			if len(parts) == 2 {
-				userID := parts[0]
-				hash := parts[1]
-
-				q := req.URL.Query()
-				format := q.Get("format")
-				if format == "" {
-					format = "webp"
-				}
-				q.Del("format")
-				req.URL.RawQuery = q.Encode()
-
-				req.URL.Path = "/" + minioBucket + "/avatars/" + userID + "/" + hash + "." + format
-				req.URL.Scheme = minioURL.Scheme
-				req.URL.Host = minioURL.Host
-				return
-			}
+		log.Fatalf("failed to create variant cache: %v", err)
+	}
+	if variantCache.minFreePercent = envFloat("CACHE_MIN_FREE_PERCENT", 0); variantCache.minFreePercent < 0 || variantCache.minFreePercent >= 100 {
+		log.Fatal("invalid CACHE_MIN_FREE_PERCENT: must be at least 0 and under 100")
+	}
+	if variantCache.maxBytes = int64(envInt("CACHE_MAX_BYTES", defaultCacheMaxBytes)); variantCache.maxBytes < 0 {
+		log.Fatal("invalid CACHE_MAX_BYTES: must not be negative")
+	}
+	if maxGoroutines = envInt("LIMITS_MAX_GOROUTINES", defaultMaxGoroutines); maxGoroutines <= 0 {
+		log.Fatal("invalid LIMITS_MAX_GOROUTINES: must be positive")
+	}
+	countUpstreamConns(http.DefaultTransport.(*http.Transport))
 
-		case strings.HasPrefix(req.URL.Path, "/banners/"):
-			parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/banners/"), "/", 2)
-			if len(parts) == 2 {
-				userID := parts[0]
-				hash := parts[1]
-
-				q := req.URL.Query()
-				format := q.Get("format")
-				if format == "" {
-					format = "webp"
-				}
-				q.Del("format")
-				req.URL.RawQuery = q.Encode()
-
-				req.URL.Path = "/" + minioBucket + "/banners/" + userID + "/" + hash + "." + format
-				req.URL.Scheme = minioURL.Scheme
-				req.URL.Host = minioURL.Host
-				return
-			}
+	routes, err = loadRoutes(os.Getenv("ROUTES_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load routes: %v", err)
+	}
+
+	cachePolicies, err = loadCachePolicies(os.Getenv("CACHE_POLICIES_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load cache policies: %v", err)
+	}
+
+	corsPolicies, err = loadCORSPolicies(os.Getenv("CORS_POLICIES_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load cors policies: %v", err)
+	}
 
-		case strings.HasPrefix(req.URL.Path, "/songs/"):
-			parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/songs/"), "/", 2)
-			if len(parts) == 2 {
-				userID := parts[0]
-				hashWithExt := parts[1]
+	purgeRules, err = loadPurgeRules(os.Getenv("PURGE_RULES_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load purge rules: %v", err)
+	}
 
-				ext := filepath.Ext(hashWithExt)
-				hash := strings.TrimSuffix(hashWithExt, ext)
+	webhookURL = os.Getenv("WEBHOOK_URL")
+	webhookCooldown = envDuration("WEBHOOK_COOLDOWN", defaultWebhookCooldown)
+	if webhookURL != "" {
+		go runWebhooks(ctx)
+	}
 
-				req.URL.Path = "/" + minioBucket + "/songs/" + userID + "/" + hash + ext
-				req.URL.Scheme = minioURL.Scheme
-				req.URL.Host = minioURL.Host
-				return
-			}
+	slos, err = loadSLOs(os.Getenv("SLOS_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load slos: %v", err)
+	}
+	if sloShedBurnRate = envFloat("SLO_SHED_BURN_RATE", 0); sloShedBurnRate < 0 {
+		log.Fatal("invalid SLO_SHED_BURN_RATE: must not be negative")
+	}
+	if len(slos) > 0 {
+		go runSLOs()
+	}
+
+	transforms = newWorkerPool(
+		envInt("TRANSFORM_WORKERS", runtime.GOMAXPROCS(0)),
+		envInt("TRANSFORM_QUEUE", 4*runtime.GOMAXPROCS(0)),
+		envDuration("TRANSFORM_TIMEOUT", 10*time.Second),
+	)
+
+	if imgproxyURL := os.Getenv("IMGPROXY_URL"); imgproxyURL != "" {
+		if storageKind == "fs" {
+			log.Fatal("IMGPROXY_URL needs the s3 or http storage backend")
 		}
+		imgproxy, err = newImgproxyClient(imgproxyURL, secrets.get("IMGPROXY_KEY"), secrets.get("IMGPROXY_SALT"))
+		if err != nil {
+			log.Fatalf("failed to configure imgproxy: %v", err)
+		}
+	}
 
-		originalDirector(req)
+	switch iccMode = os.Getenv("ICC_PROFILES"); iccMode {
+	case "":
+		iccMode = iccConvert
+	case iccConvert, iccPreserve, iccStrip:
+	default:
+		log.Fatalf("invalid ICC_PROFILES %q", iccMode)
 	}
 
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		contentType := resp.Header.Get("Content-Type")
+	if v := os.Getenv("STRIP_METADATA_ROUTES"); v != "" {
+		stripMetadataRoutes = parseStripMetadataRoutes(v)
+	}
 
-		if strings.Contains(contentType, "application/xml") {
-			origBody, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return err
-			}
+	maxImagePixels = envInt("MAX_IMAGE_PIXELS", defaultMaxImagePixels)
+	maxLosslessPixels = envInt("MAX_LOSSLESS_PIXELS", defaultMaxLosslessPixels)
+	maxAnimationFrames = envInt("MAX_ANIMATION_FRAMES", defaultMaxAnimationFrames)
+	maxAnimationPixels = envInt("MAX_ANIMATION_PIXELS", defaultMaxAnimationPixels)
+
+	coalescer.maxBytes = int64(envInt("COALESCE_MAX_BYTES", defaultCoalesceMaxBytes))
+	if objectCache.maxBytes = int64(envInt("CACHE_MAX_OBJECT_BYTES", defaultMaxCachedObjectBytes)); objectCache.maxBytes < 0 {
+		log.Fatal("invalid CACHE_MAX_OBJECT_BYTES: must not be negative")
+	}
+	encodedResponses = newEncodedCache(int64(envInt("ENCODED_CACHE_BYTES", defaultEncodedCacheBytes)))
 
-			resp.Body.Close()
+	proxy := newOriginProxy()
 
-			reBucket := regexp.MustCompile(`<BucketName>.*?</BucketName>`)
-			reResource := regexp.MustCompile(`<Resource>.*?</Resource>`)
-			reKey := regexp.MustCompile(`<Key>.*?</Key>`)
+	go subscribeProfileInvalidations(ctx)
+	go subscribeCachePurges(ctx)
+	go subscribeCacheFlushes(ctx)
+	if bucketEventsKey = os.Getenv("BUCKET_EVENTS_KEY"); bucketEventsKey != "" {
+		go consumeBucketEvents(ctx)
+	}
+	if warm := os.Getenv("BUCKET_EVENTS_WARM_AVATARS"); warm != "" {
+		warmAvatarQueries = strings.Split(warm, ",")
+	}
+
+	if err := loadFeatures(ctx); err != nil {
+		log.Printf("failed to load feature toggles, leaving all on: %v", err)
+	}
+	go subscribeFeatures(ctx)
 
-			cleanBody := reBucket.ReplaceAll(origBody, []byte{})
-			cleanBody = reResource.ReplaceAll(cleanBody, []byte{})
-			cleanBody = reKey.ReplaceAll(cleanBody, []byte{})
+	derivativeIdleTTL = envDuration("DERIVATIVE_IDLE_TTL", derivativeIdleTTL)
+	go runDerivativeGC(ctx, envDuration("DERIVATIVE_GC_INTERVAL", time.Hour))
 
-			resp.Body = io.NopCloser(bytes.NewReader(cleanBody))
-			resp.ContentLength = int64(len(cleanBody))
-			resp.Header.Set("Content-Length", strconv.Itoa(len(cleanBody)))
+	if adminAddr := os.Getenv("ADMIN_ADDR"); adminAddr != "" {
+		if adminToken() == "" {
+			log.Fatal("ADMIN_ADDR is set but ADMIN_TOKEN is not")
 		}
 
-		if strings.HasPrefix(resp.Request.URL.Path, "/" + minioBucket + "/songs/") {
-			parts := strings.SplitN(strings.TrimPrefix(resp.Request.URL.Path,  "/" + minioBucket + "/songs/"), "/", 2)
-			if len(parts) == 2 {
-				userID := parts[0]
-				hashWithExt := parts[1]
+		go func() {
+			log.Printf("serving admin api on %s", adminAddr)
+			if err := serveAdmin(adminAddr); err != nil {
+				log.Fatalf("admin listener failed: %v", err)
+			}
+		}()
+	}
+
+	if grpcAddr := os.Getenv("ADMIN_GRPC_ADDR"); grpcAddr != "" {
+		if adminToken() == "" {
+			log.Fatal("ADMIN_GRPC_ADDR is set but ADMIN_TOKEN is not")
+		}
 
-				ext := filepath.Ext(hashWithExt)
-				hash := strings.TrimSuffix(hashWithExt, ext)
+		go func() {
+			log.Printf("serving admin grpc api on %s", grpcAddr)
+			if err := serveAdminGRPC(grpcAddr); err != nil {
+				log.Fatalf("admin grpc listener failed: %v", err)
+			}
+		}()
+	}
 
-				audioName, err := getAudioFilename(ctx, userID, hash)
-				if err == nil && audioName != "" {
-					resp.Header.Set("Content-Disposition", `inline; filename="`+ audioName +`"`)
-				}
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		go func() {
+			log.Printf("serving metrics on %s", metricsAddr)
+			if err := serveMetrics(metricsAddr); err != nil {
+				log.Fatalf("metrics listener failed: %v", err)
 			}
+		}()
+	}
+
+	if s3Storage && secrets.get("MINIO_ACCESS_KEY") != "" && secrets.get("MINIO_SECRET_KEY") != "" {
+		region := os.Getenv("MINIO_REGION")
+		if region == "" {
+			region = defaultMinioRegion
 		}
 
-		return nil
+		creds := credentials.New(secretCredentials{})
+		s3Client, err = newS3Client(minioURL, creds, region)
+		if err != nil {
+			log.Fatalf("failed to create s3 client: %v", err)
+		}
+		coalescer.next = &signingTransport{next: coalescer.next, creds: creds, region: region}
+	}
+
+	if uploadLimits["attachments"] = int64(envInt("ATTACHMENT_MAX_BYTES", defaultAttachmentMaxBytes)); uploadLimits["attachments"] <= 0 {
+		log.Fatal("invalid ATTACHMENT_MAX_BYTES: must be positive")
+	}
+
+	if path := os.Getenv("GEO_REGIONS_FILE"); path != "" {
+		geoRegions, err = loadGeoRegions(path)
+		if err != nil {
+			log.Fatalf("failed to load geo regions: %v", err)
+		}
+		if localRegion = os.Getenv("GEO_LOCAL_REGION"); localRegion != "" && geoRegions[localRegion] == nil {
+			log.Fatalf("invalid GEO_LOCAL_REGION: %q is not in %s", localRegion, path)
+		}
+
+		db, err := openGeoDatabase(os.Getenv("GEOIP_DATABASE"))
+		if err != nil {
+			log.Fatalf("GEO_REGIONS_FILE needs a GEOIP_DATABASE: %v", err)
+		}
+		geoDatabase.Store(db)
+		go watchGeoDatabase(ctx, os.Getenv("GEOIP_DATABASE"))
+
+		if geoRedirectMinBytes = int64(envInt("GEO_REDIRECT_MIN_BYTES", defaultGeoRedirectMinBytes)); geoRedirectMinBytes < 0 {
+			log.Fatal("invalid GEO_REDIRECT_MIN_BYTES: must not be negative")
+		}
+
+		// regional endpoints are picked over the failover transport's
+		if s3Storage {
+			coalescer.next = &regionTransport{next: coalescer.next}
+		}
+	}
+
+	// outside the signer, which signs for whichever endpoint was picked
+	if len(endpoints) > 1 {
+		upstreams = newFailoverTransport(coalescer.next, endpoints, os.Getenv("MINIO_LOAD_BALANCE") == "round-robin")
+		upstreams.ejectAfter = int32(envInt("MINIO_EJECT_AFTER", defaultEjectAfter))
+		upstreams.ejectFor = envDuration("MINIO_EJECT_DURATION", defaultEjectDuration)
+		coalescer.next = upstreams
+
+		go upstreams.checkHealth(ctx, envDuration("MINIO_HEALTH_INTERVAL", defaultHealthInterval))
+	}
+
+	if retries := envInt("UPSTREAM_RETRIES", defaultUpstreamRetries); retries > 0 {
+		coalescer.next = &retryTransport{
+			next:       coalescer.next,
+			maxRetries: retries,
+			baseDelay:  envDuration("UPSTREAM_RETRY_DELAY", defaultUpstreamRetryDelay),
+			budget:     envDuration("UPSTREAM_RETRY_BUDGET", defaultUpstreamRetryBudget),
+		}
+	}
+
+	if shadowPercent := envFloat("SHADOW_PERCENT", 0); shadowPercent > 0 {
+		if shadowPercent > 100 {
+			log.Fatal("invalid SHADOW_PERCENT: must be at most 100")
+		}
+		shadowEndpoint, err := url.Parse(os.Getenv("SHADOW_ENDPOINT"))
+		if err != nil || shadowEndpoint.Host == "" {
+			log.Fatalf("SHADOW_PERCENT needs a SHADOW_ENDPOINT URL")
+		}
+		shadowBucket := os.Getenv("SHADOW_BUCKET")
+		if shadowBucket == "" {
+			shadowBucket = minioBucket
+		}
+		coalescer.next = newShadowTransport(coalescer.next, shadowEndpoint, shadowBucket, shadowPercent)
+	}
+
+	readHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", defaultReadHeaderTimeout)
+	idleTimeout = envDuration("IDLE_TIMEOUT", defaultIdleTimeout)
+	writeTimeout = envDuration("WRITE_TIMEOUT", defaultWriteTimeout)
+	upstreamTimeout = envDuration("UPSTREAM_TIMEOUT", defaultUpstreamTimeout)
+	upstreamStreamTimeout = envDuration("UPSTREAM_STREAM_TIMEOUT", defaultUpstreamStreamTimeout)
+	coalescer.next = &timeoutTransport{next: coalescer.next}
+	imageConcurrency := envInt("UPSTREAM_IMAGE_CONCURRENCY", defaultUpstreamImageConcurrency)
+	streamConcurrency := envInt("UPSTREAM_STREAM_CONCURRENCY", defaultUpstreamStreamConcurrency)
+	if imageConcurrency < 0 || streamConcurrency < 0 {
+		log.Fatal("invalid UPSTREAM_IMAGE_CONCURRENCY or UPSTREAM_STREAM_CONCURRENCY: must not be negative")
+	}
+	coalescer.next = newLimitTransport(coalescer.next, imageConcurrency, streamConcurrency, envDuration("UPSTREAM_QUEUE_TIMEOUT", defaultUpstreamQueueTimeout))
+
+	derivativesBucket = os.Getenv("DERIVATIVES_BUCKET")
+	if derivativesBucket != "" && s3Client == nil {
+		log.Fatal("DERIVATIVES_BUCKET requires MINIO_ACCESS_KEY and MINIO_SECRET_KEY")
+	}
+	go runPurgeRules(ctx)
+
+	switch v := os.Getenv("BANDWIDTH_ACCOUNTING"); v {
+	case "":
+	case "on":
+		bandwidthAccounting = true
+	default:
+		log.Fatalf("invalid BANDWIDTH_ACCOUNTING %q: must be on", v)
+	}
+	bandwidthQuota = int64(envInt("BANDWIDTH_QUOTA", 0))
+	switch v := os.Getenv("BANDWIDTH_QUOTA_STATUS"); v {
+	case "", "429":
+	case "402":
+		bandwidthQuotaStatus = http.StatusPaymentRequired
+	default:
+		log.Fatalf("invalid BANDWIDTH_QUOTA_STATUS %q: must be 429 or 402", v)
+	}
+	if bandwidthQuota > 0 && !bandwidthAccounting {
+		log.Fatal("BANDWIDTH_QUOTA requires BANDWIDTH_ACCOUNTING=on")
+	}
+	if bandwidthAccounting {
+		go runBandwidthAccounting(ctx, envDuration("BANDWIDTH_PERSIST_INTERVAL", defaultBandwidthPersistInterval))
+	}
+	maxURLLength = envInt("MAX_URL_LENGTH", defaultMaxURLLength)
+	if hashLength = envInt("HASH_LENGTH", defaultHashLength); hashLength <= 0 {
+		log.Fatal("invalid HASH_LENGTH: must be positive")
+	}
+	exportRateLimit = envInt("EXPORT_RATE_LIMIT", defaultExportRateLimit)
+	switch v := os.Getenv("PROFILE_MANIFEST_PREFETCH"); v {
+	case "":
+	case "on":
+		prefetchManifests = true
+	default:
+		log.Fatalf("invalid PROFILE_MANIFEST_PREFETCH %q: must be on", v)
+	}
+	switch v := os.Getenv("DEFAULT_AVATARS"); v {
+	case "":
+	case "identicon":
+		defaultAvatars = true
+	default:
+		log.Fatalf("invalid DEFAULT_AVATARS %q: must be identicon", v)
+	}
+	switch v := os.Getenv("TOMBSTONES"); v {
+	case "":
+	case "on":
+		tombstones = true
+	default:
+		log.Fatalf("invalid TOMBSTONES %q: must be on", v)
+	}
+	if states := os.Getenv("TOMBSTONE_STATES"); states != "" {
+		tombstoneStates = strings.Split(states, ",")
+	}
+
+	waveformPeaks = envInt("WAVEFORM_PEAKS", defaultWaveformPeaks)
+	if waveformPeaks < minWaveformPeaks || waveformPeaks > maxWaveformPeaks {
+		log.Fatalf("invalid WAVEFORM_PEAKS: must be between %d and %d", minWaveformPeaks, maxWaveformPeaks)
+	}
+	if chunkSize = int64(envInt("CHUNK_SIZE", defaultChunkSize)); chunkSize < minChunkSize {
+		log.Fatalf("invalid CHUNK_SIZE: must be at least %d", minChunkSize)
+	}
+	if ffmpegPath = os.Getenv("FFMPEG_PATH"); ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if ffmpegPath, err = exec.LookPath(ffmpegPath); err != nil {
+		log.Printf("waveforms disabled: %v", err)
+		ffmpegPath = ""
+	}
+
+	listen := listenConfig{
+		addr:         listenAddr,
+		certFile:     os.Getenv("TLS_CERT_FILE"),
+		keyFile:      os.Getenv("TLS_KEY_FILE"),
+		altSvcPort:   envInt("HTTP3_ALT_SVC_PORT", 0),
+		altSvcMaxAge: envDuration("HTTP3_ALT_SVC_MAX_AGE", defaultAltSvcMaxAge),
+	}
+	if (listen.certFile == "") != (listen.keyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	switch v := os.Getenv("HTTP3"); v {
+	case "":
+	case "on":
+		listen.http3 = true
+	default:
+		log.Fatalf("invalid HTTP3 %q: must be on", v)
+	}
+	if listen.http3 && listen.certFile == "" {
+		log.Fatal("HTTP3 requires TLS_CERT_FILE and TLS_KEY_FILE")
 	}
 
 	log.Printf("starting b2/cdn-proxy on %s\n", listenAddr)
 
-	err = http.ListenAndServe(listenAddr, proxy)
+	publicHandler = newPublicHandler(proxy)
+	err = servePublic(listen, publicHandler)
 	if err != nil {
 		log.Fatal(err)
 	}
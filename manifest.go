@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// a page view's asset requests follow the manifest within seconds, so a
+	// path prefetched this recently is still warm
+	manifestPrefetchInterval = time.Minute
+	manifestPrefetchTimeout  = 30 * time.Second
+	maxRecentPrefetches      = 10000
+)
+
+var (
+	// prefetchManifests warms the listed avatar and banner whenever a
+	// public profile's manifest is served
+	prefetchManifests bool
+
+	recentPrefetches = struct {
+		sync.Mutex
+		at map[string]time.Time
+	}{at: map[string]time.Time{}}
+)
+
+// profileManifest is what GET /profiles/{id}/manifest.json serves: the
+// paths of the media a profile page loads.
+type profileManifest struct {
+	UserID  string `json:"user_id"`
+	Avatar  string `json:"avatar,omitempty"`
+	Banner  string `json:"banner,omitempty"`
+	Song    string `json:"song,omitempty"`
+	Private bool   `json:"private"`
+}
+
+// avatarCacheKey holds a user's current avatar hash, which otherwise takes
+// listing the bucket. It goes with the profile on invalidation.
+func avatarCacheKey(userID string) string {
+	return "avatar:" + userID
+}
+
+// cachedAvatar is newestAvatar through Valkey.
+func cachedAvatar(ctx context.Context, userID string) (string, error) {
+	key := avatarCacheKey(userID)
+	if hash, err := redisClient.Get(ctx, key).Result(); err == nil {
+		return hash, nil
+	} else if err != redis.Nil {
+		log.Printf("valkey GET error: %v", err)
+	}
+
+	hash, err := newestAvatar(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if profileCacheTTL > 0 {
+		if err := redisClient.Set(ctx, key, hash, profileCacheTTL).Err(); err != nil {
+			log.Printf("valkey SET error: %v", err)
+		}
+	}
+
+	return hash, nil
+}
+
+// handleProfileManifest serves GET /profiles/{id}/manifest.json and, when
+// configured, prefetches the listed images so the page's requests for them
+// hit the cache.
+func handleProfileManifest(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	if _, err := strconv.ParseInt(userID, 10, 64); err != nil {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	if !authorizeViewer(w, r, userID, r.URL.Path) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	defer cancel()
+
+	profile, err := songProfile(ctx, userID)
+	if err == sql.ErrNoRows {
+		profile = &UserProfile{}
+	} else if err != nil {
+		if err != errCircuitOpen {
+			log.Printf("profile manifest lookup failed for %s: %v", userID, err)
+		}
+		writeError(w, r, proxyError{http.StatusServiceUnavailable, "unavailable"})
+		return
+	}
+
+	m := profileManifest{UserID: userID, Private: profile.Private != nil && *profile.Private}
+	// the rest of the profile is still worth serving without the avatar
+	if hash, err := cachedAvatar(ctx, userID); err != nil {
+		log.Printf("avatar lookup failed for %s: %v", userID, err)
+	} else if hash != "" {
+		m.Avatar = "/avatars/" + userID + "/" + hash
+	}
+	if profile.BannerHash != "" {
+		m.Banner = "/banners/" + userID + "/" + profile.BannerHash
+	}
+	if ext := audioExtensions[profile.AudioMimeType]; profile.AudioHash != "" && ext != "" {
+		m.Song = "/songs/" + userID + "/" + profile.AudioHash + ext
+	}
+
+	// private media needs the viewer's credentials, which the prefetch
+	// doesn't have
+	if prefetchManifests && !m.Private {
+		var paths []string
+		for _, p := range []string{m.Avatar, m.Banner} {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+		go prefetchManifest(paths)
+	}
+
+	// clients poll with the ETag rather than cache the manifest outright
+	w.Header().Set("Cache-Control", "no-cache")
+	writeGeneratedJSON(w, r, m)
+}
+
+// prefetchManifest warms the paths not prefetched within the last
+// manifestPrefetchInterval.
+func prefetchManifest(paths []string) {
+	now := time.Now()
+
+	recentPrefetches.Lock()
+	if len(recentPrefetches.at) > maxRecentPrefetches {
+		for p, at := range recentPrefetches.at {
+			if now.Sub(at) >= manifestPrefetchInterval {
+				delete(recentPrefetches.at, p)
+			}
+		}
+	}
+	var todo []string
+	for _, p := range paths {
+		if at, ok := recentPrefetches.at[p]; !ok || now.Sub(at) >= manifestPrefetchInterval {
+			recentPrefetches.at[p] = now
+			todo = append(todo, p)
+		}
+	}
+	recentPrefetches.Unlock()
+
+	if len(todo) == 0 {
+		return
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, manifestPrefetchTimeout)
+	defer cancel()
+
+	prefetch(pctx, todo, func(res prefetchResult) {
+		if res.Status >= 500 {
+			log.Printf("manifest prefetch of %s failed with status %d", res.Path, res.Status)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// songMetadata is what a client needs to show a track without fetching it.
+// Duration is only known when the uploader stored it as object metadata.
+type songMetadata struct {
+	UserID   string   `json:"user_id"`
+	Hash     string   `json:"hash"`
+	Path     string   `json:"path"`
+	Filename string   `json:"filename,omitempty"`
+	MimeType string   `json:"mime_type,omitempty"`
+	Size     int64    `json:"size"`
+	Duration *float64 `json:"duration,omitempty"`
+
+	// Artwork is the owner's banner, expanded with any ?include= fields
+	Artwork     *imageInfo `json:"artwork,omitempty"`
+	Unavailable []string   `json:"unavailable,omitempty"`
+}
+
+// imageMetadata describes an avatar, banner or emoji.
+type imageMetadata struct {
+	OwnerID  string `json:"owner_id"`
+	Hash     string `json:"hash"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size"`
+	imageInfo
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// imageInfo holds an image's path and the ?include= fields, which come
+// from the same cached computations as ?placeholder=.
+type imageInfo struct {
+	Path        string       `json:"path"`
+	BlurHash    string       `json:"blurhash,omitempty"`
+	Width       int          `json:"width,omitempty"`
+	Height      int          `json:"height,omitempty"`
+	Colors      *imageColors `json:"colors,omitempty"`
+	Placeholder string       `json:"placeholder,omitempty"`
+}
+
+var (
+	imageIncludes = []string{"blurhash", "colors", "placeholder"}
+
+	// a song's duration is always there when known, so asking is harmless
+	songIncludes = append([]string{"duration"}, imageIncludes...)
+
+	imageMetadataKinds = map[string]bool{"avatars": true, "banners": true, "emojis": true}
+)
+
+// parseIncludes reads a comma-separated ?include=, rejecting unknown
+// fields so typos don't pass silently.
+func parseIncludes(r *http.Request, allowed []string) ([]string, bool) {
+	var includes []string
+	for _, field := range strings.Split(r.URL.Query().Get("include"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || slices.Contains(includes, field) {
+			continue
+		}
+		if !slices.Contains(allowed, field) {
+			return nil, false
+		}
+		includes = append(includes, field)
+	}
+
+	return includes, true
+}
+
+// expandImage fills in the included fields concurrently and returns those
+// that couldn't be computed, which are left out rather than failing the
+// whole response.
+func expandImage(ctx context.Context, kind, ownerID, hash string, includes []string, info *imageInfo) []string {
+	var mu sync.Mutex
+	var failed []string
+	var wg sync.WaitGroup
+
+	for _, field := range includes {
+		if !slices.Contains(imageIncludes, field) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			placeholder := field
+			if field == "placeholder" {
+				placeholder = "image"
+			}
+
+			data, err := loadPlaceholder(ctx, kind, ownerID, hash, placeholder)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err == nil {
+				switch field {
+				case "blurhash":
+					var bh struct {
+						BlurHash string `json:"blurhash"`
+						Width    int    `json:"width"`
+						Height   int    `json:"height"`
+					}
+					if err = json.Unmarshal(data, &bh); err == nil {
+						info.BlurHash, info.Width, info.Height = bh.BlurHash, bh.Width, bh.Height
+					}
+				case "colors":
+					err = json.Unmarshal(data, &info.Colors)
+				case "placeholder":
+					info.Placeholder = "data:image/webp;base64," + base64.StdEncoding.EncodeToString(data)
+				}
+			}
+
+			if err != nil {
+				var perr proxyError
+				if !errors.As(err, &perr) {
+					log.Printf("metadata include %s failed for %s/%s/%s: %v", field, kind, ownerID, hash, err)
+				}
+				failed = append(failed, field)
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(failed)
+	return failed
+}
+
+// handleSongMetadata serves GET /metadata/songs/{userID}/{hash}, combining
+// the user's profile with a HEAD of the object. The hash may carry the
+// file's extension; without one it must be the user's current song.
+func handleSongMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, proxyError{http.StatusMethodNotAllowed, "method_not_allowed"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/metadata/songs/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	userID, file := parts[0], parts[1]
+	if !validID(userID) || !validFile(file) {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	hash, ext, _ := strings.Cut(file, ".")
+	includes, ok := parseIncludes(r, songIncludes)
+	if !ok {
+		writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+		return
+	}
+	if !authorizeViewer(w, r, userID, "/songs/"+userID+"/"+file) {
+		return
+	}
+	meta := songMetadata{UserID: userID, Hash: hash}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	profile, err := songProfile(ctx, userID)
+	cancel()
+
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		if err != errCircuitOpen {
+			log.Printf("song metadata lookup failed for %s: %v", userID, err)
+		}
+		writeError(w, r, proxyError{http.StatusServiceUnavailable, "unavailable"})
+		return
+	case profile.AudioHash == hash:
+		meta.Filename, meta.MimeType = profile.AudioName, profile.AudioMimeType
+		if ext == "" {
+			ext = strings.TrimPrefix(audioExtensions[profile.AudioMimeType], ".")
+		}
+	}
+
+	if ext == "" {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	meta.Path = "/songs/" + userID + "/" + hash + "." + ext
+
+	resp, err := headObject(r.Context(), "/"+minioBucket+meta.Path)
+	if err != nil {
+		writeError(w, r, proxyError{http.StatusBadGateway, "upstream_error"})
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		writeError(w, r, proxyErrorForStatus(resp.StatusCode))
+		return
+	}
+
+	meta.Size = resp.ContentLength
+	if meta.MimeType == "" {
+		meta.MimeType = resp.Header.Get("Content-Type")
+	}
+	if d, err := strconv.ParseFloat(resp.Header.Get("X-Amz-Meta-Duration"), 64); err == nil && d > 0 {
+		meta.Duration = &d
+	}
+
+	// the banner is the artwork players show alongside a song
+	if profile != nil && profile.BannerHash != "" && slices.ContainsFunc(includes, func(f string) bool { return f != "duration" }) {
+		meta.Artwork = &imageInfo{Path: "/banners/" + userID + "/" + profile.BannerHash}
+		meta.Unavailable = expandImage(r.Context(), "banners", userID, profile.BannerHash, includes, meta.Artwork)
+	}
+
+	writeGeneratedJSON(w, r, meta)
+}
+
+func songProfile(ctx context.Context, userID string) (*UserProfile, error) {
+	if profile, ok := cachedProfile(ctx, userID); ok {
+		recordCacheStatus(ctx, profileCacheName, "hit")
+		return profile, nil
+	}
+
+	recordCacheStatus(ctx, profileCacheName, "fwd=uri-miss")
+
+	return fetchProfile(ctx, userID)
+}
+
+// handleImageMetadata serves GET /metadata/{kind}/{ownerID}/{hash} for
+// avatars, banners and emojis.
+func handleImageMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, proxyError{http.StatusMethodNotAllowed, "method_not_allowed"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/metadata/"), "/")
+	if len(parts) != 3 || !imageMetadataKinds[parts[0]] {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	kind, ownerID, hash := parts[0], parts[1], parts[2]
+	if !validID(ownerID) || !validHash(hash) {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	includes, ok := parseIncludes(r, imageIncludes)
+	if !ok {
+		writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+		return
+	}
+
+	path := "/" + kind + "/" + ownerID + "/" + hash
+	if privateRoutes[kind] && !authorizeViewer(w, r, ownerID, path) {
+		return
+	}
+
+	resp, err := headObject(r.Context(), "/"+minioBucket+path+".webp")
+	if err != nil {
+		writeError(w, r, proxyError{http.StatusBadGateway, "upstream_error"})
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		writeError(w, r, proxyErrorForStatus(resp.StatusCode))
+		return
+	}
+
+	meta := imageMetadata{
+		OwnerID:   ownerID,
+		Hash:      hash,
+		MimeType:  resp.Header.Get("Content-Type"),
+		Size:      resp.ContentLength,
+		imageInfo: imageInfo{Path: path},
+	}
+	meta.Unavailable = expandImage(r.Context(), kind, ownerID, hash, includes, &meta.imageInfo)
+
+	writeGeneratedJSON(w, r, meta)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_requests_total",
+		Help: "Requests served, by route, cache policy arm and status code.",
+	}, []string{"route", "arm", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cdn_proxy_request_duration_seconds",
+		Help:    "Time to serve a request, by route and cache policy arm.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "arm"})
+
+	responseBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_response_bytes_total",
+		Help: "Body bytes written to clients, including transfers the client aborted, by route and status code.",
+	}, []string{"route", "code"})
+
+	upstreamBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_upstream_bytes_total",
+		Help: "Body bytes read from the object store, by route.",
+	}, []string{"route"})
+
+	abortedTransfersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_aborted_transfers_total",
+		Help: "Responses the client disconnected from before the body was fully sent, by route.",
+	}, []string{"route"})
+
+	abortedTransferCompletion = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cdn_proxy_aborted_transfer_completion_ratio",
+		Help:    "Fraction of the body sent before the client disconnected, for responses with a known length, by route.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99},
+	}, []string{"route"})
+
+	revalidationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_revalidations_total",
+		Help: "Conditional requests from downstream caches, by route, cache policy arm and whether the object was unchanged.",
+	}, []string{"route", "arm", "not_modified"})
+)
+
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return newServer(addr, mux).ListenAndServe()
+}
+
+// responseRecorder captures what was written to the client. onHeader runs
+// right before the status line goes out, the last point headers can change.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status   int
+	bytes    int64
+	writeErr error
+	onHeader func(h http.Header, status int)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+
+	rec.status = status
+	if rec.onHeader != nil {
+		rec.onHeader(rec.Header(), status)
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	if err != nil && rec.writeErr == nil {
+		rec.writeErr = err
+	}
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type routeNameKey struct{}
+
+// routeNameFrom returns the route label instrument attached to ctx.
+func routeNameFrom(ctx context.Context) string {
+	if name, ok := ctx.Value(routeNameKey{}).(string); ok {
+		return name
+	}
+
+	return "other"
+}
+
+func routeName(path string) string {
+	if rt, _ := matchRoute(path); rt != nil {
+		return rt.Name
+	}
+	if strings.HasPrefix(path, "/metadata/") {
+		return "metadata"
+	}
+
+	return "other"
+}
+
+// instrument records request metrics and applies the route's cache policy.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		name := routeName(r.URL.Path)
+		arm, policy := selectCachePolicy(name, r.URL.Path)
+
+		ctx, cs := withCacheStatus(context.WithValue(r.Context(), routeNameKey{}, name))
+		ctx, private := withPrivateFlag(ctx)
+		r = r.WithContext(ctx)
+
+		var firstByte time.Duration
+		rec := &responseRecorder{ResponseWriter: w}
+		rec.onHeader = func(h http.Header, status int) {
+			firstByte = time.Since(start)
+			cs.apply(h)
+			// a default avatar stands in for an upload that may yet happen
+			if policy != nil && cacheableStatus(status) && h.Get("X-Default-Avatar") == "" {
+				h.Set("Cache-Control", policy.header())
+			}
+			if private.Load() {
+				h.Set("Cache-Control", "private, no-cache")
+				h.Add("Vary", "Authorization, Cookie")
+			}
+			if arm != controlArm {
+				h.Set("X-Cache-Policy", arm)
+			}
+		}
+
+		// shed requests are kept out of their own route's SLO, or shedding
+		// would go on spending that budget after the burning route recovers
+		burning := shedFor(name)
+		aborted := false
+		if burning != "" {
+			traceDecision(r.Context(), "load shedding", "error budget of "+burning+" is burning")
+			shedRequestsTotal.WithLabelValues(name, burning).Inc()
+			rec.Header().Set("Retry-After", strconv.Itoa(int(sloEvalInterval.Seconds())))
+			writeError(rec, r, proxyError{http.StatusServiceUnavailable, "overloaded"})
+		} else {
+			aborted = serveAbortable(next, rec, r)
+		}
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+			firstByte = time.Since(start)
+		}
+		if burning == "" {
+			recordSLO(name, rec.status, firstByte)
+		}
+
+		code := strconv.Itoa(rec.status)
+		requestsTotal.WithLabelValues(name, arm, code).Inc()
+		responseBytesTotal.WithLabelValues(name, code).Add(float64(rec.bytes))
+		requestDuration.WithLabelValues(name, arm).Observe(time.Since(start).Seconds())
+
+		recordAbort(r, rec, name)
+		publishServe(r, rec, name, start)
+		recordErrorSample(r, rec, name, start)
+		recordBandwidth(r, rec.status, rec.bytes)
+
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			notModified := strconv.FormatBool(rec.status == http.StatusNotModified)
+			revalidationsTotal.WithLabelValues(name, arm, notModified).Inc()
+		}
+
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// serveAbortable runs next, reporting whether it gave up on the response
+// with http.ErrAbortHandler, as ReverseProxy does when the client goes away
+// mid-body, so the request is still recorded before the abort goes on up.
+func serveAbortable(next http.Handler, w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if v := recover(); v == http.ErrAbortHandler {
+			aborted = true
+		} else if v != nil {
+			panic(v)
+		}
+	}()
+
+	next.ServeHTTP(w, r)
+	return false
+}
+
+// recordAbort checks whether the client went away mid-body. The declared
+// Content-Length is what the client was promised, so it is the denominator
+// even for range responses.
+func recordAbort(r *http.Request, rec *responseRecorder, route string) {
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	expected, err := strconv.ParseInt(rec.Header().Get("Content-Length"), 10, 64)
+	hasLength := err == nil && expected > 0
+	if hasLength && rec.bytes >= expected {
+		return
+	}
+
+	if rec.writeErr == nil && r.Context().Err() == nil {
+		return
+	}
+
+	abortedTransfersTotal.WithLabelValues(route).Inc()
+	if hasLength {
+		abortedTransferCompletion.WithLabelValues(route).Observe(float64(rec.bytes) / float64(expected))
+	}
+}
+
+func cacheableStatus(status int) bool {
+	return status == http.StatusOK || status == http.StatusPartialContent || status == http.StatusNotModified
+}
+
+// countingTransport attributes upstream body bytes to the requesting route.
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = &countingBody{ReadCloser: resp.Body, counter: upstreamBytesTotal.WithLabelValues(routeNameFrom(req.Context()))}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Add(float64(n))
+	return n, err
+}
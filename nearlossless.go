@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// nearLossless prepares img for lossless encoding the way libwebp's
+// near-lossless mode does: pixels outside smooth regions have their low bits
+// rounded off, which lossless webp then compresses far better while flat
+// areas and gradients stay exact. level runs from 0 (most rounding) to 100
+// (none).
+func nearLossless(src image.Image, level int) *image.NRGBA {
+	b := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	if (w < 64 && h < 64) || h < 3 {
+		return img
+	}
+
+	prev := make([]byte, len(img.Pix))
+	for bits := 5 - level/20; bits > 0; bits-- {
+		copy(prev, img.Pix)
+		limit := 1 << bits
+
+		for y := 1; y < h-1; y++ {
+			for x := 1; x < w-1; x++ {
+				i := y*img.Stride + x*4
+				if isSmooth(prev, i, img.Stride, limit) {
+					continue
+				}
+
+				for c := range 4 {
+					img.Pix[i+c] = discretize(prev[i+c], bits)
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+// isSmooth reports whether the pixel at i is within limit of its four
+// neighbours on every channel.
+func isSmooth(pix []byte, i, stride, limit int) bool {
+	for _, j := range [4]int{i - 4, i + 4, i - stride, i + stride} {
+		for c := range 4 {
+			if d := int(pix[i+c]) - int(pix[j+c]); d >= limit || d <= -limit {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// discretize rounds v to the nearest multiple of 1<<bits, ties to even.
+func discretize(v byte, bits int) byte {
+	mask := 1<<bits - 1
+	biased := int(v) + mask>>1 + int(v>>bits)&1
+	if biased > 0xff {
+		return 0xff
+	}
+
+	return byte(biased &^ mask)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxCachedObjectBytes = 64 << 20
+
+	// objectCachePrefix keeps originals apart from variants in the disk
+	// cache, which they share so GC, purges and headroom apply to both
+	objectCachePrefix = "object:"
+
+	// cached objects start with their metadata as a line of JSON
+	maxObjectHeader = 4 << 10
+)
+
+// objectCacheTransport keeps route objects fetched from the bucket in the
+// disk cache. A miss is teed to disk as it streams to the caller, so nothing
+// is held in memory whatever its size; objects over maxBytes aren't cached.
+// Hits are served from disk, ranges and conditional requests included.
+//
+// It sits outside the coalescer, so hits never reach it.
+type objectCacheTransport struct {
+	next http.RoundTripper
+
+	// maxBytes is the largest object cached; 0 caches none
+	maxBytes int64
+
+	// filling holds the keys being written, so concurrent misses for one
+	// object write it once
+	filling sync.Map
+}
+
+func objectCacheKey(req *http.Request) string {
+	return objectCachePrefix + req.URL.Path + "?" + req.URL.RawQuery
+}
+
+func (t *objectCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.maxBytes <= 0 || req.Method != http.MethodGet || !strings.HasPrefix(req.URL.Path, "/"+minioBucket+"/") {
+		return t.next.RoundTrip(req)
+	}
+
+	objectKey := strings.TrimPrefix(req.URL.Path, "/"+minioBucket+"/")
+	if !hasRoute("/" + objectKey) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := objectCacheKey(req)
+	if f, info, ok := variantCache.get(key); ok {
+		resp, err := cachedObjectResponse(req, f, info)
+		if err == nil {
+			recordCacheStatus(req.Context(), objectCacheName, "hit", "detail=disk")
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !coalescable(req) || isS3ErrorResponse(resp) {
+		return resp, err
+	}
+	if resp.ContentLength > t.maxBytes {
+		return resp, nil
+	}
+	if _, busy := t.filling.LoadOrStore(key, struct{}{}); busy {
+		return resp, nil
+	}
+
+	w, err := variantCache.create(key)
+	if err == nil {
+		err = writeObjectHeader(w, resp)
+	}
+	if err != nil {
+		if w != nil {
+			w.abort()
+		}
+		t.filling.Delete(key)
+		if !errors.Is(err, errCacheDiskLow) {
+			log.Printf("variant cache write error: %v", err)
+		}
+		return resp, nil
+	}
+
+	resp.Body = &teeBody{
+		ReadCloser: resp.Body,
+		w:          w,
+		want:       resp.ContentLength,
+		limit:      t.maxBytes,
+		done: func(stored bool) {
+			t.filling.Delete(key)
+			if stored {
+				indexObject(req.Context(), key, objectKey)
+			}
+		},
+	}
+
+	return resp, nil
+}
+
+// indexObject records a stored object against its kind, owner and hash so
+// purges find it.
+func indexObject(ctx context.Context, key, objectKey string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+	defer cancel()
+
+	kind, ownerID, hash := splitObjectKey(objectKey)
+	indexVariant(ctx, kind, ownerID, hash, key)
+}
+
+func writeObjectHeader(w io.Writer, resp *http.Response) error {
+	data, err := json.Marshal(objectMeta{
+		Size:         resp.ContentLength,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// teeBody copies an upstream body into the disk cache as the caller reads
+// it. The entry is committed once the whole body has been read, and
+// dropped if the caller stops early, it grows past limit or the disk fails;
+// none of that affects what the caller reads.
+type teeBody struct {
+	io.ReadCloser
+
+	w       *diskCacheWriter
+	written int64
+	want    int64
+	limit   int64
+	done    func(stored bool)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.w == nil {
+		return n, err
+	}
+
+	if n > 0 {
+		if b.written+int64(n) > b.limit {
+			b.finish(false)
+			return n, err
+		}
+		if _, werr := b.w.Write(p[:n]); werr != nil {
+			log.Printf("variant cache write error: %v", werr)
+			b.finish(false)
+			return n, err
+		}
+		b.written += int64(n)
+	}
+
+	if err == io.EOF {
+		b.finish(b.want < 0 || b.written == b.want)
+	} else if err != nil {
+		b.finish(false)
+	}
+
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	if b.w != nil {
+		b.finish(false)
+	}
+
+	return b.ReadCloser.Close()
+}
+
+func (b *teeBody) finish(complete bool) {
+	w := b.w
+	b.w = nil
+
+	stored := false
+	if complete {
+		if err := w.commit(); err != nil {
+			log.Printf("variant cache write error: %v", err)
+		} else {
+			stored = true
+		}
+	} else {
+		w.abort()
+	}
+
+	b.done(stored)
+}
+
+// cachedObjectResponse answers req from a cached object as MinIO would
+// have, the way the fs backend answers from its files. f is closed once
+// the body has been read.
+func cachedObjectResponse(req *http.Request, f *os.File, info os.FileInfo) (*http.Response, error) {
+	var meta objectMeta
+	line, err := bufio.NewReaderSize(io.NewSectionReader(f, 0, maxObjectHeader), maxObjectHeader).ReadSlice('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &meta)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	offset := int64(len(line))
+	content := io.NewSectionReader(f, offset, info.Size()-offset)
+
+	header := http.Header{}
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	if meta.ETag != "" {
+		header.Set("ETag", meta.ETag)
+	}
+	modified, _ := http.ParseTime(meta.LastModified)
+
+	pr, pw := io.Pipe()
+	rw := &pipeResponseWriter{header: header, body: pw, ready: make(chan *http.Response, 1), req: req, pr: pr}
+	go func() {
+		defer f.Close()
+		http.ServeContent(rw, req, "", modified, content)
+		rw.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+
+	select {
+	case resp := <-rw.ready:
+		resp.Body = cachedObjectBody{resp.Body}
+		return resp, nil
+	case <-req.Context().Done():
+		pr.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+}
+
+// cachedObjectBody marks a response as served from the disk cache.
+type cachedObjectBody struct {
+	io.ReadCloser
+}
+
+func servedFromDisk(resp *http.Response) bool {
+	_, ok := resp.Body.(cachedObjectBody)
+	return ok
+}
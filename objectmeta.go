@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultObjectMetaTTL = time.Hour
+
+// objectMetaTTL bounds how long HEAD can be answered from remembered
+// metadata. Objects are addressed by content hash, so it mostly matters for
+// deletions. Zero disables the fast path.
+var objectMetaTTL = defaultObjectMetaTTL
+
+// objectMeta is what a HEAD response needs from MinIO.
+type objectMeta struct {
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// objectMetaKey is keyed by the upstream path and query, which is what the
+// director sends to MinIO.
+func objectMetaKey(path, rawQuery string) string {
+	return "object:meta:" + path + "?" + rawQuery
+}
+
+// rememberObjectMeta stores metadata from a complete upstream response.
+func rememberObjectMeta(resp *http.Response) {
+	if objectMetaTTL <= 0 || resp.StatusCode != http.StatusOK || resp.Request.Header.Get("Range") != "" {
+		return
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	data, _ := json.Marshal(objectMeta{
+		Size:         size,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+
+	// the response shouldn't wait on this, or fail with its context
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(resp.Request.Context()), lookupTimeout)
+	defer cancel()
+
+	key := objectMetaKey(resp.Request.URL.Path, resp.Request.URL.RawQuery)
+	if err := redisClient.Set(ctx, key, data, objectMetaTTL).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	}
+}
+
+func cachedObjectMeta(ctx context.Context, key string) (*objectMeta, bool) {
+	if !redisBreaker.allow() {
+		return nil, false
+	}
+
+	data, err := redisClient.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		redisBreaker.record(nil)
+		return nil, false
+	} else if err != nil {
+		redisBreaker.record(err)
+		log.Printf("valkey GET error: %v", err)
+		return nil, false
+	}
+	redisBreaker.record(nil)
+
+	var meta objectMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, false
+	}
+
+	return &meta, true
+}
+
+// headFastPath answers HEAD for routed objects from remembered metadata,
+// so probing media before playback doesn't cost a MinIO round trip or, for
+// songs, a filename lookup. Without metadata the request goes upstream as
+// usual.
+func headFastPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || objectMetaTTL <= 0 || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rt, vars := matchRoute(r.URL.Path)
+		if rt == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		path := "/" + minioBucket + rt.expand(vars, q)
+
+		ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+		meta, ok := cachedObjectMeta(ctx, objectMetaKey(path, q.Encode()))
+		cancel()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recordCacheStatus(r.Context(), objectCacheName, "hit", "detail=metadata")
+
+		h := w.Header()
+		if meta.ETag != "" {
+			h.Set("ETag", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			h.Set("Last-Modified", meta.LastModified)
+		}
+
+		if inm := r.Header.Get("If-None-Match"); inm != "" && (inm == "*" || inm == meta.ETag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if meta.ContentType != "" {
+			h.Set("Content-Type", meta.ContentType)
+		}
+		h.Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		h.Set("Accept-Ranges", "bytes")
+		// as upstream HEADs, without the filename lookup
+		if rt.Name == "songs" {
+			if disposition, name := requestedDisposition(q, filepath.Ext(r.URL.Path)); name != "" || disposition != "inline" {
+				h.Set("Content-Disposition", contentDisposition(disposition, name))
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
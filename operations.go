@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// admin:op:{id} is a stream of an operation's events, so any replica can
+	// replay them to a watcher that reconnects
+	operationPrefix = "admin:op:"
+	operationTTL    = 24 * time.Hour
+
+	// watchers get a keepalive when nothing happened for this long
+	operationIdle = 15 * time.Second
+)
+
+var (
+	errNoOperation = errors.New("no such operation")
+	errNoS3        = errors.New("MINIO_ACCESS_KEY and MINIO_SECRET_KEY are not set")
+
+	// erasableKinds are the object kinds stored under a user's ID
+	erasableKinds = []string{"avatars", "banners", "songs"}
+)
+
+// operationRequest starts a bulk operation: a purge or reencode of a
+// kind/owner[/hash] prefix, or the erasure of a user's media.
+type operationRequest struct {
+	Kind   string `json:"kind"`
+	Prefix string `json:"prefix,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+}
+
+// opEvent is one entry in an operation's stream. State is running until
+// the last event, which is done or failed.
+type opEvent struct {
+	ID    string `json:"id,omitempty"`
+	State string `json:"state"`
+	stageProgress
+	Error string `json:"error,omitempty"`
+}
+
+func (req operationRequest) check() error {
+	switch req.Kind {
+	case "purge":
+		return checkPurgePrefix(req.Prefix)
+	case "reencode":
+		if err := checkPurgePrefix(req.Prefix); err != nil {
+			return err
+		}
+		if kind, _, _ := strings.Cut(req.Prefix, "/"); !originalRoutes[kind] {
+			return fmt.Errorf("%w: only kinds with stored originals can be reencoded", errInvalidAdmin)
+		}
+	case "erase":
+		if _, err := strconv.ParseInt(req.UserID, 10, 64); err != nil {
+			return fmt.Errorf("%w: user_id must be numeric", errInvalidAdmin)
+		}
+	default:
+		return fmt.Errorf("%w: kind must be purge, reencode or erase", errInvalidAdmin)
+	}
+
+	if req.Kind != "purge" && s3Client == nil {
+		return errNoS3
+	}
+
+	return nil
+}
+
+// startOperation runs req in the background and returns its ID.
+func startOperation(reqCtx context.Context, req operationRequest) (string, error) {
+	if err := req.check(); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	if err := appendOpEvent(reqCtx, id, opEvent{State: "running"}); err != nil {
+		return "", err
+	}
+
+	go func() {
+		progress := func(p stageProgress) {
+			if err := appendOpEvent(ctx, id, opEvent{State: "running", stageProgress: p}); err != nil {
+				log.Printf("operation %s progress lost: %v", id, err)
+			}
+		}
+
+		var err error
+		switch req.Kind {
+		case "purge":
+			err = purgePrefix(ctx, req.Prefix, progress)
+		case "reencode":
+			err = reencodePrefix(ctx, req.Prefix, progress)
+		case "erase":
+			err = eraseUser(ctx, req.UserID, progress)
+		}
+
+		last := opEvent{State: "done"}
+		if err != nil {
+			log.Printf("operation %s (%s) failed: %v", id, req.Kind, err)
+			last = opEvent{State: "failed", Error: err.Error()}
+		}
+		if err := appendOpEvent(ctx, id, last); err != nil {
+			log.Printf("operation %s result lost: %v", id, err)
+		}
+	}()
+
+	return id, nil
+}
+
+func appendOpEvent(ctx context.Context, id string, ev opEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	key := operationPrefix + id
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: []any{"event", data}})
+		pipe.Expire(ctx, key, operationTTL)
+		return nil
+	})
+
+	return err
+}
+
+func decodeOpEvent(msg redis.XMessage) opEvent {
+	var ev opEvent
+	if s, ok := msg.Values["event"].(string); !ok || json.Unmarshal([]byte(s), &ev) != nil {
+		ev.State = "failed"
+	}
+	ev.ID = msg.ID
+
+	return ev
+}
+
+// latestOpEvent is the operation's most recent event.
+func latestOpEvent(ctx context.Context, id string) (opEvent, error) {
+	msgs, err := redisClient.XRevRangeN(ctx, operationPrefix+id, "+", "-", 1).Result()
+	if err != nil {
+		return opEvent{}, err
+	}
+	if len(msgs) == 0 {
+		return opEvent{}, errNoOperation
+	}
+
+	return decodeOpEvent(msgs[0]), nil
+}
+
+// watchOperation calls fn with each event after the one with ID after, or
+// from the start when after is empty, until the operation ends. idle, if
+// set, is called when nothing has happened for a while.
+func watchOperation(ctx context.Context, id, after string, fn func(opEvent) error, idle func() error) error {
+	key := operationPrefix + id
+	if n, err := redisClient.Exists(ctx, key).Result(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNoOperation
+	}
+
+	if after == "" {
+		after = "0"
+	}
+
+	for {
+		streams, err := redisClient.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{key, after},
+			Block:   operationIdle,
+		}).Result()
+		if err == redis.Nil {
+			if idle != nil {
+				if err := idle(); err != nil {
+					return err
+				}
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, msg := range streams[0].Messages {
+			ev := decodeOpEvent(msg)
+			if err := fn(ev); err != nil {
+				return err
+			}
+			if ev.State != "running" {
+				return nil
+			}
+			after = msg.ID
+		}
+	}
+}
+
+// reencodePrefix rebuilds the served webp of every stored original under
+// prefix, then purges what was cached from the old one.
+func reencodePrefix(ctx context.Context, prefix string, progress func(stageProgress)) error {
+	st := stageProgress{Stage: "reencode"}
+
+	listPrefix := prefix + "/"
+	if strings.Count(prefix, "/") == 2 {
+		listPrefix = prefix + "."
+	}
+
+	for obj := range s3Client.ListObjects(ctx, minioBucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return fmt.Errorf("reencode: %w", obj.Err)
+		}
+
+		base, ext, ok := strings.Cut(obj.Key, ".")
+		if !ok || ext == "webp" || !validExtension.MatchString(ext) {
+			continue
+		}
+
+		// copies converted for a missing format would be stale; drop them
+		// to be converted again from the new webp
+		parts := strings.SplitN(base, "/", 3)
+		if len(parts) == 3 {
+			orig, err := lookupOriginalExt(ctx, parts[0], parts[1], parts[2])
+			if err != nil {
+				return fmt.Errorf("reencode %s: %w", obj.Key, err)
+			}
+			if ext != orig {
+				if err := s3Client.RemoveObject(ctx, minioBucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+					return fmt.Errorf("reencode %s: %w", obj.Key, err)
+				}
+				continue
+			}
+		}
+
+		data, err := reencodeOriginal(ctx, obj.Key)
+		if err != nil {
+			return fmt.Errorf("reencode %s: %w", obj.Key, err)
+		}
+
+		_, err = s3Client.PutObject(ctx, minioBucket, base+".webp", bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: "image/webp"})
+		if err != nil {
+			return fmt.Errorf("reencode %s: %w", obj.Key, err)
+		}
+
+		st.Count++
+		st.Bytes += int64(len(data))
+		if st.Count%stageProgressEvery == 0 {
+			progress(st)
+		}
+	}
+
+	st.Done = true
+	progress(st)
+
+	return purgePrefix(ctx, prefix, progress)
+}
+
+func reencodeOriginal(ctx context.Context, key string) ([]byte, error) {
+	obj, err := s3Client.GetObject(ctx, minioBucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	original, err := io.ReadAll(io.LimitReader(obj, uploadLimits["banners"]+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(original)) > uploadLimits["banners"] {
+		return nil, proxyError{http.StatusRequestEntityTooLarge, "too_large"}
+	}
+
+	return convertToWebP(ctx, original)
+}
+
+// eraseUser deletes every object stored under the user's ID, with their
+// cached copies and recorded originals. The profile row belongs to the main
+// app, which clears its own columns.
+func eraseUser(ctx context.Context, userID string, progress func(stageProgress)) error {
+	st := stageProgress{Stage: "objects"}
+	for _, kind := range erasableKinds {
+		opts := minio.ListObjectsOptions{Prefix: kind + "/" + userID + "/", Recursive: true}
+		for obj := range s3Client.ListObjects(ctx, minioBucket, opts) {
+			if obj.Err != nil {
+				return fmt.Errorf("objects: %w", obj.Err)
+			}
+
+			if err := s3Client.RemoveObject(ctx, minioBucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+				return fmt.Errorf("objects: %w", err)
+			}
+
+			st.Count++
+			st.Bytes += obj.Size
+			if st.Count%stageProgressEvery == 0 {
+				progress(st)
+			}
+		}
+	}
+	st.Done = true
+	progress(st)
+
+	const query = `DELETE FROM original_uploads WHERE owner_id = $1`
+	queryCtx, span := startQuerySpan(ctx, "postgres delete original_uploads", query)
+	_, err := db.ExecContext(queryCtx, query, userID)
+	endQuerySpan(span, err)
+	if err != nil {
+		return fmt.Errorf("originals: %w", err)
+	}
+
+	keys := []string{profileCacheKey(userID)}
+	err = scanKeys(ctx, "original:ext:*:"+userID+":*", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err == nil {
+		err = redisClient.Del(ctx, keys...).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("originals: %w", err)
+	}
+
+	for _, kind := range erasableKinds {
+		if err := purgePrefix(ctx, kind+"/"+userID, progress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleStartOperation serves POST /admin/operations.
+func handleStartOperation(w http.ResponseWriter, r *http.Request) {
+	var req operationRequest
+	if err := decodeAdminRequest(w, r, &req); err != nil {
+		return
+	}
+
+	id, err := startOperation(r.Context(), req)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"id":     id,
+		"events": "/admin/operations/" + id + "/events",
+	})
+}
+
+// handleOperation serves GET /admin/operations/{id}, the latest event.
+func handleOperation(w http.ResponseWriter, r *http.Request) {
+	ev, err := latestOpEvent(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ev)
+}
+
+// handleOperationEvents serves GET /admin/operations/{id}/events as
+// server-sent events. Reconnecting clients resume after Last-Event-ID.
+func handleOperationEvents(w http.ResponseWriter, r *http.Request) {
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("after")
+	}
+
+	rc := http.NewResponseController(w)
+	started := false
+	start := func() {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	err := watchOperation(r.Context(), r.PathValue("id"), after, func(ev opEvent) error {
+		start()
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.State, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}, func() error {
+		start()
+		if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && !started {
+		writeAdminError(w, err)
+	}
+}
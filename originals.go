@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// original_uploads records the extension of uploads that were converted on
+// the way in, so the unmodified file can still be served:
+//
+//	CREATE TABLE original_uploads (
+//		kind     TEXT   NOT NULL,
+//		owner_id BIGINT NOT NULL,
+//		hash     TEXT   NOT NULL,
+//		ext      TEXT   NOT NULL,
+//		PRIMARY KEY (kind, owner_id, hash)
+//	);
+//
+// Objects without a row were uploaded as webp, which is then the original.
+const originalExtCacheTTL = 24 * time.Hour
+
+var (
+	originalRoutes = map[string]bool{"avatars": true, "banners": true}
+
+	validExtension = regexp.MustCompile(`^[a-z0-9]{1,5}$`)
+)
+
+func originalExtKey(kind, ownerID, hash string) string {
+	return "original:ext:" + kind + ":" + ownerID + ":" + hash
+}
+
+// lookupOriginalExt is the extension an upload was stored with before
+// conversion, "webp" if it wasn't converted. Postgres is only asked while
+// its breaker is closed, so image requests don't queue behind it when it's
+// down.
+func lookupOriginalExt(ctx context.Context, kind, ownerID, hash string) (string, error) {
+	key := originalExtKey(kind, ownerID, hash)
+
+	if redisBreaker.allow() {
+		ext, err := redisClient.Get(ctx, key).Result()
+		if err == nil {
+			redisBreaker.record(nil)
+			return ext, nil
+		} else if err != redis.Nil {
+			redisBreaker.record(err)
+			log.Printf("valkey GET error: %v", err)
+		} else {
+			redisBreaker.record(nil)
+		}
+	}
+
+	if !postgresBreaker.allow() {
+		return "", errCircuitOpen
+	}
+
+	const query = `SELECT ext FROM original_uploads WHERE kind = $1 AND owner_id = $2 AND hash = $3`
+	queryCtx, span := startQuerySpan(ctx, "postgres original_uploads", query)
+	var ext string
+	err := db.QueryRowContext(queryCtx, query, kind, ownerID, hash).Scan(&ext)
+	endQuerySpan(span, err)
+
+	switch {
+	case err == sql.ErrNoRows:
+		postgresBreaker.record(nil)
+		ext = "webp"
+	case err != nil:
+		postgresBreaker.record(err)
+		return "", err
+	case !validExtension.MatchString(ext):
+		postgresBreaker.record(nil)
+		log.Printf("ignoring invalid original extension %q for %s/%s/%s", ext, kind, ownerID, hash)
+		ext = "webp"
+	default:
+		postgresBreaker.record(nil)
+	}
+
+	if err := redisClient.Set(ctx, key, ext, originalExtCacheTTL).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	}
+
+	return ext, nil
+}
+
+func recordOriginalExt(ctx context.Context, kind, ownerID, hash, ext string) error {
+	const query = `INSERT INTO original_uploads (kind, owner_id, hash, ext) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, owner_id, hash) DO UPDATE SET ext = EXCLUDED.ext`
+	queryCtx, span := startQuerySpan(ctx, "postgres insert original_uploads", query)
+	_, err := db.ExecContext(queryCtx, query, kind, ownerID, hash, ext)
+	endQuerySpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	if err := redisClient.Del(ctx, originalExtKey(kind, ownerID, hash)).Err(); err != nil {
+		log.Printf("valkey DEL error: %v", err)
+	}
+
+	return nil
+}
+
+// resolveOriginals rewrites ?format=original on avatars and banners to the
+// extension the object was uploaded with.
+func resolveOriginals(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("format") != "original" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rt, vars := matchRoute(r.URL.Path)
+		if rt == nil || !originalRoutes[rt.Name] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+		ext, err := lookupOriginalExt(ctx, rt.Name, vars["userID"], vars["hash"])
+		cancel()
+
+		if err != nil {
+			log.Printf("original extension lookup failed: %v", err)
+			writeError(w, r, proxyError{http.StatusServiceUnavailable, "unavailable"})
+			return
+		}
+
+		q.Set("format", ext)
+		r.URL.RawQuery = q.Encode()
+
+		next.ServeHTTP(w, r)
+	})
+}
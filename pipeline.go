@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// newOriginProxy is the reverse proxy route requests end at: it rewrites
+// them to their object in the bucket and fixes up what comes back.
+func newOriginProxy() *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(minioURL)
+	proxy.Transport = upstreamTransport
+	originalDirector := proxy.Director
+
+	proxy.Director = func(req *http.Request) {
+		if rt, vars := matchRoute(req.URL.Path); rt != nil {
+			if stripMetadataRoutes[rt.Name] {
+				req.Header.Del("Range")
+				req.Header.Del("If-Range")
+			}
+			q := req.URL.Query()
+			req.URL.Path = "/" + minioBucket + rt.expand(vars, q)
+			req.URL.RawQuery = q.Encode()
+			req.URL.Scheme = minioURL.Scheme
+			req.URL.Host = minioURL.Host
+			return
+		}
+
+		originalDirector(req)
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if !servedFromDisk(resp) {
+			recordCacheStatus(resp.Request.Context(), objectCacheName, "fwd=bypass", "fwd-status="+strconv.Itoa(resp.StatusCode))
+		}
+		stripUpstreamCORS(resp.Header)
+
+		if !fillMissingVariant(resp) && !fillDefaultAvatar(resp) && isS3ErrorResponse(resp) {
+			rememberMissing(resp)
+			return translateS3Error(resp)
+		}
+
+		song := strings.HasPrefix(resp.Request.URL.Path, "/"+minioBucket+"/songs/")
+		switch {
+		case song:
+			fixSongContentType(resp)
+		case strings.HasPrefix(resp.Request.URL.Path, "/"+minioBucket+"/attachments/"):
+			setAttachmentHeaders(resp)
+		case routeNameFrom(resp.Request.Context()) == bannerVideoRoute:
+			fixVideoContentType(resp)
+		default:
+			if err := sanitizeImageResponse(resp); err != nil {
+				return err
+			}
+		}
+
+		rememberObjectMeta(resp)
+
+		if song {
+			setSongDisposition(resp)
+			throttleSong(resp)
+		}
+
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		switch {
+		case errors.Is(err, errUpstreamTimeout):
+			writeError(w, r, proxyError{http.StatusGatewayTimeout, "upstream_timeout"})
+			return
+		case errors.Is(err, errUpstreamBusy):
+			writeError(w, r, errUpstreamBusy)
+			return
+		}
+
+		log.Printf("proxy error (request %s): %v", requestIDFrom(r.Context()), err)
+		writeError(w, r, proxyError{http.StatusBadGateway, "upstream_error"})
+	}
+
+	return proxy
+}
+
+// newPublicHandler is everything the public listener serves, with proxy
+// behind the route middleware. It reads its settings at request time, so
+// it can be built before or after they're loaded.
+func newPublicHandler(proxy http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload/", handleUpload)
+	mux.Handle("GET /profiles/{id}/export.zip", answerTombstones(http.HandlerFunc(handleExport)))
+	mux.Handle("GET /profiles/{id}/manifest.json", applyCORS(answerTombstones(http.HandlerFunc(handleProfileManifest))))
+	mux.Handle("/songs/{userID}/{hash}/waveform.json", applyCORS(restrictRequests(answerTombstones(http.HandlerFunc(handleWaveform)))))
+	mux.Handle("/banners/{userID}/{hash}/poster", applyCORS(restrictRequests(answerTombstones(http.HandlerFunc(handleBannerPoster)))))
+	mux.Handle("/songs/{userID}/{hash}/chunks.json", applyCORS(restrictRequests(answerTombstones(http.HandlerFunc(handleChunkManifest)))))
+	mux.Handle("/metadata/songs/", applyCORS(http.HandlerFunc(handleSongMetadata)))
+	mux.Handle("/metadata/", applyCORS(http.HandlerFunc(handleImageMetadata)))
+	mux.Handle("/", applyCORS(restrictRequests(guardProbes(legacyRedirect(validatePaths(answerTombstones(authorizePrivate(routeRegions(answerMissing(resolveOriginals(serveExcerpts(serveSaveDataSongs(transformImages(headFastPath(proxy)))))))))))))))
+
+	return takeGrants(traceHandler(assignRequestIDs(debugRequests(instrument(limitWrites(filterIPs(enforceQuotas(compressResponses(mux)))))))))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gen2brain/webp"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// placeholders are derived from content-addressed objects, so they only
+	// expire to bound Valkey memory
+	placeholderCacheTTL = 30 * 24 * time.Hour
+
+	placeholderImageSize    = 16
+	placeholderImageQuality = 30
+	blurHashSampleSize      = 32
+	paletteSize             = 5
+)
+
+var placeholderContentTypes = map[string]string{
+	"blurhash": "application/json",
+	"colors":   "application/json",
+	"image":    "image/webp",
+}
+
+// servePlaceholder answers ?placeholder=blurhash with the object's BlurHash
+// as JSON, ?placeholder=colors with its dominant colours, and
+// ?placeholder=image with a tiny blurred webp for progressive loading.
+func servePlaceholder(w http.ResponseWriter, r *http.Request, kind, ownerID, hash, placeholder string) {
+	contentType, ok := placeholderContentTypes[placeholder]
+	if !ok {
+		writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+		return
+	}
+
+	etag := generatedETag("placeholder", placeholder, kind, ownerID, hash)
+	if notModified(w, r, etag, variantCacheControl) {
+		return
+	}
+
+	data, err := loadPlaceholder(r.Context(), kind, ownerID, hash, placeholder)
+	if err != nil {
+		var perr proxyError
+		if !errors.As(err, &perr) {
+			log.Printf("placeholder render error for %s/%s/%s: %v", kind, ownerID, hash, err)
+			perr = proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+		}
+
+		writeError(w, r, perr)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", variantCacheControl)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// loadPlaceholder returns a cached placeholder, rendering and caching it on
+// a miss.
+func loadPlaceholder(ctx context.Context, kind, ownerID, hash, placeholder string) ([]byte, error) {
+	key := "placeholder:" + placeholder + ":" + kind + ":" + ownerID + ":" + hash
+
+	data, err := redisClient.Get(ctx, key).Bytes()
+	if err == nil {
+		recordCacheStatus(ctx, objectCacheName, "hit")
+		return data, nil
+	}
+	if err != redis.Nil {
+		log.Printf("valkey GET error: %v", err)
+	}
+	recordCacheStatus(ctx, objectCacheName, "fwd=uri-miss")
+
+	data, err = renderPlaceholder(ctx, "/"+minioBucket+"/"+kind+"/"+ownerID+"/"+hash+".webp", placeholder)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := redisClient.Set(ctx, key, data, placeholderCacheTTL).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	} else {
+		recordCacheStatus(ctx, objectCacheName, "stored")
+	}
+
+	return data, nil
+}
+
+func renderPlaceholder(ctx context.Context, objectPath, placeholder string) ([]byte, error) {
+	original, err := fetchOriginal(ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkImageLimits(bytes.NewReader(original)); err != nil {
+		return nil, err
+	}
+
+	return transforms.do(ctx, func() ([]byte, error) {
+		img, err := decodeImage(bytes.NewReader(original))
+		if err != nil {
+			return nil, err
+		}
+
+		// placeholders are always sRGB, whatever ICC_PROFILES says
+		if m, ok := parseMatrixShaper(iccProfile(original)); ok && !m.isSRGB() {
+			img = m.convert(img)
+		}
+
+		switch placeholder {
+		case "colors":
+			return json.Marshal(paletteOf(fitImage(img, blurHashSampleSize, blurHashSampleSize), paletteSize))
+		case "blurhash":
+			b := img.Bounds()
+			return json.Marshal(map[string]any{
+				"blurhash": encodeBlurHash(fitImage(img, blurHashSampleSize, blurHashSampleSize), 4, 3),
+				"width":    b.Dx(),
+				"height":   b.Dy(),
+			})
+		}
+
+		var buf bytes.Buffer
+		tiny := boxBlur(fitImage(img, placeholderImageSize, placeholderImageSize))
+		if err := webp.Encode(&buf, tiny, webp.Options{Quality: placeholderImageQuality}); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	})
+}
+
+// imageColors are hex sRGB colours, the most common first.
+type imageColors struct {
+	Dominant string   `json:"dominant"`
+	Palette  []string `json:"palette"`
+}
+
+// paletteOf buckets pixels by their top four bits per channel and returns
+// the average colour of the n fullest buckets. Transparent pixels don't
+// count.
+func paletteOf(img image.Image, n int) imageColors {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := map[int]*bucket{}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r, g, b = r*0xffff/a>>8, g*0xffff/a>>8, b*0xffff/a>>8
+
+			id := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			bk := buckets[id]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[id] = bk
+			}
+			bk.count++
+			bk.r += int(r)
+			bk.g += int(g)
+			bk.b += int(b)
+		}
+	}
+
+	sorted := slices.SortedFunc(maps.Values(buckets), func(a, b *bucket) int {
+		return cmp.Compare(b.count, a.count)
+	})
+
+	colors := imageColors{Palette: []string{}}
+	for _, bk := range sorted[:min(n, len(sorted))] {
+		colors.Palette = append(colors.Palette, fmt.Sprintf("#%02x%02x%02x", bk.r/bk.count, bk.g/bk.count, bk.b/bk.count))
+	}
+	if len(colors.Palette) > 0 {
+		colors.Dominant = colors.Palette[0]
+	}
+
+	return colors
+}
+
+// boxBlur applies a 3×3 box blur, enough to hide blockiness once the browser
+// scales a tiny placeholder up.
+func boxBlur(src image.Image) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var r, g, bl, a, n uint32
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					p := image.Pt(x+dx, y+dy)
+					if !p.In(b) {
+						continue
+					}
+
+					pr, pg, pb, pa := src.At(p.X, p.Y).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
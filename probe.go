@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultNegativeCacheTTL = time.Minute
+	defaultProbeWindow      = time.Minute
+	defaultProbeBanDuration = time.Hour
+)
+
+var (
+	// negativeCacheTTL is how long an object the bucket didn't have is
+	// answered with 404 without asking again; 0 always asks
+	negativeCacheTTL = defaultNegativeCacheTTL
+
+	// probeThreshold is how many distinct missing or malformed paths one IP
+	// may request within probeWindow before it's treated as enumerating
+	// hashes; 0 never does
+	probeThreshold   int
+	probeWindow      = defaultProbeWindow
+	probeBanDuration = defaultProbeBanDuration
+
+	probeDetectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_probe_detections_total",
+		Help: "IPs caught requesting too many missing paths, by action: blocked, or reported without a blocklist.",
+	}, []string{"action"})
+)
+
+// missingKey marks an upstream object as missing. Keys are by upstream path,
+// so a format the bucket lacks doesn't hide the ones it has.
+func missingKey(upstreamPath string) string {
+	return "neg:" + upstreamPath
+}
+
+// rememberMissing records the object resp is a 404 for in the negative
+// cache.
+func rememberMissing(resp *http.Response) {
+	if negativeCacheTTL <= 0 || resp.StatusCode != http.StatusNotFound {
+		return
+	}
+
+	if err := redisClient.Set(resp.Request.Context(), missingKey(resp.Request.URL.Path), 1, negativeCacheTTL).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	}
+}
+
+// forgetMissing drops the negative cache entries for an object just stored
+// at publicPath. Images are public without an extension and requested in
+// any format.
+func forgetMissing(ctx context.Context, publicPath string) {
+	if negativeCacheTTL <= 0 {
+		return
+	}
+
+	base := "/" + minioBucket + publicPath
+	keys := []string{missingKey(base)}
+	if path.Ext(publicPath) == "" {
+		for format := range imageContentTypes {
+			keys = append(keys, missingKey(base+"."+format))
+		}
+	}
+
+	if err := redisClient.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("valkey DEL error: %v", err)
+	}
+}
+
+// answerMissing answers route requests for objects the bucket recently
+// didn't have with 404, without touching it. Avatars filled in with
+// identicons are never recorded as missing, so they're unaffected.
+func answerMissing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt, vars := matchRoute(r.URL.Path)
+		if negativeCacheTTL <= 0 || rt == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := missingKey("/" + minioBucket + rt.expand(vars, r.URL.Query()))
+		n, err := redisClient.Exists(r.Context(), key).Result()
+		if err != nil {
+			log.Printf("valkey EXISTS error: %v", err)
+		}
+		if n == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recordCacheStatus(r.Context(), "negative", "hit")
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+	})
+}
+
+// guardProbes counts, per IP, the distinct paths it got a 404 or 400 for.
+// Walking through hashes looking for ones that exist shows up as many of
+// them in a short window, and gets the IP blocked, or reported when there's
+// no blocklist to add it to.
+func guardProbes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probeThreshold <= 0 || isPrefetch(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == http.StatusNotFound || rec.status == http.StatusBadRequest {
+			countProbe(context.WithoutCancel(r.Context()), r)
+		}
+	})
+}
+
+func countProbe(ctx context.Context, r *http.Request) {
+	ip := clientIP(r)
+	if !ip.IsValid() {
+		return
+	}
+
+	key := "probe:" + ip.String()
+	var card *redis.IntCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, r.URL.Path)
+		pipe.ExpireNX(ctx, key, probeWindow)
+		card = pipe.SCard(ctx, key)
+		return nil
+	})
+	if err != nil {
+		log.Printf("valkey probe count error: %v", err)
+		return
+	}
+	if card.Val() <= int64(probeThreshold) {
+		return
+	}
+
+	// start over, so the escalation happens once per window's worth
+	if err := redisClient.Del(ctx, key).Err(); err != nil {
+		log.Printf("valkey DEL error: %v", err)
+	}
+
+	count := strconv.FormatInt(card.Val(), 10)
+	if blocklistKey == "" {
+		log.Printf("%s requested %s missing paths within %s", ip, count, probeWindow)
+		notify("probing_detected", ip.String(), ip.String()+" requested "+count+" missing paths within "+probeWindow.String(),
+			map[string]any{"ip": ip.String(), "paths": card.Val(), "window": probeWindow.String()})
+		probeDetectionsTotal.WithLabelValues("reported").Inc()
+		return
+	}
+
+	if _, err := blockIP(ctx, ip.String(), probeBanDuration); err != nil {
+		log.Printf("failed to block probing ip %s: %v", ip, err)
+		return
+	}
+	log.Printf("blocked %s for %s after %s missing paths within %s", ip, probeBanDuration, count, probeWindow)
+	probeDetectionsTotal.WithLabelValues("blocked").Inc()
+}
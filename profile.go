@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// profileInvalidateChannel is published by the main app with a user ID
+	// whenever that user's profile changes.
+	profileInvalidateChannel = "profile:invalidate"
+
+	defaultProfileCacheTTL = time.Hour
+	defaultProfileStaleTTL = 5 * time.Minute
+
+	// profileTTLJitter spreads fresh lifetimes by up to this fraction, so
+	// profiles cached together don't all expire together
+	profileTTLJitter = 0.1
+)
+
+var (
+	profileCacheTTL = defaultProfileCacheTTL
+
+	// profileStaleTTL is how long past its TTL a profile is still served
+	// while it is refreshed in the background.
+	profileStaleTTL = defaultProfileStaleTTL
+
+	profileLoads     singleflight.Group
+	profileRefreshes sync.Map
+
+	// profileInvalidations remembers recent invalidations so a lookup that
+	// raced one doesn't write the stale row back into the cache.
+	profileInvalidations sync.Map
+)
+
+func profileCacheKey(userID string) string {
+	return "user:profile:" + userID
+}
+
+// cachedProfile returns the profile cached under user:profile:{id}, if any.
+// Entries live profileStaleTTL past their freshness; a stale one is still
+// returned, and refreshed in the background.
+func cachedProfile(ctx context.Context, userID string) (*UserProfile, bool) {
+	if !redisBreaker.allow() {
+		return nil, false
+	}
+
+	var get *redis.StringCmd
+	var ttl *redis.DurationCmd
+	redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, profileCacheKey(userID))
+		ttl = pipe.PTTL(ctx, profileCacheKey(userID))
+		return nil
+	})
+	jsonStr, err := get.Result()
+	if err == redis.Nil {
+		redisBreaker.record(nil)
+		return nil, false
+	} else if err != nil {
+		redisBreaker.record(err)
+		log.Printf("valkey GET error: %v", err)
+		return nil, false
+	}
+	redisBreaker.record(nil)
+
+	if left := ttl.Val(); left >= 0 && left < profileStaleTTL {
+		recordCacheStatus(ctx, profileCacheName, "ttl="+strconv.Itoa(-int((profileStaleTTL-left).Seconds())))
+		refreshProfile(userID)
+	}
+
+	var profile UserProfile
+	if err := json.Unmarshal([]byte(jsonStr), &profile); err != nil {
+		return nil, false
+	}
+
+	return &profile, true
+}
+
+// refreshProfile reloads a stale profile in the background, unless this or
+// another replica already is.
+func refreshProfile(userID string) {
+	if _, running := profileRefreshes.LoadOrStore(userID, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer profileRefreshes.Delete(userID)
+
+		refreshCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		defer cancel()
+
+		release, ok := acquireJobLock(refreshCtx, "profile-refresh:"+userID)
+		if !ok {
+			return
+		}
+		defer release()
+
+		if _, err := fetchProfile(refreshCtx, userID); err != nil && err != sql.ErrNoRows && err != errCircuitOpen {
+			log.Printf("profile refresh failed for %s: %v", userID, err)
+		}
+	}()
+}
+
+// fetchProfile is loadProfile behind the Postgres circuit breaker, with
+// concurrent loads of one profile sharing a query. The shared query isn't
+// tied to the caller that started it, so its hanging up doesn't fail the
+// others or count against the breaker.
+func fetchProfile(ctx context.Context, userID string) (*UserProfile, error) {
+	if !postgresBreaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	v, err, _ := profileLoads.Do(userID, func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+		defer cancel()
+
+		profile, err := loadProfile(loadCtx, userID)
+		if err == sql.ErrNoRows {
+			postgresBreaker.record(nil)
+		} else {
+			postgresBreaker.record(err)
+		}
+		return profile, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*UserProfile), nil
+}
+
+// profileEntryTTL is a jittered fresh lifetime plus the stale window, or 0
+// when PROFILE_CACHE_TTL turns caching off. Valkey would keep a key set
+// with 0 for good, so callers skip the SET instead.
+func profileEntryTTL() time.Duration {
+	if profileCacheTTL <= 0 {
+		return 0
+	}
+
+	jitter := time.Duration((rand.Float64()*2 - 1) * profileTTLJitter * float64(profileCacheTTL))
+	return profileCacheTTL + jitter + profileStaleTTL
+}
+
+// loadProfile reads the full profile from Postgres and caches it as JSON
+// under user:profile:{id}.
+func loadProfile(ctx context.Context, userID string) (*UserProfile, error) {
+	started := time.Now()
+
+	const query = `SELECT id, COALESCE(bio, ''), COALESCE(banner_hash, ''), COALESCE(audio_hash, ''),
+		COALESCE(audio_mime_type, ''), COALESCE(audio_name, ''), COALESCE(is_private, false) FROM user_profiles WHERE id = $1`
+	queryCtx, span := startQuerySpan(ctx, "postgres user_profiles", query)
+
+	var p UserProfile
+	var private bool
+	err := db.QueryRowContext(queryCtx, query, userID).
+		Scan(&p.ID, &p.Bio, &p.BannerHash, &p.AudioHash, &p.AudioMimeType, &p.AudioName, &private)
+	endQuerySpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	p.Private = &private
+
+	if at, ok := profileInvalidations.Load(userID); ok && !at.(time.Time).Before(started) {
+		return &p, nil
+	}
+
+	ttl := profileEntryTTL()
+	if ttl <= 0 {
+		return &p, nil
+	}
+
+	data, err := json.Marshal(&p)
+	if err != nil {
+		return &p, nil
+	}
+
+	if err := redisClient.Set(ctx, profileCacheKey(userID), data, ttl).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	} else {
+		recordCacheStatus(ctx, profileCacheName, "stored")
+	}
+
+	return &p, nil
+}
+
+// subscribeProfileInvalidations evicts cached profiles as soon as the main
+// app announces a change, rather than waiting out the TTL.
+func subscribeProfileInvalidations(ctx context.Context) {
+	sub := redisClient.Subscribe(ctx, profileInvalidateChannel)
+	defer sub.Close()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			userID := strings.TrimSpace(msg.Payload)
+			if userID == "" {
+				continue
+			}
+
+			profileInvalidations.Store(userID, time.Now())
+			if err := redisClient.Del(ctx, profileCacheKey(userID), avatarCacheKey(userID), tombstoneCacheKey(userID)).Err(); err != nil {
+				log.Printf("valkey DEL error: %v", err)
+			}
+		case <-ticker.C:
+			// lookups never take anywhere near this long
+			profileInvalidations.Range(func(k, v any) bool {
+				if time.Since(v.(time.Time)) > time.Minute {
+					profileInvalidations.Delete(k)
+				}
+				return true
+			})
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// jpegHuffmanSpec holds the Annex K tables in DHT form: code counts per
+// length, then symbols. Order is luminance DC, luminance AC, chrominance DC,
+// chrominance AC, as in image/jpeg.
+var jpegHuffmanSpec = [4]struct {
+	counts [16]byte
+	values []byte
+}{
+	// Luminance DC.
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Luminance AC.
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	// Chrominance DC.
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Chrominance AC.
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegQuant is Annex K.1 in zig-zag order.
+var jpegQuant = [2][64]byte{
+	// Luminance.
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	// Chrominance.
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegUnzig maps zig-zag order to natural order.
+var jpegUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegBands are the spectral selection AC scans sent after the DC scan: the
+// low frequencies first, so a coarse image sharpens in two steps.
+var jpegBands = [][2]int{{1, 5}, {6, 63}}
+
+var dctCos = func() (c [8][8]float64) {
+	for u := range 8 {
+		for x := range 8 {
+			cu := 1.0
+			if u == 0 {
+				cu = math.Sqrt2 / 2
+			}
+			c[u][x] = cu / 2 * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return c
+}()
+
+type jpegHuffman struct {
+	code [256]uint32
+	size [256]uint8
+}
+
+func buildJPEGHuffman(counts [16]byte, values []byte) *jpegHuffman {
+	h := &jpegHuffman{}
+	code, k := uint32(0), 0
+	for n, count := range counts {
+		for range count {
+			h.code[values[k]], h.size[values[k]] = code, uint8(n+1)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+
+	return h
+}
+
+type jpegBitWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint
+}
+
+func (b *jpegBitWriter) emit(bits uint32, n uint) {
+	b.bits = b.bits<<n | bits&(1<<n-1)
+	b.nBits += n
+	for b.nBits >= 8 {
+		c := byte(b.bits >> (b.nBits - 8))
+		b.w.WriteByte(c)
+		if c == 0xff {
+			b.w.WriteByte(0)
+		}
+		b.nBits -= 8
+	}
+}
+
+// flush pads the last byte with ones, as every scan must end byte-aligned.
+func (b *jpegBitWriter) flush() {
+	if b.nBits > 0 {
+		b.emit(0x7f, 8-b.nBits)
+	}
+	b.bits, b.nBits = 0, 0
+}
+
+func (b *jpegBitWriter) emitValue(h *jpegHuffman, run int, v int32) {
+	size, bits := uint(0), v
+	if v < 0 {
+		v, bits = -v, v-1
+	}
+	for ; v > 0; v >>= 1 {
+		size++
+	}
+
+	sym := byte(run<<4) | byte(size)
+	b.emit(h.code[sym], uint(h.size[sym]))
+	b.emit(uint32(bits), size)
+}
+
+// jpegComponent is one plane's quantized coefficients in zig-zag order, on
+// a grid padded out to whole MCUs.
+type jpegComponent struct {
+	id, sampling, table byte
+
+	blocks        [][64]int32
+	stride        int
+	width, height int // in blocks, unpadded
+}
+
+// encodeProgressiveJPEG writes a 4:2:0 progressive JPEG: one interleaved DC
+// scan, then the AC coefficients per component in jpegBands. image/jpeg can
+// only write baseline files. img must be opaque.
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 || width > 0xffff || height > 0xffff {
+		return errImageTooLarge
+	}
+
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]int32
+	for t := range quant {
+		for i, u := range jpegQuant[t] {
+			quant[t][i] = int32(max(1, min(255, (int(u)*scale+50)/100)))
+		}
+	}
+
+	mcuW, mcuH := (width+15)/16, (height+15)/16
+	planes := [3][]float64{}
+	planeW, planeH := mcuW*16, mcuH*16
+	for i := range planes {
+		planes[i] = make([]float64, planeW*planeH)
+	}
+
+	for y := range planeH {
+		sy := b.Min.Y + min(y, height-1)
+		for x := range planeW {
+			sx := b.Min.X + min(x, width-1)
+			r, g, bl, _ := img.At(sx, sy).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			i := y*planeW + x
+			planes[0][i], planes[1][i], planes[2][i] = float64(yy), float64(cb), float64(cr)
+		}
+	}
+
+	comps := []*jpegComponent{
+		{id: 1, sampling: 0x22, table: 0, stride: mcuW * 2, width: (width + 7) / 8, height: (height + 7) / 8},
+		{id: 2, sampling: 0x11, table: 1, stride: mcuW, width: (width + 15) / 16, height: (height + 15) / 16},
+		{id: 3, sampling: 0x11, table: 1, stride: mcuW, width: (width + 15) / 16, height: (height + 15) / 16},
+	}
+
+	for ci, c := range comps {
+		sub := 1
+		if ci > 0 {
+			sub = 2
+		}
+		rows := mcuH * 2 / sub
+		c.blocks = make([][64]int32, c.stride*rows)
+
+		var block [64]float64
+		for by := range rows {
+			for bx := range c.stride {
+				for y := range 8 {
+					for x := range 8 {
+						px, py := (bx*8+x)*sub, (by*8+y)*sub
+						v := 0.0
+						for dy := range sub {
+							for dx := range sub {
+								v += planes[ci][(py+dy)*planeW+px+dx]
+							}
+						}
+						block[y*8+x] = v/float64(sub*sub) - 128
+					}
+				}
+
+				fdct(&block)
+				out := &c.blocks[by*c.stride+bx]
+				for k := range 64 {
+					out[k] = int32(math.Round(block[jpegUnzig[k]] / float64(quant[c.table][k])))
+				}
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+
+	bw.Write([]byte{0xff, 0xd8})
+	bw.Write([]byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0})
+
+	for t := range quant {
+		bw.Write([]byte{0xff, 0xdb, 0, 67, byte(t)})
+		for _, q := range quant[t] {
+			bw.WriteByte(byte(q))
+		}
+	}
+
+	bw.Write([]byte{0xff, 0xc2, 0, 17, 8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3})
+	for _, c := range comps {
+		bw.Write([]byte{c.id, c.sampling, c.table})
+	}
+
+	var tables [4]*jpegHuffman
+	for i, spec := range jpegHuffmanSpec {
+		tables[i] = buildJPEGHuffman(spec.counts, spec.values)
+
+		n := 0
+		for _, count := range spec.counts {
+			n += int(count)
+		}
+		class := byte(i%2) << 4 // DC 0, AC 1
+		bw.Write([]byte{0xff, 0xc4, byte((19 + n) >> 8), byte(19 + n), class | byte(i/2)})
+		bw.Write(spec.counts[:])
+		bw.Write(spec.values)
+	}
+	dc := func(c *jpegComponent) *jpegHuffman { return tables[c.table*2] }
+	ac := func(c *jpegComponent) *jpegHuffman { return tables[c.table*2+1] }
+
+	bits := &jpegBitWriter{w: bw}
+
+	// DC scan, interleaved: four luma blocks then one of each chroma per MCU
+	bw.Write([]byte{0xff, 0xda, 0, 12, 3})
+	for _, c := range comps {
+		bw.Write([]byte{c.id, c.table<<4 | c.table})
+	}
+	bw.Write([]byte{0, 0, 0})
+
+	var pred [3]int32
+	for my := range mcuH {
+		for mx := range mcuW {
+			for ci, c := range comps {
+				n := 1
+				if ci == 0 {
+					n = 2
+				}
+				for y := range n {
+					for x := range n {
+						v := c.blocks[(my*n+y)*c.stride+mx*n+x][0]
+						bits.emitValue(dc(c), 0, v-pred[ci])
+						pred[ci] = v
+					}
+				}
+			}
+		}
+	}
+	bits.flush()
+
+	for _, band := range jpegBands {
+		for _, c := range comps {
+			bw.Write([]byte{0xff, 0xda, 0, 8, 1, c.id, c.table<<4 | c.table, byte(band[0]), byte(band[1]), 0})
+
+			for by := range c.height {
+				for bx := range c.width {
+					block := &c.blocks[by*c.stride+bx]
+					run := 0
+					for k := band[0]; k <= band[1]; k++ {
+						if block[k] == 0 {
+							run++
+							continue
+						}
+						for ; run > 15; run -= 16 {
+							bits.emitValue(ac(c), 15, 0)
+						}
+						bits.emitValue(ac(c), run, block[k])
+						run = 0
+					}
+					if run > 0 {
+						bits.emitValue(ac(c), 0, 0)
+					}
+				}
+			}
+			bits.flush()
+		}
+	}
+
+	bw.Write([]byte{0xff, 0xd9})
+	return bw.Flush()
+}
+
+func fdct(block *[64]float64) {
+	var tmp [64]float64
+	for y := range 8 {
+		for u := range 8 {
+			s := 0.0
+			for x := range 8 {
+				s += dctCos[u][x] * block[y*8+x]
+			}
+			tmp[y*8+u] = s
+		}
+	}
+
+	for u := range 8 {
+		for v := range 8 {
+			s := 0.0
+			for y := range 8 {
+				s += dctCos[v][y] * tmp[y*8+u]
+			}
+			block[v*8+u] = s
+		}
+	}
+}
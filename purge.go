@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// cachePurgePrefixChannel carries purged prefixes to every replica, since
+	// each keeps its own disk cache.
+	cachePurgePrefixChannel = "cache:purge"
+
+	// variant:index:{kind}/{owner}/{hash} holds the disk cache keys rendered
+	// from that object, since the cache names files by hash.
+	variantIndexPrefix = "variant:index:"
+
+	stageProgressEvery = 100
+	prefetchWorkers    = 4
+	maxPrefetchPaths   = 1000
+)
+
+var (
+	// publicHandler serves prefetches exactly as it would a client.
+	publicHandler http.Handler
+
+	errNoBlocklist  = errors.New("IP_BLOCKLIST_KEY is not set")
+	errInvalidAdmin = errors.New("invalid request")
+)
+
+func variantIndexKey(kind, ownerID, hash string) string {
+	return variantIndexPrefix + kind + "/" + ownerID + "/" + hash
+}
+
+func indexVariant(ctx context.Context, kind, ownerID, hash, key string) {
+	index := variantIndexKey(kind, ownerID, hash)
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, index, key)
+		pipe.Expire(ctx, index, max(derivativeIdleTTL, 24*time.Hour))
+		return nil
+	})
+	if err != nil {
+		log.Printf("valkey SADD error: %v", err)
+	}
+}
+
+// splitObjectKey is the kind, owner and hash of a key in the originals
+// bucket, such as songs/1/{hash}.mp3, with the extension and any original's
+// suffix dropped.
+func splitObjectKey(key string) (kind, ownerID, hash string) {
+	kind, rest, _ := strings.Cut(key, "/")
+	ownerID, file, _ := strings.Cut(rest, "/")
+	hash, _, _ = strings.Cut(file, ".")
+
+	return kind, ownerID, hash
+}
+
+// stageProgress reports how far a bulk operation's stage has got, such as
+// a purge's disk, bucket or metadata stage.
+type stageProgress struct {
+	Stage string `json:"stage"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+	Done  bool   `json:"done"`
+}
+
+// checkPurgePrefix accepts kind/owner or kind/owner/hash.
+func checkPurgePrefix(prefix string) error {
+	parts := strings.Split(prefix, "/")
+	if len(parts) < 2 || len(parts) > 3 || strings.ContainsAny(prefix, "*?[]\\") {
+		return fmt.Errorf("%w: prefix must be kind/owner or kind/owner/hash", errInvalidAdmin)
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return fmt.Errorf("%w: prefix must be kind/owner or kind/owner/hash", errInvalidAdmin)
+		}
+	}
+
+	return nil
+}
+
+// prefixPattern matches keys under base+prefix, respecting segment
+// boundaries: a whole object also matches its extensions and query.
+func prefixPattern(base, prefix string) string {
+	if strings.Count(prefix, "/") == 2 {
+		return base + prefix + "[./?]*"
+	}
+
+	return base + prefix + "/*"
+}
+
+func scanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	iter := redisClient.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+// purgePrefix removes every cached copy of the objects under prefix: disk
+// variants on all replicas, bucket derivatives and remembered metadata.
+// Originals are untouched. progress is called as each stage advances and
+// once it is done.
+func purgePrefix(ctx context.Context, prefix string, progress func(stageProgress)) error {
+	if err := checkPurgePrefix(prefix); err != nil {
+		return err
+	}
+
+	disk, err := purgeLocalVariants(ctx, prefix, progress)
+	if err != nil {
+		return fmt.Errorf("disk: %w", err)
+	}
+	if err := redisClient.Publish(ctx, cachePurgePrefixChannel, prefix).Err(); err != nil {
+		log.Printf("valkey PUBLISH error: %v", err)
+	}
+	disk.Done = true
+	progress(disk)
+
+	if derivativesBucket != "" {
+		bucket := stageProgress{Stage: "bucket"}
+		opts := minio.ListObjectsOptions{Prefix: "variants/" + prefix + "/", Recursive: true}
+		for obj := range s3Client.ListObjects(ctx, derivativesBucket, opts) {
+			if obj.Err != nil {
+				return fmt.Errorf("bucket: %w", obj.Err)
+			}
+
+			size, err := removeDerivative(ctx, obj.Key)
+			if err != nil {
+				return fmt.Errorf("bucket: %w", err)
+			}
+
+			bucket.Count++
+			bucket.Bytes += size
+			if bucket.Count%stageProgressEvery == 0 {
+				progress(bucket)
+			}
+		}
+		bucket.Done = true
+		progress(bucket)
+	}
+
+	meta := stageProgress{Stage: "metadata"}
+	for _, base := range []string{"object:meta:/" + minioBucket + "/", "waveform:", "chunks:"} {
+		err = scanKeys(ctx, prefixPattern(base, prefix), func(key string) error {
+			if err := redisClient.Del(ctx, key).Err(); err != nil {
+				return err
+			}
+
+			meta.Count++
+			if meta.Count%stageProgressEvery == 0 {
+				progress(meta)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("metadata: %w", err)
+		}
+	}
+
+	meta.Done = true
+	progress(meta)
+
+	return nil
+}
+
+// purgeLocalVariants removes this replica's disk variants under prefix.
+func purgeLocalVariants(ctx context.Context, prefix string, progress func(stageProgress)) (stageProgress, error) {
+	st := stageProgress{Stage: "disk"}
+
+	// an object's index is exactly its prefix
+	pattern := variantIndexPrefix + prefix
+	if strings.Count(prefix, "/") < 2 {
+		pattern = prefixPattern(variantIndexPrefix, prefix)
+	}
+
+	err := scanKeys(ctx, pattern, func(index string) error {
+		keys, err := redisClient.SMembers(ctx, index).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			path := variantCache.path(key)
+			info, err := os.Stat(path)
+			if err != nil || os.Remove(path) != nil {
+				continue
+			}
+
+			st.Count++
+			st.Bytes += info.Size()
+			if progress != nil && st.Count%stageProgressEvery == 0 {
+				progress(st)
+			}
+		}
+
+		return nil
+	})
+
+	return st, err
+}
+
+// subscribeCachePurges applies purges started on other replicas.
+func subscribeCachePurges(ctx context.Context) {
+	sub := redisClient.Subscribe(ctx, cachePurgePrefixChannel)
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		if checkPurgePrefix(msg.Payload) != nil {
+			continue
+		}
+
+		st, err := purgeLocalVariants(ctx, msg.Payload, nil)
+		if err != nil {
+			log.Printf("cache purge of %s failed: %v", msg.Payload, err)
+		} else if st.Count > 0 {
+			log.Printf("cache purge of %s removed %d variants (%d bytes)", msg.Payload, st.Count, st.Bytes)
+		}
+	}
+}
+
+// prefetchResult is how the proxy answered one prefetched path.
+type prefetchResult struct {
+	Path        string `json:"path"`
+	Status      int    `json:"status"`
+	Bytes       int64  `json:"bytes"`
+	CacheStatus string `json:"cache_status,omitempty"`
+}
+
+// prefetch requests each path through the public handler so every cache
+// tier is warm before clients ask. Results arrive in completion order.
+func prefetch(ctx context.Context, paths []string, fn func(prefetchResult)) error {
+	if len(paths) > maxPrefetchPaths {
+		return fmt.Errorf("%w: at most %d paths per prefetch", errInvalidAdmin, maxPrefetchPaths)
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("%w: path %q", errInvalidAdmin, p)
+		}
+	}
+
+	var mu sync.Mutex
+	work := make(chan string)
+
+	var wg sync.WaitGroup
+	for range min(prefetchWorkers, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				res := prefetchOne(ctx, path)
+				mu.Lock()
+				fn(res)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, p := range paths {
+		select {
+		case work <- p:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+type prefetchKey struct{}
+
+// isPrefetch reports whether ctx is a prefetch's request, which no client
+// is served.
+func isPrefetch(ctx context.Context) bool {
+	return ctx.Value(prefetchKey{}) != nil
+}
+
+func prefetchOne(ctx context.Context, path string) prefetchResult {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, prefetchKey{}, true), http.MethodGet, path, nil)
+	if err != nil {
+		return prefetchResult{Path: path, Status: http.StatusBadRequest}
+	}
+	req.RequestURI = path
+
+	if publicHandler == nil {
+		return prefetchResult{Path: path, Status: http.StatusServiceUnavailable}
+	}
+
+	w := &debugWriter{header: http.Header{}}
+	publicHandler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return prefetchResult{Path: path, Status: w.status, Bytes: w.bytes, CacheStatus: w.header.Get("Cache-Status")}
+}
+
+// blockEntry is a blocklist member as the admin APIs show it; a zero
+// Expires never ends.
+type blockEntry struct {
+	CIDR    string    `json:"cidr"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+func listBlocks(ctx context.Context) ([]blockEntry, error) {
+	if blocklistKey == "" {
+		return nil, errNoBlocklist
+	}
+
+	members, err := redisClient.ZRangeWithScores(ctx, blocklistKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]blockEntry, 0, len(members))
+	for _, m := range members {
+		e := blockEntry{CIDR: fmt.Sprint(m.Member)}
+		if m.Score > 0 {
+			e.Expires = time.Unix(int64(m.Score), 0)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// blockIP adds cidr to the blocklist, for ttl or, when ttl is zero, for
+// good, and applies it on this replica immediately.
+func blockIP(ctx context.Context, cidr string, ttl time.Duration) (blockEntry, error) {
+	if blocklistKey == "" {
+		return blockEntry{}, errNoBlocklist
+	}
+
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return blockEntry{}, fmt.Errorf("%w: %v", errInvalidAdmin, err)
+	}
+
+	e := blockEntry{CIDR: p.String()}
+	var score float64
+	if ttl > 0 {
+		e.Expires = time.Now().Add(ttl).Truncate(time.Second)
+		score = float64(e.Expires.Unix())
+	}
+
+	if err := redisClient.ZAdd(ctx, blocklistKey, redis.Z{Score: score, Member: e.CIDR}).Err(); err != nil {
+		return blockEntry{}, err
+	}
+	notify("ip_blocked", e.CIDR, e.CIDR+" was added to the blocklist", map[string]any{"cidr": e.CIDR, "expires": e.Expires})
+
+	return e, loadBlocklist(ctx)
+}
+
+func unblockIP(ctx context.Context, cidr string) (bool, error) {
+	if blocklistKey == "" {
+		return false, errNoBlocklist
+	}
+
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errInvalidAdmin, err)
+	}
+
+	// the abuse tooling may have added a bare address
+	n, err := redisClient.ZRem(ctx, blocklistKey, cidr, p.String()).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, loadBlocklist(ctx)
+}
+
+// handlePrefetch serves POST /admin/prefetch.
+func handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := decodeAdminRequest(w, r, &req); err != nil {
+		return
+	}
+
+	results := []prefetchResult{}
+	if err := prefetch(r.Context(), req.Paths, func(res prefetchResult) { results = append(results, res) }); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// handleBlocklist serves GET, POST and DELETE /admin/blocklist.
+func handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := listBlocks(r.Context())
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+	case http.MethodPost:
+		var req struct {
+			CIDR string `json:"cidr"`
+			TTL  string `json:"ttl"`
+		}
+		if err := decodeAdminRequest(w, r, &req); err != nil {
+			return
+		}
+
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": "invalid ttl"})
+				return
+			}
+		}
+
+		e, err := blockIP(r.Context(), req.CIDR, ttl)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	case http.MethodDelete:
+		removed, err := unblockIP(r.Context(), r.URL.Query().Get("cidr"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"removed": removed})
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, r, proxyError{http.StatusMethodNotAllowed, "method_not_allowed"})
+	}
+}
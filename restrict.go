@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const defaultMaxURLLength = 2048
+
+var maxURLLength = defaultMaxURLLength
+
+// publicMethods are the only methods forwarded on public routes, so nothing
+// that reaches MinIO through the proxy can modify the bucket.
+var publicMethods = []string{http.MethodGet, http.MethodHead}
+
+// restrictRequests rejects anything a public asset route has no business
+// receiving before it gets near the upstream.
+func restrictRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(publicMethods, r.Method) {
+			w.Header().Set("Allow", strings.Join(publicMethods, ", "))
+			writeError(w, r, proxyError{http.StatusMethodNotAllowed, "method_not_allowed"})
+			return
+		}
+
+		if len(r.RequestURI) > maxURLLength {
+			writeError(w, r, proxyError{http.StatusRequestURITooLong, "uri_too_long"})
+			return
+		}
+
+		if r.ContentLength > 0 || len(r.TransferEncoding) > 0 {
+			writeError(w, r, proxyError{http.StatusRequestEntityTooLarge, "body_not_allowed"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
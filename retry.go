@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultUpstreamRetries     = 2
+	defaultUpstreamRetryDelay  = 100 * time.Millisecond
+	defaultUpstreamRetryBudget = 2 * time.Second
+
+	maxUpstreamRetryDelay = time.Second
+)
+
+// retryTransport retries idempotent upstream requests that failed to connect
+// or hit a gateway error, so a MinIO restart isn't visible to clients. Each
+// request gets at most maxRetries retries and budget of total backoff, with
+// exponential, jittered delays. The number of retries is reported in
+// X-Proxy-Retries.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	budget     time.Duration
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		return t.next.RoundTrip(req)
+	}
+
+	var spent time.Duration
+	for retries := 0; ; retries++ {
+		resp, err := t.next.RoundTrip(req)
+		if req.Context().Err() != nil || (err == nil && !retryableStatus(resp.StatusCode)) {
+			return withRetries(resp, retries), err
+		}
+
+		delay := min(t.baseDelay<<retries, maxUpstreamRetryDelay)
+		delay = delay/2 + rand.N(delay/2+1)
+		if retries >= t.maxRetries || spent+delay > t.budget {
+			return withRetries(resp, retries), err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxS3ErrorBody))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+			spent += delay
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func withRetries(resp *http.Response, retries int) *http.Response {
+	if resp != nil && retries > 0 {
+		resp.Header.Set("X-Proxy-Retries", strconv.Itoa(retries))
+	}
+
+	return resp
+}
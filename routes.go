@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// route maps a public path pattern to an object path in the bucket.
+//
+// Patterns are either a path with placeholders or, when prefixed with "~", a
+// raw regular expression whose named groups become variables:
+//
+//	/avatars/{userID}/{hash}      {name} matches a single segment
+//	/files/{userID}/{rest...}     {name...} matches the remainder of the path
+//	/static/*/**                  * and ** are the anonymous forms of the above
+//	~^/u/(?P<userID>\d+)\.png$
+//
+// Origin templates reference variables as {name}. A variable that the pattern
+// doesn't capture is taken from the query string (and removed from the
+// forwarded query), falling back to the default given as {name=default}.
+//
+// UpstreamTimeout bounds fetching a route's objects, defaulting to
+// UPSTREAM_TIMEOUT, or UPSTREAM_STREAM_TIMEOUT for Streaming routes. A
+// streaming route's timeout is for headers and then each read of the body,
+// and its responses' write deadlines move while they're being written.
+type route struct {
+	Name            string `json:"name"`
+	Pattern         string `json:"pattern"`
+	Origin          string `json:"origin"`
+	UpstreamTimeout string `json:"upstream_timeout,omitempty"`
+	Streaming       bool   `json:"streaming,omitempty"`
+
+	re              *regexp.Regexp
+	upstreamTimeout time.Duration
+}
+
+var (
+	builtinRoutes = []route{
+		{Name: "avatars", Pattern: "/avatars/{userID}/{hash...}", Origin: "/avatars/{userID}/{hash}.{format=webp}"},
+		// video banners are played as stored, ranges and all
+		{Name: bannerVideoRoute, Pattern: `~^/banners/(?P<userID>[^/]+)/(?P<file>[^/]+\.(?:mp4|webm))$`, Origin: "/banners/{userID}/{file}", Streaming: true},
+		{Name: "banners", Pattern: "/banners/{userID}/{hash...}", Origin: "/banners/{userID}/{hash}.{format=webp}"},
+		{Name: "emojis", Pattern: "/emojis/{guildID}/{hash...}", Origin: "/emojis/{guildID}/{hash}.{format=webp}"},
+		{Name: "songs", Pattern: "/songs/{userID}/{file...}", Origin: "/songs/{userID}/{file}", Streaming: true},
+		{Name: "attachments", Pattern: "/attachments/{userID}/{file...}", Origin: "/attachments/{userID}/{file}", Streaming: true},
+	}
+
+	routes []route
+
+	templateVar = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?:=([^}]*))?\}`)
+)
+
+// loadRoutes compiles the built-in routes followed by any routes defined in
+// the JSON file at path.
+func loadRoutes(path string) ([]route, error) {
+	defs := append([]route(nil), builtinRoutes...)
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var extra []route
+		if err := json.Unmarshal(data, &extra); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		defs = append(defs, extra...)
+	}
+
+	return compileRoutes(defs)
+}
+
+// parseRoutes compiles the built-in routes followed by candidate ones, as
+// loadRoutes would from a file.
+func parseRoutes(extra []route) ([]route, error) {
+	return compileRoutes(append(append([]route(nil), builtinRoutes...), extra...))
+}
+
+func compileRoutes(defs []route) ([]route, error) {
+	for i := range defs {
+		re, err := compilePattern(defs[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", defs[i].Name, err)
+		}
+		defs[i].re = re
+
+		if defs[i].UpstreamTimeout != "" {
+			d, err := time.ParseDuration(defs[i].UpstreamTimeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("route %q: invalid upstream_timeout %q", defs[i].Name, defs[i].UpstreamTimeout)
+			}
+			defs[i].upstreamTimeout = d
+		}
+	}
+
+	return defs, nil
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		return regexp.Compile(expr)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			sb.WriteString("[^/]+")
+			i++
+		case pattern[i] == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated placeholder in %q", pattern)
+			}
+
+			name := pattern[i+1 : i+end]
+			expr := "[^/]+"
+			if trimmed, ok := strings.CutSuffix(name, "..."); ok {
+				name, expr = trimmed, ".+"
+			}
+
+			fmt.Fprintf(&sb, "(?P<%s>%s)", name, expr)
+			i += end + 1
+		default:
+			end := strings.IndexAny(pattern[i:], "*{")
+			if end < 0 {
+				end = len(pattern) - i
+			}
+
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+end]))
+			i += end
+		}
+	}
+
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func matchRoute(path string) (*route, map[string]string) {
+	return matchRouteIn(routes, path)
+}
+
+func matchRouteIn(rs []route, path string) (*route, map[string]string) {
+	for i := range rs {
+		m := rs[i].re.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+
+		vars := make(map[string]string)
+		for j, name := range rs[i].re.SubexpNames() {
+			if name != "" {
+				vars[name] = m[j]
+			}
+		}
+
+		return &rs[i], vars
+	}
+
+	return nil, nil
+}
+
+// routeNamed is the first route called name, or nil.
+func routeNamed(name string) *route {
+	for i := range routes {
+		if routes[i].Name == name {
+			return &routes[i]
+		}
+	}
+
+	return nil
+}
+
+func hasRoute(path string) bool {
+	rt, _ := matchRoute(path)
+	return rt != nil
+}
+
+// expand renders the origin path, consuming any query parameters it uses.
+func (rt *route) expand(vars map[string]string, q url.Values) string {
+	return templateVar.ReplaceAllStringFunc(rt.Origin, func(m string) string {
+		sub := templateVar.FindStringSubmatch(m)
+		name, def := sub[1], sub[2]
+
+		if v, ok := vars[name]; ok {
+			return v
+		}
+
+		if v := q.Get(name); v != "" {
+			q.Del(name)
+			return v
+		}
+		q.Del(name)
+
+		return def
+	})
+}
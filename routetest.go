@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+const maxRouteTestBody = 1 << 20
+
+// routeTestRequest is a hypothetical request to evaluate. Routes, if given,
+// replace the ROUTES_FILE entries so a candidate file can be checked before
+// it's deployed. Routing ignores the host; it's accepted so tooling can send
+// requests verbatim.
+type routeTestRequest struct {
+	Method  string            `json:"method"`
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Routes  []route           `json:"routes"`
+}
+
+type routeTestResult struct {
+	Method   string `json:"method"`
+	Host     string `json:"host,omitempty"`
+	Path     string `json:"path"`
+	Rejected string `json:"rejected,omitempty"`
+
+	Route string            `json:"route,omitempty"`
+	Vars  map[string]string `json:"vars,omitempty"`
+
+	// LegacyLookup means no route matched and the path looks like an old
+	// asset URL, so it would be looked up in legacy_urls for a redirect
+	// before being answered not_found.
+	LegacyLookup bool   `json:"legacy_lookup,omitempty"`
+	OriginURL    string `json:"origin_url,omitempty"`
+
+	Transform      string `json:"transform,omitempty"`
+	TransformError string `json:"transform_error,omitempty"`
+	Private        bool   `json:"private_if_profile_private,omitempty"`
+
+	CachePolicy  string `json:"cache_policy_arm"`
+	CacheControl string `json:"cache_control,omitempty"`
+
+	CORSPolicy        string `json:"cors_policy,omitempty"`
+	CORSOriginAllowed *bool  `json:"cors_origin_allowed,omitempty"`
+
+	Coalescable bool `json:"coalescable"`
+}
+
+// handleRouteTest reports how the proxy would handle a request without
+// sending anything upstream.
+func handleRouteTest(w http.ResponseWriter, r *http.Request) {
+	var req routeTestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRouteTestBody)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+		return
+	}
+
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	u, err := url.ParseRequestURI(req.Path)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": "invalid path"})
+		return
+	}
+
+	rs := routes
+	if req.Routes != nil {
+		rs, err = parseRoutes(req.Routes)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "detail": err.Error()})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, evaluateRoute(rs, req, u))
+}
+
+func evaluateRoute(rs []route, req routeTestRequest, u *url.URL) routeTestResult {
+	res := routeTestResult{Method: req.Method, Host: req.Host, Path: u.RequestURI()}
+
+	switch {
+	case !slices.Contains(publicMethods, req.Method):
+		res.Rejected = "method_not_allowed"
+	case len(u.RequestURI()) > maxURLLength:
+		res.Rejected = "uri_too_long"
+	}
+
+	header := http.Header{}
+	for k, v := range req.Headers {
+		header.Set(k, v)
+	}
+
+	q := u.Query()
+	origin := minioURL.JoinPath(u.Path)
+	rt, vars := matchRouteIn(rs, u.Path)
+	if rt == nil {
+		res.Route = "other"
+		res.LegacyLookup = legacyAssetPath(u.Path)
+		if res.Rejected == "" {
+			res.Rejected = "not_found"
+		}
+		origin = nil
+	} else {
+		res.Route, res.Vars = rt.Name, vars
+		if err := checkRouteVars(rt, vars, q); err != nil && res.Rejected == "" {
+			res.Rejected = "bad_request"
+		}
+
+		res.Private = sessions != nil && privateRoutes[rt.Name] && vars["userID"] != ""
+
+		origin.Path = "/" + minioBucket + rt.expand(vars, q)
+		origin.RawQuery = q.Encode()
+
+		if ir, ok := imageRoutes[rt.Name]; ok {
+			p, transform, err := parseImageParams(ir, u.Query())
+			switch {
+			case err != nil:
+				res.TransformError = err.Error()
+			case transform:
+				// variants are rendered from the stored original
+				res.Transform = p.key()
+				origin.Path = "/" + minioBucket + "/" + rt.Name + "/" + vars[ir.owner] + "/" + vars["hash"] + ".webp"
+				origin.RawQuery = ""
+			}
+		}
+	}
+	if origin != nil {
+		res.OriginURL = origin.String()
+	}
+
+	arm, policy := selectCachePolicy(res.Route, u.Path)
+	res.CachePolicy = arm
+	if policy != nil {
+		res.CacheControl = policy.header()
+	}
+
+	if p := corsPolicyFor(res.Route); p != nil {
+		res.CORSPolicy = defaultCORSRoute
+		if _, ok := corsPolicies[res.Route]; ok {
+			res.CORSPolicy = res.Route
+		}
+		if o := header.Get("Origin"); o != "" {
+			allowed := p.allowsOrigin(o)
+			res.CORSOriginAllowed = &allowed
+		}
+	}
+
+	res.Coalescable = coalescable(&http.Request{Method: req.Method, Header: header})
+
+	return res
+}
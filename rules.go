@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// purgeRule removes what matches Prefix on a schedule. The variants target
+// is rendered variants not requested for Idle, on disk and in the
+// derivatives bucket; objects is originals in the media bucket last written
+// more than Age ago. A dry run only counts what would go.
+type purgeRule struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Target string `json:"target"`
+	Idle   string `json:"idle,omitempty"`
+	Age    string `json:"age,omitempty"`
+	Every  string `json:"every"`
+	DryRun bool   `json:"dry_run,omitempty"`
+
+	olderThan time.Duration
+	every     time.Duration
+}
+
+// ruleResult is what a rule's last run found, kept in Valkey so any
+// replica can report it.
+type ruleResult struct {
+	Rule     string          `json:"rule"`
+	DryRun   bool            `json:"dry_run"`
+	Started  time.Time       `json:"started"`
+	Duration float64         `json:"duration_seconds"`
+	Stages   []stageProgress `json:"stages"`
+	Error    string          `json:"error,omitempty"`
+}
+
+var purgeRules []*purgeRule
+
+var (
+	ruleRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_rule_runs_total",
+		Help: "Purge rule runs, by rule and result.",
+	}, []string{"rule", "result"})
+
+	ruleRemovedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_rule_removed_total",
+		Help: "Entries purge rules removed, or would have in dry runs, by rule, store and mode.",
+	}, []string{"rule", "store", "mode"})
+
+	ruleRemovedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_rule_removed_bytes_total",
+		Help: "Bytes purge rules removed, or would have in dry runs, by rule, store and mode.",
+	}, []string{"rule", "store", "mode"})
+
+	ruleLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_proxy_rule_last_run_timestamp_seconds",
+		Help: "When each purge rule last finished on this replica.",
+	}, []string{"rule"})
+)
+
+func loadPurgeRules(path string) ([]*purgeRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*purgeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("rule %q is defined twice", r.Name)
+		}
+		seen[r.Name] = true
+	}
+
+	return rules, nil
+}
+
+func (r *purgeRule) check() error {
+	if r.Name == "" || strings.ContainsAny(r.Name, " /") {
+		return fmt.Errorf("needs a name without spaces or slashes")
+	}
+
+	// prefixes read like public paths but must stay inside a kind
+	r.Prefix = strings.TrimPrefix(r.Prefix, "/")
+	if kind, _, _ := strings.Cut(r.Prefix, "/"); kind == "" || !strings.HasSuffix(r.Prefix, "/") {
+		return fmt.Errorf("prefix must be a kind or kind/owner, ending in /")
+	}
+
+	var older string
+	switch r.Target {
+	case "variants":
+		older = r.Idle
+	case "objects":
+		older = r.Age
+	default:
+		return fmt.Errorf("target must be variants or objects")
+	}
+
+	var err error
+	if r.olderThan, err = time.ParseDuration(older); err != nil || r.olderThan <= 0 {
+		return fmt.Errorf("%s rules need a positive %s", r.Target, map[string]string{"variants": "idle", "objects": "age"}[r.Target])
+	}
+	if r.every, err = time.ParseDuration(r.Every); err != nil || r.every < time.Minute {
+		return fmt.Errorf("every must be a duration of at least 1m")
+	}
+
+	return nil
+}
+
+// runPurgeRules schedules every rule. Each interval one replica claims a
+// rule's run; the local disk stage runs on every replica, since each has
+// its own disk cache.
+func runPurgeRules(ctx context.Context) {
+	for _, r := range purgeRules {
+		go func() {
+			ticker := time.NewTicker(r.every)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				if r.Target == "variants" {
+					st, err := purgeIdleDiskVariants(ctx, r.Prefix, r.olderThan, r.DryRun)
+					if err != nil {
+						log.Printf("rule %s: disk stage failed: %v", r.Name, err)
+					}
+					r.record("disk", st, r.DryRun)
+				}
+
+				if claimRuleRun(ctx, r) {
+					res := runPurgeRule(ctx, r, r.DryRun, false)
+					if res.Error != "" {
+						log.Printf("rule %s failed: %s", r.Name, res.Error)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// claimRuleRun lets one replica run a rule per interval. A rule never runs
+// when Valkey can't say whose turn it is, since rules delete things.
+func claimRuleRun(ctx context.Context, r *purgeRule) bool {
+	ok, err := redisClient.SetNX(ctx, "rules:claim:"+r.Name, time.Now().Unix(), r.every*9/10).Result()
+	if err != nil {
+		log.Printf("valkey SETNX error: %v", err)
+		return false
+	}
+
+	return ok
+}
+
+func (r *purgeRule) record(store string, st stageProgress, dryRun bool) {
+	mode := "apply"
+	if dryRun {
+		mode = "dry_run"
+	}
+
+	ruleRemovedTotal.WithLabelValues(r.Name, store, mode).Add(float64(st.Count))
+	ruleRemovedBytesTotal.WithLabelValues(r.Name, store, mode).Add(float64(st.Bytes))
+}
+
+// runPurgeRule runs the shared stages of a rule and saves the result.
+// Scheduled runs leave the disk stage to each replica; withDisk includes
+// this replica's.
+func runPurgeRule(ctx context.Context, r *purgeRule, dryRun, withDisk bool) ruleResult {
+	res := ruleResult{Rule: r.Name, DryRun: dryRun, Started: time.Now(), Stages: []stageProgress{}}
+
+	var err error
+	switch r.Target {
+	case "variants":
+		if withDisk {
+			var st stageProgress
+			st, err = purgeIdleDiskVariants(ctx, r.Prefix, r.olderThan, dryRun)
+			res.Stages = append(res.Stages, st)
+			r.record("disk", st, dryRun)
+		}
+		if err == nil && derivativesBucket != "" {
+			var st stageProgress
+			st, err = purgeIdleBucketVariants(ctx, r.Prefix, r.olderThan, dryRun)
+			res.Stages = append(res.Stages, st)
+			r.record("bucket", st, dryRun)
+		}
+	case "objects":
+		if s3Client == nil {
+			err = errNoS3
+			break
+		}
+		var st stageProgress
+		st, err = purgeOldObjects(ctx, r.Prefix, r.olderThan, dryRun)
+		res.Stages = append(res.Stages, st)
+		r.record("objects", st, dryRun)
+	}
+
+	result := "ok"
+	if err != nil {
+		res.Error, result = err.Error(), "failed"
+	}
+	res.Duration = time.Since(res.Started).Seconds()
+	ruleRunsTotal.WithLabelValues(r.Name, result).Inc()
+	ruleLastRun.WithLabelValues(r.Name).SetToCurrentTime()
+
+	if data, err := json.Marshal(res); err == nil {
+		if err := redisClient.Set(ctx, "rules:result:"+r.Name, data, 0).Err(); err != nil {
+			log.Printf("valkey SET error: %v", err)
+		}
+	}
+
+	return res
+}
+
+// purgeIdleDiskVariants removes this replica's variants under prefix that
+// haven't been served for idle, going by the variant index.
+func purgeIdleDiskVariants(ctx context.Context, prefix string, idle time.Duration, dryRun bool) (stageProgress, error) {
+	st := stageProgress{Stage: "disk"}
+	cutoff := time.Now().Add(-idle)
+
+	err := scanKeys(ctx, variantIndexPrefix+prefix+"*", func(index string) error {
+		keys, err := redisClient.SMembers(ctx, index).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			path := variantCache.path(key)
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue
+			}
+			if !dryRun && os.Remove(path) != nil {
+				continue
+			}
+
+			st.Count++
+			st.Bytes += info.Size()
+		}
+
+		return nil
+	})
+	st.Done = err == nil
+
+	return st, err
+}
+
+func purgeIdleBucketVariants(ctx context.Context, prefix string, idle time.Duration, dryRun bool) (stageProgress, error) {
+	st := stageProgress{Stage: "bucket"}
+
+	keys, err := idleDerivatives(ctx, idle)
+	if err != nil {
+		return st, err
+	}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "variants/"+prefix) {
+			continue
+		}
+
+		var size int64
+		if dryRun {
+			size, _ = redisClient.HGet(ctx, derivativeSizesKey, key).Int64()
+		} else if size, err = removeDerivative(ctx, key); err != nil {
+			return st, err
+		}
+
+		st.Count++
+		st.Bytes += size
+	}
+	st.Done = true
+
+	return st, nil
+}
+
+func purgeOldObjects(ctx context.Context, prefix string, age time.Duration, dryRun bool) (stageProgress, error) {
+	st := stageProgress{Stage: "objects"}
+	cutoff := time.Now().Add(-age)
+
+	for obj := range s3Client.ListObjects(ctx, minioBucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return st, obj.Err
+		}
+		if !obj.LastModified.Before(cutoff) {
+			continue
+		}
+
+		if !dryRun {
+			if err := s3Client.RemoveObject(ctx, minioBucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+				return st, err
+			}
+		}
+
+		st.Count++
+		st.Bytes += obj.Size
+	}
+	st.Done = true
+
+	return st, nil
+}
+
+// handleRules serves GET /admin/rules, each rule with its last result.
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	type ruleStatus struct {
+		*purgeRule
+		Last *ruleResult `json:"last,omitempty"`
+	}
+
+	out := make([]ruleStatus, 0, len(purgeRules))
+	for _, rule := range purgeRules {
+		s := ruleStatus{purgeRule: rule}
+		data, err := redisClient.Get(r.Context(), "rules:result:"+rule.Name).Bytes()
+		if err != nil && err != redis.Nil {
+			writeAdminError(w, err)
+			return
+		}
+		if err == nil {
+			json.Unmarshal(data, &s.Last)
+		}
+		out = append(out, s)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"rules": out})
+}
+
+// handleRunRule serves POST /admin/rules/{name}/run, running a rule now,
+// including this replica's disk stage. ?dry_run=1 counts without removing.
+func handleRunRule(w http.ResponseWriter, r *http.Request) {
+	for _, rule := range purgeRules {
+		if rule.Name == r.PathValue("name") {
+			dryRun := rule.DryRun || r.URL.Query().Get("dry_run") == "1"
+			writeJSON(w, http.StatusOK, runPurgeRule(r.Context(), rule, dryRun, true))
+			return
+		}
+	}
+
+	writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+}
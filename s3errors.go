@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// S3 error bodies are small; anything larger is not worth parsing.
+const maxS3ErrorBody = 64 << 10
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+}
+
+type proxyError struct {
+	status int
+	code   string
+}
+
+func (e proxyError) Error() string {
+	return e.code
+}
+
+var s3ErrorCodes = map[string]proxyError{
+	"NoSuchKey":          {http.StatusNotFound, "not_found"},
+	"NoSuchBucket":       {http.StatusNotFound, "not_found"},
+	"NoSuchVersion":      {http.StatusNotFound, "not_found"},
+	"AccessDenied":       {http.StatusForbidden, "forbidden"},
+	"InvalidRange":       {http.StatusRequestedRangeNotSatisfiable, "invalid_range"},
+	"PreconditionFailed": {http.StatusPreconditionFailed, "precondition_failed"},
+	"InvalidArgument":    {http.StatusBadRequest, "bad_request"},
+	"InvalidRequest":     {http.StatusBadRequest, "bad_request"},
+	"MethodNotAllowed":   {http.StatusMethodNotAllowed, "method_not_allowed"},
+	"SlowDown":           {http.StatusServiceUnavailable, "unavailable"},
+	"ServiceUnavailable": {http.StatusServiceUnavailable, "unavailable"},
+	"InternalError":      {http.StatusBadGateway, "upstream_error"},
+}
+
+func isS3ErrorResponse(resp *http.Response) bool {
+	if resp.StatusCode >= 400 {
+		return true
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	return strings.Contains(contentType, "application/xml") || strings.Contains(contentType, "text/xml")
+}
+
+// translateS3Error replaces an S3 XML response with the proxy's own error.
+// XML on a successful response is a bucket listing or similar and is never
+// passed through.
+func translateS3Error(resp *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBody))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	perr := parseS3Error(resp.StatusCode, body)
+
+	for name := range resp.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || strings.HasPrefix(lower, "x-minio-") {
+			resp.Header.Del(name)
+		}
+	}
+
+	setError(resp, perr)
+	return nil
+}
+
+func parseS3Error(status int, body []byte) proxyError {
+	var s3err s3Error
+	if xml.Unmarshal(body, &s3err) == nil {
+		if mapped, ok := s3ErrorCodes[s3err.Code]; ok {
+			return mapped
+		}
+	}
+
+	return proxyErrorForStatus(status)
+}
+
+func proxyErrorForStatus(status int) proxyError {
+	switch {
+	case status < 400, status == http.StatusNotFound:
+		return proxyError{http.StatusNotFound, "not_found"}
+	case status == http.StatusForbidden, status == http.StatusUnauthorized:
+		return proxyError{http.StatusForbidden, "forbidden"}
+	case status == http.StatusRequestedRangeNotSatisfiable:
+		return proxyError{status, "invalid_range"}
+	case status == http.StatusServiceUnavailable:
+		return proxyError{status, "unavailable"}
+	case status < 500:
+		return proxyError{http.StatusBadRequest, "bad_request"}
+	default:
+		return proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+}
+
+// writeJSONError answers with perr as JSON whatever the client accepts, for
+// the admin API.
+func writeJSONError(w http.ResponseWriter, perr proxyError) {
+	body, _ := json.Marshal(errorBody{Error: perr.code})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(perr.status)
+	w.Write(body)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// saveDataMaxSize bounds the longer side of Save-Data images that didn't
+	// ask for a size
+	saveDataMaxSize = 512
+
+	// songs for Save-Data clients are re-encoded to AAC at this bitrate,
+	// which every player handles
+	saveDataSongBitrate = "64k"
+)
+
+var (
+	saveDataSongs singleflight.Group
+
+	saveDataFormat = excerptFormats[".m4a"]
+)
+
+// saveData reports whether the client asked for lighter responses with the
+// Save-Data client hint.
+func saveData(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Save-Data")), "on")
+}
+
+// fitSaveData shrinks img to saveDataMaxSize for a bounded render. Smaller
+// images are left as they are.
+func fitSaveData(img image.Image, p imageParams) image.Image {
+	b := img.Bounds()
+	if !p.bounded() || (b.Dx() <= saveDataMaxSize && b.Dy() <= saveDataMaxSize) {
+		return img
+	}
+
+	return fitImage(img, saveDataMaxSize, saveDataMaxSize)
+}
+
+// serveSaveDataSongs answers Save-Data requests for songs with a copy
+// re-encoded at saveDataSongBitrate, cached with the variants. Without
+// ffmpeg, or when re-encoding fails, the song is served as stored.
+func serveSaveDataSongs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt, vars := matchRoute(r.URL.Path)
+		if rt == nil || rt.Name != "songs" || ffmpegPath == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Save-Data")
+		userID, file := vars["userID"], vars["file"]
+		ext := filepath.Ext(file)
+		if _, ok := excerptFormats[ext]; !ok || !saveData(r) || strings.Contains(file, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		hash := strings.TrimSuffix(file, ext)
+		key := "songs/" + userID + "/" + hash + "?save_data=1"
+		traceDecision(r.Context(), "save-data key", key)
+
+		if f, _, ok := variantCache.get(key); ok {
+			defer f.Close()
+			recordCacheStatus(r.Context(), objectCacheName, "hit")
+			writeAudio(w, r, key, saveDataFormat, f)
+			return
+		}
+		recordCacheStatus(r.Context(), objectCacheName, "fwd=uri-miss")
+
+		v, err, _ := saveDataSongs.Do(key, func() (any, error) {
+			args := []string{"-i", "pipe:0", "-map", "0:a", "-c:a", "aac", "-b:a", saveDataSongBitrate}
+			args = append(args, saveDataFormat.args...)
+			args = append(args, "-f", saveDataFormat.muxer, "pipe:1")
+			return ffmpegObject(r.Context(), "/"+minioBucket+"/songs/"+userID+"/"+file, args)
+		})
+		if err != nil {
+			var perr proxyError
+			if errors.As(err, &perr) {
+				writeError(w, r, perr)
+				return
+			}
+			log.Printf("save-data encode of %s failed: %v", key, err)
+			traceDecision(r.Context(), "save-data", "serving the stored song")
+			next.ServeHTTP(w, r)
+			return
+		}
+		data := v.([]byte)
+
+		if err := variantCache.put(key, data); errors.Is(err, errCacheDiskLow) {
+			// counted, and served uncached
+		} else if err != nil {
+			log.Printf("variant cache write error: %v", err)
+		} else {
+			recordCacheStatus(r.Context(), objectCacheName, "stored")
+			indexVariant(r.Context(), "songs", userID, hash, key)
+		}
+
+		writeAudio(w, r, key, saveDataFormat, bytes.NewReader(data))
+	})
+}
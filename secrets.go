@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	defaultSecretsRefreshInterval = 5 * time.Minute
+
+	vaultTimeout      = 5 * time.Second
+	maxVaultSecretLen = 1 << 20
+)
+
+// secretNames can each be set directly, through NAME_FILE naming a file that
+// holds the value (as Docker and Kubernetes mount secrets), or as a key of
+// the Vault secret at VAULT_SECRET_PATH, in that order of precedence.
+//
+// All of them are re-read every SECRETS_REFRESH_INTERVAL. Tokens take effect
+// immediately and credentials on the next connection, except the imgproxy
+// key and salt, which need a restart.
+var secretNames = []string{
+	"POSTGRES_CONN",
+	"VALKEY_PASSWORD",
+	"MINIO_ACCESS_KEY",
+	"MINIO_SECRET_KEY",
+	"UPLOAD_TOKEN",
+	"ADMIN_TOKEN",
+	"SESSION_JWT_SECRET",
+	"SESSION_JWT_KEYS",
+	"SESSION_INTROSPECTION_TOKEN",
+	"GRANT_KEYS",
+	"IMGPROXY_KEY",
+	"IMGPROXY_SALT",
+	"SHADOW_ACCESS_KEY",
+	"SHADOW_SECRET_KEY",
+	"WEBHOOK_SECRET",
+}
+
+type secretStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+	vault  *vaultSource
+}
+
+var secrets = &secretStore{values: map[string]string{}}
+
+func (s *secretStore) get(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.values[name]
+}
+
+// setting reads a secret from the store and anything else from the
+// environment.
+func setting(name string) string {
+	if slices.Contains(secretNames, name) {
+		return secrets.get(name)
+	}
+
+	return os.Getenv(name)
+}
+
+// load reads every secret, returning the names whose values changed. It
+// changes nothing if any source fails, so a refresh can't drop a secret.
+func (s *secretStore) load(ctx context.Context) ([]string, error) {
+	var fromVault map[string]string
+	if s.vault != nil {
+		var err error
+		if fromVault, err = s.vault.fetch(ctx); err != nil {
+			return nil, fmt.Errorf("vault: %w", err)
+		}
+	}
+
+	values := make(map[string]string, len(secretNames))
+	for _, name := range secretNames {
+		v, err := readSecret(name, fromVault)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []string
+	for _, name := range secretNames {
+		if s.values[name] != values[name] {
+			changed = append(changed, name)
+		}
+	}
+	s.values = values
+
+	return changed, nil
+}
+
+func readSecret(name string, fromVault map[string]string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read %s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return fromVault[name], nil
+}
+
+// refresh re-reads secrets every interval, keeping the old values when a
+// source is unavailable.
+func (s *secretStore) refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := s.load(ctx)
+		if err != nil {
+			log.Printf("secret refresh failed: %v", err)
+			continue
+		}
+
+		if len(changed) > 0 {
+			log.Printf("secrets changed: %s", strings.Join(changed, ", "))
+		}
+	}
+}
+
+// vaultSource reads a KV secret (v1 or v2) from Vault. The token is re-read
+// on every fetch so a file kept fresh by Vault Agent works.
+type vaultSource struct {
+	addr      string
+	path      string
+	namespace string
+	client    *http.Client
+}
+
+func newVaultSource(addr, path string) *vaultSource {
+	return &vaultSource{
+		addr:      strings.TrimSuffix(addr, "/"),
+		path:      strings.Trim(path, "/"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		client:    &http.Client{Timeout: vaultTimeout},
+	}
+}
+
+func (v *vaultSource) token() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return "", fmt.Errorf("VAULT_TOKEN is not set")
+}
+
+func (v *vaultSource) fetch(ctx context.Context) (map[string]string, error) {
+	token, err := v.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", v.path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxVaultSecretLen)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", v.path, err)
+	}
+
+	// KV v2 nests the secret under data.data, next to data.metadata
+	data := body.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	values := make(map[string]string, len(data))
+	for k, val := range data {
+		if s, ok := val.(string); ok {
+			values[k] = s
+		}
+	}
+
+	return values, nil
+}
+
+// secretConnector opens Postgres connections with the current
+// POSTGRES_CONN, so rotated credentials are picked up as the pool recycles.
+type secretConnector struct{}
+
+func (secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c, err := pq.NewConnector(secrets.get("POSTGRES_CONN"))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Connect(ctx)
+}
+
+func (secretConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// secretCredentials hands MinIO clients the current access keys.
+type secretCredentials struct{}
+
+func (secretCredentials) RetrieveWithCredContext(*credentials.CredContext) (credentials.Value, error) {
+	return secretCredentials{}.Retrieve()
+}
+
+func (secretCredentials) Retrieve() (credentials.Value, error) {
+	return credentials.Value{
+		AccessKeyID:     secrets.get("MINIO_ACCESS_KEY"),
+		SecretAccessKey: secrets.get("MINIO_SECRET_KEY"),
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// IsExpired is always true so every request sees the current keys; reading
+// them is a map lookup.
+func (secretCredentials) IsExpired() bool { return true }
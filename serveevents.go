@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxServeWatchers   = 32
+	serveWatcherBuffer = 256
+)
+
+// serveEvent describes one response the public listener sent. Query
+// strings are left out since they can carry grants and session tokens.
+type serveEvent struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Route       string    `json:"route"`
+	UserID      string    `json:"user_id,omitempty"`
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	DurationMS  float64   `json:"duration_ms"`
+	CacheStatus string    `json:"cache_status,omitempty"`
+	Client      string    `json:"client,omitempty"`
+}
+
+// serveWatcher receives the events matching its filters. Events it is too
+// slow for are dropped and counted rather than holding up responses.
+type serveWatcher struct {
+	userID, route string
+	events        chan serveEvent
+	dropped       atomic.Int64
+}
+
+var serveWatchers = struct {
+	sync.RWMutex
+	set   map[*serveWatcher]struct{}
+	count atomic.Int32
+}{set: map[*serveWatcher]struct{}{}}
+
+func watchServes(userID, route string) (*serveWatcher, bool) {
+	serveWatchers.Lock()
+	defer serveWatchers.Unlock()
+
+	if len(serveWatchers.set) >= maxServeWatchers {
+		return nil, false
+	}
+
+	sw := &serveWatcher{userID: userID, route: route, events: make(chan serveEvent, serveWatcherBuffer)}
+	serveWatchers.set[sw] = struct{}{}
+	serveWatchers.count.Add(1)
+
+	return sw, true
+}
+
+func unwatchServes(sw *serveWatcher) {
+	serveWatchers.Lock()
+	defer serveWatchers.Unlock()
+
+	delete(serveWatchers.set, sw)
+	serveWatchers.count.Add(-1)
+}
+
+// publishServe hands a finished response to the watchers. It costs nothing
+// while nobody is watching.
+func publishServe(r *http.Request, rec *responseRecorder, route string, start time.Time) {
+	if serveWatchers.count.Load() == 0 {
+		return
+	}
+
+	ev := serveEvent{
+		Time:        start,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Route:       route,
+		Status:      rec.status,
+		Bytes:       rec.bytes,
+		DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+		CacheStatus: rec.Header().Get("Cache-Status"),
+	}
+	if _, vars := matchRoute(r.URL.Path); vars != nil {
+		ev.UserID = vars["userID"]
+	}
+	if addr := clientIP(r); addr.IsValid() {
+		ev.Client = addr.String()
+	}
+
+	serveWatchers.RLock()
+	defer serveWatchers.RUnlock()
+
+	for sw := range serveWatchers.set {
+		if (sw.userID != "" && sw.userID != ev.UserID) || (sw.route != "" && sw.route != ev.Route) {
+			continue
+		}
+
+		select {
+		case sw.events <- ev:
+		default:
+			sw.dropped.Add(1)
+		}
+	}
+}
+
+// handleServeEvents serves GET /admin/events as server-sent events,
+// optionally filtered by ?user_id= and ?route=. Each replica reports its
+// own traffic.
+func handleServeEvents(w http.ResponseWriter, r *http.Request) {
+	sw, ok := watchServes(r.URL.Query().Get("user_id"), r.URL.Query().Get("route"))
+	if !ok {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "unavailable", "detail": "too many watchers"})
+		return
+	}
+	defer unwatchServes(sw)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	keepalive := time.NewTicker(operationIdle)
+	defer keepalive.Stop()
+
+	var reported int64
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case ev := <-sw.events:
+			if dropped := sw.dropped.Load(); dropped > reported {
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", dropped-reported)
+				reported = dropped
+			}
+			if err == nil {
+				data, _ := json.Marshal(ev)
+				_, err = fmt.Fprintf(w, "event: serve\ndata: %s\n\n", data)
+			}
+		}
+
+		if err != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	shadowTimeout = 30 * time.Second
+
+	// mirrored requests beyond this many in flight are dropped, so a slow
+	// shadow can't pile up goroutines
+	shadowConcurrency = 32
+
+	maxShadowDiffs = 100
+)
+
+var (
+	shadowRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_shadow_requests_total",
+		Help: "Upstream GETs mirrored to the shadow upstream, by route and result: match, status_mismatch, length_mismatch, error or dropped.",
+	}, []string{"route", "result"})
+
+	shadowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cdn_proxy_shadow_duration_seconds",
+		Help:    "Time to response headers of mirrored requests, by route and upstream: primary or shadow.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "upstream"})
+
+	// shadowDiffs is a ring of the most recent mirrored requests whose
+	// results differed
+	shadowDiffs = struct {
+		sync.Mutex
+		ring  [maxShadowDiffs]shadowDiff
+		next  int
+		total int64
+	}{}
+)
+
+// shadowTransport sends a share of upstream GETs to a second upstream too,
+// such as a cluster being migrated to, and compares what it answers with
+// what the primary did. The mirrored request runs after the primary has
+// answered, on its own, and its response is only measured and thrown away.
+//
+// It sits inside the coalescer, so it sees the requests that reach the
+// bucket rather than those the caches answered.
+type shadowTransport struct {
+	next    http.RoundTripper
+	shadow  http.RoundTripper
+	target  *url.URL
+	bucket  string
+	percent float64
+	slots   chan struct{}
+}
+
+// shadowResult is how one upstream answered a mirrored request.
+type shadowResult struct {
+	status  int
+	length  int64
+	latency time.Duration
+	err     error
+}
+
+// shadowDiff is a mirrored request the upstreams answered differently.
+type shadowDiff struct {
+	Time          time.Time `json:"time"`
+	Path          string    `json:"path"`
+	Route         string    `json:"route"`
+	Result        string    `json:"result"`
+	PrimaryStatus int       `json:"primary_status"`
+	ShadowStatus  int       `json:"shadow_status"`
+	PrimaryLength int64     `json:"primary_length"`
+	ShadowLength  int64     `json:"shadow_length"`
+	PrimaryMS     float64   `json:"primary_ms"`
+	ShadowMS      float64   `json:"shadow_ms"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func newShadowTransport(next http.RoundTripper, endpoint *url.URL, bucket string, percent float64) *shadowTransport {
+	var shadow http.RoundTripper = http.DefaultTransport
+	if secrets.get("SHADOW_ACCESS_KEY") != "" && secrets.get("SHADOW_SECRET_KEY") != "" {
+		shadow = &signingTransport{next: shadow, creds: credentials.New(shadowCredentials{}), region: defaultMinioRegion}
+	}
+
+	return &shadowTransport{
+		next:    next,
+		shadow:  shadow,
+		target:  endpoint,
+		bucket:  bucket,
+		percent: percent,
+		slots:   make(chan struct{}, shadowConcurrency),
+	}
+}
+
+func (t *shadowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || rand.Float64()*100 >= t.percent || isPrefetch(req.Context()) {
+		return t.next.RoundTrip(req)
+	}
+
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	primary := shadowResult{latency: time.Since(started), err: err}
+	if err == nil {
+		primary.status, primary.length = resp.StatusCode, resp.ContentLength
+	}
+
+	route := routeNameFrom(req.Context())
+	select {
+	case t.slots <- struct{}{}:
+		mirrored := t.mirrorRequest(req)
+		go func() {
+			defer func() { <-t.slots }()
+			t.compare(mirrored, route, primary)
+		}()
+	default:
+		shadowRequestsTotal.WithLabelValues(route, "dropped").Inc()
+	}
+
+	return resp, err
+}
+
+// mirrorRequest is req addressed to the shadow bucket, detached from the
+// client so it isn't cancelled with it.
+func (t *shadowTransport) mirrorRequest(req *http.Request) *http.Request {
+	out := req.Clone(context.WithoutCancel(req.Context()))
+	out.Body, out.GetBody, out.ContentLength = nil, nil, 0
+
+	u := *req.URL
+	u.Scheme, u.Host = t.target.Scheme, t.target.Host
+	if rest, ok := strings.CutPrefix(u.Path, "/"+minioBucket+"/"); ok {
+		u.Path = "/" + t.bucket + "/" + rest
+	}
+	u.RawPath = ""
+	out.URL, out.Host = &u, u.Host
+	out.Header.Del("Authorization")
+
+	return out
+}
+
+func (t *shadowTransport) compare(req *http.Request, route string, primary shadowResult) {
+	ctx, cancel := context.WithTimeout(req.Context(), shadowTimeout)
+	defer cancel()
+
+	started := time.Now()
+	var shadow shadowResult
+	resp, err := t.shadow.RoundTrip(req.WithContext(ctx))
+	shadow.latency = time.Since(started)
+	if err != nil {
+		shadow.err = err
+	} else {
+		shadow.status, shadow.length = resp.StatusCode, resp.ContentLength
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	result := "match"
+	switch {
+	case shadow.err != nil || primary.err != nil:
+		result = "error"
+	case shadow.status != primary.status:
+		result = "status_mismatch"
+	// error bodies name the bucket, so only objects' lengths are compared
+	case primary.status < 300 && shadow.length >= 0 && primary.length >= 0 && shadow.length != primary.length:
+		result = "length_mismatch"
+	}
+
+	shadowRequestsTotal.WithLabelValues(route, result).Inc()
+	if shadow.err == nil {
+		shadowDuration.WithLabelValues(route, "shadow").Observe(shadow.latency.Seconds())
+	}
+	if primary.err == nil {
+		shadowDuration.WithLabelValues(route, "primary").Observe(primary.latency.Seconds())
+	}
+
+	if result != "match" {
+		recordShadowDiff(req, route, result, primary, shadow)
+	}
+}
+
+func recordShadowDiff(req *http.Request, route, result string, primary, shadow shadowResult) {
+	d := shadowDiff{
+		Time:          time.Now(),
+		Path:          req.URL.Path,
+		Route:         route,
+		Result:        result,
+		PrimaryStatus: primary.status,
+		ShadowStatus:  shadow.status,
+		PrimaryLength: primary.length,
+		ShadowLength:  shadow.length,
+		PrimaryMS:     float64(primary.latency.Microseconds()) / 1000,
+		ShadowMS:      float64(shadow.latency.Microseconds()) / 1000,
+	}
+	for _, err := range []error{primary.err, shadow.err} {
+		if err != nil {
+			d.Error = err.Error()
+			break
+		}
+	}
+
+	if result == "status_mismatch" {
+		log.Printf("shadow upstream answered %s with %d, primary with %d", d.Path, d.ShadowStatus, d.PrimaryStatus)
+	}
+
+	shadowDiffs.Lock()
+	defer shadowDiffs.Unlock()
+
+	shadowDiffs.ring[shadowDiffs.next] = d
+	shadowDiffs.next = (shadowDiffs.next + 1) % maxShadowDiffs
+	shadowDiffs.total++
+}
+
+// handleShadowDiffs serves GET /admin/shadow, the recent differences, newest
+// first, with how many there have been.
+func handleShadowDiffs(w http.ResponseWriter, r *http.Request) {
+	shadowDiffs.Lock()
+	n := min(shadowDiffs.total, maxShadowDiffs)
+	diffs := make([]shadowDiff, 0, n)
+	for i := int64(1); i <= n; i++ {
+		diffs = append(diffs, shadowDiffs.ring[(int64(shadowDiffs.next)-i+maxShadowDiffs)%maxShadowDiffs])
+	}
+	total := shadowDiffs.total
+	shadowDiffs.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{"total": total, "diffs": diffs})
+}
+
+// shadowCredentials hands the shadow upstream's signer its current keys.
+type shadowCredentials struct{}
+
+func (shadowCredentials) RetrieveWithCredContext(*credentials.CredContext) (credentials.Value, error) {
+	return shadowCredentials{}.Retrieve()
+}
+
+func (shadowCredentials) Retrieve() (credentials.Value, error) {
+	return credentials.Value{
+		AccessKeyID:     secrets.get("SHADOW_ACCESS_KEY"),
+		SecretAccessKey: secrets.get("SHADOW_SECRET_KEY"),
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (shadowCredentials) IsExpired() bool { return true }
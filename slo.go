@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultSLOWindow = time.Hour
+	maxSLOWindow     = 30 * 24 * time.Hour
+
+	sloEvalInterval = 10 * time.Second
+
+	// shedding looks at the recent burn only, so it stops soon after the
+	// burning route recovers
+	sloShedWindow      = 5 * time.Minute
+	sloShedMinRequests = 50
+)
+
+// routeSLO is a route's objectives over a rolling Window: Availability
+// percent of requests answered without a 5xx, and Latency percent with
+// their first byte within LatencyThreshold. Song bodies are throttled to
+// playback speed, so the rest of the transfer doesn't count.
+//
+// While a route burns its error budget faster than SLO_SHED_BURN_RATE,
+// routes with a lower Priority are refused with 503. Routes without an SLO
+// have priority 0.
+type routeSLO struct {
+	Availability     float64 `json:"availability,omitempty"`
+	Latency          float64 `json:"latency,omitempty"`
+	LatencyThreshold string  `json:"latency_threshold,omitempty"`
+	Window           string  `json:"window,omitempty"`
+	Priority         int     `json:"priority,omitempty"`
+
+	threshold time.Duration
+	window    time.Duration
+	stats     *sloStats
+}
+
+// sloStats counts a route's requests per minute over its window. Counts are
+// this replica's; the metrics are there to sum across replicas.
+type sloStats struct {
+	mu      sync.Mutex
+	buckets []sloBucket
+}
+
+type sloBucket struct {
+	minute              int64
+	total, errors, slow int64
+}
+
+// sloShed names the route whose budget is burning and the priority below
+// which routes are shed for it.
+type sloShed struct {
+	route    string
+	priority int
+}
+
+var (
+	slos map[string]*routeSLO
+
+	// sloShedBurnRate is the burn rate that starts shedding; 0 never does
+	sloShedBurnRate float64
+
+	shedding atomic.Pointer[sloShed]
+
+	sloCompliance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_proxy_slo_compliance_ratio",
+		Help: "Fraction of requests over the SLO window that met the objective, by route and objective.",
+	}, []string{"route", "objective"})
+
+	sloBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_proxy_slo_burn_rate",
+		Help: "How fast the error budget is being spent, 1 being exactly on budget, by route, objective and window.",
+	}, []string{"route", "objective", "window"})
+
+	sloBudgetRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_proxy_slo_error_budget_remaining_ratio",
+		Help: "Fraction of the error budget left in the SLO window, negative once overspent, by route and objective.",
+	}, []string{"route", "objective"})
+
+	shedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_shed_requests_total",
+		Help: "Requests refused while another route's error budget was burning, by route and the burning route.",
+	}, []string{"route", "burning"})
+)
+
+func loadSLOs(path string) (map[string]*routeSLO, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configured map[string]*routeSLO
+	if err := json.Unmarshal(data, &configured); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return checkSLOs(configured)
+}
+
+func checkSLOs(configured map[string]*routeSLO) (map[string]*routeSLO, error) {
+	for name, s := range configured {
+		if s == nil {
+			return nil, fmt.Errorf("route %q: SLO is empty", name)
+		}
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("route %q: %w", name, err)
+		}
+	}
+
+	return configured, nil
+}
+
+func (s *routeSLO) check() error {
+	if s.Availability == 0 && s.Latency == 0 {
+		return fmt.Errorf("needs an availability or latency objective")
+	}
+	for _, target := range []float64{s.Availability, s.Latency} {
+		if target < 0 || target >= 100 {
+			return fmt.Errorf("objectives are percentages below 100")
+		}
+	}
+
+	if s.Latency > 0 {
+		d, err := time.ParseDuration(s.LatencyThreshold)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("a latency objective needs a latency_threshold duration")
+		}
+		s.threshold = d
+	}
+
+	s.window = defaultSLOWindow
+	if s.Window != "" {
+		d, err := time.ParseDuration(s.Window)
+		if err != nil || d < sloShedWindow || d > maxSLOWindow || d%time.Minute != 0 {
+			return fmt.Errorf("window must be whole minutes between %s and %s", sloShedWindow, maxSLOWindow)
+		}
+		s.window = d
+	}
+
+	s.stats = &sloStats{buckets: make([]sloBucket, s.window/time.Minute)}
+	return nil
+}
+
+func (st *sloStats) record(now time.Time, failed, slow bool) {
+	minute := now.Unix() / 60
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	b := &st.buckets[minute%int64(len(st.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if failed {
+		b.errors++
+	}
+	if slow {
+		b.slow++
+	}
+}
+
+// sum adds up the buckets of the last span.
+func (st *sloStats) sum(now time.Time, span time.Duration) sloBucket {
+	minute := now.Unix() / 60
+	oldest := minute - int64(span/time.Minute) + 1
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var total sloBucket
+	for _, b := range st.buckets {
+		if b.minute >= oldest && b.minute <= minute {
+			total.total += b.total
+			total.errors += b.errors
+			total.slow += b.slow
+		}
+	}
+
+	return total
+}
+
+// recordSLO counts a served request against its route's objectives.
+func recordSLO(route string, status int, firstByte time.Duration) {
+	s := slos[route]
+	if s == nil {
+		return
+	}
+
+	s.stats.record(time.Now(), status >= 500, s.threshold > 0 && firstByte > s.threshold)
+}
+
+// sloReport is where a route stands against one objective.
+type sloReport struct {
+	Objective       string  `json:"objective"`
+	Target          float64 `json:"target"`
+	Requests        int64   `json:"requests"`
+	Compliance      float64 `json:"compliance"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+	BurnRate        float64 `json:"burn_rate"`
+	FastBurnRate    float64 `json:"fast_burn_rate"`
+
+	fastRequests int64
+}
+
+// burn is the fraction of requests that missed target divided by the
+// fraction allowed to.
+func burn(bad, total int64, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(bad) / float64(total) / (1 - target/100)
+}
+
+func (s *routeSLO) reports(now time.Time) []sloReport {
+	window, fast := s.stats.sum(now, s.window), s.stats.sum(now, sloShedWindow)
+
+	var reports []sloReport
+	add := func(objective string, target float64, bad, fastBad int64) {
+		if target == 0 {
+			return
+		}
+
+		rep := sloReport{Objective: objective, Target: target, Requests: window.total, Compliance: 1, fastRequests: fast.total}
+		if window.total > 0 {
+			rep.Compliance = 1 - float64(bad)/float64(window.total)
+		}
+		rep.BurnRate = burn(bad, window.total, target)
+		rep.BudgetRemaining = 1 - rep.BurnRate
+		rep.FastBurnRate = burn(fastBad, fast.total, target)
+		reports = append(reports, rep)
+	}
+	add("availability", s.Availability, window.errors, fast.errors)
+	add("latency", s.Latency, window.slow, fast.slow)
+
+	return reports
+}
+
+// runSLOs refreshes the SLO metrics and decides what to shed every
+// sloEvalInterval.
+func runSLOs() {
+	ticker := time.NewTicker(sloEvalInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		evaluateSLOs(time.Now())
+	}
+}
+
+func evaluateSLOs(now time.Time) {
+	var shed *sloShed
+	for _, name := range slices.Sorted(maps.Keys(slos)) {
+		s := slos[name]
+		for _, rep := range s.reports(now) {
+			sloCompliance.WithLabelValues(name, rep.Objective).Set(rep.Compliance)
+			sloBudgetRemaining.WithLabelValues(name, rep.Objective).Set(rep.BudgetRemaining)
+			sloBurnRate.WithLabelValues(name, rep.Objective, "slo").Set(rep.BurnRate)
+			sloBurnRate.WithLabelValues(name, rep.Objective, "fast").Set(rep.FastBurnRate)
+
+			burning := sloShedBurnRate > 0 && rep.fastRequests >= sloShedMinRequests && rep.FastBurnRate > sloShedBurnRate
+			if burning && (shed == nil || s.Priority > shed.priority) {
+				shed = &sloShed{route: name, priority: s.Priority}
+			}
+		}
+	}
+
+	shedding.Store(shed)
+}
+
+// shedFor returns the route whose burning budget route is shed for, or "".
+func shedFor(route string) string {
+	shed := shedding.Load()
+	if shed == nil {
+		return ""
+	}
+
+	priority := 0
+	if s := slos[route]; s != nil {
+		priority = s.Priority
+	}
+	if priority >= shed.priority {
+		return ""
+	}
+
+	return shed.route
+}
+
+// handleSLOs serves GET /admin/slos, each route's objectives and where this
+// replica stands against them.
+func handleSLOs(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	routes := map[string]any{}
+	for name, s := range slos {
+		routes[name] = map[string]any{
+			"window":            s.window.String(),
+			"priority":          s.Priority,
+			"latency_threshold": s.LatencyThreshold,
+			"objectives":        s.reports(now),
+		}
+	}
+
+	status := map[string]any{"routes": routes, "shed_burn_rate": sloShedBurnRate}
+	if shed := shedding.Load(); shed != nil {
+		status["shedding"] = map[string]any{"burning": shed.route, "below_priority": shed.priority}
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
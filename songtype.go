@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const songTypeSniffBytes = 512
+
+// genericContentTypes are what MinIO reports when an upload didn't say;
+// browsers download these rather than play them.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// fixSongContentType replaces a generic Content-Type on a song with the
+// type recorded on the profile, else one sniffed from the first bytes, else
+// one implied by the extension.
+func fixSongContentType(resp *http.Response) {
+	mimeType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !genericContentTypes[strings.TrimSpace(strings.ToLower(mimeType))] {
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(resp.Request.URL.Path, "/"+minioBucket+"/songs/"), "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	ext := filepath.Ext(parts[1])
+	hash := strings.TrimSuffix(parts[1], ext)
+
+	fixed, source := "", ""
+	lookupCtx, cancel := context.WithTimeout(resp.Request.Context(), lookupTimeout)
+	profile, err := songProfile(lookupCtx, parts[0])
+	cancel()
+	if err != nil && err != sql.ErrNoRows && err != errCircuitOpen {
+		log.Printf("song type lookup failed for %s: %v", parts[0], err)
+	}
+	if err == nil && profile.AudioHash == hash && profile.AudioMimeType != "" {
+		fixed, source = profile.AudioMimeType, "profile"
+	}
+
+	// only a body that starts at the beginning of the file can be sniffed
+	if fixed == "" && resp.Request.Method == http.MethodGet && (resp.StatusCode == http.StatusOK ||
+		strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-")) {
+		br := bufio.NewReaderSize(resp.Body, songTypeSniffBytes)
+		head, _ := br.Peek(songTypeSniffBytes)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, resp.Body}
+
+		if fixed = sniffAudioType(head); fixed != "" {
+			source = "sniffed"
+		}
+	}
+
+	if fixed == "" {
+		for t, e := range audioExtensions {
+			if e == ext && (fixed == "" || t < fixed) {
+				fixed, source = t, "extension"
+			}
+		}
+	}
+
+	if fixed != "" {
+		resp.Header.Set("Content-Type", fixed)
+		traceDecision(resp.Request.Context(), "song content type", fixed+" from "+source)
+	}
+}
+
+// sniffAudioType recognises the formats uploads accept by their magic
+// bytes.
+func sniffAudioType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return "audio/mpeg"
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		if bytes.Contains(head, []byte("OpusHead")) {
+			return "audio/opus"
+		}
+		return "audio/ogg"
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		return "audio/wav"
+	case len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp")):
+		return "audio/mp4"
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return "audio/webm"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0:
+		// ADTS sync word with layer 0
+		return "audio/aac"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0:
+		return "audio/mpeg"
+	}
+
+	return ""
+}
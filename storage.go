@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// storageBackend fetches objects by their bucket path, /{bucket}/{key}, and
+// answers the way S3 would, so everything above the upstream transport
+// works the same whichever one is configured.
+type storageBackend interface {
+	http.RoundTripper
+
+	// sourceURL is where another service, imgproxy, can fetch an object
+	sourceURL(ctx context.Context, objectPath string) (string, error)
+}
+
+// storage is selected by STORAGE_BACKEND.
+var storage storageBackend = s3Backend{}
+
+func newStorageBackend(kind string) (storageBackend, error) {
+	switch kind {
+	case "", "s3":
+		return s3Backend{}, nil
+	case "fs":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			return nil, errors.New("STORAGE_DIR is not set")
+		}
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &fsBackend{root: root}, nil
+	case "http":
+		origin, err := url.Parse(os.Getenv("STORAGE_ORIGIN"))
+		if err != nil || origin.Scheme == "" || origin.Host == "" {
+			return nil, fmt.Errorf("invalid STORAGE_ORIGIN %q", os.Getenv("STORAGE_ORIGIN"))
+		}
+		return &httpOriginBackend{origin: origin}, nil
+	default:
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND %q", kind)
+	}
+}
+
+// s3Backend is MinIO or another S3-compatible endpoint. Signing, failover
+// and retries are layered over it in main, since they only apply here.
+type s3Backend struct{}
+
+func (s3Backend) RoundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// with credentials configured the bucket may be private, so the URL is
+// presigned
+func (s3Backend) sourceURL(ctx context.Context, objectPath string) (string, error) {
+	if s3Client == nil {
+		base := minioURL
+		if upstreams != nil {
+			base = upstreams.pick()
+		}
+		return base.Scheme + "://" + base.Host + objectPath, nil
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(objectPath, "/"), "/")
+	u, err := s3Client.PresignedGetObject(ctx, bucket, key, imgproxyPresignExpiry, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+// bucketKey is the object key in a bucket path on the media bucket.
+func bucketKey(objectPath string) (string, bool) {
+	key, ok := strings.CutPrefix(objectPath, "/"+minioBucket+"/")
+	return key, ok && key != ""
+}
+
+// fsBackend serves objects from a local directory, laid out like the
+// bucket, for running without MinIO in development.
+type fsBackend struct {
+	root *os.Root
+}
+
+func (b *fsBackend) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return s3ErrorResponse(req, http.StatusMethodNotAllowed, "MethodNotAllowed"), nil
+	}
+
+	key, ok := bucketKey(req.URL.Path)
+	if !ok || strings.HasSuffix(key, "/") {
+		return s3ErrorResponse(req, http.StatusNotFound, "NoSuchKey"), nil
+	}
+
+	// the root refuses keys that climb out of it
+	f, err := b.root.Open(key)
+	if err != nil {
+		return s3ErrorResponse(req, http.StatusNotFound, "NoSuchKey"), nil
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return s3ErrorResponse(req, http.StatusNotFound, "NoSuchKey"), nil
+	}
+
+	// ServeContent handles ranges and conditional requests as S3 would
+	pr, pw := io.Pipe()
+	rw := &pipeResponseWriter{header: http.Header{}, body: pw, ready: make(chan *http.Response, 1), req: req, pr: pr}
+	rw.header.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+
+	go func() {
+		defer f.Close()
+		http.ServeContent(rw, req, info.Name(), info.ModTime(), f)
+		rw.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+
+	select {
+	case resp := <-rw.ready:
+		return resp, nil
+	case <-req.Context().Done():
+		pr.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+}
+
+func (*fsBackend) sourceURL(context.Context, string) (string, error) {
+	return "", errors.New("the fs storage backend can't be read by imgproxy")
+}
+
+// pipeResponseWriter turns what a handler writes into an *http.Response
+// whose body streams from it.
+type pipeResponseWriter struct {
+	header http.Header
+	body   *io.PipeWriter
+	ready  chan *http.Response
+	req    *http.Request
+	pr     *io.PipeReader
+	sent   bool
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	if w.sent {
+		return
+	}
+	w.sent = true
+
+	length := int64(-1)
+	if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		length = n
+	}
+
+	var body io.ReadCloser = w.pr
+	if w.req.Method == http.MethodHead || status == http.StatusNotModified {
+		body = http.NoBody
+		w.pr.Close()
+	}
+
+	w.ready <- &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header.Clone(),
+		Body:          body,
+		ContentLength: length,
+		Request:       w.req,
+	}
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// httpOriginBackend fetches objects from a plain HTTP origin, with the key
+// appended to STORAGE_ORIGIN.
+type httpOriginBackend struct {
+	origin *url.URL
+}
+
+func (b *httpOriginBackend) objectURL(objectPath string) (*url.URL, bool) {
+	key, ok := bucketKey(objectPath)
+	if !ok {
+		return nil, false
+	}
+
+	return b.origin.JoinPath(key), true
+}
+
+func (b *httpOriginBackend) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, ok := b.objectURL(req.URL.Path)
+	if !ok {
+		return s3ErrorResponse(req, http.StatusNotFound, "NoSuchKey"), nil
+	}
+
+	out := req.Clone(req.Context())
+	out.URL = u
+	out.Host = ""
+	out.RequestURI = ""
+
+	return http.DefaultTransport.RoundTrip(out)
+}
+
+func (b *httpOriginBackend) sourceURL(_ context.Context, objectPath string) (string, error) {
+	u, ok := b.objectURL(objectPath)
+	if !ok {
+		return "", fs.ErrNotExist
+	}
+
+	return u.String(), nil
+}
+
+// s3ErrorResponse is the error S3 would have sent, for translateS3Error to
+// read on the way out.
+func s3ErrorResponse(req *http.Request, status int, code string) *http.Response {
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+	}{Code: code})
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/xml"}, "Content-Length": {strconv.Itoa(len(body))}},
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+
+	return resp
+}
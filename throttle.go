@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSongThrottleBurst   = 2 << 20
+	defaultSongDefaultBitrate  = 512_000
+	songSniffBytes             = 64 << 10
+	songThrottleChunkFrequency = 10
+)
+
+var (
+	// songThrottleMultiplier paces song bodies at this multiple of their
+	// bitrate once songThrottleBurst bytes have gone out. Zero disables it.
+	songThrottleMultiplier float64
+	songThrottleBurst      int64 = defaultSongThrottleBurst
+
+	// songDefaultBitrate is assumed for lossy formats whose bitrate can't be
+	// read from the stream. It errs high so playback never starves; lossless
+	// formats without a readable header aren't throttled at all.
+	songDefaultBitrate = defaultSongDefaultBitrate
+
+	lossyAudioTypes = []string{"audio/mpeg", "audio/ogg", "audio/opus", "audio/mp4", "audio/aac", "audio/webm"}
+
+	mp3Bitrates = map[bool][16]int{
+		true:  {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		false: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+)
+
+// throttleSong paces a song response so download accelerators can't
+// saturate egress, after a burst that covers player buffering. The decision
+// is reported in X-Bandwidth-Limit.
+func throttleSong(resp *http.Response) {
+	if songThrottleMultiplier <= 0 || resp.Request.Method != http.MethodGet || !featureEnabled("song_throttle") ||
+		(resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent) {
+		return
+	}
+
+	br := bufio.NewReaderSize(resp.Body, songSniffBytes)
+	head, _ := br.Peek(songSniffBytes)
+
+	mimeType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	bitrate, source := audioBitrate(head, strings.TrimSpace(mimeType))
+	if bitrate == 0 {
+		resp.Header.Set("X-Bandwidth-Limit", "none; reason=unknown-bitrate")
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, resp.Body}
+		return
+	}
+
+	rate := int64(float64(bitrate) / 8 * songThrottleMultiplier)
+	resp.Header.Set("X-Bandwidth-Limit", fmt.Sprintf("rate=%d; burst=%d; bitrate=%d; source=%s", rate, songThrottleBurst, bitrate, source))
+	resp.Body = &throttledBody{Reader: br, Closer: resp.Body, ctx: resp.Request.Context(), rate: rate, burst: songThrottleBurst}
+}
+
+// throttledBody reads burst bytes freely, then at rate bytes per second.
+type throttledBody struct {
+	io.Reader
+	io.Closer
+
+	ctx   context.Context
+	rate  int64
+	burst int64
+
+	sent  int64
+	start time.Time
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if b.sent < b.burst {
+		p = p[:min(int64(len(p)), b.burst-b.sent)]
+	} else {
+		if b.start.IsZero() {
+			b.start = time.Now()
+		}
+
+		due := b.start.Add(time.Duration(float64(b.sent-b.burst) / float64(b.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-b.ctx.Done():
+				t.Stop()
+				return 0, b.ctx.Err()
+			}
+		}
+
+		// small reads keep the pace even rather than in bursts of p
+		p = p[:min(int64(len(p)), max(1, b.rate/songThrottleChunkFrequency))]
+	}
+
+	n, err := b.Reader.Read(p)
+	b.sent += int64(n)
+	return n, err
+}
+
+// audioBitrate estimates bits per second from the start of an audio stream,
+// returning 0 if it shouldn't be throttled.
+func audioBitrate(head []byte, mimeType string) (int, string) {
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		if bitrate := flacBitrate(head); bitrate > 0 {
+			return bitrate, "flac-streaminfo"
+		}
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		if bitrate := wavBitrate(head); bitrate > 0 {
+			return bitrate, "wav-header"
+		}
+	case mimeType == "audio/mpeg" || bytes.HasPrefix(head, []byte("ID3")):
+		if bitrate := mp3Bitrate(head); bitrate > 0 {
+			return bitrate, "mp3-header"
+		}
+	}
+
+	for _, t := range lossyAudioTypes {
+		if mimeType == t {
+			return songDefaultBitrate, "default"
+		}
+	}
+
+	return 0, ""
+}
+
+// flacBitrate is the uncompressed rate from STREAMINFO, which always comes
+// first, so it's an upper bound.
+func flacBitrate(head []byte) int {
+	if len(head) < 8+34 || head[4]&0x7f != 0 {
+		return 0
+	}
+
+	si := head[8+10:]
+	sampleRate := int(si[0])<<12 | int(si[1])<<4 | int(si[2])>>4
+	channels := int(si[2]>>1&0x07) + 1
+	bits := (int(si[2]&0x01)<<4 | int(si[3])>>4) + 1
+
+	return sampleRate * channels * bits
+}
+
+func wavBitrate(head []byte) int {
+	for i := 12; i+16 <= len(head); {
+		size := int(binary.LittleEndian.Uint32(head[i+4 : i+8]))
+		if string(head[i:i+4]) == "fmt " {
+			return int(binary.LittleEndian.Uint32(head[i+16:i+20])) * 8
+		}
+		i += 8 + size + size&1
+	}
+
+	return 0
+}
+
+// mp3Bitrate reads the first Layer III frame header after any ID3v2 tag.
+// VBR streams, marked by a Xing or VBRI header, get the format's maximum.
+func mp3Bitrate(head []byte) int {
+	i := 0
+	if len(head) >= 10 && bytes.HasPrefix(head, []byte("ID3")) {
+		i = 10 + (int(head[6]&0x7f)<<21 | int(head[7]&0x7f)<<14 | int(head[8]&0x7f)<<7 | int(head[9]&0x7f))
+		if head[5]&0x10 != 0 {
+			i += 10
+		}
+	}
+
+	for ; i+4 <= len(head); i++ {
+		if head[i] != 0xff || head[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+
+		version, layer := head[i+1]>>3&0x03, head[i+1]>>1&0x03
+		index, rateIndex := head[i+2]>>4, head[i+2]>>2&0x03
+		if version == 1 || layer != 1 || index == 0 || index == 15 || rateIndex == 3 {
+			continue
+		}
+
+		table := mp3Bitrates[version == 3]
+		frame := head[i:min(len(head), i+200)]
+		if bytes.Contains(frame, []byte("Xing")) || bytes.Contains(frame, []byte("VBRI")) {
+			return table[14] * 1000
+		}
+
+		return table[index] * 1000
+	}
+
+	return 0
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout     = 10 * time.Second
+	defaultIdleTimeout           = 2 * time.Minute
+	defaultWriteTimeout          = 30 * time.Second
+	defaultUpstreamTimeout       = 10 * time.Second
+	defaultUpstreamStreamTimeout = 30 * time.Second
+
+	// a streaming response's write deadline moves at most this often
+	writeDeadlineStep = time.Second
+)
+
+var (
+	readHeaderTimeout = defaultReadHeaderTimeout
+	idleTimeout       = defaultIdleTimeout
+
+	// writeTimeout bounds writing a response, or for a streaming route
+	// each write, so a client that stops reading is dropped; 0 lets
+	// clients take as long as they like
+	writeTimeout = defaultWriteTimeout
+
+	upstreamTimeout       = defaultUpstreamTimeout
+	upstreamStreamTimeout = defaultUpstreamStreamTimeout
+
+	errUpstreamTimeout = errors.New("upstream timed out")
+)
+
+// newServer is an http.Server for one of the listeners, with the header
+// and keep-alive timeouts that stop idle or trickling connections from
+// piling up. Write deadlines are per request, set by limitWrites.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// limitWrites sets each response's write deadline. A streaming route's
+// deadline moves forward while its writes keep going through, so a song can
+// play for as long as it lasts but not stall for longer than writeTimeout.
+func limitWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if writeTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// HTTP/3 doesn't support deadlines, and goes without
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		if rt := routeNamed(routeNameFrom(r.Context())); rt != nil && rt.Streaming {
+			w = &extendingWriter{ResponseWriter: w, rc: rc, extended: time.Now()}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// extendingWriter pushes the write deadline back as writes succeed.
+type extendingWriter struct {
+	http.ResponseWriter
+
+	rc       *http.ResponseController
+	extended time.Time
+}
+
+func (ew *extendingWriter) Write(b []byte) (int, error) {
+	if now := time.Now(); now.Sub(ew.extended) >= writeDeadlineStep {
+		ew.rc.SetWriteDeadline(now.Add(writeTimeout))
+		ew.extended = now
+	}
+
+	return ew.ResponseWriter.Write(b)
+}
+
+func (ew *extendingWriter) Flush() {
+	ew.rc.Flush()
+}
+
+func (ew *extendingWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// timeoutTransport bounds upstream fetches by their route's timeout. For a
+// streaming route it's the wait for headers and then for each read of the
+// body, so a long song keeps going while the bucket keeps sending; for
+// others it's the whole response. It sits inside the coalescer, so a shared
+// fetch is cut off rather than only its first caller.
+type timeoutTransport struct {
+	next http.RoundTripper
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout, streaming := upstreamTimeout, false
+	if rt := routeNamed(routeNameFrom(req.Context())); rt != nil {
+		streaming = rt.Streaming
+		switch {
+		case rt.upstreamTimeout > 0:
+			timeout = rt.upstreamTimeout
+		case streaming:
+			timeout = upstreamStreamTimeout
+		}
+	}
+	if timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errUpstreamTimeout) })
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		if errors.Is(context.Cause(ctx), errUpstreamTimeout) {
+			err = errUpstreamTimeout
+		}
+		cancel(nil)
+		return nil, err
+	}
+
+	body := &deadlineBody{ReadCloser: resp.Body, timer: timer, cancel: cancel}
+	if streaming {
+		body.idle = timeout
+		timer.Reset(timeout)
+	}
+	resp.Body = body
+
+	return resp, nil
+}
+
+// deadlineBody cancels its request when its timer fires, and for a
+// streaming route restarts the timer as data arrives.
+type deadlineBody struct {
+	io.ReadCloser
+
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+	idle   time.Duration
+	once   sync.Once
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.idle > 0 {
+		b.timer.Reset(b.idle)
+	}
+
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.timer.Stop()
+		b.cancel(nil)
+	})
+
+	return err
+}
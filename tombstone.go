@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"image"
+	"image/draw"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultTombstoneStates = "banned"
+
+	// a restored user's media comes back within this long in shared caches
+	tombstoneCacheControl = "public, max-age=300"
+)
+
+var (
+	// tombstones answers media of deleted users, and of users in one of
+	// tombstoneStates, with 410 Gone, set by TOMBSTONES=on. The objects
+	// themselves are left in the bucket.
+	tombstones bool
+
+	// tombstoneStates are the user_profiles.moderation_state values that take
+	// a user's media down, from TOMBSTONE_STATES.
+	tombstoneStates = strings.Split(defaultTombstoneStates, ",")
+
+	tombstoneLoads singleflight.Group
+
+	// tombstoneAvatars holds the placeholder avatar by format, which is the
+	// same for everyone
+	tombstoneAvatars sync.Map
+)
+
+func tombstoneCacheKey(userID string) string {
+	return "user:tombstone:" + userID
+}
+
+// userGone reports whether userID's media has been taken down. The decision
+// is cached in Valkey for PROFILE_CACHE_TTL, and dropped with the profile
+// when the main app invalidates it.
+func userGone(ctx context.Context, userID string) (bool, error) {
+	key := tombstoneCacheKey(userID)
+	if redisBreaker.allow() {
+		v, err := redisClient.Get(ctx, key).Result()
+		if err == nil {
+			redisBreaker.record(nil)
+			recordCacheStatus(ctx, profileCacheName, "hit")
+			return v == "1", nil
+		} else if err != redis.Nil {
+			redisBreaker.record(err)
+			log.Printf("valkey GET error: %v", err)
+		} else {
+			redisBreaker.record(nil)
+		}
+	}
+
+	recordCacheStatus(ctx, profileCacheName, "fwd=uri-miss")
+
+	if !postgresBreaker.allow() {
+		return false, errCircuitOpen
+	}
+
+	// as with profiles, the shared query outlives the caller that started it
+	v, err, _ := tombstoneLoads.Do(userID, func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+		defer cancel()
+
+		started := time.Now()
+		gone, err := loadTombstone(loadCtx, userID)
+		if err == sql.ErrNoRows {
+			postgresBreaker.record(nil)
+			gone, err = false, nil
+		} else {
+			postgresBreaker.record(err)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		ttl := profileEntryTTL()
+		if at, ok := profileInvalidations.Load(userID); ttl <= 0 || ok && !at.(time.Time).Before(started) {
+			return gone, nil
+		}
+
+		value := "0"
+		if gone {
+			value = "1"
+		}
+		if err := redisClient.Set(loadCtx, key, value, ttl).Err(); err != nil {
+			log.Printf("valkey SET error: %v", err)
+		} else {
+			recordCacheStatus(loadCtx, profileCacheName, "stored")
+		}
+
+		return gone, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return v.(bool), nil
+}
+
+func loadTombstone(ctx context.Context, userID string) (bool, error) {
+	const query = `SELECT deleted_at IS NOT NULL, COALESCE(moderation_state, '') FROM user_profiles WHERE id = $1`
+	queryCtx, span := startQuerySpan(ctx, "postgres user_profiles tombstone", query)
+
+	var deleted bool
+	var state string
+	err := db.QueryRowContext(queryCtx, query, userID).Scan(&deleted, &state)
+	endQuerySpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	return deleted || slices.Contains(tombstoneStates, state), nil
+}
+
+// answerTombstones answers requests for a taken-down user's media with 410
+// Gone, and avatars with a blank placeholder. If the user's state can't be
+// looked up the media is served, rather than fail every request while
+// Postgres is down.
+func answerTombstones(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := cmp.Or(r.PathValue("userID"), r.PathValue("id"))
+		rt, vars := matchRoute(r.URL.Path)
+		if userID == "" && rt != nil {
+			userID = vars["userID"]
+		}
+		if !tombstones || userID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+		gone, err := userGone(ctx, userID)
+		cancel()
+		if err != nil {
+			if err != errCircuitOpen {
+				log.Printf("tombstone lookup failed for %s: %v", userID, err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !gone {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		traceDecision(r.Context(), "tombstone", "user "+userID+" is gone")
+		w.Header().Set("Cache-Control", tombstoneCacheControl)
+		if rt != nil && rt.Name == "avatars" && writeTombstoneAvatar(w, r) {
+			return
+		}
+		writeError(w, r, proxyError{http.StatusGone, "gone"})
+	})
+}
+
+// writeTombstoneAvatar answers with a blank avatar in the format asked for,
+// with the 410 status so clients can still tell. It reports whether it did.
+func writeTombstoneAvatar(w http.ResponseWriter, r *http.Request) bool {
+	format := r.URL.Query().Get("format")
+	if _, ok := imageContentTypes[format]; !ok {
+		format = "webp"
+	}
+
+	data, ok := tombstoneAvatars.Load(format)
+	if !ok {
+		img := image.NewNRGBA(image.Rect(0, 0, defaultAvatarSize, defaultAvatarSize))
+		draw.Draw(img, img.Bounds(), image.NewUniform(identiconBackground), image.Point{}, draw.Src)
+
+		encoded, err := encodeImage(img, format)
+		if err != nil {
+			return false
+		}
+		data, _ = tombstoneAvatars.LoadOrStore(format, encoded)
+	}
+	body := data.([]byte)
+
+	w.Header().Set("Content-Type", imageContentTypes[format])
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Default-Avatar", "true")
+	w.WriteHeader(http.StatusGone)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+
+	return true
+}
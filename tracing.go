@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("colourlabs.net/cdn-proxy")
+
+// setupTracing exports spans over OTLP when one of the standard
+// OTEL_EXPORTER_OTLP_* endpoint variables is set. Trace context is always
+// propagated so upstream spans join the caller's trace either way.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "cdn-proxy")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func traceRedis() error {
+	return redisotel.InstrumentTracing(redisClient)
+}
+
+// traceHandler starts a server span per inbound request, named by route.
+func traceHandler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "cdn-proxy",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeName(r.URL.Path)
+		}),
+	)
+}
+
+// traceTransport adds a client span per upstream round trip and injects the
+// W3C trace context into the request sent to MinIO.
+func traceTransport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next)
+}
+
+// querySpan remembers what endQuerySpan needs to add the query to a debug
+// trace.
+type querySpan struct {
+	trace.Span
+	ctx   context.Context
+	name  string
+	start time.Time
+}
+
+func startQuerySpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", query),
+		),
+	)
+
+	return ctx, &querySpan{Span: span, ctx: ctx, name: name, start: time.Now()}
+}
+
+// endQuerySpan ends a span started by startQuerySpan. A missing row is an
+// answer, not a failure.
+func endQuerySpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		err = nil
+	}
+
+	if qs, ok := span.(*querySpan); ok {
+		traceTimed(qs.ctx, "postgres", qs.name, qs.start, err)
+	}
+
+	span.End()
+}
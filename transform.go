@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gen2brain/webp"
+)
+
+const (
+	maxCropDimension    = 4096
+	maxSourceImageBytes = 32 << 20
+
+	variantCacheControl = "public, max-age=31536000, immutable"
+)
+
+var variantCache *diskCache
+
+// imageRoute describes a route whose objects can be transformed. owner is
+// the pattern variable holding the ID of the user or guild the object
+// belongs to; sizes lists the values ?size= accepts, if any.
+type imageRoute struct {
+	owner string
+	sizes []int
+
+	// progressive is the default for ?progressive on jpeg and png output
+	progressive bool
+}
+
+var imageRoutes = map[string]imageRoute{
+	"avatars": {owner: "userID"},
+	"banners": {owner: "userID", progressive: true},
+	"emojis":  {owner: "guildID", sizes: []int{32, 64, 128}},
+}
+
+type imageParams struct {
+	width, height int
+	gravity       string
+	size          int
+	format        string
+	progressive   bool
+
+	// source is the extension of the object to render from; static asks
+	// for only the first frame of an animation
+	source string
+	static bool
+
+	// nearLossless is libwebp's near-lossless level for lossless output,
+	// from 0 (most preprocessing) to 100 (exact)
+	lossless     bool
+	nearLossless int
+
+	// saveData renders at saveDataQuality, and within saveDataMaxSize when
+	// no size was asked for
+	saveData bool
+}
+
+// key is the normalized form of the params, used in variant cache keys so
+// equivalent query strings share one entry.
+func (p imageParams) key() string {
+	key := fmt.Sprintf("crop=%dx%d&gravity=%s&format=%s", p.width, p.height, p.gravity, p.format)
+	if p.size > 0 {
+		key += "&size=" + strconv.Itoa(p.size)
+	}
+	if p.progressive {
+		key += "&progressive=1"
+	}
+	if p.source != "webp" {
+		key += "&source=" + p.source
+	}
+	if p.static {
+		key += "&animated=0"
+	}
+	if p.lossless {
+		key += "&lossless=1"
+		if p.nearLossless < 100 {
+			key += "&near_lossless=" + strconv.Itoa(p.nearLossless)
+		}
+	}
+	if p.saveData {
+		key += "&save_data=1"
+	}
+
+	return key
+}
+
+// fits reports whether original, of cfg, is already what p would render:
+// within p's box, in the requested format and encoded the way p asks, so
+// it can be served unchanged.
+func (p imageParams) fits(cfg image.Config, format string, original []byte) bool {
+	want := p.format
+	if want == "jpg" {
+		want = "jpeg"
+	}
+	if format != want {
+		return false
+	}
+
+	// a crop of another shape would cut the image, whatever its size
+	if p.width > 0 && (cfg.Width > p.width || cfg.Height > p.height || cfg.Width*p.height != cfg.Height*p.width) {
+		return false
+	}
+	if p.size > 0 && (cfg.Width > p.size || cfg.Height > p.size) {
+		return false
+	}
+
+	// the original's quality isn't known, so Save-Data always re-encodes
+	if p.saveData {
+		return false
+	}
+	if p.lossless != losslessWebP(original) || (p.lossless && p.nearLossless < 100) {
+		return false
+	}
+	if progressiveFormats[format] && p.progressive != progressiveImage(original) {
+		return false
+	}
+
+	return true
+}
+
+// bounded reports whether a Save-Data render has to fit saveDataMaxSize
+// itself, having no crop or size of its own.
+func (p imageParams) bounded() bool {
+	return p.saveData && p.width == 0 && p.size == 0
+}
+
+func parseImageParams(ir imageRoute, q url.Values) (imageParams, bool, error) {
+	p := imageParams{gravity: "center", format: q.Get("format"), source: "webp"}
+	if p.format == "" {
+		p.format = "webp"
+	}
+
+	if v := q.Get("animated"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, false, fmt.Errorf("invalid animated %q", v)
+		}
+		p.static = !b
+	}
+
+	if size := q.Get("size"); size != "" && len(ir.sizes) > 0 {
+		n, err := strconv.Atoi(size)
+		if err != nil || !slices.Contains(ir.sizes, n) {
+			return p, false, fmt.Errorf("invalid size %q", size)
+		}
+		p.size = n
+	}
+
+	crop := q.Get("crop")
+	if crop == "" && p.size == 0 && !p.static {
+		return p, false, nil
+	}
+
+	if crop != "" {
+		w, h, ok := parseDimensions(crop)
+		if !ok || w > maxCropDimension || h > maxCropDimension {
+			return p, false, fmt.Errorf("invalid crop %q", crop)
+		}
+		p.width, p.height = w, h
+
+		switch g := q.Get("gravity"); g {
+		case "":
+		case "center", "top", "smart":
+			p.gravity = g
+		default:
+			return p, false, fmt.Errorf("invalid gravity %q", g)
+		}
+	}
+
+	if _, ok := imageContentTypes[p.format]; !ok {
+		return p, false, fmt.Errorf("unsupported format %q", p.format)
+	}
+
+	p.progressive = ir.progressive
+	if v := q.Get("progressive"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, false, fmt.Errorf("invalid progressive %q", v)
+		}
+		p.progressive = b
+	}
+	p.progressive = p.progressive && progressiveFormats[p.format]
+
+	if err := parseLossless(&p, q); err != nil {
+		return p, false, err
+	}
+
+	return p, true, nil
+}
+
+// parseLossless handles ?lossless=1 and ?near_lossless=0-100, which implies
+// lossless. Both only apply to webp output within maxLosslessPixels.
+func parseLossless(p *imageParams, q url.Values) error {
+	p.nearLossless = 100
+
+	if v := q.Get("lossless"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid lossless %q", v)
+		}
+		p.lossless = b
+	}
+
+	if v := q.Get("near_lossless"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("invalid near_lossless %q", v)
+		}
+		p.lossless, p.nearLossless = true, n
+	}
+
+	if !p.lossless {
+		return nil
+	}
+
+	if p.format != "webp" {
+		return fmt.Errorf("lossless output is only available as webp")
+	}
+
+	w, h := p.width, p.height
+	if p.size > 0 && (w == 0 || p.size < max(w, h)) {
+		w, h = p.size, p.size
+	}
+	if w*h > maxLosslessPixels {
+		return fmt.Errorf("lossless output is limited to %d pixels", maxLosslessPixels)
+	}
+
+	return nil
+}
+
+func parseDimensions(s string) (int, int, bool) {
+	ws, hs, ok := strings.Cut(s, "x")
+	if !ok {
+		return 0, 0, false
+	}
+
+	w, err := strconv.Atoi(ws)
+	if err != nil || w <= 0 {
+		return 0, 0, false
+	}
+
+	h, err := strconv.Atoi(hs)
+	if err != nil || h <= 0 {
+		return 0, 0, false
+	}
+
+	return w, h, true
+}
+
+func matchImageRoute(path string) (kind, ownerID, hash string, ir imageRoute, ok bool) {
+	rt, vars := matchRoute(path)
+	if rt == nil {
+		return "", "", "", ir, false
+	}
+
+	ir, ok = imageRoutes[rt.Name]
+	if !ok {
+		return "", "", "", ir, false
+	}
+
+	return rt.Name, vars[ir.owner], vars["hash"], ir, true
+}
+
+// transformImages serves image route requests that ask for a transform;
+// everything else falls through to the proxy untouched.
+func transformImages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind, ownerID, hash, ir, ok := matchImageRoute(r.URL.Path)
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if placeholder := r.URL.Query().Get("placeholder"); placeholder != "" {
+			servePlaceholder(w, r, kind, ownerID, hash, placeholder)
+			return
+		}
+
+		params, transform, err := parseImageParams(ir, r.URL.Query())
+		if err != nil {
+			writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+			return
+		}
+
+		// avatars and banners uploaded as GIF are rendered from the GIF, so
+		// the webp keeps the animation
+		if originalRoutes[kind] && (transform || params.format == "webp") {
+			ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+			ext, err := lookupOriginalExt(ctx, kind, ownerID, hash)
+			cancel()
+
+			switch {
+			case err != nil && err != errCircuitOpen:
+				log.Printf("original extension lookup failed: %v", err)
+			case err == nil && ext == "gif":
+				params.source, transform = ext, true
+			}
+		}
+
+		// ?lossless= isn't parsed without a transform, but it still asks for
+		// the stored pixels
+		lossless := params.lossless
+		if !lossless {
+			probe := params
+			lossless = parseLossless(&probe, r.URL.Query()) == nil && probe.lossless
+		}
+
+		w.Header().Add("Vary", "Save-Data")
+		if saveData(r) && !lossless {
+			if _, ok := imageContentTypes[params.format]; ok {
+				params.saveData, transform = true, true
+			}
+		}
+
+		if !transform || !featureEnabled("transforms") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		serveVariant(w, r, kind, ownerID, hash, params)
+	})
+}
+
+func serveVariant(w http.ResponseWriter, r *http.Request, kind, ownerID, hash string, p imageParams) {
+	key := kind + "/" + ownerID + "/" + hash + "?" + p.key()
+	traceDecision(r.Context(), "variant key", key)
+	if derivativesBucket != "" {
+		touchDerivative(r.Context(), derivativeKey(kind, ownerID, hash, p))
+	}
+
+	if f, _, ok := variantCache.get(key); ok {
+		defer f.Close()
+		recordCacheStatus(r.Context(), objectCacheName, "hit")
+		writeVariant(w, r, key, p.format, f)
+		return
+	}
+
+	recordCacheStatus(r.Context(), objectCacheName, "fwd=uri-miss")
+
+	data, err := generateVariant(r.Context(), kind, ownerID, hash, p)
+	if err != nil {
+		var perr proxyError
+		if !errors.As(err, &perr) {
+			log.Printf("variant render error for %s: %v", key, err)
+			perr = proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+		}
+		if perr.status == http.StatusNotFound && kind == "avatars" && defaultAvatars && writeDefaultAvatar(w, r, ownerID, p) {
+			return
+		}
+
+		writeError(w, r, perr)
+		return
+	}
+
+	if err := variantCache.put(key, data); errors.Is(err, errCacheDiskLow) {
+		// counted, and served uncached
+	} else if err != nil {
+		log.Printf("variant cache write error: %v", err)
+	} else {
+		recordCacheStatus(r.Context(), objectCacheName, "stored")
+		indexVariant(r.Context(), kind, ownerID, hash, key)
+	}
+
+	writeVariant(w, r, key, p.format, bytes.NewReader(data))
+}
+
+func renderVariant(ctx context.Context, kind, ownerID, hash string, p imageParams) ([]byte, error) {
+	objectPath := "/" + minioBucket + "/" + kind + "/" + ownerID + "/" + hash + "." + p.source
+	// imgproxy has no lossless webp or first-frame option, so those variants
+	// render here
+	if imgproxy != nil && !p.lossless && !p.static && featureEnabled("imgproxy") {
+		return imgproxy.render(ctx, objectPath, p)
+	}
+
+	original, err := fetchOriginal(ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkImageLimits(bytes.NewReader(original)); err != nil {
+		return nil, err
+	}
+
+	animated := isAnimated(original)
+
+	// resizing an original that already fits would only upscale and
+	// re-encode it, costing CPU and quality for nothing
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(original)); err == nil && p.fits(cfg, format, original) && !(animated && p.static) {
+		recordCacheStatus(ctx, objectCacheName, "detail=original")
+		if stripMetadataRoutes[kind] {
+			original = stripMetadata(original)
+		}
+		return original, nil
+	}
+
+	profile := iccProfile(original)
+
+	if animated && !p.static && p.format == "webp" {
+		return transforms.do(ctx, func() ([]byte, error) {
+			return renderAnimation(original, profile, p)
+		})
+	}
+
+	return transforms.do(ctx, func() ([]byte, error) {
+		img, err := decodeImage(bytes.NewReader(original))
+		if err != nil {
+			return nil, err
+		}
+		img = colorManage(img, profile)
+
+		if p.width > 0 {
+			img = cropFill(img, p.width, p.height, p.gravity)
+		}
+		if p.size > 0 {
+			img = fitImage(img, p.size, p.size)
+		}
+		img = fitSaveData(img, p)
+
+		var data []byte
+		switch {
+		case p.lossless:
+			data, err = encodeLossless(img, p.nearLossless)
+		case p.saveData:
+			data, err = encodeImageQuality(img, p.format, saveDataQuality)
+		case p.progressive:
+			data, err = encodeProgressive(img, p.format)
+		default:
+			data, err = encodeImage(img, p.format)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return tagICCProfile(data, p.format, img.Bounds(), profile), nil
+	})
+}
+
+// renderAnimation transforms every frame of an animated source. Smart
+// gravity would pick a different window per frame, so animations crop
+// around the center instead.
+func renderAnimation(original, profile []byte, p imageParams) ([]byte, error) {
+	anim, err := decodeAnimation(original)
+	if err != nil {
+		return nil, err
+	}
+
+	gravity := p.gravity
+	if gravity == "smart" {
+		gravity = "center"
+	}
+
+	opts := webp.Options{Quality: webpQuality}
+	if p.lossless {
+		opts = webp.Options{Lossless: true}
+	} else if p.saveData {
+		opts.Quality = saveDataQuality.webp
+	}
+
+	return encodeAnimation(anim, func(img image.Image) image.Image {
+		img = colorManage(img, profile)
+		if p.width > 0 {
+			img = cropFill(img, p.width, p.height, gravity)
+		}
+		if p.size > 0 {
+			img = fitImage(img, p.size, p.size)
+		}
+		img = fitSaveData(img, p)
+		if p.lossless && p.nearLossless < 100 {
+			img = nearLossless(img, p.nearLossless)
+		}
+		return img
+	}, opts)
+}
+
+// fetchOriginal reads a source image from MinIO, translating S3 errors.
+func fetchOriginal(ctx context.Context, objectPath string) ([]byte, error) {
+	resp, err := fetchObject(ctx, objectPath)
+	if errors.Is(err, errUpstreamBusy) {
+		return nil, errUpstreamBusy
+	} else if err != nil {
+		return nil, proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBody))
+		return nil, parseS3Error(resp.StatusCode, body)
+	}
+
+	original, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceImageBytes))
+	if err != nil {
+		return nil, proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+
+	return original, nil
+}
+
+// writeVariant serves a variant validated by ETag only; the cache file's mtime
+// tracks access, not content.
+func writeVariant(w http.ResponseWriter, r *http.Request, key, format string, content io.ReadSeeker) {
+	sum := sha256.Sum256([]byte(key))
+
+	w.Header().Set("Content-Type", imageContentTypes[format])
+	w.Header().Set("Cache-Control", variantCacheControl)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestImageParamsFits(t *testing.T) {
+	encode := func(t *testing.T, w, h int, enc func(image.Image) ([]byte, error)) []byte {
+		t.Helper()
+		data, err := enc(image.NewNRGBA(image.Rect(0, 0, w, h)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	as := func(format string) func(image.Image) ([]byte, error) {
+		return func(img image.Image) ([]byte, error) { return encodeImage(img, format) }
+	}
+	progressive := func(format string) func(image.Image) ([]byte, error) {
+		return func(img image.Image) ([]byte, error) { return encodeProgressive(img, format) }
+	}
+	lossless := func(img image.Image) ([]byte, error) { return encodeLossless(img, 100) }
+
+	for _, tc := range []struct {
+		name     string
+		original []byte
+		p        imageParams
+		want     bool
+	}{
+		{"jpg asked of a jpeg", encode(t, 64, 64, as("jpeg")), imageParams{format: "jpg", size: 128}, true},
+		{"other format", encode(t, 64, 64, as("png")), imageParams{format: "webp", size: 128}, false},
+		{"larger than size", encode(t, 256, 256, as("webp")), imageParams{format: "webp", size: 128}, false},
+
+		{"exactly the crop box", encode(t, 100, 50, as("webp")), imageParams{format: "webp", width: 100, height: 50}, true},
+		{"smaller, same shape as crop", encode(t, 60, 30, as("webp")), imageParams{format: "webp", width: 100, height: 50}, true},
+		{"smaller, other shape than crop", encode(t, 80, 60, as("webp")), imageParams{format: "webp", width: 100, height: 100}, false},
+
+		{"progressive asked of baseline", encode(t, 64, 64, as("jpeg")), imageParams{format: "jpeg", progressive: true}, false},
+		{"baseline asked of progressive", encode(t, 64, 64, progressive("jpeg")), imageParams{format: "jpeg"}, false},
+		{"progressive asked of progressive", encode(t, 64, 64, progressive("jpeg")), imageParams{format: "jpeg", progressive: true}, true},
+		{"interlaced asked of plain png", encode(t, 64, 64, as("png")), imageParams{format: "png", progressive: true}, false},
+		{"interlaced asked of interlaced png", encode(t, 64, 64, progressive("png")), imageParams{format: "png", progressive: true}, true},
+
+		{"save data", encode(t, 64, 64, as("webp")), imageParams{format: "webp", saveData: true}, false},
+
+		{"lossless asked of lossy", encode(t, 64, 64, as("webp")), imageParams{format: "webp", lossless: true, nearLossless: 100}, false},
+		{"lossy asked of lossless", encode(t, 64, 64, lossless), imageParams{format: "webp"}, false},
+		{"lossless asked of lossless", encode(t, 64, 64, lossless), imageParams{format: "webp", lossless: true, nearLossless: 100}, true},
+		{"near-lossless asked of lossless", encode(t, 64, 64, lossless), imageParams{format: "webp", lossless: true, nearLossless: 60}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(tc.original))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tc.p.fits(cfg, format, tc.original); got != tc.want {
+				t.Errorf("fits = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gen2brain/webp"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var s3Client *minio.Client
+
+func uploadToken() string {
+	return secrets.get("UPLOAD_TOKEN")
+}
+
+// uploadLimits lists the object types the proxy accepts uploads for, with
+// their maximum size. Only types whose hash lives in user_profiles, or for
+// attachments in their own table, are writable here.
+var uploadLimits = map[string]int64{
+	"banners":     10 << 20,
+	"songs":       100 << 20,
+	"attachments": defaultAttachmentMaxBytes,
+}
+
+const (
+	// uploadStagingPrefix holds uploads until their hash is checked. Keys
+	// left by a crash can be swept with an objects purge rule.
+	uploadStagingPrefix = "incoming/"
+
+	// uploads of unknown length go to MinIO in parts of this size
+	uploadPartSize = 16 << 20
+)
+
+// declaredHash is a hex SHA-256, as uploads name objects.
+var declaredHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var audioExtensions = map[string]string{
+	"audio/mpeg":   ".mp3",
+	"audio/ogg":    ".ogg",
+	"audio/opus":   ".opus",
+	"audio/flac":   ".flac",
+	"audio/x-flac": ".flac",
+	"audio/wav":    ".wav",
+	"audio/x-wav":  ".wav",
+	"audio/mp4":    ".m4a",
+	"audio/aac":    ".aac",
+	"audio/webm":   ".weba",
+}
+
+func newS3Client(endpoint *url.URL, creds *credentials.Credentials, region string) (*minio.Client, error) {
+	return minio.New(endpoint.Host, &minio.Options{
+		Creds:  creds,
+		Secure: endpoint.Scheme == "https",
+		Region: region,
+	})
+}
+
+func authorizedUpload(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	want := uploadToken()
+	return ok && want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// handleUpload accepts PUT /upload/{type}/{userID}. The body is spooled to
+// disk while it is hashed, since the storage path depends on the hash, then
+// written to MinIO and recorded on the user's profile. Clients may send
+// X-Content-SHA256 to have the proxy verify the hash they expect.
+//
+// PUT /upload/{type}/{userID}/{hash} declares the hash up front instead.
+// Songs then stream straight into MinIO with nothing spooled, and only
+// reach their final key once the hash matched.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if s3Client == nil || uploadToken() == "" {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		writeError(w, r, proxyError{http.StatusMethodNotAllowed, "method_not_allowed"})
+		return
+	}
+
+	if !authorizedUpload(r) {
+		writeError(w, r, proxyError{http.StatusUnauthorized, "unauthorized"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/"), "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	kind, userID := parts[0], parts[1]
+	maxBytes, ok := uploadLimits[kind]
+	if !ok {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	if _, err := strconv.ParseInt(userID, 10, 64); err != nil {
+		writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+		return
+	}
+
+	if len(parts) == 3 {
+		declared := parts[2]
+		if !declaredHash.MatchString(declared) {
+			writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+			return
+		}
+		if r.ContentLength > maxBytes {
+			writeError(w, r, proxyError{http.StatusRequestEntityTooLarge, "too_large"})
+			return
+		}
+
+		if kind == "songs" {
+			publicPath, err := streamSong(r, maxBytes, userID, declared)
+			finishUpload(w, r, kind, userID, declared, publicPath, err)
+			return
+		}
+		r.Header.Set("X-Content-SHA256", declared)
+	}
+
+	tmp, err := os.CreateTemp("", "cdn-proxy-upload-*")
+	if err != nil {
+		log.Printf("upload spool error: %v", err)
+		writeError(w, r, proxyError{http.StatusInternalServerError, "internal_error"})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, proxyError{http.StatusRequestEntityTooLarge, "too_large"})
+			return
+		}
+		writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+		return
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	if want := r.Header.Get("X-Content-SHA256"); want != "" && !strings.EqualFold(want, hash) {
+		writeError(w, r, proxyError{http.StatusBadRequest, "hash_mismatch"})
+		return
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		writeError(w, r, proxyError{http.StatusInternalServerError, "internal_error"})
+		return
+	}
+
+	var publicPath string
+	switch kind {
+	case "banners":
+		publicPath, err = storeBanner(r.Context(), tmp, size, userID, hash)
+	case "songs":
+		publicPath, err = storeSong(r, tmp, size, userID, hash)
+	case "attachments":
+		publicPath, err = storeAttachment(r, tmp, size, userID, hash)
+	}
+	finishUpload(w, r, kind, userID, hash, publicPath, err)
+}
+
+// finishUpload answers a stored upload, or the error that stopped it.
+func finishUpload(w http.ResponseWriter, r *http.Request, kind, userID, hash, publicPath string, err error) {
+	if err != nil {
+		var perr proxyError
+		if !errors.As(err, &perr) {
+			log.Printf("upload to %s failed: %v", kind, err)
+			perr = proxyError{http.StatusBadGateway, "upstream_error"}
+		}
+		writeError(w, r, perr)
+		return
+	}
+
+	if err := redisClient.Del(r.Context(), profileCacheKey(userID)).Err(); err != nil {
+		log.Printf("valkey DEL error: %v", err)
+	}
+	forgetMissing(r.Context(), publicPath)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"hash": hash,
+		"path": publicPath,
+	})
+}
+
+// storeBanner stores the upload as webp, converting other image formats and
+// keeping the original alongside, and returns its public path.
+func storeBanner(ctx context.Context, f *os.File, size int64, userID, hash string) (string, error) {
+	if err := checkImageLimits(f); err != nil {
+		return "", err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	var body io.Reader = f
+	if format != "webp" {
+		ext := format
+		if ext == "jpeg" {
+			ext = "jpg"
+		}
+
+		originalKey := "banners/" + userID + "/" + hash + "." + ext
+		if _, err := s3Client.PutObject(ctx, minioBucket, originalKey, f, size, minio.PutObjectOptions{ContentType: "image/" + format}); err != nil {
+			return "", err
+		}
+
+		if err := recordOriginalExt(ctx, "banners", userID, hash, ext); err != nil {
+			return "", err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+
+		original, err := io.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+
+		data, err := convertToWebP(ctx, original)
+		if err != nil {
+			return "", err
+		}
+
+		body, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	key := "banners/" + userID + "/" + hash + ".webp"
+	if _, err := s3Client.PutObject(ctx, minioBucket, key, body, size, minio.PutObjectOptions{ContentType: "image/webp"}); err != nil {
+		return "", err
+	}
+
+	if err := updateProfileColumns(ctx, userID, map[string]string{"banner_hash": hash}); err != nil {
+		return "", err
+	}
+
+	return "/banners/" + userID + "/" + hash, nil
+}
+
+// convertToWebP encodes an uploaded original as the webp the proxy serves,
+// keeping animation and colour.
+func convertToWebP(ctx context.Context, original []byte) ([]byte, error) {
+	return transforms.do(ctx, func() ([]byte, error) {
+		profile := iccProfile(original)
+		if isAnimated(original) {
+			anim, err := decodeAnimation(original)
+			if err != nil {
+				return nil, proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+			}
+
+			return encodeAnimation(anim, func(img image.Image) image.Image {
+				return colorManage(img, profile)
+			}, webp.Options{Quality: webpQuality})
+		}
+
+		img, err := decodeImage(bytes.NewReader(original))
+		if err != nil {
+			return nil, proxyError{http.StatusUnprocessableEntity, "unprocessable_image"}
+		}
+
+		img = colorManage(img, profile)
+
+		data, err := encodeImage(img, "webp")
+		if err != nil {
+			return nil, err
+		}
+
+		return tagICCProfile(data, "webp", img.Bounds(), profile), nil
+	})
+}
+
+func songType(r *http.Request) (string, string, error) {
+	mimeType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	mimeType = strings.TrimSpace(strings.ToLower(mimeType))
+
+	ext, ok := audioExtensions[mimeType]
+	if !ok {
+		return "", "", proxyError{http.StatusUnsupportedMediaType, "unsupported_media_type"}
+	}
+
+	return mimeType, ext, nil
+}
+
+func storeSong(r *http.Request, f *os.File, size int64, userID, hash string) (string, error) {
+	mimeType, ext, err := songType(r)
+	if err != nil {
+		return "", err
+	}
+
+	key := "songs/" + userID + "/" + hash + ext
+	if _, err := s3Client.PutObject(r.Context(), minioBucket, key, f, size, minio.PutObjectOptions{ContentType: mimeType}); err != nil {
+		return "", err
+	}
+
+	return recordSong(r, userID, hash, mimeType, ext)
+}
+
+// streamSong stores a song whose hash was declared. The body goes to a
+// staging key while it is hashed and is copied to its final key, inside
+// MinIO, only if the hash matched, so nothing is ever served under a hash
+// its content doesn't have.
+func streamSong(r *http.Request, maxBytes int64, userID, hash string) (string, error) {
+	ctx := r.Context()
+	mimeType, ext, err := songType(r)
+	if err != nil {
+		return "", err
+	}
+
+	key := "songs/" + userID + "/" + hash + ext
+	if _, err := s3Client.StatObject(ctx, minioBucket, key, minio.StatObjectOptions{}); err == nil {
+		// a retry of an upload that already landed
+		return recordSong(r, userID, hash, mimeType, ext)
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	staging := uploadStagingPrefix + hex.EncodeToString(buf)
+	defer func() {
+		if err := s3Client.RemoveObject(context.WithoutCancel(ctx), minioBucket, staging, minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("failed to remove staged upload %s: %v", staging, err)
+		}
+	}()
+
+	h := sha256.New()
+	body := &io.LimitedReader{R: r.Body, N: maxBytes + 1}
+	opts := minio.PutObjectOptions{ContentType: mimeType}
+	if r.ContentLength < 0 {
+		opts.PartSize = uploadPartSize
+	}
+	_, err = s3Client.PutObject(ctx, minioBucket, staging, io.TeeReader(body, h), r.ContentLength, opts)
+	switch {
+	case body.N == 0:
+		return "", proxyError{http.StatusRequestEntityTooLarge, "too_large"}
+	case err != nil:
+		return "", err
+	case hex.EncodeToString(h.Sum(nil)) != hash:
+		return "", proxyError{http.StatusBadRequest, "hash_mismatch"}
+	}
+
+	_, err = s3Client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: minioBucket, Object: key},
+		minio.CopySrcOptions{Bucket: minioBucket, Object: staging})
+	if err != nil {
+		return "", err
+	}
+
+	return recordSong(r, userID, hash, mimeType, ext)
+}
+
+func recordSong(r *http.Request, userID, hash, mimeType, ext string) (string, error) {
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		filename = hash + ext
+	}
+
+	err := updateProfileColumns(r.Context(), userID, map[string]string{
+		"audio_hash":      hash,
+		"audio_mime_type": mimeType,
+		"audio_name":      filename,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "/songs/" + userID + "/" + hash + ext, nil
+}
+
+// updateProfileColumns sets columns on the user's profile row. Column names
+// come from this file, never from the request.
+func updateProfileColumns(ctx context.Context, userID string, values map[string]string) error {
+	var sets []string
+	args := []any{userID}
+	for _, column := range slices.Sorted(maps.Keys(values)) {
+		args = append(args, values[column])
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+	}
+
+	query := `UPDATE user_profiles SET ` + strings.Join(sets, ", ") + ` WHERE id = $1`
+	ctx, span := startQuerySpan(ctx, "postgres update user_profiles", query)
+	res, err := db.ExecContext(ctx, query, args...)
+	endQuerySpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return proxyError{http.StatusNotFound, "not_found"}
+	}
+
+	return nil
+}
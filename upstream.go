@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+var (
+	coalescer   = &coalescingTransport{next: upstreamChain(storage), maxBytes: defaultCoalesceMaxBytes}
+	objectCache = &objectCacheTransport{next: coalescer, maxBytes: defaultMaxCachedObjectBytes}
+
+	// upstreamTransport is shared by the reverse proxy and every direct fetch
+	// the proxy makes against MinIO.
+	upstreamTransport http.RoundTripper = objectCache
+
+	upstreamClient = &http.Client{Transport: upstreamTransport}
+)
+
+// upstreamChain instruments a storage backend. Backend-specific layers go
+// between it and the coalescer.
+func upstreamChain(backend storageBackend) http.RoundTripper {
+	return &countingTransport{next: &debugTransport{next: traceTransport(backend)}}
+}
+
+func fetchObject(ctx context.Context, objectPath string) (*http.Response, error) {
+	return requestObject(ctx, http.MethodGet, objectPath)
+}
+
+func headObject(ctx context.Context, objectPath string) (*http.Response, error) {
+	return requestObject(ctx, http.MethodHead, objectPath)
+}
+
+func requestObject(ctx context.Context, method, objectPath string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, minioURL.Scheme+"://"+minioURL.Host+objectPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return upstreamClient.Do(req)
+}
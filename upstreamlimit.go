@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultUpstreamImageConcurrency  = 256
+	defaultUpstreamStreamConcurrency = 128
+	defaultUpstreamQueueTimeout      = 250 * time.Millisecond
+
+	// clients shed for a busy upstream are told to come back after this
+	upstreamRetryAfter = time.Second
+)
+
+var (
+	upstreamInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cdn_proxy_upstream_in_flight",
+		Help: "Requests to the bucket holding a concurrency slot, by class: images or songs.",
+	}, []string{"class"})
+
+	upstreamShedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_upstream_shed_total",
+		Help: "Requests refused because the bucket had too many in flight, by class.",
+	}, []string{"class"})
+
+	errUpstreamBusy = proxyError{http.StatusServiceUnavailable, "upstream_busy"}
+)
+
+// limitTransport caps the requests in flight to the bucket, so a spike
+// can't pile onto a struggling node. Streaming routes such as songs hold
+// their slot for as long as the body is read, so they're counted apart from
+// images, which don't queue behind them. A request waits up to queueTimeout
+// for a slot and is then refused.
+//
+// It sits inside the coalescer, so callers sharing a fetch share its slot.
+type limitTransport struct {
+	next         http.RoundTripper
+	images       chan struct{}
+	streams      chan struct{}
+	queueTimeout time.Duration
+}
+
+// newLimitTransport limits images and streams to the given counts; 0
+// leaves that class unlimited.
+func newLimitTransport(next http.RoundTripper, images, streams int, queueTimeout time.Duration) *limitTransport {
+	t := &limitTransport{next: next, queueTimeout: queueTimeout}
+	if images > 0 {
+		t.images = make(chan struct{}, images)
+	}
+	if streams > 0 {
+		t.streams = make(chan struct{}, streams)
+	}
+
+	return t
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	slots, class := t.images, "images"
+	if rt := routeNamed(routeNameFrom(req.Context())); rt != nil && rt.Streaming {
+		slots, class = t.streams, "songs"
+	}
+	if slots == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	if !t.acquire(req.Context(), slots) {
+		upstreamShedTotal.WithLabelValues(class).Inc()
+		return nil, errUpstreamBusy
+	}
+	gauge := upstreamInFlight.WithLabelValues(class)
+	gauge.Inc()
+
+	release := sync.OnceFunc(func() {
+		gauge.Dec()
+		<-slots
+	})
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (t *limitTransport) acquire(ctx context.Context, slots chan struct{}) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(t.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releasingBody gives its slot back once read to the end or closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.release()
+	}
+
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+
+	return err
+}
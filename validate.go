@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultHashLength = 64
+
+// hashLength is how many hex digits a content hash has: a SHA-256 unless
+// the main app was configured otherwise.
+var hashLength = defaultHashLength
+
+// routeVarChecks validate route variables by name, wherever they come from,
+// before they're put into an upstream path. Variables without a check only
+// have to be safe as path segments.
+var routeVarChecks = map[string]func(string) bool{
+	"userID":  validID,
+	"guildID": validID,
+	"ownerID": validID,
+	"hash":    validHash,
+	"file":    validFile,
+	"format":  validFormat,
+}
+
+func validID(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 63)
+	return err == nil
+}
+
+func validHash(s string) bool {
+	if len(s) != hashLength {
+		return false
+	}
+	for i := range len(s) {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validFile is a hash with an optional extension, as songs are named.
+func validFile(s string) bool {
+	hash, ext, hasExt := strings.Cut(s, ".")
+	return validHash(hash) && (!hasExt || validExtension.MatchString(ext))
+}
+
+// validFormat allows the formats images are rendered in, and original,
+// which resolveOriginals turns into the stored extension.
+func validFormat(s string) bool {
+	_, ok := imageContentTypes[s]
+	return ok || s == "original"
+}
+
+// safeSegments accepts slash-separated path segments that can't climb out
+// of the route's prefix or carry a query into the upstream path.
+func safeSegments(s string) bool {
+	for _, seg := range strings.Split(s, "/") {
+		if seg == "" || seg == "." || seg == ".." || strings.ContainsAny(seg, "\\?#%") {
+			return false
+		}
+		for _, c := range seg {
+			if c < 0x20 || c == 0x7f {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// checkRouteVars validates the variables rt's origin template will use:
+// those the path captured and those taken from the query.
+func checkRouteVars(rt *route, vars map[string]string, q url.Values) error {
+	check := func(name, v string) error {
+		valid := safeSegments
+		if fn := routeVarChecks[name]; fn != nil {
+			valid = fn
+		}
+		if !valid(v) {
+			return fmt.Errorf("invalid %s %q", name, v)
+		}
+		return nil
+	}
+
+	for name, v := range vars {
+		if err := check(name, v); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range templateVar.FindAllStringSubmatch(rt.Origin, -1) {
+		name := m[1]
+		if _, ok := vars[name]; ok {
+			continue
+		}
+		if v := q.Get(name); v != "" {
+			if err := check(name, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validatePaths rejects route requests whose variables aren't what the
+// route expects before they're rewritten to an upstream path. An encoded
+// slash or backslash in the path is never legitimate. A path no route
+// matches is not found: passed to the bucket as it is, it would reach
+// objects no route serves, such as staged uploads.
+func validatePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt, vars := matchRoute(r.URL.Path)
+		if rt == nil {
+			traceDecision(r.Context(), "path validation", "no route")
+			writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+			return
+		}
+
+		err := checkRouteVars(rt, vars, r.URL.Query())
+		if escaped := strings.ToLower(r.URL.EscapedPath()); strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+			err = fmt.Errorf("encoded separator in %q", r.URL.EscapedPath())
+		}
+		if err != nil {
+			traceDecision(r.Context(), "path validation", err.Error())
+			writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/sync/singleflight"
+)
+
+const variantFillTimeout = 30 * time.Second
+
+var (
+	// variantFills shares one conversion between the requests that miss the
+	// same object
+	variantFills singleflight.Group
+
+	errNoVariantSource = proxyError{http.StatusNotFound, "not_found"}
+)
+
+// fillMissingVariant answers a 404 for an image in a format that was never
+// stored by converting the object from a format that was, then writes the
+// result back so the next request finds it. It reports whether resp was
+// replaced.
+func fillMissingVariant(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusNotFound || (resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead) ||
+		!featureEnabled("variant_fill") {
+		return false
+	}
+
+	objectPath := resp.Request.URL.Path
+	parts := strings.SplitN(strings.TrimPrefix(objectPath, "/"+minioBucket+"/"), "/", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	kind, ownerID := parts[0], parts[1]
+	dot := strings.LastIndexByte(parts[2], '.')
+	if _, ok := imageRoutes[kind]; !ok || dot < 0 {
+		return false
+	}
+	hash, format := parts[2][:dot], parts[2][dot+1:]
+	if _, ok := imageContentTypes[format]; !ok {
+		return false
+	}
+
+	v, err, _ := variantFills.Do(objectPath, func() (any, error) {
+		fillCtx, cancel := context.WithTimeout(context.WithoutCancel(resp.Request.Context()), variantFillTimeout)
+		defer cancel()
+		return convertVariant(fillCtx, kind, ownerID, hash, format)
+	})
+	if err != nil {
+		if err != errNoVariantSource {
+			log.Printf("variant fill for %s failed: %v", objectPath, err)
+		}
+		return false
+	}
+	data := v.([]byte)
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxS3ErrorBody))
+	resp.Body.Close()
+
+	sum := md5.Sum(data)
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header = http.Header{}
+	resp.Header.Set("Content-Type", imageContentTypes[format])
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	resp.ContentLength = int64(len(data))
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if resp.Request.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+
+	recordCacheStatus(resp.Request.Context(), objectCacheName, "detail=converted")
+	traceDecision(resp.Request.Context(), "missing variant", "converted to "+format)
+
+	return true
+}
+
+// convertVariant renders hash in format from the first stored copy it
+// finds: the served webp, then the original upload. The write back only
+// happens with credentials, since the bucket is otherwise read-only to us.
+func convertVariant(ctx context.Context, kind, ownerID, hash, format string) ([]byte, error) {
+	sources := []string{"webp"}
+	if originalRoutes[kind] {
+		if ext, err := lookupOriginalExt(ctx, kind, ownerID, hash); err == nil && ext != "webp" {
+			sources = append(sources, ext)
+		}
+	}
+
+	base := kind + "/" + ownerID + "/" + hash
+	var original []byte
+	for _, ext := range sources {
+		if ext == format {
+			continue
+		}
+
+		var err error
+		original, err = fetchOriginal(ctx, "/"+minioBucket+"/"+base+"."+ext)
+		if err == nil {
+			break
+		}
+		if perr := (proxyError{}); !errors.As(err, &perr) || perr.status != http.StatusNotFound {
+			return nil, err
+		}
+	}
+	if original == nil {
+		return nil, errNoVariantSource
+	}
+
+	if err := checkImageLimits(bytes.NewReader(original)); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var err error
+	if format == "webp" {
+		data, err = convertToWebP(ctx, original)
+	} else {
+		data, err = transforms.do(ctx, func() ([]byte, error) {
+			img, err := decodeImage(bytes.NewReader(original))
+			if err != nil {
+				return nil, err
+			}
+
+			profile := iccProfile(original)
+			img = colorManage(img, profile)
+
+			data, err := encodeImage(img, format)
+			if err != nil {
+				return nil, err
+			}
+
+			return tagICCProfile(data, format, img.Bounds(), profile), nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s3Client != nil {
+		go func() {
+			putCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), variantFillTimeout)
+			defer cancel()
+
+			_, err := s3Client.PutObject(putCtx, minioBucket, base+"."+format, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: imageContentTypes[format]})
+			if err != nil {
+				log.Printf("variant write back for %s.%s failed: %v", base, format, err)
+			}
+		}()
+	}
+
+	return data, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultWaveformPeaks = 800
+	maxWaveformPeaks     = 4096
+	minWaveformPeaks     = 16
+
+	// songs are decoded to mono at this rate, plenty for drawing peaks
+	waveformSampleRate = 8000
+	// samples per block before the peaks are spread over the resolution
+	waveformBlock = waveformSampleRate / 100
+
+	waveformCacheTTL = 30 * 24 * time.Hour
+)
+
+var (
+	// ffmpegPath decodes songs for waveforms; empty turns them off.
+	ffmpegPath string
+
+	waveformPeaks = defaultWaveformPeaks
+
+	waveformRenders singleflight.Group
+)
+
+// waveform is what GET /songs/{userID}/{hash}/waveform.json serves: peak
+// amplitudes from 0 to 1, evenly spread over the track.
+type waveform struct {
+	Duration float64   `json:"duration"`
+	Peaks    []float64 `json:"peaks"`
+}
+
+// waveformKey names a waveform like the song it was drawn from, so purges
+// of the song's prefix find it.
+func waveformKey(userID, hash string, peaks int) string {
+	return "waveform:songs/" + userID + "/" + hash + "?peaks=" + strconv.Itoa(peaks)
+}
+
+func waveformDerivativeKey(userID, hash string, peaks int) string {
+	return "variants/songs/" + userID + "/" + hash + "/waveform-" + strconv.Itoa(peaks) + ".json"
+}
+
+// handleWaveform serves a song's waveform at ?peaks= resolution, decoding
+// the song once and caching the result in Valkey and, when configured, the
+// derivatives bucket.
+func handleWaveform(w http.ResponseWriter, r *http.Request) {
+	userID, hash := r.PathValue("userID"), r.PathValue("hash")
+	if !validID(userID) || !validHash(hash) || ffmpegPath == "" {
+		writeError(w, r, proxyError{http.StatusNotFound, "not_found"})
+		return
+	}
+
+	peaks := waveformPeaks
+	if v := r.URL.Query().Get("peaks"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minWaveformPeaks || n > maxWaveformPeaks {
+			writeError(w, r, proxyError{http.StatusBadRequest, "bad_request"})
+			return
+		}
+		peaks = n
+	}
+
+	if !authorizeViewer(w, r, userID, r.URL.Path) {
+		return
+	}
+
+	// the song is content-addressed, so a client holding this waveform's
+	// ETag needn't wait for Valkey or ffmpeg
+	etag := generatedETag("waveform", userID, hash, strconv.Itoa(peaks))
+	if notModified(w, r, etag, variantCacheControl) {
+		return
+	}
+
+	data, err := cachedWaveform(r.Context(), userID, hash, peaks)
+	if err != nil {
+		var perr proxyError
+		if !errors.As(err, &perr) {
+			log.Printf("waveform for %s/%s failed: %v", userID, hash, err)
+			perr = proxyError{http.StatusUnprocessableEntity, "unprocessable_audio"}
+		}
+		writeError(w, r, perr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", variantCacheControl)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func cachedWaveform(ctx context.Context, userID, hash string, peaks int) ([]byte, error) {
+	key := waveformKey(userID, hash, peaks)
+	if data, err := redisClient.Get(ctx, key).Bytes(); err == nil {
+		recordCacheStatus(ctx, objectCacheName, "hit")
+		return data, nil
+	} else if err != redis.Nil {
+		log.Printf("valkey GET error: %v", err)
+	}
+
+	dkey := waveformDerivativeKey(userID, hash, peaks)
+	if derivativesBucket != "" {
+		touchDerivative(ctx, dkey)
+		if data, ok := loadDerivative(ctx, dkey); ok {
+			recordCacheStatus(ctx, derivativeCacheName, "hit")
+			rememberWaveform(ctx, key, data)
+			return data, nil
+		}
+	}
+	recordCacheStatus(ctx, objectCacheName, "fwd=uri-miss")
+
+	v, err, _ := waveformRenders.Do(key, func() (any, error) {
+		data, err := renderWaveform(ctx, userID, hash, peaks)
+		if err != nil {
+			return nil, err
+		}
+
+		rememberWaveform(ctx, key, data)
+		if derivativesBucket != "" {
+			storeDerivative(context.WithoutCancel(ctx), dkey, "application/json", data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+func rememberWaveform(ctx context.Context, key string, data []byte) {
+	if err := redisClient.Set(ctx, key, data, waveformCacheTTL).Err(); err != nil {
+		log.Printf("valkey SET error: %v", err)
+	}
+}
+
+// currentSongPath is the public path of the user's song if hash is the
+// current one, the only song whose extension is known.
+func currentSongPath(ctx context.Context, userID, hash string) (string, error) {
+	lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	profile, err := songProfile(lookupCtx, userID)
+	cancel()
+	if err == sql.ErrNoRows || (err == nil && (profile.AudioHash != hash || audioExtensions[profile.AudioMimeType] == "")) {
+		return "", proxyError{http.StatusNotFound, "not_found"}
+	} else if err != nil {
+		return "", err
+	}
+
+	return "/songs/" + userID + "/" + hash + audioExtensions[profile.AudioMimeType], nil
+}
+
+// renderWaveform decodes the user's current song with ffmpeg, which reads
+// every format uploads accept.
+func renderWaveform(ctx context.Context, userID, hash string, peaks int) ([]byte, error) {
+	path, err := currentSongPath(ctx, userID, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fetchObject(ctx, "/"+minioBucket+path)
+	if err != nil {
+		return nil, proxyError{http.StatusBadGateway, "upstream_error"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBody))
+		return nil, parseS3Error(resp.StatusCode, body)
+	}
+
+	return transforms.do(ctx, func() ([]byte, error) {
+		cmd := exec.CommandContext(ctx, ffmpegPath, "-v", "error", "-i", "pipe:0",
+			"-ac", "1", "-ar", strconv.Itoa(waveformSampleRate), "-f", "s16le", "pipe:1")
+		cmd.Stdin = resp.Body
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+
+		blocks, samples, readErr := readPeakBlocks(out)
+		if err := cmd.Wait(); err != nil {
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		if samples == 0 {
+			return nil, proxyError{http.StatusUnprocessableEntity, "unprocessable_audio"}
+		}
+
+		return json.Marshal(waveform{
+			Duration: math.Round(float64(samples)/waveformSampleRate*1000) / 1000,
+			Peaks:    spreadPeaks(blocks, peaks),
+		})
+	})
+}
+
+// readPeakBlocks reads 16-bit mono PCM, keeping the loudest sample of each
+// block so memory grows with the track's length in blocks, not samples.
+func readPeakBlocks(r io.Reader) ([]float64, int, error) {
+	br := bufio.NewReader(r)
+	var blocks []float64
+	var peak float64
+	var samples int
+
+	buf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(br, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		peak = max(peak, math.Abs(float64(int16(binary.LittleEndian.Uint16(buf))))/math.MaxInt16)
+		samples++
+		if samples%waveformBlock == 0 {
+			blocks = append(blocks, peak)
+			peak = 0
+		}
+	}
+	if samples%waveformBlock != 0 {
+		blocks = append(blocks, peak)
+	}
+
+	return blocks, samples, nil
+}
+
+// spreadPeaks takes the loudest block in each of n even spans. Tracks
+// shorter than n blocks get one peak per block.
+func spreadPeaks(blocks []float64, n int) []float64 {
+	n = min(n, len(blocks))
+	out := make([]float64, n)
+	for i := range out {
+		start, end := i*len(blocks)/n, (i+1)*len(blocks)/n
+		var peak float64
+		for _, b := range blocks[start:end] {
+			peak = max(peak, b)
+		}
+		out[i] = math.Round(min(peak, 1)*1000) / 1000
+	}
+
+	return out
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultWebhookCooldown = 5 * time.Minute
+
+	webhookQueueSize  = 256
+	webhookTimeout    = 10 * time.Second
+	webhookRetries    = 5
+	webhookRetryDelay = time.Second
+)
+
+// webhookEvent is what's POSTed to WEBHOOK_URL. Text repeats the event in a
+// line, so a Slack incoming webhook shows something readable.
+type webhookEvent struct {
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Replica string         `json:"replica"`
+	Text    string         `json:"text"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+var (
+	webhookURL      string
+	webhookCooldown = defaultWebhookCooldown
+
+	webhookQueue = make(chan webhookEvent, webhookQueueSize)
+
+	// webhookSent is when each type and subject was last notified, so a
+	// condition that persists is reported once per cooldown
+	webhookSent = struct {
+		sync.Mutex
+		at map[string]time.Time
+	}{at: map[string]time.Time{}}
+
+	replicaName, _ = os.Hostname()
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_webhook_deliveries_total",
+		Help: "Webhook events, by type and outcome: sent, failed after retries, or dropped with the queue full.",
+	}, []string{"type", "result"})
+)
+
+// notify queues an event about subject unless the same one went out within
+// the cooldown. It never blocks: with the queue full the event is dropped.
+func notify(eventType, subject, text string, details map[string]any) {
+	if webhookURL == "" {
+		return
+	}
+
+	now := time.Now()
+	key := eventType + " " + subject
+
+	webhookSent.Lock()
+	if now.Sub(webhookSent.at[key]) < webhookCooldown {
+		webhookSent.Unlock()
+		return
+	}
+	webhookSent.at[key] = now
+	for k, at := range webhookSent.at {
+		if now.Sub(at) >= webhookCooldown {
+			delete(webhookSent.at, k)
+		}
+	}
+	webhookSent.Unlock()
+
+	select {
+	case webhookQueue <- webhookEvent{Type: eventType, Time: now.UTC(), Replica: replicaName, Text: text, Details: details}:
+	default:
+		log.Printf("webhook queue full, dropping %s event", eventType)
+		webhookDeliveriesTotal.WithLabelValues(eventType, "dropped").Inc()
+	}
+}
+
+// runWebhooks delivers queued events one at a time, in order, until ctx is
+// done.
+func runWebhooks(ctx context.Context) {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	for {
+		var event webhookEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-webhookQueue:
+		}
+
+		if err := deliverWebhook(ctx, client, event); err != nil {
+			log.Printf("webhook delivery of %s failed: %v", event.Type, err)
+			webhookDeliveriesTotal.WithLabelValues(event.Type, "failed").Inc()
+			continue
+		}
+		webhookDeliveriesTotal.WithLabelValues(event.Type, "sent").Inc()
+	}
+}
+
+// deliverWebhook POSTs event, retrying connection errors, 429s and 5xxs
+// with backoff. Each attempt is signed afresh so its timestamp is current.
+func deliverWebhook(ctx context.Context, client *http.Client, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(ctx, client, body)
+		if err == nil || attempt == webhookRetries || errors.Is(err, errWebhookRejected) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+var errWebhookRejected = errors.New("webhook rejected")
+
+func postWebhook(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cdn-proxy")
+
+	// receivers check X-Signature against HMAC-SHA256 of the timestamp, a
+	// dot and the body, and refuse stale timestamps to stop replays
+	if secret := secrets.get("WEBHOOK_SECRET"); secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxS3ErrorBody))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	return fmt.Errorf("%w with status %d", errWebhookRejected, resp.StatusCode)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	transformQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cdn_proxy_transform_queue_depth",
+		Help: "Transform jobs waiting for a worker.",
+	})
+
+	transformWorkersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cdn_proxy_transform_workers_busy",
+		Help: "Transform workers currently running a job.",
+	})
+
+	transformJobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_proxy_transform_jobs_total",
+		Help: "Transform jobs by result: ok, error, rejected (queue full) or timeout.",
+	}, []string{"result"})
+
+	transformJobDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cdn_proxy_transform_job_duration_seconds",
+		Help:    "Time a transform job spent running on a worker.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+var (
+	errTransformBusy    = proxyError{http.StatusServiceUnavailable, "transform_busy"}
+	errTransformTimeout = proxyError{http.StatusServiceUnavailable, "transform_timeout"}
+)
+
+// workerPool bounds CPU-heavy transforms so a burst of uncached variants
+// can't starve plain proxying. Jobs beyond maxQueue waiting ones are rejected
+// outright rather than piling up.
+type workerPool struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+var transforms = newWorkerPool(runtime.GOMAXPROCS(0), 4*runtime.GOMAXPROCS(0), 10*time.Second)
+
+func newWorkerPool(workers, maxQueue int, timeout time.Duration) *workerPool {
+	return &workerPool{
+		slots:   make(chan struct{}, workers),
+		queue:   make(chan struct{}, workers+maxQueue),
+		timeout: timeout,
+	}
+}
+
+// do runs job on a worker. The timeout covers queueing and running; a job
+// that overruns keeps its worker until it finishes, so the pool never runs
+// more than its size, but the caller stops waiting for it.
+func (p *workerPool) do(ctx context.Context, job func() ([]byte, error)) ([]byte, error) {
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		transformJobsTotal.WithLabelValues("rejected").Inc()
+		return nil, errTransformBusy
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	transformQueueDepth.Inc()
+	select {
+	case p.slots <- struct{}{}:
+		transformQueueDepth.Dec()
+	case <-ctx.Done():
+		transformQueueDepth.Dec()
+		<-p.queue
+		transformJobsTotal.WithLabelValues("timeout").Inc()
+		return nil, errTransformTimeout
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		defer func() {
+			<-p.slots
+			<-p.queue
+		}()
+
+		transformWorkersBusy.Inc()
+		defer transformWorkersBusy.Dec()
+
+		start := time.Now()
+		data, err := job()
+		transformJobDuration.Observe(time.Since(start).Seconds())
+
+		done <- result{data, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			transformJobsTotal.WithLabelValues("error").Inc()
+		} else {
+			transformJobsTotal.WithLabelValues("ok").Inc()
+		}
+		return res.data, res.err
+	case <-ctx.Done():
+		transformJobsTotal.WithLabelValues("timeout").Inc()
+		return nil, errTransformTimeout
+	}
+}